@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength   = 8
+	emailChangeTTL      = 30 * time.Minute
+	emailChangeAttempts = 5
+
+	// Guesses allowed at a verification OTP before it is discarded
+	verificationAttempts = 5
+)
+
+var errSessionChanged = errors.New("account was modified concurrently")
+
+// generateOTP returns a random 6-digit code
+func generateOTP() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()+100000), nil
+}
+
+// Route for the logged-in user to change their password, signing out every other session
+func changePassword(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"currentPassword" binding:"required"`
+		NewPassword     string `json:"newPassword" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("New password must be at least %d characters", minPasswordLength)})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(req.CurrentPassword)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	// Bumping the token version revokes every other session
+	newVersion := dbUser.TokenVersion + 1
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := registeredUsers.UpdateOne(sc,
+			bson.M{"username": dbUser.Username, "tokenVersion": versionFilter(dbUser.TokenVersion)},
+			bson.M{"$set": bson.M{"password": string(hashedPassword), "tokenVersion": newVersion}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errSessionChanged
+		}
+		return enqueueEmail(sc, dbUser.Username, "password_changed", dbUser.Locale, EmailData{
+			"Username":  dbUser.Username,
+			"ChangedAt": formatEmailTime(time.Now()),
+		})
+	})
+	if err == errSessionChanged {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account was modified concurrently, please try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	// Keep the caller signed in with a token for the new version
+	tokenString, err := generateJWT(dbUser.Username, dbUser.Role, newVersion, claims.MFA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully", "token": tokenString})
+}
+
+// Route for the logged-in user to start moving their account to a new email address
+func requestEmailChange(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		NewEmail        string `json:"newEmail" binding:"required"`
+		CurrentPassword string `json:"currentPassword" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(req.CurrentPassword)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	newEmail, err := validateAccountEmail(req.NewEmail, dbUser.Role)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "field": "newEmail"})
+		return
+	}
+	if newEmail == dbUser.Username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "New email is the same as the current one", "field": "newEmail"})
+		return
+	}
+
+	count, err := registeredUsers.CountDocuments(ctx, bson.M{"username": newEmail})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check email availability"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address is already in use", "field": "newEmail"})
+		return
+	}
+
+	otp, err := generateOTP()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate OTP"})
+		return
+	}
+	hashedOTP, err := bcrypt.GenerateFromPassword([]byte(otp), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate OTP"})
+		return
+	}
+
+	expires := time.Now().Add(emailChangeTTL)
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		_, err := registeredUsers.UpdateOne(sc, bson.M{"username": dbUser.Username}, bson.M{"$set": bson.M{
+			"pendingEmail":             newEmail,
+			"pendingEmailOtp":          string(hashedOTP),
+			"pendingEmailExpires":      expires,
+			"pendingEmailAttemptsLeft": emailChangeAttempts,
+		}})
+		if err != nil {
+			return err
+		}
+		return enqueueEmail(sc, newEmail, "email_change", dbUser.Locale, EmailData{
+			"NewEmail":  newEmail,
+			"OTP":       otp,
+			"ExpiresAt": formatEmailTime(expires),
+		})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start email change"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "An OTP has been sent to the new email address"})
+}
+
+// Route for the logged-in user to confirm the new email address with the OTP sent to it
+func confirmEmailChange(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		OTP string `json:"otp" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if dbUser.PendingEmail == "" || time.Now().After(dbUser.PendingEmailExpires) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No email change is pending or it has expired"})
+		return
+	}
+
+	// Each guess uses up an attempt before it is checked, so parallel guesses
+	// cannot get past the limit
+	result, err := registeredUsers.UpdateOne(ctx,
+		bson.M{"username": dbUser.Username, "pendingEmailOtp": dbUser.PendingEmailOTP, "pendingEmailAttemptsLeft": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"pendingEmailAttemptsLeft": -1}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check OTP"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No email change is pending or it has expired"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbUser.PendingEmailOTP), []byte(req.OTP)) != nil {
+		// The change is discarded with the last attempt
+		if dbUser.PendingEmailAttemptsLeft <= 1 {
+			_, err := registeredUsers.UpdateOne(ctx,
+				bson.M{"username": dbUser.Username, "pendingEmailOtp": dbUser.PendingEmailOTP},
+				bson.M{"$unset": bson.M{"pendingEmail": "", "pendingEmailOtp": "", "pendingEmailExpires": "", "pendingEmailAttemptsLeft": ""}})
+			if err != nil {
+				log.Printf("Failed to discard email change for %s: %v", dbUser.Username, err)
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		return
+	}
+
+	oldEmail, newEmail := dbUser.Username, dbUser.PendingEmail
+	newVersion := dbUser.TokenVersion + 1
+
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		// The address may have been taken since the change was requested
+		count, err := registeredUsers.CountDocuments(sc, bson.M{"username": newEmail})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errUsernameTaken
+		}
+
+		_, err = registeredUsers.UpdateOne(sc, bson.M{"username": oldEmail}, bson.M{
+			"$set":   bson.M{"username": newEmail, "tokenVersion": newVersion},
+			"$unset": bson.M{"pendingEmail": "", "pendingEmailOtp": "", "pendingEmailExpires": "", "pendingEmailAttemptsLeft": ""},
+		})
+		if err != nil {
+			return err
+		}
+		if err := renameUserReferences(sc, oldEmail, newEmail); err != nil {
+			return err
+		}
+
+		return enqueueEmail(sc, oldEmail, "email_changed", dbUser.Locale, EmailData{
+			"OldEmail": oldEmail,
+			"NewEmail": newEmail,
+		})
+	})
+	if err == errUsernameTaken || mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address is already in use"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+		return
+	}
+
+	// Tokens carry the username, so the caller needs a new one
+	tokenString, err := generateJWT(newEmail, dbUser.Role, newVersion, claims.MFA)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed successfully", "username": newEmail, "token": tokenString})
+}
+
+// renameUserReferences moves everything other collections hold under a
+// username to a new one. The audit log is left alone, since rewriting it
+// would break its hash chain; entries keep the name used at the time.
+func renameUserReferences(sc mongo.SessionContext, oldUsername, newUsername string) error {
+	references := []struct {
+		collection *mongo.Collection
+		field      string
+	}{
+		{requestCollection, "username"},
+		{waitlistCollection, "username"},
+		{courseRecordCollection, "username"},
+		{courseRecordCollection, "reviewedBy"},
+		{serviceAccountCollection, "createdBy"},
+		{apiKeyCollection, "createdBy"},
+		{inviteCollection, "createdBy"},
+		{inviteCollection, "usedBy"},
+		{inviteCollection, "revokedBy"},
+	}
+	for _, ref := range references {
+		_, err := ref.collection.UpdateMany(sc, bson.M{ref.field: oldUsername}, bson.M{"$set": bson.M{ref.field: newUsername}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionFilter matches a token version, treating a missing field as version 0
+func versionFilter(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return version
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConfirmEmailChangeAttempts(t *testing.T) {
+	hashedOTP, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingUser := func(attemptsLeft int) bson.D {
+		return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "role", Value: "student"},
+			{Key: "pendingEmail", Value: "asha.k@iitk.ac.in"},
+			{Key: "pendingEmailOtp", Value: string(hashedOTP)},
+			{Key: "pendingEmailExpires", Value: time.Now().Add(time.Minute)},
+			{Key: "pendingEmailAttemptsLeft", Value: attemptsLeft},
+		})
+	}
+	matched := func(n int) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+	}
+	confirm := func(otp string) int {
+		return serveJSONAs(confirmEmailChange, "asha@iitk.ac.in", "student", http.MethodPost, "/api/me/email/verify", map[string]string{"otp": otp}).Code
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("attempt is used before checking", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), pendingUser(3), matched(1))
+		if status := confirm("000000"); status != http.StatusUnauthorized {
+			mt.Fatalf("status = %d, want %d", status, http.StatusUnauthorized)
+		}
+		update := sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document()
+		if update.Lookup("u", "$inc", "pendingEmailAttemptsLeft").Int32() != -1 {
+			mt.Errorf("wrong guess did not use up an attempt: %v", update)
+		}
+	})
+
+	mt.Run("no attempts left", func(mt *mtest.T) {
+		useMockCollections(mt)
+		// Another guess took the last attempt after the account was read
+		mt.AddMockResponses(activeSession(), pendingUser(1), matched(0))
+		if status := confirm("123456"); status != http.StatusBadRequest {
+			mt.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+
+	mt.Run("last wrong guess discards the change", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), pendingUser(1), matched(1), matched(1))
+		if status := confirm("000000"); status != http.StatusUnauthorized {
+			mt.Fatalf("status = %d, want %d", status, http.StatusUnauthorized)
+		}
+		update := sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document()
+		if _, err := update.LookupErr("u", "$unset", "pendingEmail"); err != nil {
+			mt.Errorf("email change was kept after the last attempt: %v", update)
+		}
+	})
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// API keys look like ck_<prefix>_<secret>; the prefix identifies the key
+	// in listings and logs without revealing the secret
+	apiKeyMarker       = "ck_"
+	apiKeyPrefixLength = 8
+
+	// apiKeyInsertAttempts bounds the retries when a new key's prefix is taken
+	apiKeyInsertAttempts = 5
+
+	roleService = "service"
+	scopeAPIKey = "apikey"
+
+	defaultAPIKeyTTL       = 90 * 24 * time.Hour
+	maxAPIKeyTTL           = 365 * 24 * time.Hour
+	defaultAPIKeyRateLimit = 60
+	maxAPIKeyRateLimit     = 6000
+)
+
+// Scopes an API key can be granted, and what each allows
+var apiKeyScopes = map[string]string{
+	"students:read":    "List students and read their details",
+	"enrollments:read": "Read the courses a student is enrolled in",
+	"requests:read":    "List pending course requests",
+}
+
+var (
+	serviceAccountCollection *mongo.Collection
+	apiKeyCollection         *mongo.Collection
+
+	serviceAccountNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,39}$`)
+)
+
+// ServiceAccount is a non-human identity that integrations authenticate as
+type ServiceAccount struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty"`
+	CreatedBy   string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	Disabled    bool               `json:"disabled" bson:"disabled"`
+}
+
+// APIKey is a credential for a service account; only a hash of the secret is stored
+type APIKey struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Prefix         string             `json:"prefix" bson:"prefix"`
+	Hash           string             `json:"-" bson:"hash"`
+	ServiceAccount string             `json:"serviceAccount" bson:"serviceAccount"`
+	Scopes         []string           `json:"scopes" bson:"scopes"`
+	RateLimit      int                `json:"rateLimitPerMinute" bson:"rateLimit"`
+	CreatedBy      string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt      time.Time          `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt      *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt"`
+	LastUsedAt     *time.Time         `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	LastUsedIP     string             `json:"lastUsedIp,omitempty" bson:"lastUsedIp,omitempty"`
+	Status         string             `json:"status" bson:"-"`
+}
+
+// status derives the key's lifecycle state
+func (k *APIKey) status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case now.After(k.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new key along with its prefix
+func generateAPIKey() (string, string, error) {
+	raw := make([]byte, apiKeyPrefixLength/2)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	prefix := hex.EncodeToString(raw)
+
+	secret, err := randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyMarker + prefix + "_" + secret, prefix, nil
+}
+
+// apiKeyFromRequest returns the API key sent as a bearer token or in X-API-Key, if any
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); strings.HasPrefix(token, apiKeyMarker) {
+		return token
+	}
+	return ""
+}
+
+// apiKeyWindow counts the requests a key made in the current minute
+type apiKeyWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	apiKeyWindowsMu    sync.Mutex
+	apiKeyWindows      = map[string]*apiKeyWindow{}
+	apiKeyWindowsSwept time.Time
+)
+
+// allowAPIKeyRequest applies the key's per-minute rate limit, returning the
+// requests left in the window and when it resets
+func allowAPIKeyRequest(key *APIKey, now time.Time) (bool, int, time.Time) {
+	apiKeyWindowsMu.Lock()
+	defer apiKeyWindowsMu.Unlock()
+
+	// Windows of keys that have gone quiet are dropped once a minute so the
+	// map only holds keys used recently
+	if now.Sub(apiKeyWindowsSwept) >= time.Minute {
+		for prefix, window := range apiKeyWindows {
+			if now.Sub(window.start) >= time.Minute {
+				delete(apiKeyWindows, prefix)
+			}
+		}
+		apiKeyWindowsSwept = now
+	}
+
+	window := apiKeyWindows[key.Prefix]
+	if window == nil || now.Sub(window.start) >= time.Minute {
+		window = &apiKeyWindow{start: now.Truncate(time.Minute)}
+		apiKeyWindows[key.Prefix] = window
+	}
+	reset := window.start.Add(time.Minute)
+	if window.count >= key.RateLimit {
+		return false, 0, reset
+	}
+	window.count++
+	return true, key.RateLimit - window.count, reset
+}
+
+// authenticateAPIKey validates an API key and checks that it grants scope
+func authenticateAPIKey(c *gin.Context, rawKey, scope string) (*Claims, bool) {
+	invalid := func() (*Claims, bool) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return nil, false
+	}
+
+	if !strings.HasPrefix(rawKey, apiKeyMarker) || len(rawKey) < len(apiKeyMarker)+apiKeyPrefixLength+2 {
+		return invalid()
+	}
+	prefix := rawKey[len(apiKeyMarker) : len(apiKeyMarker)+apiKeyPrefixLength]
+
+	var key APIKey
+	if err := apiKeyCollection.FindOne(ctx, bson.M{"prefix": prefix}).Decode(&key); err != nil {
+		return invalid()
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(rawKey)), []byte(key.Hash)) != 1 {
+		return invalid()
+	}
+
+	now := time.Now()
+	if status := key.status(now); status != "active" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "API key has been " + status})
+		return nil, false
+	}
+
+	var account ServiceAccount
+	err := serviceAccountCollection.FindOne(ctx, bson.M{"name": key.ServiceAccount}).Decode(&account)
+	if err != nil || account.Disabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Service account is disabled"})
+		return nil, false
+	}
+
+	// A call outside the key's scopes is refused before it counts as use
+	if !key.hasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key does not have the " + scope + " scope"})
+		return nil, false
+	}
+
+	allowed, remaining, reset := allowAPIKeyRequest(&key, now)
+	c.Header("X-RateLimit-Limit", strconv.Itoa(key.RateLimit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "API key rate limit exceeded"})
+		return nil, false
+	}
+
+	if _, err := apiKeyCollection.UpdateOne(ctx, bson.M{"_id": key.ID}, bson.M{"$set": bson.M{
+		"lastUsedAt": now,
+		"lastUsedIp": c.ClientIP(),
+	}}); err != nil {
+		log.Printf("Failed to record use of API key %s: %v", key.Prefix, err)
+	}
+
+	claims := &Claims{Username: "service:" + account.Name, Role: roleService, Scope: scopeAPIKey}
+	c.Set("claims", claims)
+	return claims, true
+}
+
+// authenticateOrAPIKey accepts either a user session or an API key granting scope
+func authenticateOrAPIKey(c *gin.Context, scope string) (*Claims, bool) {
+	if rawKey := apiKeyFromRequest(c); rawKey != "" {
+		return authenticateAPIKey(c, rawKey, scope)
+	}
+	return authenticate(c)
+}
+
+// checkRoleOrScope admits users with role and API keys granted scope
+func checkRoleOrScope(c *gin.Context, role, scope string) bool {
+	claims, ok := authenticateOrAPIKey(c, scope)
+	if !ok {
+		return false
+	}
+	if claims.Role != role && claims.Role != roleService {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return false
+	}
+	return true
+}
+
+// ensureAPIKeyIndexes keeps service account names and key prefixes unique
+func ensureAPIKeyIndexes() {
+	if _, err := serviceAccountCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Printf("Failed to create service account index: %v", err)
+	}
+	if _, err := apiKeyCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "prefix", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Printf("Failed to create API key index: %v", err)
+	}
+}
+
+// Route for admins to create a service account
+func createServiceAccount(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+	if !serviceAccountNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be 2 to 40 lowercase letters, digits or hyphens", "field": "name"})
+		return
+	}
+
+	account := ServiceAccount{
+		Name:        req.Name,
+		Description: strings.TrimSpace(req.Description),
+		CreatedBy:   claims.Username,
+		CreatedAt:   time.Now(),
+	}
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		result, err := serviceAccountCollection.InsertOne(sc, account)
+		if err != nil {
+			return err
+		}
+		account.ID = result.InsertedID.(primitive.ObjectID)
+		return recordAuditIn(sc, c, "service_account.create", "service:"+account.Name, nil, account)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A service account with that name already exists", "field": "name"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// Route for admins to list service accounts
+func listServiceAccounts(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	cursor, err := serviceAccountCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch service accounts"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	accounts := []ServiceAccount{}
+	if err := cursor.All(ctx, &accounts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode service accounts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+// Route for admins to disable a service account and revoke all of its keys
+func disableServiceAccount(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	name := c.Param("name")
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		result, err := serviceAccountCollection.UpdateOne(sc, bson.M{"name": name}, bson.M{"$set": bson.M{"disabled": true}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		_, err = apiKeyCollection.UpdateMany(sc,
+			bson.M{"serviceAccount": name, "revokedAt": nil},
+			bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+		if err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "service_account.disable", "service:"+name, gin.H{"disabled": false}, gin.H{"disabled": true})
+	})
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable service account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service account disabled and its keys revoked"})
+}
+
+// Route for admins to issue an API key; the key is only ever shown in this response
+func createAPIKey(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	var req struct {
+		Scopes             []string `json:"scopes" binding:"required"`
+		ExpiresInDays      int      `json:"expiresInDays"`
+		RateLimitPerMinute int      `json:"rateLimitPerMinute"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required", "field": "scopes"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := apiKeyScopes[scope]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope " + scope, "field": "scopes"})
+			return
+		}
+	}
+
+	ttl := defaultAPIKeyTTL
+	if req.ExpiresInDays > 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	if ttl > maxAPIKeyTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API keys cannot be valid for more than 365 days", "field": "expiresInDays"})
+		return
+	}
+	rateLimit := defaultAPIKeyRateLimit
+	if req.RateLimitPerMinute > 0 {
+		rateLimit = req.RateLimitPerMinute
+	}
+	if rateLimit > maxAPIKeyRateLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Rate limit cannot exceed 6000 requests per minute", "field": "rateLimitPerMinute"})
+		return
+	}
+
+	var account ServiceAccount
+	err := serviceAccountCollection.FindOne(ctx, bson.M{"name": c.Param("name")}).Decode(&account)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch service account"})
+		return
+	}
+	if account.Disabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Service account is disabled"})
+		return
+	}
+
+	// Prefixes are short enough to collide now and then, so a clash on the
+	// unique index is retried with a fresh key in a new transaction
+	now := time.Now()
+	var rawKey string
+	var key APIKey
+	for attempt := 0; attempt < apiKeyInsertAttempts; attempt++ {
+		var prefix string
+		rawKey, prefix, err = generateAPIKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+			return
+		}
+		key = APIKey{
+			Prefix:         prefix,
+			Hash:           hashAPIKey(rawKey),
+			ServiceAccount: account.Name,
+			Scopes:         req.Scopes,
+			RateLimit:      rateLimit,
+			CreatedBy:      claims.Username,
+			CreatedAt:      now,
+			ExpiresAt:      now.Add(ttl),
+		}
+		err = withTransaction(func(sc mongo.SessionContext) error {
+			result, err := apiKeyCollection.InsertOne(sc, key)
+			if err != nil {
+				return err
+			}
+			key.ID = result.InsertedID.(primitive.ObjectID)
+			key.Status = key.status(now)
+			return recordAuditIn(sc, c, "api_key.create", "api_key:"+key.Prefix, nil, key)
+		})
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"key": rawKey, "apiKey": key})
+}
+
+// Route for admins to list the keys of a service account
+func listAPIKeys(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	cursor, err := apiKeyCollection.Find(ctx, bson.M{"serviceAccount": c.Param("name")}, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode API keys"})
+		return
+	}
+	now := time.Now()
+	for i := range keys {
+		keys[i].Status = keys[i].status(now)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// Route for admins to revoke an API key by its prefix
+func revokeAPIKey(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	prefix := c.Param("prefix")
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		result, err := apiKeyCollection.UpdateOne(sc,
+			bson.M{"prefix": prefix, "revokedAt": nil},
+			bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		return recordAuditIn(sc, c, "api_key.revoke", "api_key:"+prefix, nil, nil)
+	})
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found or already revoked"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAPIKeyWindowsAreSwept(t *testing.T) {
+	apiKeyWindowsMu.Lock()
+	apiKeyWindows = map[string]*apiKeyWindow{}
+	apiKeyWindowsSwept = time.Time{}
+	apiKeyWindowsMu.Unlock()
+
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, prefix := range []string{"aaaa1111", "bbbb2222", "cccc3333"} {
+		allowAPIKeyRequest(&APIKey{Prefix: prefix, RateLimit: 10}, start)
+	}
+	if len(apiKeyWindows) != 3 {
+		t.Fatalf("tracking %d windows, want 3", len(apiKeyWindows))
+	}
+
+	// Only the key still in use keeps a window once the others have gone quiet
+	allowAPIKeyRequest(&APIKey{Prefix: "aaaa1111", RateLimit: 10}, start.Add(90*time.Second))
+	if len(apiKeyWindows) != 1 || apiKeyWindows["aaaa1111"] == nil {
+		t.Fatalf("windows after sweep = %v", apiKeyWindows)
+	}
+}
+
+func TestCreateAPIKeyRetriesPrefixCollision(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("prefix taken", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateCursorResponse(0, "db.service_accounts", mtest.FirstBatch, bson.D{{Key: "name", Value: "registrar"}}),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "E11000 duplicate key error"}),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+
+		body := map[string]interface{}{"scopes": []string{"students:read"}}
+		recorder := serveRoute(createAPIKey, http.MethodPost, "/api/admin/service-accounts/:name/keys",
+			"/api/admin/service-accounts/registrar/keys", body, "admin@iitk.ac.in", "admin")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		var prefixes []string
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" && event.Command.Lookup("insert").StringValue() == "api_keys" {
+				prefixes = append(prefixes, event.Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("prefix").StringValue())
+			}
+		}
+		if len(prefixes) != 2 || prefixes[0] == prefixes[1] {
+			mt.Errorf("inserted prefixes %v, want a second attempt with a new prefix", prefixes)
+		}
+	})
+}
+
+// testAPIKey is a key granted scope, returned as the raw key to send and the
+// mock response to its lookup
+func testAPIKey(prefix, scope string) (string, bson.D) {
+	raw := apiKeyMarker + prefix + "_secret"
+	return raw, mtest.CreateCursorResponse(0, "db.api_keys", mtest.FirstBatch, bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "prefix", Value: prefix},
+		{Key: "hash", Value: hashAPIKey(raw)},
+		{Key: "serviceAccount", Value: "registrar"},
+		{Key: "scopes", Value: bson.A{scope}},
+		{Key: "rateLimit", Value: 10},
+		{Key: "expiresAt", Value: time.Now().Add(time.Hour)},
+	})
+}
+
+// serveWithAPIKey mounts a handler on route and serves target with the raw key
+func serveWithAPIKey(handler gin.HandlerFunc, route, target, rawKey string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	request.Header.Set("X-API-Key", rawKey)
+	router := gin.New()
+	router.GET(route, handler)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestStudentsOmitCredentials(t *testing.T) {
+	student := bson.D{
+		{Key: "username", Value: "asha@iitk.ac.in"},
+		{Key: "password", Value: "$2a$10$hash"},
+		{Key: "role", Value: "student"},
+		{Key: "isVerified", Value: false},
+		{Key: "otp", Value: "123456"},
+		{Key: "courses", Value: bson.A{"CS201"}},
+	}
+	account := mtest.CreateCursorResponse(0, "db.service_accounts", mtest.FirstBatch, bson.D{{Key: "name", Value: "registrar"}})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("list", func(mt *mtest.T) {
+		useMockCollections(mt)
+		rawKey, key := testAPIKey("aaaa0001", "students:read")
+		mt.AddMockResponses(key, account, mtest.CreateSuccessResponse(),
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, student))
+
+		recorder := serveWithAPIKey(getStudentsList, "/api/students", "/api/students", rawKey)
+		expectStatus(mt, recorder, http.StatusOK)
+		var students []map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &students); err != nil || len(students) != 1 {
+			mt.Fatalf("students = %s", recorder.Body.String())
+		}
+		expectNoCredentials(mt, students[0])
+	})
+	mt.Run("details", func(mt *mtest.T) {
+		useMockCollections(mt)
+		rawKey, key := testAPIKey("aaaa0002", "students:read")
+		mt.AddMockResponses(key, account, mtest.CreateSuccessResponse(),
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, student))
+
+		recorder := serveWithAPIKey(getStudentDetails, "/api/students/:username",
+			"/api/students/asha@iitk.ac.in", rawKey)
+		expectStatus(mt, recorder, http.StatusOK)
+		expectNoCredentials(mt, responseBody(mt, recorder))
+	})
+}
+
+func expectNoCredentials(t testing.TB, student map[string]interface{}) {
+	t.Helper()
+	if student["username"] != "asha@iitk.ac.in" {
+		t.Errorf("username = %v", student["username"])
+	}
+	for _, field := range []string{"password", "otp"} {
+		if _, ok := student[field]; ok {
+			t.Errorf("response includes %q: %v", field, student)
+		}
+	}
+}
+
+func TestAPIKeyOutOfScopeIsNotUsage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("wrong scope", func(mt *mtest.T) {
+		useMockCollections(mt)
+		rawKey, key := testAPIKey("aaaa0003", "requests:read")
+		mt.AddMockResponses(key,
+			mtest.CreateCursorResponse(0, "db.service_accounts", mtest.FirstBatch, bson.D{{Key: "name", Value: "registrar"}}))
+
+		recorder := serveWithAPIKey(getStudentsList, "/api/students", "/api/students", rawKey)
+		expectStatus(mt, recorder, http.StatusForbidden)
+		if collections, _ := sentUpdates(mt); len(collections) != 0 {
+			mt.Errorf("updates sent to %v, want no recorded use", collections)
+		}
+		apiKeyWindowsMu.Lock()
+		window := apiKeyWindows["aaaa0003"]
+		apiKeyWindowsMu.Unlock()
+		if window != nil {
+			mt.Errorf("rate limit window = %+v, want none", window)
+		}
+	})
+}
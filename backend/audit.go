@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	auditMaxRetries = 5
+)
+
+var (
+	auditCollection *mongo.Collection
+
+	// auditMu serialises appends from this process; the unique index on seq
+	// catches appends racing in from other instances
+	auditMu sync.Mutex
+
+	requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+)
+
+// AuditEntry is one link in the append-only, hash-chained audit log. OnBehalfOf
+// names the user an admin was impersonating. Before and After hold JSON
+// snapshots of the target so that the hash covers exact bytes.
+type AuditEntry struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Seq        int64              `json:"seq" bson:"seq"`
+	Timestamp  time.Time          `json:"timestamp" bson:"timestamp"`
+	Actor      string             `json:"actor" bson:"actor"`
+	OnBehalfOf string             `json:"onBehalfOf,omitempty" bson:"onBehalfOf,omitempty"`
+	Action     string             `json:"action" bson:"action"`
+	Target     string             `json:"target" bson:"target"`
+	Before     string             `json:"-" bson:"before,omitempty"`
+	After      string             `json:"-" bson:"after,omitempty"`
+	RequestID  string             `json:"requestId" bson:"requestId"`
+	IP         string             `json:"ip" bson:"ip"`
+	PrevHash   string             `json:"prevHash" bson:"prevHash"`
+	Hash       string             `json:"hash" bson:"hash"`
+}
+
+// MarshalJSON inlines the before and after snapshots as JSON values
+func (e AuditEntry) MarshalJSON() ([]byte, error) {
+	type plain AuditEntry
+	return json.Marshal(struct {
+		plain
+		Before json.RawMessage `json:"before,omitempty"`
+		After  json.RawMessage `json:"after,omitempty"`
+	}{plain(e), rawJSON(e.Before), rawJSON(e.After)})
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+// computeHash chains the entry to its predecessor. Fields are hashed in a
+// fixed order and the timestamp at millisecond precision, which is what
+// MongoDB stores, so that a stored entry always hashes to the same value.
+func (e *AuditEntry) computeHash() string {
+	payload, _ := json.Marshal(struct {
+		Seq        int64  `json:"seq"`
+		PrevHash   string `json:"prevHash"`
+		Timestamp  string `json:"timestamp"`
+		Actor      string `json:"actor"`
+		Action     string `json:"action"`
+		Target     string `json:"target"`
+		OnBehalfOf string `json:"onBehalfOf,omitempty"`
+		Before     string `json:"before,omitempty"`
+		After      string `json:"after,omitempty"`
+		RequestID  string `json:"requestId"`
+		IP         string `json:"ip"`
+	}{
+		e.Seq, e.PrevHash, e.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"),
+		e.Actor, e.Action, e.Target, e.OnBehalfOf, e.Before, e.After, e.RequestID, e.IP,
+	})
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// ensureAuditIndexes makes seq the unique position of each entry in the chain
+func ensureAuditIndexes() {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "target", Value: 1}, {Key: "timestamp", Value: -1}}},
+	}
+	if _, err := auditCollection.Indexes().CreateMany(ctx, models); err != nil {
+		log.Printf("Failed to create audit log indexes: %v", err)
+	}
+}
+
+// requestID tags every request with an ID, reusing a well-formed one sent by
+// the client or a proxy, and echoes it in the response
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			generated, err := randomURLString(16)
+			if err != nil {
+				generated = primitive.NewObjectID().Hex()
+			}
+			id = generated
+		}
+		c.Set("requestID", id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// auditActor names whoever made the request, and the impersonated user when an
+// admin is acting as someone else. Only identities already checked by
+// authenticate or authenticateOrAPIKey are recorded; anything else, including
+// a bearer token sent to a handler that does not require a login, is anonymous.
+func auditActor(c *gin.Context) (actor, onBehalfOf string) {
+	if value, ok := c.Get("claims"); ok {
+		return claimsActor(value.(*Claims))
+	}
+	return "anonymous", ""
+}
+
+func claimsActor(claims *Claims) (string, string) {
+	if claims.ImpersonatedBy != "" {
+		return claims.ImpersonatedBy, claims.Username
+	}
+	return claims.Username, ""
+}
+
+// recordAudit appends an entry for an action that changes no data, such as a
+// read made while impersonating. The caller refuses the action when it fails.
+func recordAudit(c *gin.Context, action, target string, before, after interface{}) error {
+	entry := newAuditEntry(c, action, target, before, after)
+	if err := appendAudit(ctx, entry); err != nil {
+		log.Printf("Failed to record audit entry %s on %s by %s: %v", action, target, entry.Actor, err)
+		return err
+	}
+	return nil
+}
+
+// recordAuditIn appends an entry within the transaction of sc, so the action
+// and its record commit together or not at all
+func recordAuditIn(sc mongo.SessionContext, c *gin.Context, action, target string, before, after interface{}) error {
+	return appendAudit(sc, newAuditEntry(c, action, target, before, after))
+}
+
+func newAuditEntry(c *gin.Context, action, target string, before, after interface{}) *AuditEntry {
+	actor, onBehalfOf := auditActor(c)
+	return &AuditEntry{
+		Actor:      actor,
+		OnBehalfOf: onBehalfOf,
+		Action:     action,
+		Target:     target,
+		Before:     snapshotJSON(before),
+		After:      snapshotJSON(after),
+		RequestID:  c.GetString("requestID"),
+		IP:         c.ClientIP(),
+	}
+}
+
+func snapshotJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// appendAudit links entry to the current head of the chain and inserts it
+// using c, which may be a transaction. The head is always read outside the
+// transaction, whose snapshot may predate entries committed since. An append
+// racing another transaction's then fails with a write conflict, and the
+// whole transaction is retried.
+func appendAudit(c context.Context, entry *AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	for attempt := 0; attempt < auditMaxRetries; attempt++ {
+		var head AuditEntry
+		opts := options.FindOne().SetSort(bson.M{"seq": -1})
+		err := auditCollection.FindOne(ctx, bson.M{}, opts).Decode(&head)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		entry.ID = primitive.NilObjectID
+		entry.Seq = head.Seq + 1
+		entry.PrevHash = head.Hash
+		entry.Timestamp = time.Now().UTC().Truncate(time.Millisecond)
+		entry.Hash = entry.computeHash()
+
+		_, err = auditCollection.InsertOne(c, entry)
+		if mongo.IsDuplicateKeyError(err) && mongo.SessionFromContext(c) == nil {
+			// Another instance appended first; link to its entry instead
+			continue
+		}
+		return err
+	}
+	return errors.New("audit log head kept moving")
+}
+
+// auditFilter builds a query from the actor, onBehalfOf, action, target, requestId, from and to parameters
+func auditFilter(c *gin.Context) (bson.M, error) {
+	filter := bson.M{}
+	for _, field := range []string{"actor", "onBehalfOf", "action", "target", "requestId"} {
+		if value := c.Query(field); value != "" {
+			filter[field] = value
+		}
+	}
+
+	timestamp := bson.M{}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, errors.New("from must be an RFC 3339 timestamp")
+		}
+		timestamp["$gte"] = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, errors.New("to must be an RFC 3339 timestamp")
+		}
+		timestamp["$lt"] = t
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	return filter, nil
+}
+
+// Route for admins to query the audit log, or export it with format=csv or format=json
+func listAuditLog(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	filter, err := auditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := c.Query("format")
+	opts := options.Find().SetSort(bson.M{"seq": -1})
+	switch format {
+	case "":
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if limit < 1 || limit > 1000 {
+			limit = 100
+		}
+		opts.SetLimit(int64(limit))
+		if before, err := strconv.ParseInt(c.Query("beforeSeq"), 10, 64); err == nil {
+			filter["seq"] = bson.M{"$lt": before}
+		}
+	case "csv", "json":
+		// Exports are the full matching history in chain order
+		opts.SetSort(bson.M{"seq": 1})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be csv or json"})
+		return
+	}
+
+	cursor, err := auditCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	if format == "" {
+		entries := []AuditEntry{}
+		if err := cursor.All(ctx, &entries); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode audit log"})
+			return
+		}
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+
+	filename := "audit-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// Stream the export so large histories are not held in memory
+	if format == "json" {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		for cursor.Next(ctx) {
+			var entry AuditEntry
+			if err := cursor.Decode(&entry); err != nil {
+				log.Printf("Failed to decode audit entry during export: %v", err)
+				return
+			}
+			encoder.Encode(entry)
+		}
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"seq", "timestamp", "actor", "onBehalfOf", "action", "target", "before", "after", "requestId", "ip", "prevHash", "hash"})
+	for cursor.Next(ctx) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			log.Printf("Failed to decode audit entry during export: %v", err)
+			break
+		}
+		writer.Write([]string{
+			strconv.FormatInt(entry.Seq, 10),
+			entry.Timestamp.UTC().Format(time.RFC3339Nano),
+			entry.Actor, entry.OnBehalfOf, entry.Action, entry.Target, entry.Before, entry.After,
+			entry.RequestID, entry.IP, entry.PrevHash, entry.Hash,
+		})
+	}
+	writer.Flush()
+}
+
+// Route for admins to walk the whole chain and report the first entry that
+// was altered, removed or inserted out of order
+func verifyAuditLog(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	cursor, err := auditCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit log"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var checked int64
+	prevHash := ""
+	for cursor.Next(ctx) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode audit log"})
+			return
+		}
+
+		problem := ""
+		switch {
+		case entry.Seq != checked+1:
+			problem = "sequence gap"
+		case entry.PrevHash != prevHash:
+			problem = "previous hash mismatch"
+		case entry.computeHash() != entry.Hash:
+			problem = "entry hash mismatch"
+		}
+		if problem != "" {
+			c.JSON(http.StatusOK, gin.H{"valid": false, "checked": checked, "brokenAt": entry.Seq, "reason": problem})
+			return
+		}
+
+		checked++
+		prevHash = entry.Hash
+	}
+	if err := cursor.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "checked": checked, "head": prevHash})
+}
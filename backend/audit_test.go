@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestAuditActor(t *testing.T) {
+	newContext := func(token string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/add-course", nil)
+		if token != "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}
+		return c
+	}
+
+	// A valid token that no handler has checked, e.g. one revoked since
+	token, err := generateJWT("mallory@iitk.ac.in", "admin", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actor, _ := auditActor(newContext(token)); actor != "anonymous" {
+		t.Errorf("unchecked token recorded as %q, want anonymous", actor)
+	}
+
+	c := newContext("")
+	c.Set("claims", &Claims{Username: "asha@iitk.ac.in", Role: "student"})
+	if actor, onBehalfOf := auditActor(c); actor != "asha@iitk.ac.in" || onBehalfOf != "" {
+		t.Errorf("auditActor = %q, %q", actor, onBehalfOf)
+	}
+
+	c = newContext("")
+	c.Set("claims", &Claims{Username: "asha@iitk.ac.in", Role: "student", ImpersonatedBy: "admin@iitk.ac.in"})
+	if actor, onBehalfOf := auditActor(c); actor != "admin@iitk.ac.in" || onBehalfOf != "asha@iitk.ac.in" {
+		t.Errorf("auditActor while impersonating = %q, %q", actor, onBehalfOf)
+	}
+}
+
+// auditChain builds n correctly linked entries starting at seq 1
+func auditChain(n int) []*AuditEntry {
+	start := time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC)
+	var entries []*AuditEntry
+	prevHash := ""
+	for i := 1; i <= n; i++ {
+		entry := &AuditEntry{
+			Seq:       int64(i),
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Actor:     "admin@iitk.ac.in",
+			Action:    "course.update",
+			Target:    "course:CS201",
+			Before:    `{"capacity":40}`,
+			After:     `{"capacity":60}`,
+			RequestID: "req-1",
+			IP:        "10.0.0.1",
+			PrevHash:  prevHash,
+		}
+		entry.Hash = entry.computeHash()
+		prevHash = entry.Hash
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// auditEntries is the mock response to a find returning the entries
+func auditEntries(entries ...*AuditEntry) bson.D {
+	docs := make([]bson.D, len(entries))
+	for i, entry := range entries {
+		data, _ := bson.Marshal(entry)
+		bson.Unmarshal(data, &docs[i])
+	}
+	return mtest.CreateCursorResponse(0, "db.audit_log", mtest.FirstBatch, docs...)
+}
+
+func TestAuditHashChain(t *testing.T) {
+	entries := auditChain(2)
+	if entries[1].PrevHash != entries[0].Hash || entries[0].PrevHash != "" {
+		t.Fatalf("entries are not linked: %+v", entries)
+	}
+
+	edited := *entries[1]
+	edited.Actor = "mallory@iitk.ac.in"
+	if edited.computeHash() == entries[1].Hash {
+		t.Error("editing the actor kept the hash")
+	}
+	relinked := *entries[1]
+	relinked.PrevHash = "0"
+	if relinked.computeHash() == entries[1].Hash {
+		t.Error("changing the previous hash kept the hash")
+	}
+
+	// MongoDB keeps milliseconds, so finer precision must not change the hash
+	stored := *entries[1]
+	stored.Timestamp = stored.Timestamp.Add(400 * time.Microsecond)
+	if stored.computeHash() != entries[1].Hash {
+		t.Error("sub-millisecond timestamp changed the hash")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("append links to the head", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(auditEntries(entries[1]), mtest.CreateSuccessResponse())
+		entry := &AuditEntry{Actor: "admin@iitk.ac.in", Action: "term.create", Target: "term:2024-odd"}
+		if err := appendAudit(ctx, entry); err != nil {
+			mt.Fatal(err)
+		}
+		if entry.Seq != 3 || entry.PrevHash != entries[1].Hash || entry.Hash != entry.computeHash() {
+			mt.Errorf("appended entry = %+v", entry)
+		}
+		inserted := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		if inserted.Lookup("hash").StringValue() != entry.Hash {
+			mt.Errorf("inserted %v", inserted)
+		}
+	})
+
+	mt.Run("first entry starts the chain", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(noDocuments("db.audit_log"), mtest.CreateSuccessResponse())
+		entry := &AuditEntry{Actor: "admin@iitk.ac.in", Action: "term.create", Target: "term:2024-odd"}
+		if err := appendAudit(ctx, entry); err != nil {
+			mt.Fatal(err)
+		}
+		if entry.Seq != 1 || entry.PrevHash != "" {
+			mt.Errorf("appended entry = %+v", entry)
+		}
+	})
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	verify := func(mt *mtest.T, entries ...*AuditEntry) map[string]interface{} {
+		mt.Helper()
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), auditEntries(entries...))
+		recorder := serveJSONAs(verifyAuditLog, "admin@iitk.ac.in", "admin", http.MethodGet, "/api/admin/audit/verify", nil)
+		expectStatus(mt, recorder, http.StatusOK)
+		return responseBody(mt, recorder)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("intact chain", func(mt *mtest.T) {
+		entries := auditChain(3)
+		body := verify(mt, entries...)
+		if body["valid"] != true || body["checked"] != float64(3) || body["head"] != entries[2].Hash {
+			mt.Errorf("response = %v", body)
+		}
+	})
+
+	mt.Run("removed entry", func(mt *mtest.T) {
+		entries := auditChain(3)
+		body := verify(mt, entries[0], entries[2])
+		if body["valid"] != false || body["brokenAt"] != float64(3) || body["reason"] != "sequence gap" {
+			mt.Errorf("response = %v", body)
+		}
+	})
+
+	mt.Run("edited entry", func(mt *mtest.T) {
+		entries := auditChain(3)
+		entries[1].After = `{"capacity":600}`
+		body := verify(mt, entries...)
+		if body["valid"] != false || body["brokenAt"] != float64(2) || body["checked"] != float64(1) || body["reason"] != "entry hash mismatch" {
+			mt.Errorf("response = %v", body)
+		}
+	})
+
+	mt.Run("edited entry rehashed", func(mt *mtest.T) {
+		entries := auditChain(3)
+		entries[1].After = `{"capacity":600}`
+		entries[1].Hash = entries[1].computeHash()
+		body := verify(mt, entries...)
+		if body["valid"] != false || body["brokenAt"] != float64(3) || body["reason"] != "previous hash mismatch" {
+			mt.Errorf("response = %v", body)
+		}
+	})
+
+	mt.Run("students cannot verify", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		recorder := serveJSONAs(verifyAuditLog, "asha@iitk.ac.in", "student", http.MethodGet, "/api/admin/audit/verify", nil)
+		expectStatus(mt, recorder, http.StatusForbidden)
+	})
+}
+
+func TestListAuditLog(t *testing.T) {
+	list := func(query string) *httptest.ResponseRecorder {
+		return serveRoute(listAuditLog, http.MethodGet, "/api/admin/audit", "/api/admin/audit?"+query, nil, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("filters", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), auditEntries(auditChain(1)...))
+		recorder := list("actor=admin@iitk.ac.in&onBehalfOf=asha@iitk.ac.in&action=user.role&target=user:asha@iitk.ac.in" +
+			"&requestId=req-1&from=2024-07-01T00:00:00Z&to=2024-08-01T00:00:00Z&beforeSeq=50&limit=20")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		find := sentCommand(mt, "find")
+		filter := find.Lookup("filter")
+		for field, want := range map[string]string{
+			"actor":      "admin@iitk.ac.in",
+			"onBehalfOf": "asha@iitk.ac.in",
+			"action":     "user.role",
+			"target":     "user:asha@iitk.ac.in",
+			"requestId":  "req-1",
+		} {
+			if got := filter.Document().Lookup(field).StringValue(); got != want {
+				mt.Errorf("filter %s = %q, want %q", field, got, want)
+			}
+		}
+		if from := filter.Document().Lookup("timestamp", "$gte").Time(); !from.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) {
+			mt.Errorf("from = %v", from)
+		}
+		if to := filter.Document().Lookup("timestamp", "$lt").Time(); !to.Equal(time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)) {
+			mt.Errorf("to = %v", to)
+		}
+		if filter.Document().Lookup("seq", "$lt").Int64() != 50 {
+			mt.Errorf("beforeSeq not applied: %v", filter)
+		}
+		if find.Lookup("limit").Int64() != 20 || find.Lookup("sort", "seq").Int32() != -1 {
+			mt.Errorf("find = %v", find)
+		}
+
+		var entries []map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil || len(entries) != 1 {
+			mt.Fatalf("response = %s", recorder.Body.String())
+		}
+		if after, _ := entries[0]["after"].(map[string]interface{}); after["capacity"] != float64(60) {
+			mt.Errorf("after snapshot not inlined: %v", entries[0])
+		}
+	})
+
+	for _, query := range []string{"from=yesterday", "to=2024-08-01", "format=xml"} {
+		mt.Run(query, func(mt *mtest.T) {
+			useMockCollections(mt)
+			mt.AddMockResponses(activeSession())
+			expectStatus(mt, list(query), http.StatusBadRequest)
+		})
+	}
+
+	mt.Run("csv export", func(mt *mtest.T) {
+		entries := auditChain(2)
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), auditEntries(entries...))
+		recorder := list("format=csv&action=course.update")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+			mt.Errorf("Content-Type = %q", contentType)
+		}
+		if disposition := recorder.Header().Get("Content-Disposition"); !strings.Contains(disposition, ".csv") {
+			mt.Errorf("Content-Disposition = %q", disposition)
+		}
+		find := sentCommand(mt, "find")
+		if find.Lookup("sort", "seq").Int32() != 1 {
+			mt.Errorf("export is not in chain order: %v", find)
+		}
+		if _, err := find.LookupErr("limit"); err == nil {
+			mt.Errorf("export is limited: %v", find)
+		}
+
+		rows, err := csv.NewReader(recorder.Body).ReadAll()
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if len(rows) != 3 || rows[0][0] != "seq" || rows[0][11] != "hash" {
+			mt.Fatalf("rows = %v", rows)
+		}
+		if rows[2][0] != "2" || rows[2][6] != `{"capacity":40}` || rows[2][10] != entries[0].Hash || rows[2][11] != entries[1].Hash {
+			mt.Errorf("row = %v", rows[2])
+		}
+	})
+
+	mt.Run("json export", func(mt *mtest.T) {
+		entries := auditChain(2)
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), auditEntries(entries...))
+		recorder := list("format=json")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+			mt.Errorf("Content-Type = %q", contentType)
+		}
+		var lines []map[string]interface{}
+		scanner := bufio.NewScanner(recorder.Body)
+		for scanner.Scan() {
+			var line map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				mt.Fatalf("line %q: %v", scanner.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) != 2 || lines[1]["seq"] != float64(2) || lines[1]["hash"] != entries[1].Hash {
+			mt.Fatalf("lines = %v", lines)
+		}
+		if before, _ := lines[1]["before"].(map[string]interface{}); before["capacity"] != float64(40) {
+			mt.Errorf("before snapshot not inlined: %v", lines[1])
+		}
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const signedBlobURLTTL = 15 * time.Minute
+
+var (
+	blobStore BlobStore
+
+	// blobURLSecret signs download links served by the API itself
+	blobURLSecret []byte
+
+	errBlobNotFound = errors.New("blob not found")
+
+	blobKeyPattern = regexp.MustCompile(`^[a-z0-9]{8,128}$`)
+)
+
+// BlobStore keeps uploaded files outside the database, addressed by key.
+// Implementations must stream in both directions rather than hold whole files.
+type BlobStore interface {
+	// Put stores the contents of r under key and returns the number of bytes
+	// written; a failed Put leaves nothing behind under key
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens the blob stored under key
+	Get(key string) (io.ReadCloser, error)
+	// Stat returns the size of the blob stored under key
+	Stat(key string) (int64, error)
+	// Move renames a blob, replacing anything already stored under to
+	Move(from, to string) error
+	// Delete removes the blob stored under key, if any
+	Delete(key string) error
+}
+
+// BlobURLSigner is implemented by stores that can hand out their own
+// time-limited download links; other stores are served through the API
+type BlobURLSigner interface {
+	SignedURL(key, filename, contentType string, ttl time.Duration) (string, error)
+}
+
+// newBlobStoreFromEnv builds the store selected by BLOB_STORE
+func newBlobStoreFromEnv() (BlobStore, error) {
+	blobURLSecret = deriveKey(jwtKey, "blob-url")
+	if secret := os.Getenv("BLOB_URL_SECRET"); secret != "" {
+		blobURLSecret = []byte(secret)
+	}
+
+	switch store := os.Getenv("BLOB_STORE"); store {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocalBlobStore(dir)
+	case "s3":
+		return newS3BlobStoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", store)
+	}
+}
+
+// putBlobDeduplicated streams r into the store under the SHA-256 of its
+// contents, so identical files are only kept once. On success the key stays
+// locked in blobLocks until release is called, which the caller does once the
+// blob is referenced, so a cleanup cannot delete it in the meantime.
+func putBlobDeduplicated(store BlobStore, r io.Reader) (key string, size int64, release func(), err error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", 0, nil, err
+	}
+	staging := "tmp" + hex.EncodeToString(raw)
+
+	// The hash is only known once the whole stream has been read, so the blob
+	// is written under a staging key and moved into place afterwards
+	hash := sha256.New()
+	size, err = store.Put(staging, io.TeeReader(r, hash))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	key = hex.EncodeToString(hash.Sum(nil))
+
+	release = blobLocks.Lock(key)
+	if _, err := store.Stat(key); err == nil {
+		if err := store.Delete(staging); err != nil {
+			release()
+			return "", 0, nil, err
+		}
+		return key, size, release, nil
+	} else if err != errBlobNotFound {
+		release()
+		store.Delete(staging)
+		return "", 0, nil, err
+	}
+	if err := store.Move(staging, key); err != nil {
+		release()
+		store.Delete(staging)
+		return "", 0, nil, err
+	}
+	return key, size, release, nil
+}
+
+// blobLocks serialises taking a reference to a deduplicated blob with deleting
+// it once it looks unreferenced
+var blobLocks = keyedMutex{held: map[string]*keyedLock{}}
+
+// keyedMutex is a set of mutexes created on demand, one per key
+type keyedMutex struct {
+	mu   sync.Mutex
+	held map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+// Lock locks key and returns the function that unlocks it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	lock := k.held[key]
+	if lock == nil {
+		lock = &keyedLock{}
+		k.held[key] = lock
+	}
+	lock.users++
+	k.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.mu.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(k.held, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// signedBlobURL returns a link to download the blob under key that stops working after ttl
+func signedBlobURL(c *gin.Context, key, filename, contentType string, ttl time.Duration) (string, time.Time, error) {
+	expires := time.Now().Add(ttl)
+	if signer, ok := blobStore.(BlobURLSigner); ok {
+		link, err := signer.SignedURL(key, filename, contentType, ttl)
+		return link, expires, err
+	}
+
+	query := url.Values{}
+	query.Set("name", filename)
+	query.Set("type", contentType)
+	query.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", blobURLSignature(key, filename, contentType, expires.Unix()))
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + "/api/files/" + key + "?" + query.Encode(), expires, nil
+}
+
+// deriveKey derives a key for one purpose from secret, so that a signature made
+// for that purpose is never also valid as, say, a session token
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func blobURLSignature(key, filename, contentType string, expires int64) string {
+	mac := hmac.New(sha256.New, blobURLSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", key, filename, contentType, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Route serving a blob through a link from signedBlobURL; the signature stands
+// in for authentication
+func serveSignedBlob(c *gin.Context) {
+	key := c.Param("key")
+	filename, contentType := c.Query("name"), c.Query("type")
+	expires, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(c.Query("sig")), []byte(blobURLSignature(key, filename, contentType, expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid download link"})
+		return
+	}
+	if time.Now().Unix() > expires {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Download link has expired"})
+		return
+	}
+
+	streamBlob(c, key, filename, contentType)
+}
+
+// streamBlob copies a blob to the response without buffering it
+func streamBlob(c *gin.Context, key, filename, contentType string) {
+	size, err := blobStore.Stat(key)
+	if err == errBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	blob, err := blobStore.Get(key)
+	if err == errBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer blob.Close()
+
+	c.DataFromReader(http.StatusOK, size, contentType, blob, map[string]string{
+		"Content-Disposition":    attachmentDisposition(filename),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
+
+// LocalBlobStore keeps blobs as files under a directory, sharded by key prefix
+type LocalBlobStore struct {
+	Dir string
+}
+
+// NewLocalBlobStore creates dir if needed and returns a store rooted at it
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{Dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, key[:2], key), nil
+}
+
+// Put writes to a temporary file first so a failed upload never leaves a partial blob
+func (s *LocalBlobStore) Put(key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *LocalBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Stat(key string) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, errBlobNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *LocalBlobStore) Move(from, to string) error {
+	fromPath, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), 0o750); err != nil {
+		return err
+	}
+	return os.Rename(fromPath, toPath)
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
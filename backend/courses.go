@@ -0,0 +1,577 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Course is an entry in the catalog. Code is the stable identifier used in
+// URLs; Name is what enrollments and course requests refer to and never changes
+// once the course exists. Instructors holds faculty IDs.
+type Course struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code          string             `json:"code" bson:"code"`
+	Name          string             `json:"name" bson:"name"`
+	Title         string             `json:"title" bson:"title"`
+	Credits       int                `json:"credits" bson:"credits"`
+	Department    string             `json:"department,omitempty" bson:"department,omitempty"`
+	Description   string             `json:"description,omitempty" bson:"description,omitempty"`
+	Level         string             `json:"level,omitempty" bson:"level,omitempty"`
+	Prerequisites []string           `json:"prerequisites" bson:"prerequisites"`
+	Requires      string             `json:"requires" bson:"requires,omitempty"`
+	Corequires    string             `json:"corequires" bson:"corequires,omitempty"`
+	Instructors   []string           `json:"instructors" bson:"instructors"`
+	Offering      CourseOffering     `json:"offering" bson:"offering"`
+	Slots         []CourseSlot       `json:"slots" bson:"slots"`
+
+	// Capacity limits enrollment outside any term, 0 meaning unlimited, and is
+	// the default capacity of new offerings. Enrolled counts the seats taken
+	// outside any term and is only changed through reserveSeat and releaseSeat.
+	Capacity  int  `json:"capacity" bson:"capacity"`
+	Enrolled  int  `json:"enrolled" bson:"enrolled"`
+	Available *int `json:"available" bson:"-"`
+}
+
+// CourseOffering describes when and how a course is usually taught
+type CourseOffering struct {
+	Semesters []string `json:"semesters" bson:"semesters"`
+	Mode      string   `json:"mode,omitempty" bson:"mode,omitempty"`
+}
+
+var (
+	courseCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9-]{1,15}$`)
+
+	courseLevels    = map[string]bool{"UG": true, "PG": true}
+	courseSemesters = map[string]bool{"odd": true, "even": true, "summer": true}
+	courseModes     = map[string]bool{"in-person": true, "online": true, "hybrid": true}
+
+	errCourseNotFound = errors.New("course not found")
+	errCourseInUse    = errors.New("course has pending requests")
+)
+
+// CourseInput is the body of POST /api/courses and PUT /api/courses/:id;
+// omitted fields are left unchanged
+type CourseInput struct {
+	Code          *string         `json:"code"`
+	Name          *string         `json:"name"`
+	Title         *string         `json:"title"`
+	Credits       *int            `json:"credits"`
+	Department    *string         `json:"department"`
+	Description   *string         `json:"description"`
+	Level         *string         `json:"level"`
+	Prerequisites *[]string       `json:"prerequisites"`
+	Requires      *string         `json:"requires"`
+	Corequires    *string         `json:"corequires"`
+	Instructors   *[]string       `json:"instructors"`
+	Offering      *CourseOffering `json:"offering"`
+	Slots         *[]CourseSlot   `json:"slots"`
+	Capacity      *int            `json:"capacity"`
+}
+
+// validate normalises the input in place and returns field-level errors
+func (in *CourseInput) validate() map[string]string {
+	errs := map[string]string{}
+
+	if in.Code != nil {
+		code := normaliseCourseCode(*in.Code)
+		if !courseCodePattern.MatchString(code) {
+			errs["code"] = "Code must be 2 to 16 letters, digits or hyphens"
+		}
+		in.Code = &code
+	}
+
+	if in.Name != nil {
+		name := strings.TrimSpace(*in.Name)
+		if name == "" {
+			errs["name"] = "Name cannot be empty"
+		}
+		in.Name = &name
+	}
+
+	if in.Title != nil {
+		title := strings.Join(strings.Fields(*in.Title), " ")
+		switch {
+		case title == "":
+			errs["title"] = "Title cannot be empty"
+		case len([]rune(title)) > 200:
+			errs["title"] = "Title must be at most 200 characters"
+		}
+		in.Title = &title
+	}
+
+	if in.Credits != nil && (*in.Credits < 0 || *in.Credits > 40) {
+		errs["credits"] = "Credits must be between 0 and 40"
+	}
+
+	if in.Department != nil {
+		department := strings.ToUpper(strings.TrimSpace(*in.Department))
+		if department != "" && !departments[department] {
+			errs["department"] = "Unknown department code"
+		}
+		in.Department = &department
+	}
+
+	if in.Description != nil {
+		description := strings.TrimSpace(*in.Description)
+		if len(description) > 5000 {
+			errs["description"] = "Description must be at most 5000 characters"
+		}
+		in.Description = &description
+	}
+
+	if in.Level != nil {
+		level := strings.ToUpper(strings.TrimSpace(*in.Level))
+		if level != "" && !courseLevels[level] {
+			errs["level"] = "Level must be UG or PG"
+		}
+		in.Level = &level
+	}
+
+	if in.Prerequisites != nil {
+		codes := make([]string, 0, len(*in.Prerequisites))
+		for _, raw := range *in.Prerequisites {
+			code := normaliseCourseCode(raw)
+			if !courseCodePattern.MatchString(code) {
+				errs["prerequisites"] = fmt.Sprintf("%q is not a valid course code", raw)
+				break
+			}
+			codes = appendUnique(codes, code)
+		}
+		in.Prerequisites = &codes
+	}
+
+	// Prerequisites are either a plain list, all of which are required, or a
+	// rule combining codes with AND and OR; each is kept in step with the other
+	switch {
+	case in.Requires != nil && in.Prerequisites != nil:
+		errs["requires"] = "Give either prerequisites or requires, not both"
+	case in.Requires != nil:
+		rule, err := parseRequirement(*in.Requires)
+		if err != nil {
+			errs["requires"] = "Invalid prerequisite rule: " + err.Error()
+			break
+		}
+		canonical, codes := rule.String(), rule.Codes()
+		in.Requires, in.Prerequisites = &canonical, &codes
+	case in.Prerequisites != nil:
+		rule := strings.Join(*in.Prerequisites, " AND ")
+		in.Requires = &rule
+	}
+
+	if in.Corequires != nil {
+		rule, err := parseRequirement(*in.Corequires)
+		if err != nil {
+			errs["corequires"] = "Invalid co-requisite rule: " + err.Error()
+		} else {
+			canonical := rule.String()
+			in.Corequires = &canonical
+		}
+	}
+
+	if in.Instructors != nil {
+		ids := make([]string, 0, len(*in.Instructors))
+		for _, raw := range *in.Instructors {
+			id := strings.ToLower(strings.TrimSpace(raw))
+			if !primitive.IsValidObjectID(id) {
+				errs["instructors"] = "Instructors must be faculty IDs"
+				break
+			}
+			ids = appendUnique(ids, id)
+		}
+		in.Instructors = &ids
+	}
+
+	if in.Slots != nil {
+		if problem := validateSlots(*in.Slots); problem != "" {
+			errs["slots"] = problem
+		}
+	}
+
+	if in.Capacity != nil && (*in.Capacity < 0 || *in.Capacity > 5000) {
+		errs["capacity"] = "Capacity must be between 0 (unlimited) and 5000"
+	}
+
+	if in.Offering != nil {
+		semesters := make([]string, 0, len(in.Offering.Semesters))
+		for _, raw := range in.Offering.Semesters {
+			semester := strings.ToLower(strings.TrimSpace(raw))
+			if !courseSemesters[semester] {
+				errs["offering.semesters"] = "Semesters must be odd, even or summer"
+				break
+			}
+			semesters = appendUnique(semesters, semester)
+		}
+		in.Offering.Semesters = semesters
+		in.Offering.Mode = strings.ToLower(strings.TrimSpace(in.Offering.Mode))
+		if in.Offering.Mode != "" && !courseModes[in.Offering.Mode] {
+			errs["offering.mode"] = "Mode must be in-person, online or hybrid"
+		}
+	}
+
+	return errs
+}
+
+// apply copies the provided fields onto course
+func (in *CourseInput) apply(course *Course) {
+	if in.Title != nil {
+		course.Title = *in.Title
+	}
+	if in.Credits != nil {
+		course.Credits = *in.Credits
+	}
+	if in.Department != nil {
+		course.Department = *in.Department
+	}
+	if in.Description != nil {
+		course.Description = *in.Description
+	}
+	if in.Level != nil {
+		course.Level = *in.Level
+	}
+	if in.Prerequisites != nil {
+		course.Prerequisites = *in.Prerequisites
+	}
+	if in.Requires != nil {
+		course.Requires = *in.Requires
+	}
+	if in.Corequires != nil {
+		course.Corequires = *in.Corequires
+	}
+	if in.Instructors != nil {
+		course.Instructors = *in.Instructors
+	}
+	if in.Offering != nil {
+		course.Offering = *in.Offering
+	}
+	if in.Capacity != nil {
+		course.Capacity = *in.Capacity
+	}
+	if in.Slots != nil {
+		course.Slots = *in.Slots
+	}
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// normaliseCourseCode upper-cases a code and drops spaces, so "cs 201" becomes "CS201"
+func normaliseCourseCode(raw string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(raw), ""))
+}
+
+// findCourse looks a course up by its ID, its code, or failing both its name
+func findCourse(ref string) (*Course, error) {
+	filters := []bson.M{}
+	if id, err := primitive.ObjectIDFromHex(ref); err == nil {
+		filters = append(filters, bson.M{"_id": id})
+	}
+	filters = append(filters, bson.M{"code": normaliseCourseCode(ref)}, bson.M{"name": ref})
+
+	for _, filter := range filters {
+		var course Course
+		err := courseCollection.FindOne(ctx, filter).Decode(&course)
+		if err == nil {
+			return &course, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+	return nil, errCourseNotFound
+}
+
+// checkPrerequisitesExist reports the listed codes that are not in the catalog
+func checkPrerequisitesExist(codes []string, self string) (string, error) {
+	return checkRequiredCoursesExist(codes, self, "prerequisite")
+}
+
+// checkCorequisitesExist reports the codes of a co-requisite rule that are not in the catalog
+func checkCorequisitesExist(rule, self string) (string, error) {
+	parsed, err := parseRequirement(rule)
+	if err != nil {
+		return "Invalid co-requisite rule", nil
+	}
+	return checkRequiredCoursesExist(parsed.Codes(), self, "co-requisite")
+}
+
+func checkRequiredCoursesExist(codes []string, self, kind string) (string, error) {
+	for _, code := range codes {
+		if code == self {
+			return "A course cannot be its own " + kind, nil
+		}
+	}
+	if len(codes) == 0 {
+		return "", nil
+	}
+
+	count, err := courseCollection.CountDocuments(ctx, bson.M{"code": bson.M{"$in": codes}})
+	if err != nil {
+		return "", err
+	}
+	if int(count) != len(codes) {
+		return strings.ToUpper(kind[:1]) + kind[1:] + "s must be existing course codes", nil
+	}
+	return "", nil
+}
+
+// Route returning the full details of a course
+func getCourse(c *gin.Context) {
+	course, err := findCourse(c.Param("id"))
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return
+	}
+
+	course.fillSeats()
+	c.JSON(http.StatusOK, course)
+}
+
+// Route for admins to edit a course; the code and name stay fixed
+func updateCourse(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	var req CourseInput
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course", "fields": errs})
+		return
+	}
+
+	course, err := findCourse(c.Param("id"))
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return
+	}
+
+	if req.Code != nil && *req.Code != course.Code {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Course codes cannot be changed", "field": "code"})
+		return
+	}
+	if req.Name != nil && *req.Name != course.Name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Course names cannot be changed because enrollments refer to them", "field": "name"})
+		return
+	}
+	if req.Prerequisites != nil {
+		problem, err := checkPrerequisitesExist(*req.Prerequisites, course.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check prerequisites"})
+			return
+		}
+		if problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": "prerequisites"})
+			return
+		}
+	}
+	if req.Corequires != nil {
+		problem, err := checkCorequisitesExist(*req.Corequires, course.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check co-requisites"})
+			return
+		}
+		if problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": "corequires"})
+			return
+		}
+	}
+
+	if req.Instructors != nil {
+		problem, err := checkInstructorsExist(*req.Instructors)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check instructors"})
+			return
+		}
+		if problem != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": "instructors"})
+			return
+		}
+	}
+
+	before := *course
+	req.apply(course)
+
+	// Set the editable fields only, so seats taken meanwhile are not overwritten
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		_, err := courseCollection.UpdateOne(sc, bson.M{"_id": course.ID}, bson.M{"$set": bson.M{
+			"title":         course.Title,
+			"credits":       course.Credits,
+			"department":    course.Department,
+			"description":   course.Description,
+			"level":         course.Level,
+			"prerequisites": course.Prerequisites,
+			"requires":      course.Requires,
+			"corequires":    course.Corequires,
+			"instructors":   course.Instructors,
+			"offering":      course.Offering,
+			"capacity":      course.Capacity,
+			"slots":         course.Slots,
+		}})
+		if err != nil {
+			return err
+		}
+		if course.Capacity != before.Capacity {
+			// Seats added by a larger capacity go to the waitlist first
+			if err := offerSeats(sc, course.Name, ""); err != nil {
+				return err
+			}
+		}
+		return recordAuditIn(sc, c, "course.update", "course:"+course.Code, before, course)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update course"})
+		return
+	}
+
+	course.fillSeats()
+	c.JSON(http.StatusOK, course)
+}
+
+// migrateCourses gives name-only catalog entries a code, a title and empty
+// lists, then enforces unique codes
+func migrateCourses() {
+	cursor, err := courseCollection.Find(ctx, bson.M{"code": bson.M{"$exists": false}})
+	if err != nil {
+		log.Printf("Failed to find courses to migrate: %v", err)
+		return
+	}
+	var legacy []Course
+	if err := cursor.All(ctx, &legacy); err != nil {
+		log.Printf("Failed to decode courses to migrate: %v", err)
+		return
+	}
+
+	for _, course := range legacy {
+		code, err := legacyCourseCode(course.Name)
+		if err != nil {
+			log.Printf("Failed to derive a code for course '%s': %v", course.Name, err)
+			continue
+		}
+		// Another instance starting alongside may have migrated it meanwhile
+		result, err := courseCollection.UpdateOne(ctx, bson.M{"_id": course.ID, "code": bson.M{"$exists": false}}, bson.M{"$set": bson.M{
+			"code":               code,
+			"title":              course.Name,
+			"credits":            0,
+			"prerequisites":      []string{},
+			"instructors":        []string{},
+			"offering.semesters": []string{},
+			"slots":              []CourseSlot{},
+		}})
+		if err != nil {
+			log.Printf("Failed to migrate course '%s': %v", course.Name, err)
+			continue
+		}
+		if result.MatchedCount == 0 {
+			continue
+		}
+		log.Printf("Migrated course '%s' to code %s", course.Name, code)
+	}
+
+	if _, err := courseCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Printf("Failed to create course code index: %v", err)
+	}
+}
+
+// legacyCourseCode derives a free code from a course name, adding a numeric
+// suffix when the obvious one is taken
+func legacyCourseCode(name string) (string, error) {
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return -1
+	}, name)
+	if len(base) < 2 {
+		base = "COURSE"
+	}
+	if len(base) > 12 {
+		base = base[:12]
+	}
+
+	for i := 1; i < 1000; i++ {
+		code := base
+		if i > 1 {
+			code = fmt.Sprintf("%s-%d", base, i)
+		}
+		count, err := courseCollection.CountDocuments(ctx, bson.M{"$or": []bson.M{
+			{"code": code},
+			{"name": namesReadAsCode(code, name)},
+		}})
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return code, nil
+		}
+	}
+	return "", errors.New("no free code")
+}
+
+// namesReadAsCode matches the names, other than except, that findCourse would
+// take for the given code, such as "cs 201" for CS201
+func namesReadAsCode(code, except string) bson.M {
+	var pattern strings.Builder
+	pattern.WriteString(`^\s*`)
+	for _, r := range code {
+		pattern.WriteString(regexp.QuoteMeta(string(r)) + `\s*`)
+	}
+	pattern.WriteString("$")
+	return bson.M{"$regex": pattern.String(), "$options": "i", "$ne": except}
+}
+
+// checkCourseIdentifiers reports a new course whose name reads as another
+// course's code or whose code reads as another course's name, since findCourse
+// could then resolve a reference to the wrong course
+func checkCourseIdentifiers(name, code string) (field, problem string, err error) {
+	if asCode := normaliseCourseCode(name); asCode != code {
+		count, err := courseCollection.CountDocuments(ctx, bson.M{"code": asCode})
+		if err != nil {
+			return "", "", err
+		}
+		if count > 0 {
+			return "name", "Name is the code of another course", nil
+		}
+	}
+
+	count, err := courseCollection.CountDocuments(ctx, bson.M{"name": namesReadAsCode(code, name)})
+	if err != nil {
+		return "", "", err
+	}
+	if count > 0 {
+		return "code", "Code is the name of another course", nil
+	}
+	return "", "", nil
+}
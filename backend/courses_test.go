@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUploadCourseIdentifierCollision(t *testing.T) {
+	counted := func(n int) bson.D {
+		return mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("name is another course's code", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), counted(0), counted(1))
+
+		body := map[string]string{"name": "cs 201", "code": "HSS101"}
+		recorder := serveJSONAs(uploadCourse, "admin@iitk.ac.in", "admin", http.MethodPost, "/api/courses", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if field := responseBody(mt, recorder)["field"]; field != "name" {
+			mt.Errorf("field = %v, want name", field)
+		}
+	})
+
+	mt.Run("code is another course's name", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), counted(0), counted(0), counted(1))
+
+		body := map[string]string{"name": "Probability", "code": "CS201"}
+		recorder := serveJSONAs(uploadCourse, "admin@iitk.ac.in", "admin", http.MethodPost, "/api/courses", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if field := responseBody(mt, recorder)["field"]; field != "code" {
+			mt.Errorf("field = %v, want code", field)
+		}
+
+		filter := sentCommand(mt, "aggregate").Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match", "name")
+		if pattern := filter.Document().Lookup("$regex").StringValue(); pattern != `^\s*C\s*S\s*2\s*0\s*1\s*$` {
+			mt.Errorf("name pattern = %q", pattern)
+		}
+	})
+}
+
+// sentCodeChecks lists the codes legacyCourseCode asked about, in order
+func sentCodeChecks(mt *mtest.T) []string {
+	var codes []string
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == "aggregate" {
+			match := event.Command.Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match")
+			codes = append(codes, match.Document().Lookup("$or").Array().Index(0).Value().Document().Lookup("code").StringValue())
+		}
+	}
+	return codes
+}
+
+func TestLegacyCourseCode(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("derived from the name", func(mt *mtest.T) {
+		useMockCollections(mt)
+		for name, want := range map[string]string{
+			"cs 201":                 "CS201",
+			"Data Structures":        "DATASTRUCTUR",
+			"Économie-101":           "CONOMIE101",
+			"X":                      "COURSE",
+			"!!":                     "COURSE",
+			"Intro to ML (2nd part)": "INTROTOML2ND",
+		} {
+			mt.AddMockResponses(countedDocuments("db.details", 0))
+			code, err := legacyCourseCode(name)
+			if err != nil || code != want {
+				mt.Errorf("legacyCourseCode(%q) = %q, %v, want %q", name, code, err, want)
+			}
+		}
+	})
+
+	mt.Run("taken codes get a suffix", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(countedDocuments("db.details", 1), countedDocuments("db.details", 1), countedDocuments("db.details", 0))
+		code, err := legacyCourseCode("cs201")
+		if err != nil || code != "CS201-3" {
+			mt.Fatalf("code = %q, %v", code, err)
+		}
+		if checked := sentCodeChecks(mt); len(checked) != 3 || checked[0] != "CS201" || checked[1] != "CS201-2" {
+			mt.Errorf("checked %v", checked)
+		}
+
+		// A name that reads as the code also counts as taking it, except the course's own
+		match := sentCommand(mt, "aggregate").Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match")
+		name := match.Document().Lookup("$or").Array().Index(1).Value().Document().Lookup("name")
+		if name.Document().Lookup("$ne").StringValue() != "cs201" {
+			mt.Errorf("name check = %v", name)
+		}
+	})
+
+	mt.Run("lookup fails", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 8, Message: "unavailable"}))
+		if code, err := legacyCourseCode("cs201"); err == nil {
+			mt.Errorf("code = %q despite the failed lookup", code)
+		}
+	})
+}
+
+func TestMigrateCourses(t *testing.T) {
+	legacy := func(names ...string) bson.D {
+		docs := make([]bson.D, len(names))
+		for i, name := range names {
+			docs[i] = bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "name", Value: name}}
+		}
+		return mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, docs...)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("legacy courses get codes", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			legacy("CS 201", "cs201"),
+			countedDocuments("db.details", 0),
+			matchedDocuments(1),
+			countedDocuments("db.details", 1),
+			countedDocuments("db.details", 0),
+			matchedDocuments(1),
+			mtest.CreateSuccessResponse(),
+		)
+		migrateCourses()
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 2 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		for i, want := range []string{"CS201", "CS201-2"} {
+			if code := updates[i].Lookup("u", "$set", "code").StringValue(); code != want {
+				mt.Errorf("course %d got code %q, want %q", i, code, want)
+			}
+			if _, err := updates[i].LookupErr("q", "code", "$exists"); err != nil {
+				mt.Errorf("update would overwrite a code set meanwhile: %v", updates[i])
+			}
+		}
+		if title := updates[0].Lookup("u", "$set", "title").StringValue(); title != "CS 201" {
+			mt.Errorf("title = %q", title)
+		}
+		index := sentCommand(mt, "createIndexes").Lookup("indexes").Array().Index(0).Value().Document()
+		if !index.Lookup("unique").Boolean() {
+			mt.Errorf("code index = %v", index)
+		}
+	})
+
+	mt.Run("second run changes nothing", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(noDocuments("db.details"), mtest.CreateSuccessResponse())
+		migrateCourses()
+
+		filter := sentCommand(mt, "find").Lookup("filter")
+		if exists, ok := filter.Document().Lookup("code", "$exists").BooleanOK(); !ok || exists {
+			mt.Errorf("migration looks at courses that already have a code: %v", filter)
+		}
+		if _, updates := sentUpdates(mt); len(updates) != 0 {
+			mt.Errorf("updates = %v", updates)
+		}
+	})
+}
+
+func TestUpdateCourse(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	course := mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{
+		{Key: "_id", Value: id},
+		{Key: "code", Value: "PHY103"},
+		{Key: "name", Value: "Mechanics"},
+		{Key: "title", Value: "Mechanics"},
+		{Key: "capacity", Value: 40},
+		{Key: "enrolled", Value: 40},
+	})
+	update := func(body interface{}) *httptest.ResponseRecorder {
+		return serveRoute(updateCourse, http.MethodPut, "/api/courses/:id", "/api/courses/"+id.Hex(), body, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("name is fixed", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), course)
+		recorder := update(map[string]string{"name": "Classical Mechanics"})
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if field := responseBody(mt, recorder)["field"]; field != "name" {
+			mt.Errorf("field = %v", field)
+		}
+	})
+
+	mt.Run("same capacity offers nothing", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{activeSession(), course, matchedDocuments(1)}, auditedCommit()...)...)
+		expectStatus(mt, update(map[string]interface{}{"title": "Classical  Mechanics", "capacity": 40}), http.StatusOK)
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || collections[0] != "details" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if title := updates[0].Lookup("u", "$set", "title").StringValue(); title != "Classical Mechanics" {
+			mt.Errorf("title = %q", title)
+		}
+		if _, err := updates[0].LookupErr("u", "$set", "enrolled"); err == nil {
+			mt.Errorf("update overwrites seats taken meanwhile: %v", updates[0])
+		}
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "find" && event.Command.Lookup("find").StringValue() == "waitlist" {
+				mt.Error("waitlist checked although capacity did not change")
+			}
+		}
+	})
+
+	mt.Run("larger capacity offers seats", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{
+			activeSession(),
+			course,
+			matchedDocuments(1),
+			waitlistEntry(primitive.NewObjectID(), "", waitlistWaiting, time.Time{}),
+			matchedDocuments(1),
+			matchedDocuments(1),
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{{Key: "username", Value: "ravi@iitk.ac.in"}}),
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.waitlist"),
+		}, auditedCommit()...)...)
+		expectStatus(mt, update(map[string]int{"capacity": 41}), http.StatusOK)
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 3 || collections[0] != "details" || collections[1] != "details" || collections[2] != "waitlist" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if updates[0].Lookup("u", "$set", "capacity").Int32() != 41 {
+			mt.Errorf("update = %v", updates[0])
+		}
+		if updates[2].Lookup("u", "$set", "status").StringValue() != waitlistOffered {
+			mt.Errorf("offer = %v", updates[2])
+		}
+		if action := sentAuditAction(mt); action != "course.update" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+}
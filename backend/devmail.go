@@ -0,0 +1,183 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// devInboxLimit caps how many messages the development inbox keeps
+const devInboxLimit = 500
+
+var devInbox *DevInbox
+
+// DevMail is a message captured by the development inbox
+type DevMail struct {
+	ID      int       `json:"id"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	HTML    string    `json:"html"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// DevInbox is a terminal mail transport that keeps messages in memory instead
+// of delivering them. Sending never fails, so the outbox never retries and
+// each message is captured once.
+type DevInbox struct {
+	from string
+
+	mu       sync.Mutex
+	messages []DevMail
+	lastID   int
+}
+
+func NewDevInbox(from string) *DevInbox {
+	if from == "" {
+		from = defaultMailFrom
+	}
+	return &DevInbox{from: from}
+}
+
+func (d *DevInbox) Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = d.from
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastID++
+	d.messages = append(d.messages, DevMail{
+		ID:      d.lastID,
+		From:    msg.From,
+		To:      append([]string(nil), msg.To...),
+		Subject: msg.Subject,
+		Text:    msg.Text,
+		HTML:    msg.HTML,
+		SentAt:  time.Now(),
+	})
+	if len(d.messages) > devInboxLimit {
+		d.messages = d.messages[len(d.messages)-devInboxLimit:]
+	}
+	return nil
+}
+
+// List returns the captured messages, newest first
+func (d *DevInbox) List() []DevMail {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]DevMail, 0, len(d.messages))
+	for i := len(d.messages) - 1; i >= 0; i-- {
+		list = append(list, d.messages[i])
+	}
+	return list
+}
+
+func (d *DevInbox) Get(id int) (DevMail, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, msg := range d.messages {
+		if msg.ID == id {
+			return msg, true
+		}
+	}
+	return DevMail{}, false
+}
+
+func (d *DevInbox) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = nil
+}
+
+var devInboxPage = htmltemplate.Must(htmltemplate.New("inbox").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>EduWise development inbox</title>
+<style>
+body { font-family: Arial, sans-serif; margin: 24px; color: #1f2937; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #e5e7eb; padding: 8px; text-align: left; vertical-align: top; }
+pre { white-space: pre-wrap; margin: 0; }
+</style>
+</head>
+<body>
+<h1>Development inbox</h1>
+{{if .}}
+<table>
+<tr><th>Sent</th><th>To</th><th>Subject</th><th>Body</th><th></th></tr>
+{{range .}}
+<tr>
+<td>{{.SentAt.Format "15:04:05"}}</td>
+<td>{{range .To}}{{.}}<br>{{end}}</td>
+<td>{{.Subject}}</td>
+<td><pre>{{.Text}}</pre></td>
+<td>{{if .HTML}}<a href="/dev/mail/{{.ID}}?format=html">HTML</a>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No messages yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// Route listing captured messages as JSON, or as an HTML page for browsers
+func listDevMail(c *gin.Context) {
+	messages := devInbox.List()
+
+	format := c.Query("format")
+	if format == "" && c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		format = "html"
+	}
+
+	if format == "html" {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := devInboxPage.Execute(c.Writer, messages); err != nil {
+			log.Printf("Failed to render development inbox: %v", err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, messages)
+}
+
+// Route returning a single captured message, or its HTML body with ?format=html
+func getDevMail(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	msg, ok := devInbox.Get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	if c.Query("format") == "html" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(msg.HTML))
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// Route to empty the development inbox
+func clearDevMail(c *gin.Context) {
+	devInbox.Clear()
+	c.JSON(http.StatusOK, gin.H{"message": "Development inbox cleared"})
+}
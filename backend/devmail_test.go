@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDevInbox(t *testing.T) {
+	inbox := NewDevInbox("")
+	for i := 1; i <= devInboxLimit+2; i++ {
+		if err := inbox.Send(&Message{To: []string{"asha@iitk.ac.in"}, Subject: "Message " + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := inbox.List()
+	if len(list) != devInboxLimit {
+		t.Fatalf("kept %d messages, want %d", len(list), devInboxLimit)
+	}
+	if list[0].ID != devInboxLimit+2 || list[len(list)-1].ID != 3 {
+		t.Errorf("kept messages %d to %d, want the newest first and the oldest dropped", list[0].ID, list[len(list)-1].ID)
+	}
+	if list[0].From != defaultMailFrom {
+		t.Errorf("From = %q, want the default sender", list[0].From)
+	}
+
+	if _, ok := inbox.Get(1); ok {
+		t.Error("dropped message is still retrievable")
+	}
+	if msg, ok := inbox.Get(3); !ok || msg.Subject != "Message 3" {
+		t.Errorf("Get(3) = %+v, %v", msg, ok)
+	}
+
+	inbox.Clear()
+	if len(inbox.List()) != 0 {
+		t.Error("Clear kept messages")
+	}
+	inbox.Send(&Message{To: []string{"asha@iitk.ac.in"}})
+	if list := inbox.List(); list[0].ID != devInboxLimit+3 {
+		t.Errorf("ID after Clear = %d, want IDs never to be reused", list[0].ID)
+	}
+}
+
+func TestDevMailRoutes(t *testing.T) {
+	previous := devInbox
+	devInbox = NewDevInbox("EduWise@iitk.ac.in")
+	t.Cleanup(func() { devInbox = previous })
+	devInbox.Send(&Message{To: []string{"asha@iitk.ac.in"}, Subject: "<b>OTP</b>", Text: "Your code", HTML: "<p>Your code</p>"})
+
+	router := gin.New()
+	router.GET("/dev/mail", listDevMail)
+	router.GET("/dev/mail/:id", getDevMail)
+	router.DELETE("/dev/mail", clearDevMail)
+	serve := func(method, target, accept string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := serve(http.MethodGet, "/dev/mail", "")
+	expectStatus(t, recorder, http.StatusOK)
+	var messages []DevMail
+	if err := json.Unmarshal(recorder.Body.Bytes(), &messages); err != nil || len(messages) != 1 {
+		t.Fatalf("list = %s", recorder.Body.String())
+	}
+
+	// Browsers get the page, with message fields escaped
+	recorder = serve(http.MethodGet, "/dev/mail", "text/html,application/xhtml+xml")
+	expectStatus(t, recorder, http.StatusOK)
+	if page := recorder.Body.String(); !strings.Contains(page, "&lt;b&gt;OTP&lt;/b&gt;") {
+		t.Errorf("page does not escape the subject:\n%s", page)
+	}
+
+	recorder = serve(http.MethodGet, "/dev/mail/1?format=html", "")
+	expectStatus(t, recorder, http.StatusOK)
+	if recorder.Body.String() != "<p>Your code</p>" {
+		t.Errorf("HTML body = %q", recorder.Body.String())
+	}
+
+	expectStatus(t, serve(http.MethodGet, "/dev/mail/2", ""), http.StatusNotFound)
+	expectStatus(t, serve(http.MethodGet, "/dev/mail/latest", ""), http.StatusBadRequest)
+
+	expectStatus(t, serve(http.MethodDelete, "/dev/mail", ""), http.StatusOK)
+	expectStatus(t, serve(http.MethodGet, "/dev/mail/1", ""), http.StatusNotFound)
+}
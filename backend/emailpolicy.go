@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EmailValidationError explains why an address was rejected
+type EmailValidationError struct {
+	Address string
+	Reason  string
+}
+
+func (e *EmailValidationError) Error() string {
+	return fmt.Sprintf("%q is not an acceptable email address: %s", e.Address, e.Reason)
+}
+
+// emailDomainPolicy maps a role to the domains its accounts may use; the
+// empty role holds the default applied to roles without their own list
+var emailDomainPolicy = map[string][]string{}
+
+// loadEmailDomainPolicy reads ALLOWED_EMAIL_DOMAINS and ALLOWED_EMAIL_DOMAINS_<ROLE>
+func loadEmailDomainPolicy() {
+	emailDomainPolicy = map[string][]string{"": parseDomainList(os.Getenv("ALLOWED_EMAIL_DOMAINS"))}
+	for _, role := range []string{"student", "admin"} {
+		if value, ok := os.LookupEnv("ALLOWED_EMAIL_DOMAINS_" + strings.ToUpper(role)); ok {
+			emailDomainPolicy[role] = parseDomainList(value)
+		}
+	}
+}
+
+func parseDomainList(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// normaliseEmail trims and lower-cases a bare RFC 5322 address, rejecting
+// display names, comments and anything else that isn't just an address
+func normaliseEmail(raw string) (string, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return "", &EmailValidationError{Address: raw, Reason: "address is empty"}
+	}
+
+	addr, err := mail.ParseAddress(trimmed)
+	if err != nil {
+		return "", &EmailValidationError{Address: raw, Reason: "address is not well formed"}
+	}
+	if addr.Name != "" || addr.Address != trimmed {
+		return "", &EmailValidationError{Address: raw, Reason: "only a bare address is allowed, without a display name"}
+	}
+
+	at := strings.LastIndex(addr.Address, "@")
+	local, domain := addr.Address[:at], addr.Address[at+1:]
+	switch {
+	case len(addr.Address) > 254:
+		return "", &EmailValidationError{Address: raw, Reason: "address is longer than 254 characters"}
+	case len(local) > 64:
+		return "", &EmailValidationError{Address: raw, Reason: "local part is longer than 64 characters"}
+	case strings.HasPrefix(domain, "["):
+		return "", &EmailValidationError{Address: raw, Reason: "IP address literals are not allowed"}
+	case !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") || strings.Contains(domain, ".."):
+		return "", &EmailValidationError{Address: raw, Reason: "domain is not a valid host name"}
+	}
+
+	return strings.ToLower(addr.Address), nil
+}
+
+// checkEmailDomain enforces the allow-list for the role on a normalised address
+func checkEmailDomain(email, role string) error {
+	allowed, ok := emailDomainPolicy[role]
+	if !ok {
+		allowed = emailDomainPolicy[""]
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	domain := email[strings.LastIndex(email, "@")+1:]
+	for _, candidate := range allowed {
+		// Subdomains of an allowed domain are accepted too, e.g. cse.iitk.ac.in
+		if domain == candidate || strings.HasSuffix(domain, "."+candidate) {
+			return nil
+		}
+	}
+
+	return &EmailValidationError{
+		Address: email,
+		Reason:  fmt.Sprintf("%s accounts must use an address at %s", role, strings.Join(allowed, ", ")),
+	}
+}
+
+// validateAccountEmail normalises an address and applies the domain policy for role
+func validateAccountEmail(raw, role string) (string, error) {
+	email, err := normaliseEmail(raw)
+	if err != nil {
+		return "", err
+	}
+	if err := checkEmailDomain(email, role); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// validRole reports whether role is one that accounts can hold
+func validRole(role string) bool {
+	return role == "student" || role == "admin"
+}
+
+// migrateUsernameCase lower-cases usernames stored verbatim before addresses
+// were normalised, so the lower-cased lookups in login, OTP verification and
+// password reset find them. An account whose normalised name is already taken
+// is left alone and reported for an admin to resolve.
+func migrateUsernameCase() {
+	opts := options.Find().SetProjection(bson.M{"username": 1})
+	cursor, err := registeredUsers.Find(ctx, bson.M{"username": bson.M{"$regex": `[A-Z]|^\s|\s$`}}, opts)
+	if err != nil {
+		log.Printf("Failed to find usernames to normalise: %v", err)
+		return
+	}
+	var users []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Username string             `bson:"username"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Printf("Failed to decode usernames to normalise: %v", err)
+		return
+	}
+
+	var collisions []string
+	for _, user := range users {
+		normalised := strings.ToLower(strings.TrimSpace(user.Username))
+		err := withTransaction(func(sc mongo.SessionContext) error {
+			count, err := registeredUsers.CountDocuments(sc, bson.M{"username": normalised})
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return errUsernameTaken
+			}
+			if _, err := registeredUsers.UpdateOne(sc, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"username": normalised}}); err != nil {
+				return err
+			}
+			return renameUserReferences(sc, user.Username, normalised)
+		})
+		switch {
+		case err == errUsernameTaken || mongo.IsDuplicateKeyError(err):
+			collisions = append(collisions, fmt.Sprintf("%q (%s)", user.Username, user.ID.Hex()))
+		case err != nil:
+			log.Printf("Failed to normalise username %q: %v", user.Username, err)
+		default:
+			log.Printf("Normalised username %q to %q", user.Username, normalised)
+		}
+	}
+	if len(collisions) > 0 {
+		log.Printf("WARNING: %d accounts cannot log in because their lower-cased username belongs to another account; merge or rename them: %s",
+			len(collisions), strings.Join(collisions, ", "))
+	}
+}
+
+// ensureUserIndexes keeps usernames unique. It runs after migrateUsernameCase,
+// and the checks made before each insert or rename only exist to give a
+// clearer error than the index does.
+func ensureUserIndexes() {
+	if _, err := registeredUsers.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Printf("WARNING: failed to create unique username index, duplicate accounts must be merged first: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestNormaliseEmail(t *testing.T) {
+	valid := map[string]string{
+		"asha@iitk.ac.in":           "asha@iitk.ac.in",
+		"  Asha.K@IITK.ac.in\t":     "asha.k@iitk.ac.in",
+		"asha+notes@cse.iitk.ac.in": "asha+notes@cse.iitk.ac.in",
+	}
+	for raw, want := range valid {
+		if got, err := normaliseEmail(raw); err != nil || got != want {
+			t.Errorf("normaliseEmail(%q) = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"   ",
+		"asha",
+		"asha@",
+		"Asha <asha@iitk.ac.in>",
+		"asha@iitk.ac.in (Asha)",
+		"asha@localhost",
+		"asha@[10.0.0.1]",
+		"asha@.iitk.ac.in",
+		"asha@iitk.ac.in.",
+		"asha@iitk..ac.in",
+		"a@b.c, d@e.f",
+		strings.Repeat("a", 65) + "@iitk.ac.in",
+		"asha@" + strings.Repeat("a", 250) + ".in",
+	}
+	for _, raw := range invalid {
+		if got, err := normaliseEmail(raw); err == nil {
+			t.Errorf("normaliseEmail(%q) = %q, want an error", raw, got)
+		} else if _, ok := err.(*EmailValidationError); !ok {
+			t.Errorf("normaliseEmail(%q) error is %T, want *EmailValidationError", raw, err)
+		}
+	}
+}
+
+func TestCheckEmailDomain(t *testing.T) {
+	previous := emailDomainPolicy
+	t.Cleanup(func() { emailDomainPolicy = previous })
+
+	t.Setenv("ALLOWED_EMAIL_DOMAINS", "")
+	loadEmailDomainPolicy()
+	if err := checkEmailDomain("asha@gmail.com", "student"); err != nil {
+		t.Errorf("without a policy every domain is allowed, got %v", err)
+	}
+
+	t.Setenv("ALLOWED_EMAIL_DOMAINS", " IITK.ac.in., ")
+	t.Setenv("ALLOWED_EMAIL_DOMAINS_ADMIN", "admin.iitk.ac.in")
+	loadEmailDomainPolicy()
+	tests := []struct {
+		email, role string
+		allowed     bool
+	}{
+		{"asha@iitk.ac.in", "student", true},
+		{"asha@cse.iitk.ac.in", "student", true},
+		{"asha@notiitk.ac.in", "student", false},
+		{"asha@iitk.ac.in.example.com", "student", false},
+		{"asha@gmail.com", "student", false},
+		{"head@admin.iitk.ac.in", "admin", true},
+		{"head@iitk.ac.in", "admin", false},
+	}
+	for _, test := range tests {
+		err := checkEmailDomain(test.email, test.role)
+		if (err == nil) != test.allowed {
+			t.Errorf("checkEmailDomain(%q, %q) = %v, want allowed %v", test.email, test.role, err, test.allowed)
+		}
+	}
+}
+
+func TestRegisterValidatesEmail(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("malformed address", func(mt *mtest.T) {
+		useMockCollections(mt)
+		body := map[string]string{"username": "Asha <asha@iitk.ac.in>", "password": "correct horse", "role": "student"}
+		recorder := serveJSON(register, http.MethodPost, "/api/register", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if field := responseBody(mt, recorder)["field"]; field != "username" {
+			mt.Errorf("field = %v, want username", field)
+		}
+		if len(mt.GetAllStartedEvents()) != 0 {
+			mt.Errorf("register touched the database before validating")
+		}
+	})
+}
+
+func TestMigrateUsernameCase(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("renames unless the name is taken", func(mt *mtest.T) {
+		useMockCollections(mt)
+		taken, free := primitive.NewObjectID(), primitive.NewObjectID()
+		responses := []bson.D{
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: taken}, {Key: "username", Value: "Asha@IITK.ac.in"}},
+				bson.D{{Key: "_id", Value: free}, {Key: "username", Value: " Ravi@iitk.ac.in"}}),
+			countedDocuments("db.registered_users", 1),
+			mtest.CreateSuccessResponse(),
+			countedDocuments("db.registered_users", 0),
+			matchedDocuments(1),
+		}
+		for i := 0; i < 9; i++ {
+			responses = append(responses, matchedDocuments(0))
+		}
+		mt.AddMockResponses(append(responses, mtest.CreateSuccessResponse())...)
+
+		migrateUsernameCase()
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 10 || collections[0] != "registered_users" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if updates[0].Lookup("q", "_id").ObjectID() != free {
+			mt.Errorf("renamed %v, want only the account whose name is free", updates[0])
+		}
+		if name := updates[0].Lookup("u", "$set", "username").StringValue(); name != "ravi@iitk.ac.in" {
+			mt.Errorf("renamed to %q", name)
+		}
+		if updates[1].Lookup("q", "username").StringValue() != " Ravi@iitk.ac.in" {
+			mt.Errorf("references were not moved to the new name: %v", updates[1])
+		}
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultLocale = "en"
+
+//go:embed templates/email
+var emailTemplateFS embed.FS
+
+// emailTemplate holds the subject, plain-text and HTML variants of one notification in one locale
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// EmailData is the data passed to email templates
+type EmailData map[string]interface{}
+
+// emailTemplates maps locale to template name to template
+var emailTemplates map[string]map[string]*emailTemplate
+
+// emailTemplateSamples is the data used to preview each template
+var emailTemplateSamples = map[string]EmailData{
+	"verification":     {"OTP": "123456"},
+	"password_reset":   {"Username": "student@iitk.ac.in", "Token": "4f7c-91ab", "ExpiresAt": "1 Jan 2026 12:00 IST"},
+	"request_approved": {"Course": "CS201"},
+	"request_rejected": {"Course": "CS201"},
+	"record_approved":  {"Course": "CS201 Data Structures", "Type": "Midsem", "Comment": "Thanks, clear scans."},
+	"record_rejected":  {"Course": "CS201 Data Structures", "Type": "Midsem", "Comment": "Pages 3 and 4 are missing."},
+	"waitlist_joined":  {"Course": "CS201", "Position": 3},
+	"waitlist_offer":   {"Course": "CS201", "ExpiresAt": "1 Jan 2026 12:00 IST"},
+	"announcement":     {"Title": "Course registration opens Monday", "Body": "Add/drop for the odd semester opens on Monday at 9 AM."},
+	"invitation":       {"Role": "admin", "Token": "Yw3k1xQz7rVh", "ExpiresAt": "1 Jan 2026 12:00 IST"},
+	"password_changed": {"Username": "student@iitk.ac.in", "ChangedAt": "1 Jan 2026 12:00 IST"},
+	"email_change":     {"NewEmail": "new.student@iitk.ac.in", "OTP": "123456", "ExpiresAt": "1 Jan 2026 12:00 IST"},
+	"email_changed":    {"OldEmail": "student@iitk.ac.in", "NewEmail": "new.student@iitk.ac.in"},
+}
+
+// loadEmailTemplates parses every template under templates/email, one directory per locale
+func loadEmailTemplates() error {
+	layout, err := fs.ReadFile(emailTemplateFS, "templates/email/layout.html")
+	if err != nil {
+		return err
+	}
+
+	locales, err := fs.ReadDir(emailTemplateFS, "templates/email")
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]map[string]*emailTemplate)
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		dir := path.Join("templates/email", locale.Name())
+
+		files, err := fs.Glob(emailTemplateFS, path.Join(dir, "*.subject.txt"))
+		if err != nil {
+			return err
+		}
+
+		loaded[locale.Name()] = make(map[string]*emailTemplate)
+		for _, file := range files {
+			name := strings.TrimSuffix(path.Base(file), ".subject.txt")
+
+			tmpl, err := parseEmailTemplate(dir, name, string(layout))
+			if err != nil {
+				return fmt.Errorf("email template %s/%s: %v", locale.Name(), name, err)
+			}
+			loaded[locale.Name()][name] = tmpl
+		}
+	}
+
+	if _, ok := loaded[defaultLocale]; !ok {
+		return fmt.Errorf("no email templates for default locale %q", defaultLocale)
+	}
+
+	emailTemplates = loaded
+	return nil
+}
+
+func parseEmailTemplate(dir, name, layout string) (*emailTemplate, error) {
+	read := func(suffix string) (string, error) {
+		b, err := fs.ReadFile(emailTemplateFS, path.Join(dir, name+suffix))
+		return string(b), err
+	}
+
+	subjectSource, err := read(".subject.txt")
+	if err != nil {
+		return nil, err
+	}
+	textSource, err := read(".txt")
+	if err != nil {
+		return nil, err
+	}
+	htmlSource, err := read(".html")
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &emailTemplate{}
+	if tmpl.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(strings.TrimSpace(subjectSource)); err != nil {
+		return nil, err
+	}
+	if tmpl.text, err = texttemplate.New("text").Option("missingkey=error").Parse(textSource); err != nil {
+		return nil, err
+	}
+	if tmpl.html, err = htmltemplate.New("layout").Option("missingkey=error").Parse(layout); err != nil {
+		return nil, err
+	}
+	if _, err = tmpl.html.Parse(htmlSource); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// resolveLocale picks the best available locale, falling back from "hi-IN" to "hi" to the default
+func resolveLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if _, ok := emailTemplates[locale]; ok {
+		return locale
+	}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		if _, ok := emailTemplates[locale[:i]]; ok {
+			return locale[:i]
+		}
+	}
+	return defaultLocale
+}
+
+// renderEmail renders the named template for the recipient's locale
+func renderEmail(name, locale string, data EmailData) (*Message, error) {
+	locale = resolveLocale(locale)
+	tmpl, ok := emailTemplates[locale][name]
+	if !ok {
+		// A translation may lag behind the default locale
+		if tmpl, ok = emailTemplates[defaultLocale][name]; !ok {
+			return nil, fmt.Errorf("unknown email template %q", name)
+		}
+		locale = defaultLocale
+	}
+
+	values := EmailData{}
+	for key, value := range data {
+		values[key] = value
+	}
+	values["Locale"] = locale
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, values); err != nil {
+		return nil, err
+	}
+	values["Subject"] = subject.String()
+	if err := tmpl.text.Execute(&text, values); err != nil {
+		return nil, err
+	}
+	if err := tmpl.html.Execute(&html, values); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Subject: subject.String(),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// formatEmailTime renders timestamps the same way in every template
+func formatEmailTime(t time.Time) string {
+	return t.Format("2 Jan 2006 15:04 MST")
+}
+
+// Route for admins to list the available email templates and their locales
+func listEmailTemplates(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	locales := make(map[string][]string)
+	for locale, templates := range emailTemplates {
+		for name := range templates {
+			locales[name] = append(locales[name], locale)
+		}
+	}
+
+	type templateInfo struct {
+		Name    string   `json:"name"`
+		Locales []string `json:"locales"`
+	}
+	list := []templateInfo{}
+	for name, available := range locales {
+		sort.Strings(available)
+		list = append(list, templateInfo{Name: name, Locales: available})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	c.JSON(http.StatusOK, list)
+}
+
+// Route for admins to preview a template rendered with sample data
+func previewEmailTemplate(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	name := c.Param("name")
+	msg, err := renderEmail(name, c.DefaultQuery("locale", defaultLocale), emailTemplateSamples[name])
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email template not found"})
+		return
+	}
+
+	switch c.Query("format") {
+	case "html":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(msg.HTML))
+	case "text":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(msg.Text))
+	default:
+		c.JSON(http.StatusOK, gin.H{"subject": msg.Subject, "text": msg.Text, "html": msg.HTML})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestEmailTemplatesGolden renders every template with its sample data in
+// every locale and compares the result with testdata/<name>.<locale>.golden.
+// Run with -update after changing a template to accept the new output.
+func TestEmailTemplatesGolden(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	var locales []string
+	for locale := range emailTemplates {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+
+	for _, locale := range locales {
+		for name := range emailTemplates[locale] {
+			if _, ok := emailTemplateSamples[name]; !ok {
+				t.Errorf("email template %s/%s has no sample data", locale, name)
+			}
+		}
+
+		for name, data := range emailTemplateSamples {
+			locale, name, data := locale, name, data
+			t.Run(name+"."+locale, func(t *testing.T) {
+				msg, err := renderEmail(name, locale, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := fmt.Sprintf("Subject: %s\n\n--- text ---\n%s\n--- html ---\n%s", msg.Subject, msg.Text, msg.HTML)
+
+				golden := filepath.Join("testdata", name+"."+locale+".golden")
+				if *updateGolden {
+					if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run go test -update to create it)", err)
+				}
+				if got != string(want) {
+					t.Errorf("rendered %s differs from %s (run go test -update to accept it):\n%s", name, golden, got)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	facultyCollection *mongo.Collection
+
+	errFacultyNotFound = errors.New("faculty member not found")
+)
+
+// Designations a faculty member can hold
+var designations = map[string]bool{
+	"Professor":           true,
+	"Associate Professor": true,
+	"Assistant Professor": true,
+	"Visiting Faculty":    true,
+	"Adjunct Faculty":     true,
+	"Lecturer":            true,
+}
+
+// Faculty is an instructor in the directory; courses link to instructors by ID
+type Faculty struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name        string             `json:"name" bson:"name"`
+	Email       string             `json:"email,omitempty" bson:"email,omitempty"`
+	Department  string             `json:"department,omitempty" bson:"department,omitempty"`
+	Designation string             `json:"designation,omitempty" bson:"designation,omitempty"`
+}
+
+// FacultyInput is the body of POST /api/faculty and PUT /api/faculty/:id;
+// omitted fields are left unchanged and empty strings clear a field
+type FacultyInput struct {
+	Name        *string `json:"name"`
+	Email       *string `json:"email"`
+	Department  *string `json:"department"`
+	Designation *string `json:"designation"`
+}
+
+// validate normalises the input in place and returns field-level errors
+func (in *FacultyInput) validate() map[string]string {
+	errs := map[string]string{}
+
+	if in.Name != nil {
+		name := strings.Join(strings.Fields(*in.Name), " ")
+		switch {
+		case name == "":
+			errs["name"] = "Name cannot be empty"
+		case len([]rune(name)) > 100:
+			errs["name"] = "Name must be at most 100 characters"
+		case strings.IndexFunc(name, unicode.IsControl) >= 0:
+			errs["name"] = "Name contains invalid characters"
+		}
+		in.Name = &name
+	}
+
+	if in.Email != nil {
+		email := strings.TrimSpace(*in.Email)
+		if email != "" {
+			normalised, err := normaliseEmail(email)
+			if err != nil {
+				errs["email"] = err.Error()
+			}
+			email = normalised
+		}
+		in.Email = &email
+	}
+
+	if in.Department != nil {
+		department := strings.ToUpper(strings.TrimSpace(*in.Department))
+		if department != "" && !departments[department] {
+			errs["department"] = "Unknown department code"
+		}
+		in.Department = &department
+	}
+
+	if in.Designation != nil {
+		designation := strings.Join(strings.Fields(*in.Designation), " ")
+		if designation != "" && !designations[designation] {
+			errs["designation"] = "Unknown designation"
+		}
+		in.Designation = &designation
+	}
+
+	return errs
+}
+
+// ensureFacultyIndexes keeps faculty email addresses unique
+func ensureFacultyIndexes() {
+	if _, err := facultyCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+	}); err != nil {
+		log.Printf("Failed to create faculty email index: %v", err)
+	}
+}
+
+// findFaculty looks a faculty member up by ID
+func findFaculty(ref string) (*Faculty, error) {
+	id, err := primitive.ObjectIDFromHex(ref)
+	if err != nil {
+		return nil, errFacultyNotFound
+	}
+	var member Faculty
+	err = facultyCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&member)
+	if err == mongo.ErrNoDocuments {
+		return nil, errFacultyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// checkInstructorsExist reports whether every ID refers to a faculty member
+func checkInstructorsExist(ids []string) (string, error) {
+	if len(ids) == 0 {
+		return "", nil
+	}
+	objectIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, raw := range ids {
+		id, err := primitive.ObjectIDFromHex(raw)
+		if err != nil {
+			return "Instructors must be faculty IDs", nil
+		}
+		objectIDs = append(objectIDs, id)
+	}
+
+	count, err := facultyCollection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": objectIDs}})
+	if err != nil {
+		return "", err
+	}
+	if int(count) != len(objectIDs) {
+		return "Instructors must be existing faculty members", nil
+	}
+	return "", nil
+}
+
+// Route listing the faculty directory, optionally searched by q or filtered by department
+func listFaculty(c *gin.Context) {
+	filter := bson.M{}
+	if q := c.Query("q"); q != "" {
+		pattern := containsPattern(q)
+		filter["$or"] = []bson.M{{"name": pattern}, {"email": pattern}}
+	}
+	if department := c.Query("department"); department != "" {
+		filter["department"] = strings.ToUpper(department)
+	}
+
+	cursor, err := facultyCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch faculty"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	faculty := []Faculty{}
+	if err := cursor.All(ctx, &faculty); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode faculty"})
+		return
+	}
+
+	c.JSON(http.StatusOK, faculty)
+}
+
+// Route returning a faculty member together with the courses they teach
+func getFaculty(c *gin.Context) {
+	member, err := findFaculty(c.Param("id"))
+	if err == errFacultyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Faculty member not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch faculty member"})
+		return
+	}
+
+	cursor, err := courseCollection.Find(ctx, bson.M{"instructors": member.ID.Hex()}, options.Find().SetSort(bson.M{"code": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch courses"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	courses := []Course{}
+	if err := cursor.All(ctx, &courses); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode courses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"faculty": member, "courses": courses})
+}
+
+// Route for admins to add a faculty member
+func createFaculty(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	var req FacultyInput
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required", "field": "name"})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid faculty member", "fields": errs})
+		return
+	}
+
+	member := Faculty{Name: *req.Name}
+	applyFacultyInput(&req, &member)
+
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		result, err := facultyCollection.InsertOne(sc, member)
+		if err != nil {
+			return err
+		}
+		member.ID = result.InsertedID.(primitive.ObjectID)
+		return recordAuditIn(sc, c, "faculty.create", "faculty:"+member.ID.Hex(), nil, member)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A faculty member with that email already exists", "field": "email"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store faculty member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+// Route for admins to edit a faculty member
+func updateFaculty(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	var req FacultyInput
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid faculty member", "fields": errs})
+		return
+	}
+
+	member, err := findFaculty(c.Param("id"))
+	if err == errFacultyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Faculty member not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch faculty member"})
+		return
+	}
+
+	before := *member
+	if req.Name != nil {
+		member.Name = *req.Name
+	}
+	applyFacultyInput(&req, member)
+
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		if _, err := facultyCollection.ReplaceOne(sc, bson.M{"_id": member.ID}, member); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "faculty.update", "faculty:"+member.ID.Hex(), before, member)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A faculty member with that email already exists", "field": "email"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update faculty member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, member)
+}
+
+func applyFacultyInput(in *FacultyInput, member *Faculty) {
+	if in.Email != nil {
+		member.Email = *in.Email
+	}
+	if in.Department != nil {
+		member.Department = *in.Department
+	}
+	if in.Designation != nil {
+		member.Designation = *in.Designation
+	}
+}
+
+// Route for admins to remove a faculty member, unlinking them from their courses
+func deleteFaculty(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	member, err := findFaculty(c.Param("id"))
+	if err == errFacultyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Faculty member not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch faculty member"})
+		return
+	}
+
+	var unlinked int64
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		if _, err := facultyCollection.DeleteOne(sc, bson.M{"_id": member.ID}); err != nil {
+			return err
+		}
+		result, err := courseCollection.UpdateMany(sc,
+			bson.M{"instructors": member.ID.Hex()},
+			bson.M{"$pull": bson.M{"instructors": member.ID.Hex()}})
+		if err != nil {
+			return err
+		}
+		unlinked = result.ModifiedCount
+		return recordAuditIn(sc, c, "faculty.delete", "faculty:"+member.ID.Hex(), member, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete faculty member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Faculty member deleted successfully", "unlinkedCourses": unlinked})
+}
+
+// Route for admins to add an instructor to a course
+func addCourseInstructor(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	var req struct {
+		FacultyID string `json:"facultyId" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	setCourseInstructor(c, req.FacultyID, true)
+}
+
+// Route for admins to remove an instructor from a course
+func removeCourseInstructor(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	setCourseInstructor(c, c.Param("facultyId"), false)
+}
+
+func setCourseInstructor(c *gin.Context, facultyID string, linked bool) {
+	course, err := findCourse(c.Param("id"))
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return
+	}
+
+	member, err := findFaculty(facultyID)
+	if err == errFacultyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Faculty member not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch faculty member"})
+		return
+	}
+
+	action, update := "course.instructor_add", bson.M{"$addToSet": bson.M{"instructors": member.ID.Hex()}}
+	if !linked {
+		action, update = "course.instructor_remove", bson.M{"$pull": bson.M{"instructors": member.ID.Hex()}}
+	}
+
+	var updated Course
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		err := courseCollection.FindOneAndUpdate(sc, bson.M{"_id": course.ID}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+		if err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, action, "course:"+course.Code, gin.H{"instructors": course.Instructors}, gin.H{"instructors": updated.Instructors})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update course instructors"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// resolveInstructor finds the faculty member referred to by ID or, as the upload
+// form sends it, by exact name
+func resolveInstructor(ref string) (*Faculty, error) {
+	if member, err := findFaculty(ref); err != errFacultyNotFound {
+		return member, err
+	}
+
+	pattern := bson.M{"$regex": "^" + regexp.QuoteMeta(strings.TrimSpace(ref)) + "$", "$options": "i"}
+	cursor, err := facultyCollection.Find(ctx, bson.M{"name": pattern}, options.Find().SetLimit(2))
+	if err != nil {
+		return nil, err
+	}
+	var matches []Faculty
+	if err := cursor.All(ctx, &matches); err != nil {
+		return nil, err
+	}
+	if len(matches) != 1 {
+		return nil, errFacultyNotFound
+	}
+	return &matches[0], nil
+}
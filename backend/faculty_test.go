@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestFacultyInputValidate(t *testing.T) {
+	text := func(s string) *string { return &s }
+
+	input := FacultyInput{
+		Name:        text("  Dr.   Meera   Iyer "),
+		Email:       text(" Meera@IITK.ac.in "),
+		Department:  text("cse"),
+		Designation: text("Associate  Professor"),
+	}
+	if errs := input.validate(); len(errs) != 0 {
+		t.Fatalf("errors = %v", errs)
+	}
+	if *input.Name != "Dr. Meera Iyer" || *input.Email != "meera@iitk.ac.in" || *input.Department != "CSE" || *input.Designation != "Associate Professor" {
+		t.Errorf("normalised = %q %q %q %q", *input.Name, *input.Email, *input.Department, *input.Designation)
+	}
+
+	cleared := FacultyInput{Email: text(" "), Department: text(""), Designation: text("")}
+	if errs := cleared.validate(); len(errs) != 0 || *cleared.Email != "" {
+		t.Errorf("clearing fields: errors = %v, email = %q", errs, *cleared.Email)
+	}
+
+	invalid := FacultyInput{
+		Name:        text("   "),
+		Email:       text("Meera <meera@iitk.ac.in>"),
+		Department:  text("XYZ"),
+		Designation: text("Dean"),
+	}
+	errs := invalid.validate()
+	for _, field := range []string{"name", "email", "department", "designation"} {
+		if errs[field] == "" {
+			t.Errorf("no error for %s: %v", field, errs)
+		}
+	}
+}
+
+func TestCreateFaculty(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("by a student", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		recorder := serveJSONAs(createFaculty, "asha@iitk.ac.in", "student", http.MethodPost, "/api/faculty", map[string]string{"name": "Meera Iyer"})
+		expectStatus(mt, recorder, http.StatusForbidden)
+	})
+
+	mt.Run("without a name", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		recorder := serveJSONAs(createFaculty, "admin@iitk.ac.in", "admin", http.MethodPost, "/api/faculty", map[string]string{"email": "meera@iitk.ac.in"})
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if field := responseBody(mt, recorder)["field"]; field != "name" {
+			mt.Errorf("field = %v, want name", field)
+		}
+	})
+
+	mt.Run("duplicate email", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "E11000 duplicate key error"}),
+			mtest.CreateSuccessResponse(),
+		)
+		body := map[string]string{"name": "Meera Iyer", "email": "meera@iitk.ac.in"}
+		recorder := serveJSONAs(createFaculty, "admin@iitk.ac.in", "admin", http.MethodPost, "/api/faculty", body)
+		expectStatus(mt, recorder, http.StatusConflict)
+		if field := responseBody(mt, recorder)["field"]; field != "email" {
+			mt.Errorf("field = %v, want email", field)
+		}
+	})
+}
+
+func TestDeleteFaculty(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("unlinks courses", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateCursorResponse(0, "db.faculty", mtest.FirstBatch, bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Meera Iyer"}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			matchedDocuments(2),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveRoute(deleteFaculty, http.MethodDelete, "/api/faculty/:id", "/api/faculty/"+id.Hex(), nil, "admin@iitk.ac.in", "admin")
+		expectStatus(mt, recorder, http.StatusOK)
+		if unlinked := responseBody(mt, recorder)["unlinkedCourses"]; unlinked != float64(2) {
+			mt.Errorf("unlinkedCourses = %v, want 2", unlinked)
+		}
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || collections[0] != "details" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if pulled := updates[0].Lookup("u", "$pull", "instructors").StringValue(); pulled != id.Hex() {
+			mt.Errorf("pulled %q, want %q", pulled, id.Hex())
+		}
+	})
+
+	mt.Run("unknown", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		recorder := serveRoute(deleteFaculty, http.MethodDelete, "/api/faculty/:id", "/api/faculty/not-an-id", nil, "admin@iitk.ac.in", "admin")
+		expectStatus(mt, recorder, http.StatusNotFound)
+	})
+}
+
+func TestResolveInstructor(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("by name", func(mt *mtest.T) {
+		useMockCollections(mt)
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.faculty", mtest.FirstBatch, bson.D{{Key: "_id", Value: id}, {Key: "name", Value: "Meera Iyer"}}))
+		member, err := resolveInstructor(" meera iyer ")
+		if err != nil || member.ID != id {
+			mt.Fatalf("resolveInstructor = %+v, %v", member, err)
+		}
+		filter := sentCommand(mt, "find").Lookup("filter", "name").Document()
+		if filter.Lookup("$regex").StringValue() != "^meera iyer$" || filter.Lookup("$options").StringValue() != "i" {
+			mt.Errorf("name filter = %v, want an exact case-insensitive match", filter)
+		}
+	})
+
+	mt.Run("ambiguous name", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.faculty", mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "name", Value: "A. Kumar"}},
+			bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "name", Value: "a. kumar"}}))
+		if _, err := resolveInstructor("A. Kumar"); err != errFacultyNotFound {
+			mt.Errorf("err = %v, want %v", err, errFacultyNotFound)
+		}
+		filter := sentCommand(mt, "find").Lookup("filter", "name").Document()
+		if filter.Lookup("$regex").StringValue() != `^A\. Kumar$` {
+			mt.Errorf("name is not escaped: %v", filter)
+		}
+	})
+}
+
+func TestCheckInstructorsExist(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("missing faculty", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(countedDocuments("db.faculty", 1))
+		ids := []string{primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()}
+		if reason, err := checkInstructorsExist(ids); err != nil || reason == "" {
+			mt.Errorf("checkInstructorsExist = %q, %v, want a reason", reason, err)
+		}
+	})
+
+	mt.Run("names instead of IDs", func(mt *mtest.T) {
+		useMockCollections(mt)
+		if reason, err := checkInstructorsExist([]string{"Meera Iyer"}); err != nil || reason == "" {
+			mt.Errorf("checkInstructorsExist = %q, %v, want a reason", reason, err)
+		}
+		if len(mt.GetAllStartedEvents()) != 0 {
+			mt.Errorf("looked up IDs that cannot exist")
+		}
+	})
+}
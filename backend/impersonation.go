@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	scopeImpersonation = "impersonation"
+	impersonationTTL   = 15 * time.Minute
+)
+
+// Route for admins to obtain a short-lived, read-only token that acts as a student
+func startImpersonation(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	dbUser, ok := findManagedUser(c)
+	if !ok {
+		return
+	}
+	if dbUser.Role != "student" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only student accounts can be impersonated"})
+		return
+	}
+	if dbUser.Disabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	// The token is tied to both the student's and the admin's current session
+	// versions, so it is revoked along with either
+	expires := time.Now().Add(impersonationTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		Username:            dbUser.Username,
+		Role:                dbUser.Role,
+		Scope:               scopeImpersonation,
+		Version:             dbUser.TokenVersion,
+		ImpersonatedBy:      claims.Username,
+		ImpersonatorVersion: claims.Version,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expires.Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	})
+	tokenString, err := token.SignedString(jwtKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+		return
+	}
+
+	if err := recordAudit(c, "impersonation.start", "user:"+dbUser.Username, nil, gin.H{"expiresAt": expires}); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Impersonation cannot be recorded right now"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokenString,
+		"impersonating": dbUser.Username,
+		"readOnly":      true,
+		"expiresAt":     expires,
+	})
+}
+
+// checkImpersonation enforces the limits on an impersonation token and records
+// the request against the admin who is acting
+func checkImpersonation(c *gin.Context, claims *Claims) bool {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Impersonation sessions are read-only"})
+		return false
+	}
+
+	// The admin must still hold the role, be allowed to sign in and not have
+	// had their sessions revoked since
+	var admin struct {
+		Role         string `bson:"role"`
+		Disabled     bool   `bson:"disabled"`
+		TokenVersion int    `bson:"tokenVersion"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"role": 1, "disabled": 1, "tokenVersion": 1})
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.ImpersonatedBy}, opts).Decode(&admin)
+	if err != nil || admin.Role != "admin" || admin.Disabled || admin.TokenVersion != claims.ImpersonatorVersion {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Impersonation session is no longer valid"})
+		return false
+	}
+
+	// Every impersonated request is on record, or it is not served
+	err = recordAudit(c, "impersonation.request", "user:"+claims.Username, nil, gin.H{
+		"method": c.Request.Method,
+		"path":   c.Request.URL.RequestURI(),
+	})
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Impersonated requests cannot be recorded right now"})
+		return false
+	}
+	c.Header("X-Impersonated-By", claims.ImpersonatedBy)
+	return true
+}
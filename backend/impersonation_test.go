@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// impersonationToken is a token for admin@iitk.ac.in acting as asha@iitk.ac.in
+// while the admin's sessions are at version 2
+func impersonationToken(t testing.TB) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{
+		Username:            "asha@iitk.ac.in",
+		Role:                "student",
+		Scope:               scopeImpersonation,
+		ImpersonatedBy:      "admin@iitk.ac.in",
+		ImpersonatorVersion: 2,
+		StandardClaims:      jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix()},
+	}).SignedString(jwtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// impersonatingAdmin is the mock response to the lookup of the acting admin
+func impersonatingAdmin(version int) bson.D {
+	return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+		{Key: "role", Value: "admin"},
+		{Key: "tokenVersion", Value: version},
+	})
+}
+
+func TestImpersonationRevokedWithAdminSessions(t *testing.T) {
+	token := impersonationToken(t)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("admin sessions revoked", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), impersonatingAdmin(3))
+		recorder := serveWithToken(getMe, http.MethodGet, "/api/me", token, nil)
+		expectStatus(mt, recorder, http.StatusUnauthorized)
+	})
+
+	mt.Run("admin sessions current", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			impersonatingAdmin(2),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+				{Key: "username", Value: "asha@iitk.ac.in"},
+				{Key: "role", Value: "student"},
+			}),
+		)
+		recorder := serveWithToken(getMe, http.MethodGet, "/api/me", token, nil)
+		expectStatus(mt, recorder, http.StatusOK)
+		if by := recorder.Header().Get("X-Impersonated-By"); by != "admin@iitk.ac.in" {
+			mt.Errorf("X-Impersonated-By = %q", by)
+		}
+	})
+}
+
+func TestImpersonatedRequests(t *testing.T) {
+	token := impersonationToken(t)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		mt.Run(method+" is refused", func(mt *mtest.T) {
+			useMockCollections(mt)
+			mt.AddMockResponses(activeSession())
+			recorder := serveWithToken(getMe, method, "/api/me", token, nil)
+			expectStatus(mt, recorder, http.StatusForbidden)
+			if len(mt.GetAllStartedEvents()) != 1 {
+				mt.Errorf("handler went on after refusing a write")
+			}
+		})
+	}
+
+	mt.Run("GET is recorded", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			impersonatingAdmin(2),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+				{Key: "username", Value: "asha@iitk.ac.in"},
+				{Key: "role", Value: "student"},
+			}),
+		)
+		recorder := serveWithToken(getMe, http.MethodGet, "/api/me", token, nil)
+		expectStatus(mt, recorder, http.StatusOK)
+
+		entry := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		if entry.Lookup("action").StringValue() != "impersonation.request" ||
+			entry.Lookup("actor").StringValue() != "admin@iitk.ac.in" ||
+			entry.Lookup("onBehalfOf").StringValue() != "asha@iitk.ac.in" {
+			mt.Errorf("audit entry = %v", entry)
+		}
+		if after := entry.Lookup("after").StringValue(); !strings.Contains(after, `"path":"/api/me"`) {
+			mt.Errorf("request recorded as %s", after)
+		}
+	})
+
+	mt.Run("GET is refused when it cannot be recorded", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			impersonatingAdmin(2),
+			noDocuments("db.audit_log"),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 8, Message: "audit log unavailable"}),
+		)
+		recorder := serveWithToken(getMe, http.MethodGet, "/api/me", token, nil)
+		expectStatus(mt, recorder, http.StatusServiceUnavailable)
+		if found := sentCommand(mt, "find"); found.Lookup("find").StringValue() != "audit_log" {
+			mt.Errorf("handler went on after the audit write failed: %v", found)
+		}
+	})
+}
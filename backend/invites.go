@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultInviteTTL = 72 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	inviteCollection      *mongo.Collection
+	inviteEventCollection *mongo.Collection
+
+	errInvalidInvite = errors.New("invalid or expired invitation")
+)
+
+// Invitation is a single-use, expiring token that lets one email address register with one role
+type Invitation struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Email     string             `json:"email" bson:"email"`
+	Role      string             `json:"role" bson:"role"`
+	TokenHash string             `json:"-" bson:"tokenHash"`
+	CreatedBy string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time          `json:"expiresAt" bson:"expiresAt"`
+	UsedAt    *time.Time         `json:"usedAt,omitempty" bson:"usedAt"`
+	UsedBy    string             `json:"usedBy,omitempty" bson:"usedBy,omitempty"`
+	RevokedAt *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt"`
+	RevokedBy string             `json:"revokedBy,omitempty" bson:"revokedBy,omitempty"`
+	Status    string             `json:"status" bson:"-"`
+}
+
+// InviteEvent records every action taken on an invitation
+type InviteEvent struct {
+	InviteID  primitive.ObjectID `json:"inviteId" bson:"inviteId,omitempty"`
+	Action    string             `json:"action" bson:"action"`
+	Actor     string             `json:"actor" bson:"actor"`
+	Email     string             `json:"email" bson:"email"`
+	Role      string             `json:"role" bson:"role"`
+	IP        string             `json:"ip" bson:"ip"`
+	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
+}
+
+// status derives the invitation's lifecycle state
+func (inv *Invitation) status(now time.Time) string {
+	switch {
+	case inv.RevokedAt != nil:
+		return "revoked"
+	case inv.UsedAt != nil:
+		return "used"
+	case now.After(inv.ExpiresAt):
+		return "expired"
+	default:
+		return "pending"
+	}
+}
+
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordInviteEvent appends to the invitation audit trail; failures are logged
+// rather than surfaced because the invitation change has already happened
+func recordInviteEvent(c *gin.Context, inv *Invitation, action, actor string) {
+	_, err := inviteEventCollection.InsertOne(ctx, InviteEvent{
+		InviteID:  inv.ID,
+		Action:    action,
+		Actor:     actor,
+		Email:     inv.Email,
+		Role:      inv.Role,
+		IP:        c.ClientIP(),
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to record invitation event %s for %s: %v", action, inv.Email, err)
+	}
+}
+
+// redeemInvite atomically marks the invitation for email and role as used
+func redeemInvite(c *gin.Context, token, email, role string) (*Invitation, error) {
+	now := time.Now()
+	filter := bson.M{
+		"tokenHash": hashInviteToken(token),
+		"email":     email,
+		"role":      role,
+		"usedAt":    nil,
+		"revokedAt": nil,
+		"expiresAt": bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"usedAt": now, "usedBy": email}}
+
+	var inv Invitation
+	err := inviteCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&inv)
+	if err == mongo.ErrNoDocuments {
+		recordInviteEvent(c, &Invitation{Email: email, Role: role}, "redeem_failed", email)
+		return nil, errInvalidInvite
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recordInviteEvent(c, &inv, "redeemed", email)
+	return &inv, nil
+}
+
+// releaseInvite makes a redeemed invitation usable again when registration
+// fails after the invitation was consumed
+func releaseInvite(c *gin.Context, inv *Invitation) {
+	_, err := inviteCollection.UpdateOne(ctx, bson.M{"_id": inv.ID}, bson.M{"$set": bson.M{"usedAt": nil}, "$unset": bson.M{"usedBy": ""}})
+	if err != nil {
+		log.Printf("Failed to release invitation %s: %v", inv.ID.Hex(), err)
+		return
+	}
+	recordInviteEvent(c, inv, "released", inv.Email)
+}
+
+// Route for admins to invite a new user
+func createInvite(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	var req struct {
+		Email          string `json:"email" binding:"required"`
+		Role           string `json:"role" binding:"required"`
+		ExpiresInHours int    `json:"expiresInHours"`
+		Locale         string `json:"locale"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be admin or student", "field": "role"})
+		return
+	}
+	email, err := validateAccountEmail(req.Email, req.Role)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "field": "email"})
+		return
+	}
+
+	ttl := defaultInviteTTL
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if ttl > maxInviteTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invitations cannot be valid for more than 30 days"})
+		return
+	}
+
+	token, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invitation"})
+		return
+	}
+
+	now := time.Now()
+	inv := Invitation{
+		Email:     email,
+		Role:      req.Role,
+		TokenHash: hashInviteToken(token),
+		CreatedBy: claims.Username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	// Store the invitation and queue its email together so nobody is left with
+	// an invitation they never received
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := inviteCollection.InsertOne(sc, inv)
+		if err != nil {
+			return err
+		}
+		inv.ID = result.InsertedID.(primitive.ObjectID)
+		if err := queueInvitation(sc, inv.Email, inv.Role, token, inv.ExpiresAt, req.Locale); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "invite.create", "invite:"+inv.ID.Hex(), nil, gin.H{"email": inv.Email, "role": inv.Role, "expiresAt": inv.ExpiresAt})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store invitation"})
+		return
+	}
+
+	recordInviteEvent(c, &inv, "created", claims.Username)
+
+	inv.Status = inv.status(now)
+	c.JSON(http.StatusOK, inv)
+}
+
+// Route for admins to list invitations, optionally filtered by status
+func listInvites(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	now := time.Now()
+	filter := bson.M{}
+	switch c.Query("status") {
+	case "":
+	case "pending":
+		filter = bson.M{"usedAt": nil, "revokedAt": nil, "expiresAt": bson.M{"$gt": now}}
+	case "used":
+		filter = bson.M{"usedAt": bson.M{"$ne": nil}}
+	case "revoked":
+		filter = bson.M{"revokedAt": bson.M{"$ne": nil}}
+	case "expired":
+		filter = bson.M{"usedAt": nil, "revokedAt": nil, "expiresAt": bson.M{"$lte": now}}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown invitation status"})
+		return
+	}
+
+	cursor, err := inviteCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	invites := []Invitation{}
+	if err := cursor.All(ctx, &invites); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode invitations"})
+		return
+	}
+	for i := range invites {
+		invites[i].Status = invites[i].status(now)
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+// Route for admins to revoke an unused invitation
+func revokeInvite(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	now := time.Now()
+	var inv Invitation
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		err := inviteCollection.FindOneAndUpdate(sc,
+			bson.M{"_id": id, "usedAt": nil, "revokedAt": nil},
+			bson.M{"$set": bson.M{"revokedAt": now, "revokedBy": claims.Username}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&inv)
+		if err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "invite.revoke", "invite:"+inv.ID.Hex(), gin.H{"email": inv.Email, "role": inv.Role}, nil)
+	})
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or already used"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invitation"})
+		return
+	}
+
+	recordInviteEvent(c, &inv, "revoked", claims.Username)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// Route for admins to read the invitation audit trail
+func listInviteEvents(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	cursor, err := inviteEventCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"timestamp": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitation events"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	events := []InviteEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode invitation events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, events)
+}
+
+func queueInvitation(sc mongo.SessionContext, email, role, token string, expiresAt time.Time, locale string) error {
+	return enqueueEmail(sc, email, "invitation", locale, EmailData{
+		"Role":      role,
+		"Token":     token,
+		"ExpiresAt": formatEmailTime(expiresAt),
+	})
+}
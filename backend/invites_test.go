@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestInvitationStatus(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	tests := map[string]struct {
+		invite Invitation
+		want   string
+	}{
+		"pending":          {Invitation{ExpiresAt: now.Add(time.Hour)}, "pending"},
+		"expired":          {Invitation{ExpiresAt: earlier}, "expired"},
+		"used":             {Invitation{ExpiresAt: now.Add(time.Hour), UsedAt: &earlier}, "used"},
+		"used then lapsed": {Invitation{ExpiresAt: earlier, UsedAt: &earlier}, "used"},
+		"revoked":          {Invitation{ExpiresAt: now.Add(time.Hour), RevokedAt: &earlier}, "revoked"},
+	}
+	for name, test := range tests {
+		if got := test.invite.status(now); got != test.want {
+			t.Errorf("%s: status = %q, want %q", name, got, test.want)
+		}
+	}
+}
+
+func TestRedeemInvite(t *testing.T) {
+	newContext := func() *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/register", nil)
+		return c
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("valid invitation", func(mt *mtest.T) {
+		useMockCollections(mt)
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(
+			bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: bson.D{
+				{Key: "_id", Value: id},
+				{Key: "email", Value: "admin@iitk.ac.in"},
+				{Key: "role", Value: "admin"},
+			}}},
+			mtest.CreateSuccessResponse(),
+		)
+		inv, err := redeemInvite(newContext(), "secret-token", "admin@iitk.ac.in", "admin")
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if inv.ID != id {
+			mt.Errorf("redeemed invitation %s, want %s", inv.ID.Hex(), id.Hex())
+		}
+
+		// The invitation is looked up by the hash of its token and only while it
+		// is unused, unrevoked and unexpired, for the address and role it was issued to
+		query := sentCommand(mt, "findAndModify").Lookup("query").Document()
+		if query.Lookup("tokenHash").StringValue() != hashInviteToken("secret-token") {
+			mt.Errorf("query does not match the token hash: %v", query)
+		}
+		if query.Lookup("email").StringValue() != "admin@iitk.ac.in" || query.Lookup("role").StringValue() != "admin" {
+			mt.Errorf("query does not bind the address and role: %v", query)
+		}
+		for _, field := range []string{"usedAt", "revokedAt", "expiresAt"} {
+			if _, err := query.LookupErr(field); err != nil {
+				mt.Errorf("query does not check %s: %v", field, query)
+			}
+		}
+		event := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		if event.Lookup("action").StringValue() != "redeemed" {
+			mt.Errorf("event = %v", event)
+		}
+	})
+
+	mt.Run("unknown or spent invitation", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: nil}}, mtest.CreateSuccessResponse())
+		if _, err := redeemInvite(newContext(), "secret-token", "admin@iitk.ac.in", "admin"); err != errInvalidInvite {
+			mt.Fatalf("err = %v, want %v", err, errInvalidInvite)
+		}
+		event := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		if event.Lookup("action").StringValue() != "redeem_failed" {
+			mt.Errorf("event = %v", event)
+		}
+	})
+}
+
+func TestRegisterAdminNeedsInvitation(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("without invitation", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(noDocuments("db.registered_users"))
+		body := map[string]string{"username": "admin@iitk.ac.in", "password": "correct horse", "role": "admin"}
+		recorder := serveJSON(register, http.MethodPost, "/api/register", body)
+		expectStatus(mt, recorder, http.StatusUnauthorized)
+	})
+
+	mt.Run("with invalid invitation", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			noDocuments("db.registered_users"),
+			bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: nil}},
+			mtest.CreateSuccessResponse(),
+		)
+		body := map[string]string{"username": "admin@iitk.ac.in", "password": "correct horse", "role": "admin", "inviteToken": "stolen"}
+		recorder := serveJSON(register, http.MethodPost, "/api/register", body)
+		expectStatus(mt, recorder, http.StatusUnauthorized)
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" && event.Command.Lookup("insert").StringValue() == "registered_users" {
+				mt.Errorf("account was created without a valid invitation")
+			}
+		}
+	})
+}
+
+func TestCreateInvite(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("by a student", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		body := map[string]string{"email": "ravi@iitk.ac.in", "role": "admin"}
+		recorder := serveJSONAs(createInvite, "ravi@iitk.ac.in", "student", http.MethodPost, "/api/invites", body)
+		expectStatus(mt, recorder, http.StatusForbidden)
+	})
+
+	mt.Run("longer than 30 days", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		body := map[string]interface{}{"email": "new@iitk.ac.in", "role": "admin", "expiresInHours": 31 * 24}
+		recorder := serveJSONAs(createInvite, "admin@iitk.ac.in", "admin", http.MethodPost, "/api/invites", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+	})
+
+	mt.Run("stores only the token hash", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		body := map[string]string{"email": "New@IITK.ac.in", "role": "admin"}
+		recorder := serveJSONAs(createInvite, "admin@iitk.ac.in", "admin", http.MethodPost, "/api/invites", body)
+		expectStatus(mt, recorder, http.StatusOK)
+		if status := responseBody(mt, recorder)["status"]; status != "pending" {
+			mt.Errorf("status = %v, want pending", status)
+		}
+
+		var stored bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" && event.Command.Lookup("insert").StringValue() == "invitations" {
+				stored = event.Command.Lookup("documents").Array().Index(0).Value().Document()
+			}
+		}
+		if stored == nil {
+			mt.Fatal("invitation was not stored")
+		}
+		if stored.Lookup("email").StringValue() != "new@iitk.ac.in" {
+			mt.Errorf("email = %v, want it normalised", stored.Lookup("email"))
+		}
+		if hash := stored.Lookup("tokenHash").StringValue(); len(hash) != 64 {
+			mt.Errorf("tokenHash = %q, want a SHA-256 hex digest", hash)
+		}
+	})
+}
+
+func TestRevokeInvite(t *testing.T) {
+	id := primitive.NewObjectID()
+	revoke := func() *httptest.ResponseRecorder {
+		return serveRoute(revokeInvite, http.MethodDelete, "/api/invites/:id", "/api/invites/"+id.Hex(), nil, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("already used", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: nil}}, mtest.CreateSuccessResponse())
+		expectStatus(mt, revoke(), http.StatusNotFound)
+
+		query := sentCommand(mt, "findAndModify").Lookup("query").Document()
+		if _, err := query.LookupErr("usedAt"); err != nil {
+			mt.Errorf("revocation does not skip used invitations: %v", query)
+		}
+	})
+}
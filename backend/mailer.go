@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMailFrom = "EduWise@iitk.ac.in"
+
+var mailer Mailer
+
+// Message is a single outgoing email with optional HTML alternative
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// Mailer delivers messages through some transport
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// newMailerFromEnv builds the transport selected by MAIL_TRANSPORT
+func newMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+
+	switch transport := os.Getenv("MAIL_TRANSPORT"); transport {
+	case "", "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			host = "mmtp.iitk.ac.in"
+		}
+		port := 25
+		if value := os.Getenv("SMTP_PORT"); value != "" {
+			p, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SMTP_PORT %q: %v", value, err)
+			}
+			port = p
+		}
+		// A mistyped setting must not quietly send in plain text
+		security := os.Getenv("SMTP_SECURITY")
+		switch security {
+		case "", "tls", "starttls", "opportunistic", "none":
+		default:
+			return nil, fmt.Errorf("invalid SMTP_SECURITY %q, use tls, starttls, opportunistic or none", security)
+		}
+		auth := os.Getenv("SMTP_AUTH")
+		switch auth {
+		case "", "plain", "cram-md5", "none":
+		default:
+			return nil, fmt.Errorf("invalid SMTP_AUTH %q, use plain, cram-md5 or none", auth)
+		}
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			Security: security,
+			Auth:     auth,
+			From:     from,
+		}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		return NewFileMailer(dir, from)
+	case "memory":
+		return NewMemoryMailer(from), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_TRANSPORT %q", transport)
+	}
+}
+
+// buildMessage renders msg as an RFC 5322 message, using multipart/alternative
+// when both text and HTML bodies are present
+func buildMessage(msg *Message) ([]byte, error) {
+	if msg.From == "" || len(msg.To) == 0 {
+		return nil, errors.New("message needs a sender and at least one recipient")
+	}
+	if msg.Text == "" && msg.HTML == "" {
+		return nil, errors.New("message has no body")
+	}
+
+	messageID, err := newMessageID(msg.From)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeHeader := func(key, value string) {
+		buf.WriteString(key + ": " + value + "\r\n")
+	}
+
+	writeHeader("From", msg.From)
+	writeHeader("To", strings.Join(msg.To, ", "))
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("Message-ID", messageID)
+	writeHeader("MIME-Version", "1.0")
+	for key, value := range msg.Headers {
+		writeHeader(textproto.CanonicalMIMEHeaderKey(key), value)
+	}
+
+	switch {
+	case msg.Text != "" && msg.HTML != "":
+		writer := multipart.NewWriter(&buf)
+		writeHeader("Content-Type", "multipart/alternative; boundary=\""+writer.Boundary()+"\"")
+		buf.WriteString("\r\n")
+
+		// Plain text first so that clients prefer the richer HTML part
+		if err := writePart(writer, "text/plain; charset=\"utf-8\"", msg.Text); err != nil {
+			return nil, err
+		}
+		if err := writePart(writer, "text/html; charset=\"utf-8\"", msg.HTML); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+	case msg.HTML != "":
+		writeHeader("Content-Type", "text/html; charset=\"utf-8\"")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, msg.HTML); err != nil {
+			return nil, err
+		}
+	default:
+		writeHeader("Content-Type", "text/plain; charset=\"utf-8\"")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writePart(writer *multipart.Writer, contentType, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return writeQuotedPrintable(part, body)
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// newMessageID returns a globally unique Message-ID in the sender's domain
+func newMessageID(from string) (string, error) {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domain = addr.Address[at+1:]
+		}
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain), nil
+}
+
+// envelopeAddress strips any display name so the address can be used in MAIL FROM / RCPT TO
+func envelopeAddress(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		return addr.Address
+	}
+	return address
+}
+
+// SMTPMailer delivers through an SMTP relay
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Security is "starttls" (required), "tls" (implicit TLS), "none", or empty
+	// to upgrade with STARTTLS only when the server offers it
+	Security string
+	// Auth is "plain" (default), "cram-md5" or "none"
+	Auth string
+	From string
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	raw, err := buildMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	if m.Security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 30*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	switch m.Security {
+	case "starttls":
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	case "", "opportunistic":
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed: %v", err)
+			}
+		}
+	case "tls", "none":
+	default:
+		return fmt.Errorf("unknown SMTP security %q", m.Security)
+	}
+
+	if m.Username != "" && m.Auth != "none" {
+		var auth smtp.Auth
+		switch m.Auth {
+		case "", "plain":
+			auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+		case "cram-md5":
+			auth = smtp.CRAMMD5Auth(m.Username, m.Password)
+		default:
+			return fmt.Errorf("unknown SMTP auth mechanism %q", m.Auth)
+		}
+		// Never fall back to sending unauthenticated when credentials are set
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("SMTP server does not offer AUTH")
+		}
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(envelopeAddress(msg.From)); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := client.Rcpt(envelopeAddress(to)); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// FileMailer writes each message into a maildir for local development
+type FileMailer struct {
+	Dir  string
+	From string
+
+	counter uint64
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileMailer{Dir: dir, From: from}, nil
+}
+
+func (m *FileMailer) Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	raw, err := buildMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s.eml", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&m.counter, 1), hostname)
+
+	// Write into tmp and rename so readers never see a partial message
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
+
+// SentMessage is a message captured by MemoryMailer together with its rendered form
+type SentMessage struct {
+	Message
+	Raw    []byte
+	SentAt time.Time
+}
+
+// MemoryMailer keeps every message in memory so tests can inspect them
+type MemoryMailer struct {
+	From string
+
+	mu   sync.Mutex
+	sent []SentMessage
+}
+
+func NewMemoryMailer(from string) *MemoryMailer {
+	return &MemoryMailer{From: from}
+}
+
+func (m *MemoryMailer) Send(msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	raw, err := buildMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, SentMessage{Message: *msg, Raw: raw, SentAt: time.Now()})
+	return nil
+}
+
+// Sent returns a copy of the captured messages
+func (m *MemoryMailer) Sent() []SentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentMessage(nil), m.sent...)
+}
+
+// Reset discards all captured messages
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+}
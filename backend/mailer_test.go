@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	t.Run("text and HTML", func(t *testing.T) {
+		raw, err := buildMessage(&Message{
+			From:    "EduWise <EduWise@iitk.ac.in>",
+			To:      []string{"asha@iitk.ac.in"},
+			Subject: "Café schedule",
+			Text:    "Hello Asha",
+			HTML:    "<p>Hello Asha</p>",
+			Headers: map[string]string{"x-eduwise-template": "otp"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject")); subject != "Café schedule" {
+			t.Errorf("Subject = %q", subject)
+		}
+		if got := parsed.Header.Get("X-Eduwise-Template"); got != "otp" {
+			t.Errorf("custom header = %q", got)
+		}
+		if id := parsed.Header.Get("Message-Id"); !strings.HasSuffix(id, "@iitk.ac.in>") {
+			t.Errorf("Message-ID = %q, want it in the sender's domain", id)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/alternative" {
+			t.Fatalf("Content-Type = %q", parsed.Header.Get("Content-Type"))
+		}
+		reader := multipart.NewReader(parsed.Body, params["boundary"])
+		var types, bodies []string
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(quotedprintable.NewReader(part))
+			types = append(types, part.Header.Get("Content-Type"))
+			bodies = append(bodies, string(body))
+		}
+		if len(types) != 2 || !strings.HasPrefix(types[0], "text/plain") || !strings.HasPrefix(types[1], "text/html") {
+			t.Fatalf("parts = %v, want plain text then HTML", types)
+		}
+		if bodies[0] != "Hello Asha" || bodies[1] != "<p>Hello Asha</p>" {
+			t.Errorf("bodies = %q", bodies)
+		}
+	})
+
+	t.Run("text only", func(t *testing.T) {
+		long := strings.Repeat("a", 100) + "=100%"
+		raw, err := buildMessage(&Message{From: "EduWise@iitk.ac.in", To: []string{"asha@iitk.ac.in"}, Text: long})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(parsed.Header.Get("Content-Type"), "text/plain") {
+			t.Errorf("Content-Type = %q", parsed.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+		if string(body) != long {
+			t.Errorf("body = %q, want %q", body, long)
+		}
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		for name, msg := range map[string]*Message{
+			"no sender":    {To: []string{"asha@iitk.ac.in"}, Text: "hi"},
+			"no recipient": {From: "EduWise@iitk.ac.in", Text: "hi"},
+			"no body":      {From: "EduWise@iitk.ac.in", To: []string{"asha@iitk.ac.in"}},
+		} {
+			if _, err := buildMessage(msg); err == nil {
+				t.Errorf("%s: built without an error", name)
+			}
+		}
+	})
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer, err := NewFileMailer(dir, "EduWise@iitk.ac.in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(&Message{To: []string{"asha@iitk.ac.in"}, Subject: "Hi", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	delivered, _ := os.ReadDir(filepath.Join(dir, "new"))
+	pending, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+	if len(delivered) != 1 || len(pending) != 0 {
+		t.Fatalf("new has %d messages and tmp has %d, want 1 and 0", len(delivered), len(pending))
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "new", delivered[0].Name()))
+	if !bytes.Contains(raw, []byte("From: EduWise@iitk.ac.in\r\n")) {
+		t.Errorf("message does not use the default sender:\n%s", raw)
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := NewMemoryMailer("EduWise@iitk.ac.in")
+	if err := mailer.Send(&Message{To: []string{"asha@iitk.ac.in"}, Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(&Message{To: []string{"asha@iitk.ac.in"}}); err == nil {
+		t.Error("message without a body was accepted")
+	}
+
+	sent := mailer.Sent()
+	if len(sent) != 1 || sent[0].From != "EduWise@iitk.ac.in" || len(sent[0].Raw) == 0 {
+		t.Fatalf("sent = %+v", sent)
+	}
+	mailer.Reset()
+	if len(mailer.Sent()) != 0 {
+		t.Error("Reset kept messages")
+	}
+}
+
+func TestNewMailerFromEnv(t *testing.T) {
+	t.Setenv("MAIL_FROM", "")
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("SMTP_PORT", "")
+	t.Setenv("SMTP_SECURITY", "")
+	t.Setenv("SMTP_AUTH", "")
+
+	t.Setenv("MAIL_TRANSPORT", "")
+	m, err := newMailerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if smtpMailer, ok := m.(*SMTPMailer); !ok || smtpMailer.Host != "mmtp.iitk.ac.in" || smtpMailer.Port != 25 || smtpMailer.From != defaultMailFrom {
+		t.Errorf("default mailer = %+v", m)
+	}
+
+	t.Setenv("SMTP_PORT", "submission")
+	if _, err := newMailerFromEnv(); err == nil {
+		t.Error("invalid SMTP_PORT was accepted")
+	}
+	t.Setenv("SMTP_PORT", "")
+
+	for _, security := range []string{"STARTTLS", "ssl", "start-tls"} {
+		t.Setenv("SMTP_SECURITY", security)
+		if _, err := newMailerFromEnv(); err == nil {
+			t.Errorf("SMTP_SECURITY %q was accepted", security)
+		}
+	}
+	t.Setenv("SMTP_SECURITY", "starttls")
+	for _, auth := range []string{"login", "PLAIN", "xoauth2"} {
+		t.Setenv("SMTP_AUTH", auth)
+		if _, err := newMailerFromEnv(); err == nil {
+			t.Errorf("SMTP_AUTH %q was accepted", auth)
+		}
+	}
+	t.Setenv("SMTP_AUTH", "cram-md5")
+	if m, err := newMailerFromEnv(); err != nil {
+		t.Fatal(err)
+	} else if smtpMailer := m.(*SMTPMailer); smtpMailer.Security != "starttls" || smtpMailer.Auth != "cram-md5" {
+		t.Errorf("mailer = %+v", smtpMailer)
+	}
+
+	t.Setenv("MAIL_TRANSPORT", "memory")
+	if m, err := newMailerFromEnv(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := m.(*MemoryMailer); !ok {
+		t.Errorf("memory transport = %T", m)
+	}
+
+	t.Setenv("MAIL_TRANSPORT", "pigeon")
+	if _, err := newMailerFromEnv(); err == nil {
+		t.Error("unknown transport was accepted")
+	}
+}
+
+// fakeSMTPServer accepts one plain SMTP session and records its envelope and data
+func fakeSMTPServer(t *testing.T) (port int, envelope chan []string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	envelope = make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var seen []string
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				envelope <- seen
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT":
+				seen = append(seen, line)
+				reply("250 OK")
+			case "DATA":
+				reply("354 Go ahead")
+				for {
+					data, err := reader.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+					seen = append(seen, strings.TrimRight(data, "\r\n"))
+				}
+				reply("250 Queued")
+			case "QUIT":
+				reply("221 Bye")
+				envelope <- seen
+				return
+			default:
+				reply("502 Not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, envelope
+}
+
+func TestSMTPMailer(t *testing.T) {
+	port, envelope := fakeSMTPServer(t)
+	mailer := &SMTPMailer{Host: "127.0.0.1", Port: port, Security: "none", From: "EduWise <EduWise@iitk.ac.in>"}
+
+	err := mailer.Send(&Message{To: []string{"Asha <asha@iitk.ac.in>"}, Subject: "Hi", Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := <-envelope
+	if len(seen) < 2 || seen[0] != "MAIL FROM:<EduWise@iitk.ac.in>" || seen[1] != "RCPT TO:<asha@iitk.ac.in>" {
+		t.Fatalf("envelope = %q, want bare addresses", seen)
+	}
+	if !strings.Contains(strings.Join(seen, "\n"), "From: EduWise <EduWise@iitk.ac.in>") {
+		t.Errorf("message headers lost the display name: %q", seen)
+	}
+
+	// With credentials configured, a server that does not offer AUTH is refused
+	port, envelope = fakeSMTPServer(t)
+	mailer = &SMTPMailer{Host: "127.0.0.1", Port: port, Security: "none", Username: "eduwise", Password: "secret", From: defaultMailFrom}
+	err = mailer.Send(&Message{To: []string{"asha@iitk.ac.in"}, Subject: "Hi", Text: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "AUTH") {
+		t.Fatalf("err = %v, want the missing AUTH to fail delivery", err)
+	}
+	if seen := <-envelope; len(seen) != 0 {
+		t.Errorf("mail was sent unauthenticated: %q", seen)
+	}
+}
+
+func TestSMTPMailerRequiresStartTLS(t *testing.T) {
+	port, _ := fakeSMTPServer(t)
+	mailer := &SMTPMailer{Host: "127.0.0.1", Port: port, Security: "starttls", From: defaultMailFrom}
+
+	err := mailer.Send(&Message{To: []string{"asha@iitk.ac.in"}, Text: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("err = %v, want the missing STARTTLS to fail delivery", err)
+	}
+}
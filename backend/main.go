@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
-	"fmt"
+	"crypto/subtle"
+	"errors"
 	"log"
 	"math/rand"
 	"net/http"
-	"net/smtp"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -18,46 +17,117 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
+	mongoClient       *mongo.Client
 	registeredUsers   *mongo.Collection
 	courseCollection  *mongo.Collection
 	requestCollection *mongo.Collection
 	ctx               = context.TODO()
 	jwtKey            = []byte("3J&59#sM%5D+^!Y$BXu@2pPw@sn#ZjF")
-	adminSecurityCode string
+
+	errUsernameTaken = errors.New("username already exists")
 )
 
 // Claims structure for JWT token
 type Claims struct {
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	Scope    string `json:"scope,omitempty"`
+	MFA      bool   `json:"mfa,omitempty"`
+	Version  int    `json:"ver,omitempty"`
+
+	// Set on impersonation tokens to the admin acting as this user, and the
+	// admin's own token version so revoking their sessions revokes these too
+	ImpersonatedBy      string `json:"imp,omitempty"`
+	ImpersonatorVersion int    `json:"impver,omitempty"`
 	jwt.StandardClaims
 }
 
 type UserRegistration struct {
-	Username     string   `json:"username" binding:"required"`
-	Password     string   `json:"password" binding:"required"`
-	Role         string   `json:"role" binding:"required"`
-	IsVerified   bool     `json:"isVerified"`
-	OTP          string   `json:"otp"`
-	Courses      []string `json:"courses,omitempty"`
-	SecurityCode string   `json:"securityCode"`
-	Verified     []bool   `json:"verified,omitempty"`
+	Username    string   `json:"username" binding:"required"`
+	Password    string   `json:"password" binding:"required"`
+	Role        string   `json:"role" binding:"required"`
+	IsVerified  bool     `json:"isVerified"`
+	OTP         string   `json:"otp"`
+	Courses     []string `json:"courses,omitempty"`
+	InviteToken string   `json:"inviteToken,omitempty" bson:"-"`
+	Locale      string   `json:"locale,omitempty" bson:"locale,omitempty"`
+	Verified    []bool   `json:"verified,omitempty"`
+
+	// The term each course was taken in, alongside Courses
+	Enrollments []Enrollment `json:"enrollments,omitempty" bson:"enrollments,omitempty"`
+
+	// Two-factor authentication state, never serialised to clients
+	TOTPEnabled       bool     `json:"totpEnabled" bson:"totpEnabled"`
+	TOTPSecret        string   `json:"-" bson:"totpSecret,omitempty"`
+	TOTPPendingSecret string   `json:"-" bson:"totpPendingSecret,omitempty"`
+	TOTPLastStep      int64    `json:"-" bson:"totpLastStep,omitempty"`
+	RecoveryCodes     []string `json:"-" bson:"recoveryCodes,omitempty"`
+
+	// Failed second-step attempts since the last success, and the lockout
+	// that follows running out of them
+	TOTPFailures    int       `json:"-" bson:"totpFailures,omitempty"`
+	TOTPLockedUntil time.Time `json:"-" bson:"totpLockedUntil,omitempty"`
+
+	// Identity linked through OpenID Connect single sign-on
+	OIDCIssuer  string `json:"-" bson:"oidcIssuer,omitempty"`
+	OIDCSubject string `json:"-" bson:"oidcSubject,omitempty"`
+
+	Profile *UserProfile `json:"profile,omitempty" bson:"profile,omitempty"`
+
+	// Bumped to revoke every token issued before it
+	TokenVersion int `json:"-" bson:"tokenVersion,omitempty"`
+
+	// Email change awaiting confirmation from the new address
+	PendingEmail             string    `json:"-" bson:"pendingEmail,omitempty"`
+	PendingEmailOTP          string    `json:"-" bson:"pendingEmailOtp,omitempty"`
+	PendingEmailExpires      time.Time `json:"-" bson:"pendingEmailExpires,omitempty"`
+	PendingEmailAttemptsLeft int       `json:"-" bson:"pendingEmailAttemptsLeft,omitempty"`
+
+	// Disabled accounts cannot log in and their tokens are rejected
+	Disabled bool `json:"disabled,omitempty" bson:"disabled,omitempty"`
+
+	// Set by an admin to make a verified account confirm a new OTP before logging in again
+	ReverificationRequired bool `json:"-" bson:"reverificationRequired,omitempty"`
+
+	// Password reset awaiting the code sent by email
+	ResetToken        string    `json:"-" bson:"resetToken,omitempty"`
+	ResetExpires      time.Time `json:"-" bson:"resetExpires,omitempty"`
+	ResetAttemptsLeft int       `json:"-" bson:"resetAttemptsLeft,omitempty"`
+
+	// Guesses left at the verification OTP
+	OTPAttemptsLeft int `json:"-" bson:"otpAttemptsLeft,omitempty"`
 }
 
-type CourseUpdateRequest struct {
-	Username string `json:"username" binding:"required"`
-	Course   string `json:"course" binding:"required"`
-	Verified bool   `json:"verified"`
+// StudentView is what the students endpoints return, leaving out credentials
+// and other account secrets
+type StudentView struct {
+	Username    string       `json:"username" bson:"username"`
+	Role        string       `json:"role" bson:"role"`
+	IsVerified  bool         `json:"isVerified" bson:"isVerified"`
+	Courses     []string     `json:"courses,omitempty" bson:"courses,omitempty"`
+	Verified    []bool       `json:"verified,omitempty" bson:"verified,omitempty"`
+	Enrollments []Enrollment `json:"enrollments,omitempty" bson:"enrollments,omitempty"`
+	Locale      string       `json:"locale,omitempty" bson:"locale,omitempty"`
+	Profile     *UserProfile `json:"profile,omitempty" bson:"profile,omitempty"`
 }
 
-type Course struct {
-	Name string `json:"name" bson:"name"`
+type CourseUpdateRequest struct {
+	Username string           `json:"username" binding:"required"`
+	Course   string           `json:"course" binding:"required"`
+	Verified bool             `json:"verified"`
+	Term     string           `json:"term,omitempty" bson:"term,omitempty"`
+	Clashes  []TimetableClash `json:"clashes,omitempty" bson:"clashes,omitempty"`
+
+	// UnmetCorequisites lists the co-requisites still missing when the
+	// request was made, for the admin reviewing it
+	UnmetCorequisites []UnmetRequirement `json:"unmetCorequisites,omitempty" bson:"unmetCorequisites,omitempty"`
 }
 
 func main() {
@@ -66,7 +136,29 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
-	adminSecurityCode = os.Getenv("SECURITY_CODE")
+	requireAdmin2FA = os.Getenv("REQUIRE_ADMIN_2FA") == "true"
+	loadEmailDomainPolicy()
+	loadRetentionConfig()
+	loadUploadConfig()
+	loadWaitlistConfig()
+	loadTimetableConfig()
+
+	mailer, err = newMailerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	blobStore, err = newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv("DEV_MAIL_INBOX") == "true" {
+		log.Println("Development mail inbox enabled at /dev/mail; mail is not delivered, do not use this in production")
+		devInbox = NewDevInbox(os.Getenv("MAIL_FROM"))
+		mailer = devInbox
+	}
+	if err := loadEmailTemplates(); err != nil {
+		log.Fatal(err)
+	}
 
 	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGO_URI")))
 	if err != nil {
@@ -77,15 +169,50 @@ func main() {
 		log.Fatal(err)
 	}
 	defer client.Disconnect(ctx)
+	if err := checkTransactionSupport(client); err != nil {
+		log.Fatal(err)
+	}
+	mongoClient = client
 
 	courseDB := client.Database("ListofCourse")
 	courseCollection = courseDB.Collection("details")
+	termCollection = courseDB.Collection("terms")
+	offeringCollection = courseDB.Collection("offerings")
+	facultyCollection = courseDB.Collection("faculty")
+	courseRecordCollection = courseDB.Collection("course_records")
 
 	registerDB := client.Database("Userdata")
 	registeredUsers = registerDB.Collection("registered_users")
 
 	requestDB := client.Database("CourseUpdateRequest")
 	requestCollection = requestDB.Collection("course_requests")
+	waitlistCollection = requestDB.Collection("waitlist")
+
+	oidcStates = registerDB.Collection("oidc_states")
+	inviteCollection = registerDB.Collection("invitations")
+	inviteEventCollection = registerDB.Collection("invitation_events")
+	outboxCollection = registerDB.Collection("email_outbox")
+	auditCollection = registerDB.Collection("audit_log")
+	serviceAccountCollection = registerDB.Collection("service_accounts")
+	apiKeyCollection = registerDB.Collection("api_keys")
+
+	migrateUsernameCase()
+	ensureUserIndexes()
+	migrateCourses()
+	migrateSeatCounts()
+	ensureOIDCIndexes()
+	ensureProfileIndexes()
+	ensureAuditIndexes()
+	ensureAPIKeyIndexes()
+	ensureFacultyIndexes()
+	migrateCourseRecords()
+	ensureWaitlistIndexes()
+	ensureTermIndexes()
+	migrateOfferingSeats()
+
+	startOutboxWorker()
+	startUnverifiedAccountPurge()
+	startWaitlistWorker()
 
 	r := gin.Default()
 
@@ -93,23 +220,105 @@ func main() {
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"http://example.com", "http://localhost:3000"}
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE"}
-	config.AllowHeaders = append(config.AllowHeaders, "Authorization")
+	config.AllowHeaders = append(config.AllowHeaders, "Authorization", "X-API-Key", requestIDHeader)
+	config.ExposeHeaders = []string{requestIDHeader}
 
 	r.Use(cors.New(config))
+	r.Use(requestID())
 
 	r.POST("/api/login", login)
+	r.POST("/api/login/2fa", verifyTwoFactorLogin)
+	r.POST("/api/2fa/setup", setupTwoFactor)
+	r.POST("/api/2fa/confirm", confirmTwoFactor)
+	r.POST("/api/2fa/disable", disableTwoFactor)
+
+	// Single sign-on is only available when an issuer is configured
+	if settings := loadOIDCConfig(); settings != nil {
+		oidc = newOIDCProvider(*settings)
+		r.GET("/api/oidc/login", oidcLogin)
+		r.POST("/api/oidc/callback", oidcCallback)
+	}
 	r.POST("/api/register", register)
 	r.POST("/api/verify", verifyOTP)
+	r.GET("/api/me", getMe)
+	r.PUT("/api/me", updateMe)
+	r.POST("/api/me/password", changePassword)
+	r.POST("/api/me/email", requestEmailChange)
+	r.POST("/api/me/email/verify", confirmEmailChange)
+	r.POST("/api/password-reset/request", requestPasswordReset)
+	r.POST("/api/password-reset/confirm", confirmPasswordReset)
 	r.GET("/api/students", getStudentsList)
+	r.GET("/api/terms", listTerms)
+	r.POST("/api/terms", createTerm)
+	r.POST("/api/terms/:term/open", setTermStatus(termOpen))
+	r.POST("/api/terms/:term/close", setTermStatus(termClosed))
+	r.GET("/api/terms/:term/offerings", listOfferings)
+	r.POST("/api/terms/:term/offerings", createOffering)
+	r.PUT("/api/terms/:term/offerings/:course", updateOffering)
+	r.DELETE("/api/terms/:term/offerings/:course", deleteOffering)
 	r.GET("/api/courses", fetchCourses)
 	r.POST("/api/courses", uploadCourse)
-	r.DELETE("/api/courses/:name", deleteCourse)
+	r.GET("/api/courses/:id", getCourse)
+	r.PUT("/api/courses/:id", updateCourse)
+	r.DELETE("/api/courses/:id", deleteCourse)
+	r.POST("/api/courses/:id/instructors", addCourseInstructor)
+	r.DELETE("/api/courses/:id/instructors/:facultyId", removeCourseInstructor)
+	r.GET("/api/courses/:id/waitlist", getCourseWaitlist)
+	r.GET("/api/faculty", listFaculty)
+	r.POST("/api/faculty", createFaculty)
+	r.GET("/api/faculty/:id", getFaculty)
+	r.PUT("/api/faculty/:id", updateFaculty)
+	r.DELETE("/api/faculty/:id", deleteFaculty)
+	r.POST("/api/upload", uploadCourseRecord)
+	r.GET("/api/uploads", listCourseRecords)
+	r.GET("/api/uploads/:id", getCourseRecord)
+	r.GET("/api/uploads/:id/file", downloadCourseRecord)
+	r.GET("/api/uploads/:id/link", linkCourseRecord)
+	r.GET("/api/files/:key", serveSignedBlob)
+	r.GET("/api/records", listApprovedRecords)
+	r.GET("/api/admin/records", listRecordQueue)
+	r.POST("/api/admin/records/:id/review", reviewCourseRecord)
 	r.GET("/api/students/:username", getStudentDetails)
 	r.GET("/api/students/:username/courses", getStudentCourses)
+	r.GET("/api/students/:username/timetable", getStudentTimetable)
 	r.DELETE("/api/students/:username/courses/:course", deleteCourseForStudent)
 	r.POST("/api/add-course", addCourseToStudent)
 	r.POST("/api/update-course-verification", updateCourseVerificationStatus)
 	r.GET("/api/requests", getCourseRequests)
+	r.GET("/api/waitlist", getOwnWaitlist)
+	r.POST("/api/waitlist/:id/accept", acceptWaitlistOffer)
+	r.POST("/api/waitlist/:id/leave", leaveWaitlist)
+	r.POST("/api/invites", createInvite)
+	r.GET("/api/invites", listInvites)
+	r.GET("/api/invites/events", listInviteEvents)
+	r.DELETE("/api/invites/:id", revokeInvite)
+	r.GET("/api/admin/email-templates", listEmailTemplates)
+	r.GET("/api/admin/email-templates/:name/preview", previewEmailTemplate)
+	r.GET("/api/admin/outbox", listOutbox)
+	r.POST("/api/admin/outbox/:id/retry", retryOutboxMessage)
+	r.GET("/api/admin/metrics", adminMetrics)
+	r.GET("/api/admin/users", searchUsers)
+	r.PUT("/api/admin/users/:username/role", changeUserRole)
+	r.POST("/api/admin/users/:username/disable", setUserDisabled(true))
+	r.POST("/api/admin/users/:username/enable", setUserDisabled(false))
+	r.POST("/api/admin/users/:username/verification", setUserVerification)
+	r.POST("/api/admin/users/:username/password-reset", adminTriggerPasswordReset)
+	r.DELETE("/api/admin/users/:username", deleteUser)
+	r.GET("/api/admin/audit", listAuditLog)
+	r.GET("/api/admin/audit/verify", verifyAuditLog)
+	r.POST("/api/admin/users/:username/impersonate", startImpersonation)
+	r.POST("/api/admin/service-accounts", createServiceAccount)
+	r.GET("/api/admin/service-accounts", listServiceAccounts)
+	r.DELETE("/api/admin/service-accounts/:name", disableServiceAccount)
+	r.POST("/api/admin/service-accounts/:name/keys", createAPIKey)
+	r.GET("/api/admin/service-accounts/:name/keys", listAPIKeys)
+	r.DELETE("/api/admin/api-keys/:prefix", revokeAPIKey)
+
+	if devInbox != nil {
+		r.GET("/dev/mail", listDevMail)
+		r.GET("/dev/mail/:id", getDevMail)
+		r.DELETE("/dev/mail", clearDevMail)
+	}
 
 	if err := r.Run("0.0.0.0:8080"); err != nil {
 		log.Fatalf("Failed to run server: %v", err)
@@ -122,22 +331,51 @@ func register(c *gin.Context) {
 		return
 	}
 
-	// Check if the username already exists in the database
-	count, err := registeredUsers.CountDocuments(ctx, bson.M{"username": user.Username})
+	// Validate everything before touching the database or sending any email
+	if !validRole(user.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be admin or student", "field": "role"})
+		return
+	}
+	email, err := validateAccountEmail(user.Username, user.Role)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check username availability"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "field": "username"})
 		return
 	}
-	if count > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Username already exists"})
+	user.Username = email
+
+	// Check if the username already exists in the database; an abandoned
+	// unverified registration may be replaced with a fresh one
+	var existing *accountAge
+	var found accountAge
+	err = registeredUsers.FindOne(ctx, bson.M{"username": user.Username}).Decode(&found)
+	if err == nil {
+		if !found.canBeOverwritten(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Username already exists"})
+			return
+		}
+		existing = &found
+	} else if err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check username availability"})
 		return
 	}
 
-	// Check if the user is registering as an admin with the correct security code
-	if user.Role == "admin" && user.SecurityCode != adminSecurityCode {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect security code for admin registration"})
+	// Admin accounts can only be created by redeeming an invitation issued by another admin
+	if user.Role == "admin" && user.InviteToken == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "An invitation is required for admin registration"})
 		return
 	}
+	var invite *Invitation
+	if user.InviteToken != "" {
+		invite, err = redeemInvite(c, user.InviteToken, user.Username, user.Role)
+		if err == errInvalidInvite {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired invitation"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem invitation"})
+			return
+		}
+	}
 
 	// Generate a random 6-digit OTP
 	rand.Seed(time.Now().UnixNano())
@@ -146,27 +384,72 @@ func register(c *gin.Context) {
 	// Hash the password before storing it in the database
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
+		if invite != nil {
+			releaseInvite(c, invite)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
-	// Store user registration data in the database along with the OTP
-	_, err = registeredUsers.InsertOne(ctx, bson.M{
-		"username":   user.Username,
-		"password":   string(hashedPassword),
-		"role":       user.Role,
-		"isVerified": false,
-		"otp":        otp,
+	// Store user registration data in the database along with the OTP, queueing
+	// the verification email in the same transaction so delivery problems can
+	// never leave a stored user without a pending OTP message
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		doc := bson.M{
+			"username":        user.Username,
+			"password":        string(hashedPassword),
+			"role":            user.Role,
+			"isVerified":      false,
+			"otp":             otp,
+			"otpAttemptsLeft": verificationAttempts,
+			"locale":          resolveLocale(user.Locale),
+			"createdAt":       time.Now(),
+		}
+
+		if existing != nil {
+			// Only replace the account if it is still unverified
+			result, err := registeredUsers.ReplaceOne(sc, bson.M{"_id": existing.ID, "isVerified": false}, doc)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errUsernameTaken
+			}
+			if _, err := requestCollection.DeleteMany(sc, bson.M{"username": user.Username}); err != nil {
+				return err
+			}
+		} else if _, err := registeredUsers.InsertOne(sc, doc); err != nil {
+			return err
+		}
+
+		return queueVerificationOTP(sc, user.Username, otp, user.Locale)
 	})
+	if err == errUsernameTaken {
+		if invite != nil {
+			releaseInvite(c, invite)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username already exists"})
+		return
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		// Someone registered the same address since it was checked
+		if invite != nil {
+			releaseInvite(c, invite)
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+		return
+	}
 	if err != nil {
+		if invite != nil {
+			releaseInvite(c, invite)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
 		return
 	}
 
-	// Send OTP to the user's email address
-	if err := sendVerificationOTP(user.Username, otp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification OTP"})
-		return
+	if existing != nil {
+		unverifiedOverwritten.Add(1)
+		log.Printf("Replaced stale unverified registration for %s", user.Username)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully. Please verify your email to activate your account"})
@@ -183,6 +466,7 @@ func verifyOTP(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
 
 	// Query the database to find the user by username
 	var dbUser UserRegistration
@@ -192,61 +476,58 @@ func verifyOTP(c *gin.Context) {
 		return
 	}
 
-	// Check if the provided OTP matches the stored OTP
-	if req.OTP != dbUser.OTP {
+	if dbUser.OTP == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
 		return
 	}
 
-	// Update the user's verification status to true
-	_, err = registeredUsers.UpdateOne(ctx, bson.M{"username": req.Username}, bson.M{"$set": bson.M{"isVerified": true}})
+	// Each guess uses up an attempt before it is checked, so parallel guesses
+	// cannot get past the limit. OTPs issued before attempts were counted
+	// have no counter and get a single guess.
+	result, err := registeredUsers.UpdateOne(ctx,
+		bson.M{"username": dbUser.Username, "otp": dbUser.OTP, "otpAttemptsLeft": bson.M{"$not": bson.M{"$lte": 0}}},
+		bson.M{"$inc": bson.M{"otpAttemptsLeft": -1}})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify OTP"})
 		return
 	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.OTP), []byte(dbUser.OTP)) != 1 {
+		// The OTP is discarded with the last attempt
+		if dbUser.OTPAttemptsLeft <= 1 {
+			_, err := registeredUsers.UpdateOne(ctx,
+				bson.M{"username": dbUser.Username, "otp": dbUser.OTP},
+				bson.M{"$unset": bson.M{"otp": "", "otpAttemptsLeft": ""}})
+			if err != nil {
+				log.Printf("Failed to discard OTP for %s: %v", dbUser.Username, err)
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "OTP verified successfully"})
-}
-
-func sendVerificationOTP(email, otp string) error {
-	// SMTP configuration
-	smtpHost := "mmtp.iitk.ac.in"
-	smtpPort := 25
-	smtpUsername := os.Getenv("SMTP_USERNAME")
-	smtpPassword := os.Getenv("SMTP_PASSWORD")
-	// Sender and recipient email addresses
-	from := "EduWise@iitk.ac.in"
-	to := email
-
-	// Email content
-	subject := "Account Verification OTP"
-	body := fmt.Sprintf("Dear User your verification OTP is: %s", otp)
-
-	// Constructing email headers
-	headers := make(map[string]string)
-	headers["From"] = from
-	headers["To"] = to
-	headers["Subject"] = subject
-	headers["MIME-Version"] = "1.0"
-	headers["Content-Type"] = "text/plain; charset=\"utf-8\""
-	headers["Content-Transfer-Encoding"] = "base64"
-
-	var msg bytes.Buffer
-	for key, value := range headers {
-		msg.WriteString(key + ": " + value + "\r\n")
-	}
-	msg.WriteString("\r\n" + base64.StdEncoding.EncodeToString([]byte(body)))
-
-	// SMTP authentication
-	auth := smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
-
-	// Sending email using SMTP
-	err := smtp.SendMail(fmt.Sprintf("%s:%d", smtpHost, smtpPort), auth, from, []string{to}, msg.Bytes())
+	// Mark the user verified and use up the OTP, unless a concurrent request already has
+	result, err = registeredUsers.UpdateOne(ctx, bson.M{"username": dbUser.Username, "otp": dbUser.OTP}, bson.M{
+		"$set":   bson.M{"isVerified": true},
+		"$unset": bson.M{"otp": "", "otpAttemptsLeft": "", "reverificationRequired": ""},
+	})
 	if err != nil {
-		return err
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify OTP"})
+		return
 	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid OTP"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "OTP verified successfully"})
+}
 
-	return nil
+func queueVerificationOTP(sc mongo.SessionContext, email, otp, locale string) error {
+	return enqueueEmail(sc, email, "verification", locale, EmailData{"OTP": otp})
 }
 
 func login(c *gin.Context) {
@@ -259,6 +540,7 @@ func login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	user.Username = strings.ToLower(strings.TrimSpace(user.Username))
 
 	// Query the database to find the user by username
 	var dbUser UserRegistration
@@ -269,7 +551,7 @@ func login(c *gin.Context) {
 	}
 
 	// Check if the user is verified
-	if !dbUser.IsVerified {
+	if !dbUser.IsVerified || dbUser.ReverificationRequired {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Account not verified. Please check your email for verification instructions."})
 		return
 	}
@@ -280,8 +562,44 @@ func login(c *gin.Context) {
 		return
 	}
 
+	respondWithSession(c, &dbUser)
+}
+
+// Function to respond to a successful first-factor login with either a session
+// token or the next step the user has to complete
+func respondWithSession(c *gin.Context, dbUser *UserRegistration) {
+	if dbUser.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	// Ask for the second factor before issuing a full session token
+	if dbUser.TOTPEnabled {
+		pendingToken, err := generateScopedJWT(dbUser.Username, dbUser.Role, scopeTwoFactorPending, dbUser.TokenVersion, 5*time.Minute)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"twoFactorRequired": true, "pendingToken": pendingToken})
+		return
+	}
+
 	// Generate JWT token
-	tokenString, err := generateJWT(user.Username, dbUser.Role)
+	tokenString, err := generateJWT(dbUser.Username, dbUser.Role, dbUser.TokenVersion, false)
+	if err == errTwoFactorRequired {
+		// Admins without 2FA may only use this token to enrol an authenticator
+		enrolmentToken, err := generateScopedJWT(dbUser.Username, dbUser.Role, scopeTwoFactorEnrol, dbUser.TokenVersion, 15*time.Minute)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+			return
+		}
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":                  "Two-factor authentication must be enabled for admin accounts",
+			"twoFactorSetupRequired": true,
+			"enrolmentToken":         enrolmentToken,
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
 		return
@@ -291,13 +609,19 @@ func login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": tokenString})
 }
 
-// Function to generate JWT token
-func generateJWT(username, role string) (string, error) {
+// Function to generate JWT token, mfa records whether a second factor was presented
+func generateJWT(username, role string, version int, mfa bool) (string, error) {
+	if role == "admin" && requireAdmin2FA && !mfa {
+		return "", errTwoFactorRequired
+	}
+
 	expirationTime := time.Now().Add(7 * 24 * time.Hour) // Token valid for 7 days
 
 	claims := &Claims{
 		Username: username,
 		Role:     role,
+		MFA:      mfa,
+		Version:  version,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
 			IssuedAt:  time.Now().Unix(),
@@ -313,13 +637,17 @@ func generateJWT(username, role string) (string, error) {
 	return tokenString, nil
 }
 
-// Function to check user role based on JWT token
-func checkRole(c *gin.Context, expectedRole string) bool {
+// Function to parse the bearer token and check that its scope is one of the allowed scopes
+func parseToken(c *gin.Context, scopes ...string) (*Claims, bool) {
 	// Extract JWT token from the request header
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"})
-		return false
+		return nil, false
+	}
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid JWT token"})
+		return nil, false
 	}
 
 	tokenString := authHeader[len("Bearer "):]
@@ -330,12 +658,84 @@ func checkRole(c *gin.Context, expectedRole string) bool {
 	})
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid JWT token"})
-		return false
+		return nil, false
 	}
 
 	claims, ok := token.Claims.(*Claims)
 	if !ok || !token.Valid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid JWT claims"})
+		return nil, false
+	}
+
+	for _, scope := range scopes {
+		if claims.Scope == scope {
+			return claims, true
+		}
+	}
+
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Token is not valid for this request"})
+	return nil, false
+}
+
+// Function to authenticate a fully logged-in user
+func authenticate(c *gin.Context) (*Claims, bool) {
+	claims, ok := parseToken(c, "", scopeImpersonation)
+	if !ok {
+		return nil, false
+	}
+
+	// Admin tokens issued without a second factor are rejected once the policy is on
+	if requireAdmin2FA && claims.Role == "admin" && !claims.MFA {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for admin accounts"})
+		return nil, false
+	}
+
+	if !checkSession(c, claims) {
+		return nil, false
+	}
+
+	// Remembered so later steps such as auditing know who is acting
+	c.Set("claims", claims)
+
+	if claims.Scope == scopeImpersonation && !checkImpersonation(c, claims) {
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// checkSession rejects tokens issued to a disabled account or revoked by
+// bumping the account's token version
+func checkSession(c *gin.Context, claims *Claims) bool {
+	var session struct {
+		TokenVersion int  `bson:"tokenVersion"`
+		Disabled     bool `bson:"disabled"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"tokenVersion": 1, "disabled": 1})
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}, opts).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Account no longer exists"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate session"})
+		return false
+	}
+	if session.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return false
+	}
+	if session.TokenVersion != claims.Version {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked. Please log in again"})
+		return false
+	}
+	return true
+}
+
+// Function to check user role based on JWT token
+func checkRole(c *gin.Context, expectedRole string) bool {
+	claims, ok := authenticate(c)
+	if !ok {
 		return false
 	}
 
@@ -349,8 +749,8 @@ func checkRole(c *gin.Context, expectedRole string) bool {
 }
 
 func getStudentsList(c *gin.Context) {
-	// Check if the user is an admin
-	if !checkRole(c, "admin") {
+	// Check if the user is an admin or an integration with access
+	if !checkRoleOrScope(c, "admin", "students:read") {
 		return
 	}
 
@@ -362,7 +762,7 @@ func getStudentsList(c *gin.Context) {
 	}
 	defer cursor.Close(ctx)
 
-	var students []UserRegistration
+	students := []StudentView{}
 	if err := cursor.All(ctx, &students); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode students list"})
 		return
@@ -377,36 +777,128 @@ func uploadCourse(c *gin.Context) {
 		return
 	}
 
-	var course Course
-	if err := c.ShouldBindJSON(&course); err != nil {
+	var req CourseInput
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course", "fields": errs})
+		return
+	}
 
-	// Check if the course with the same name already exists in the database
-	count, err := courseCollection.CountDocuments(ctx, bson.M{"name": course.Name})
+	// A bare name is still accepted; the title defaults to it and a code is derived
+	course := Course{Prerequisites: []string{}, Instructors: []string{}, Offering: CourseOffering{Semesters: []string{}}, Slots: []CourseSlot{}}
+	req.apply(&course)
+	switch {
+	case req.Name != nil:
+		course.Name = *req.Name
+	case req.Title != nil:
+		course.Name = *req.Title
+	case req.Code != nil:
+		course.Name = *req.Code
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A course needs a name, title or code", "field": "name"})
+		return
+	}
+	if course.Title == "" {
+		course.Title = course.Name
+	}
+	if req.Code != nil {
+		course.Code = *req.Code
+	} else {
+		code, err := legacyCourseCode(course.Name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign a course code"})
+			return
+		}
+		course.Code = code
+	}
+
+	// Check if the course with the same name or code already exists in the database
+	count, err := courseCollection.CountDocuments(ctx, bson.M{"$or": []bson.M{{"name": course.Name}, {"code": course.Code}}})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check course existence"})
 		return
 	}
 	if count > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Course with the same name already exists"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Course with the same name or code already exists"})
+		return
+	}
+	field, problem, err := checkCourseIdentifiers(course.Name, course.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check course existence"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": field})
+		return
+	}
+
+	problem, err = checkPrerequisitesExist(course.Prerequisites, course.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check prerequisites"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": "prerequisites"})
+		return
+	}
+
+	problem, err = checkCorequisitesExist(course.Corequires, course.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check co-requisites"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": "corequires"})
 		return
 	}
 
-	_, err = courseCollection.InsertOne(ctx, course)
+	problem, err = checkInstructorsExist(course.Instructors)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check instructors"})
+		return
+	}
+	if problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem, "field": "instructors"})
+		return
+	}
+
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := courseCollection.InsertOne(sc, course)
+		if err != nil {
+			return err
+		}
+		course.ID = result.InsertedID.(primitive.ObjectID)
+		return recordAuditIn(sc, c, "course.create", "course:"+course.Code, nil, course)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store course data in database"})
 		return
 	}
+	course.fillSeats()
 
-	c.JSON(http.StatusOK, gin.H{"message": "Course data uploaded successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Course data uploaded successfully", "course": course})
 }
 
 func fetchCourses(c *gin.Context) {
 	var courses []Course // Assuming you have a struct definition for Course similar to Faculty
 
-	cursor, err := courseCollection.Find(ctx, bson.M{})
+	filter := bson.M{}
+	if department := c.Query("department"); department != "" {
+		filter["department"] = strings.ToUpper(department)
+	}
+	if term := c.Query("term"); term != "" {
+		names, err := offeredCourseNames(term)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch offerings"})
+			return
+		}
+		filter["name"] = bson.M{"$in": names}
+	}
+
+	cursor, err := courseCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"code": 1}))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course data from database"})
 		return
@@ -419,6 +911,7 @@ func fetchCourses(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode course data"})
 			return
 		}
+		course.fillSeats()
 		courses = append(courses, course)
 	}
 
@@ -436,21 +929,54 @@ func deleteCourse(c *gin.Context) {
 		return
 	}
 
-	// Extract course name from the request parameters
-	courseName := c.Param("name")
+	// The course may be given by ID, code or, as before, by name
+	courseName := c.Param("id")
+	course, err := findCourse(courseName)
 
-	// Delete the course from the database
-	result, err := courseCollection.DeleteOne(ctx, bson.M{"name": courseName})
+	// Check if the course was found
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		log.Printf("Course '%s' not found in the database", courseName)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course"})
-		log.Printf("Failed to delete course '%s' from the database: %v", courseName, err)
+		log.Printf("Failed to find course '%s' in the database: %v", courseName, err)
 		return
 	}
 
-	// Check if the course was found and deleted
-	if result.DeletedCount == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
-		log.Printf("Course '%s' not found in the database", courseName)
+	// Delete the course together with its term offerings and close its
+	// waitlist. Pending requests have to be decided first.
+	var pending int64
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		var err error
+		pending, err = requestCollection.CountDocuments(sc, bson.M{"course": course.Name})
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return errCourseInUse
+		}
+		if _, err := courseCollection.DeleteOne(sc, bson.M{"_id": course.ID}); err != nil {
+			return err
+		}
+		if _, err := offeringCollection.DeleteMany(sc, bson.M{"courseName": course.Name}); err != nil {
+			return err
+		}
+		_, err = waitlistCollection.UpdateMany(sc, bson.M{"course": course.Name, "active": true},
+			bson.M{"$set": bson.M{"status": waitlistRemoved, "active": false, "closedAt": time.Now()}})
+		if err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "course.delete", "course:"+course.Code, course, nil)
+	})
+	if err == errCourseInUse {
+		c.JSON(http.StatusConflict, gin.H{"error": "The course has pending requests", "requests": pending})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course"})
+		log.Printf("Failed to delete course '%s' from the database: %v", courseName, err)
 		return
 	}
 
@@ -459,8 +985,8 @@ func deleteCourse(c *gin.Context) {
 }
 
 func getStudentDetails(c *gin.Context) {
-	// Check if the user is an admin
-	if !checkRole(c, "admin") {
+	// Check if the user is an admin or an integration with access
+	if !checkRoleOrScope(c, "admin", "students:read") {
 		return
 	}
 
@@ -468,7 +994,7 @@ func getStudentDetails(c *gin.Context) {
 	username := c.Param("username")
 
 	// Query the database to retrieve details of the student by username
-	var student UserRegistration
+	var student StudentView
 	err := registeredUsers.FindOne(ctx, bson.M{"username": username}).Decode(&student)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch student details"})
@@ -479,12 +1005,23 @@ func getStudentDetails(c *gin.Context) {
 }
 
 func addCourseToStudent(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
 	var req CourseUpdateRequest
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// Students may only change their own enrollments
+	if claims.Role != "admin" && claims.Username != req.Username {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access to another student's data"})
+		return
+	}
+
 	// Check if the provided student username exists
 	var student UserRegistration
 	err := registeredUsers.FindOne(ctx, bson.M{"username": req.Username}).Decode(&student)
@@ -493,18 +1030,76 @@ func addCourseToStudent(c *gin.Context) {
 		return
 	}
 
-	// Create a new request record for the course
-	_, err = requestCollection.InsertOne(ctx, bson.M{
+	// The course must be in the catalog; requests and enrollments refer to it by name
+	course, err := findCourse(req.Course)
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found", "field": "course"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return
+	}
+	req.Course = course.Name
+	term, ok := requestTerm(c, req.Term, course)
+	if !ok {
+		return
+	}
+
+	// A course may be taken again in another term, but only once per term
+	for _, enrolled := range student.coursesIn(term) {
+		if enrolled == course.Name {
+			c.JSON(http.StatusConflict, gin.H{"error": "Student is already enrolled in the course", "reason": "already_enrolled"})
+			return
+		}
+	}
+	pending, err := requestCollection.CountDocuments(ctx, requestFilter(req.Username, req.Course, term))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check existing requests"})
+		return
+	}
+	if pending > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request for this course is already pending", "reason": "already_requested"})
+		return
+	}
+
+	corequisites, ok := studentMeetsRequirements(c, &student, course, term, true)
+	if !ok {
+		return
+	}
+	clashes, ok := checkClashes(c, &student, course, term, true)
+	if !ok {
+		return
+	}
+
+	// Create a new request record for the course; clashes allowed by the soft
+	// policy are kept on it for the admin reviewing it
+	request := bson.M{
 		"username": req.Username,
 		"course":   req.Course,
 		"verified": false, // Set verified status to false initially
+	}
+	if term != "" {
+		request["term"] = term
+	}
+	if len(clashes) > 0 {
+		request["clashes"] = clashes
+	}
+	if len(corequisites) > 0 {
+		request["unmetCorequisites"] = corequisites
+	}
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		if _, err := requestCollection.InsertOne(sc, request); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "request.create", "user:"+req.Username, nil, CourseUpdateRequest{Username: req.Username, Course: req.Course, Term: term, Clashes: clashes, UnmetCorequisites: corequisites})
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create course request"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Course request submitted for verification"})
+	c.JSON(http.StatusOK, gin.H{"message": "Course request submitted for verification", "term": term, "clashes": clashes, "unmetCorequisites": corequisites})
 }
 
 // Route for admin to update course verification status
@@ -520,42 +1115,103 @@ func updateCourseVerificationStatus(c *gin.Context) {
 		return
 	}
 
-	// Check if the provided request exists
-	var request CourseUpdateRequest
-	err := requestCollection.FindOne(ctx, bson.M{"username": req.Username, "course": req.Course}).Decode(&request)
+	// Check if the provided request exists. Without a term, the student's
+	// request for the course must be the only one.
+	filter := bson.M{"username": req.Username, "course": req.Course}
+	if req.Term != "" {
+		filter["term"] = normaliseTermCode(req.Term)
+	}
+	var requests []CourseUpdateRequest
+	cursor, err := requestCollection.Find(ctx, filter)
+	if err == nil {
+		err = cursor.All(ctx, &requests)
+	}
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course request"})
+		return
+	}
+	if len(requests) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
 		return
 	}
-
-	// Update the verification status of the request
-	update := bson.M{"$set": bson.M{"verified": req.Verified}}
-	_, err = requestCollection.UpdateOne(ctx, bson.M{"username": req.Username, "course": req.Course}, update)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update course verification status"})
+	if len(requests) > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The student has requests for this course in several terms, say which one", "field": "term"})
 		return
 	}
+	request := requests[0]
 
 	if req.Verified {
-		// Add the course to the student's courses
-		studentUpdate := bson.M{"$push": bson.M{"courses": req.Course, "verified": req.Verified}}
-		_, err := registeredUsers.UpdateOne(ctx, bson.M{"username": req.Username}, studentUpdate)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update student courses"})
+		if !checkTermOpen(c, request.Term) {
 			return
 		}
 
-		// Delete the request from the request collection
-		_, err = requestCollection.DeleteOne(ctx, bson.M{"username": req.Username, "course": req.Course})
+		// Requirements are checked again, since enrollments may have changed
+		// since the request was made. Courses no longer in the catalog are not checked.
+		var clashes []TimetableClash
+		course, err := findCourse(req.Course)
+		if err != nil && err != errCourseNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+			return
+		}
+		if course != nil {
+			var student UserRegistration
+			if err := registeredUsers.FindOne(ctx, bson.M{"username": req.Username}).Decode(&student); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+				return
+			}
+			if _, ok := studentMeetsRequirements(c, &student, course, request.Term, false); !ok {
+				return
+			}
+			found, ok := checkClashes(c, &student, course, request.Term, false)
+			if !ok {
+				return
+			}
+			clashes = found
+		}
+
+		// Enrol the student, take a seat, close the request and queue the
+		// notification together, so concurrent approvals cannot oversubscribe
+		err = withTransaction(func(sc mongo.SessionContext) error {
+			// Add the course to the student's courses
+			if err := enrollStudent(sc, req.Username, req.Course, request.Term); err != nil {
+				return err
+			}
+
+			// Delete the request from the request collection
+			if _, err := requestCollection.DeleteOne(sc, requestFilter(req.Username, req.Course, request.Term)); err != nil {
+				return err
+			}
+
+			if err := queueCourseDecision(sc, req.Username, req.Course, "request_approved"); err != nil {
+				return err
+			}
+			return recordAuditIn(sc, c, "request.approve", "user:"+req.Username, request, gin.H{"enrolled": req.Course, "clashes": clashes})
+		})
+		if err == errCourseFull {
+			addRequestToWaitlist(c, &request)
+			return
+		}
+		if err == errAlreadyEnrolled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Student is already enrolled in the course", "reason": "already_enrolled"})
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course request"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update student courses"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Course verification status updated successfully and added to student's courses"})
+		c.JSON(http.StatusOK, gin.H{"message": "Course verification status updated successfully and added to student's courses", "clashes": clashes})
 	} else {
 		// If the request is denied, simply delete the request
-		_, err = requestCollection.DeleteOne(ctx, bson.M{"username": req.Username, "course": req.Course})
+		err = withTransaction(func(sc mongo.SessionContext) error {
+			if _, err := requestCollection.DeleteOne(sc, requestFilter(req.Username, req.Course, request.Term)); err != nil {
+				return err
+			}
+			if err := queueCourseDecision(sc, req.Username, req.Course, "request_rejected"); err != nil {
+				return err
+			}
+			return recordAuditIn(sc, c, "request.reject", "user:"+req.Username, request, nil)
+		})
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course request"})
 			return
@@ -565,13 +1221,33 @@ func updateCourseVerificationStatus(c *gin.Context) {
 	}
 }
 
+// Function to queue an email telling a student about the decision on their course request
+func queueCourseDecision(sc mongo.SessionContext, username, course, templateName string) error {
+	var student UserRegistration
+	if err := registeredUsers.FindOne(sc, bson.M{"username": username}).Decode(&student); err != nil {
+		return err
+	}
+	return enqueueEmail(sc, username, templateName, student.Locale, EmailData{"Course": course})
+}
+
 func deleteCourseForStudent(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
 	var req CourseUpdateRequest
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// Students may only change their own enrollments
+	if claims.Role != "admin" && claims.Username != req.Username {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access to another student's data"})
+		return
+	}
+
 	// Check if the provided student username exists
 	var student UserRegistration
 	err := registeredUsers.FindOne(ctx, bson.M{"username": req.Username}).Decode(&student)
@@ -580,67 +1256,94 @@ func deleteCourseForStudent(c *gin.Context) {
 		return
 	}
 
-	// Find the index of the course to delete
-	index := -1
-	for i, course := range student.Courses {
-		if course == req.Course {
-			index = i
-			break
+	// The enrollments to remove: the one in the given term, or else the course
+	// in every term the student took it. A course from before terms existed
+	// is only on the plain list of courses.
+	term := normaliseTermCode(req.Term)
+	var recorded []Enrollment
+	taken := false
+	for _, enrollment := range student.Enrollments {
+		if enrollment.Course != req.Course {
+			continue
 		}
+		taken = true
+		if term == "" || enrollment.Term == term {
+			recorded = append(recorded, enrollment)
+		}
+	}
+	legacy := false
+	if !taken && term == "" {
+		for _, course := range student.Courses {
+			if course == req.Course {
+				legacy = true
+			}
+		}
+	}
+	if len(recorded) == 0 && !legacy {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Student is not enrolled in the requested course"})
+		return
 	}
 
-	// If course found, delete it
-	if index != -1 {
-		student.Courses = append(student.Courses[:index], student.Courses[index+1:]...)
-		student.Verified = append(student.Verified[:index], student.Verified[index+1:]...)
+	// Remove only what is still there when the transaction runs, and give
+	// back a seat for each enrollment this request actually removed, so
+	// concurrent drops and approvals cannot free the same seat twice
+	var removed []Enrollment
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		removed = nil
+		for _, enrollment := range recorded {
+			pulled, err := pullEnrollment(sc, req.Username, enrollment)
+			if err != nil {
+				return err
+			}
+			if !pulled {
+				continue
+			}
+			removed = append(removed, enrollment)
+			if err := releaseSeat(sc, enrollment.Course, enrollment.Term); err != nil {
+				return err
+			}
+		}
 
-		// Update the student's document in the database
-		update := bson.M{"$set": bson.M{"courses": student.Courses, "verified": student.Verified}}
-		_, err = registeredUsers.UpdateOne(ctx, bson.M{"username": req.Username}, update)
+		// The plain list keeps the course while it is still taken in another term
+		dropped, err := dropCourse(sc, req.Username, req.Course)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course for student"})
-			return
+			return err
+		}
+		if dropped && legacy {
+			removed = append(removed, Enrollment{Course: req.Course})
+			if err := releaseSeat(sc, req.Course, ""); err != nil {
+				return err
+			}
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Course deleted for student successfully"})
-	} else {
+		if len(removed) == 0 {
+			return errNotEnrolled
+		}
+		return recordAuditIn(sc, c, "enrollment.delete", "user:"+req.Username, gin.H{"course": req.Course, "enrollments": removed}, nil)
+	})
+	if err == errNotEnrolled {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Student is not enrolled in the requested course"})
-	}
-}
-
-func getStudentCourses(c *gin.Context) {
-	// Extract JWT token from the request header
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"})
 		return
 	}
-	tokenString := authHeader[len("Bearer "):]
-
-	// Parse and validate JWT token
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid JWT token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete course for student"})
 		return
 	}
 
-	// Check if the token is valid and claims are present
-	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid JWT claims"})
+	c.JSON(http.StatusOK, gin.H{"message": "Course deleted for student successfully"})
+}
+
+func getStudentCourses(c *gin.Context) {
+	claims, ok := authenticateOrAPIKey(c, "enrollments:read")
+	if !ok {
 		return
 	}
 
-	// Log the extracted username and role
-	fmt.Printf("Username: %s, Role: %s\n", claims.Username, claims.Role)
-
 	// Get the requested username from the request parameters
 	requestedUsername := c.Param("username")
 
 	// Check if the user is authorized as an admin or if they are the correct user
-	if claims.Role != "admin" && claims.Role != "student" && claims.Username != requestedUsername {
+	if claims.Role != "admin" && claims.Role != roleService && claims.Role != "student" && claims.Username != requestedUsername {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
 		return
 	}
@@ -652,23 +1355,39 @@ func getStudentCourses(c *gin.Context) {
 
 	// Query the database to retrieve details of the student by username
 	var student UserRegistration
-	err = registeredUsers.FindOne(ctx, bson.M{"username": requestedUsername}).Decode(&student)
+	err := registeredUsers.FindOne(ctx, bson.M{"username": requestedUsername}).Decode(&student)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch student details"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"courses": student.Courses})
+	// With a term, only the courses taken in that term are listed
+	if term := c.Query("term"); term != "" {
+		courses := []string{}
+		for _, enrollment := range student.Enrollments {
+			if enrollment.Term == normaliseTermCode(term) {
+				courses = append(courses, enrollment.Course)
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"courses": courses, "term": normaliseTermCode(term)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"courses": student.Courses, "enrollments": student.Enrollments})
 }
 
 func getCourseRequests(c *gin.Context) {
-	// Check if the user is an admin
-	if !checkRole(c, "admin") {
+	// Check if the user is an admin or an integration with access
+	if !checkRoleOrScope(c, "admin", "requests:read") {
 		return
 	}
 
-	// Query the database to retrieve course requests
-	cursor, err := requestCollection.Find(ctx, bson.M{})
+	// Query the database to retrieve course requests, optionally for one term
+	filter := bson.M{}
+	if term := c.Query("term"); term != "" {
+		filter["term"] = normaliseTermCode(term)
+	}
+	cursor, err := requestCollection.Find(ctx, filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course requests"})
 		return
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// useMockCollections points every collection at the mock deployment of mt for
+// the rest of the test
+func useMockCollections(mt *mtest.T) {
+	collections := map[string]**mongo.Collection{
+		"registered_users":  &registeredUsers,
+		"details":           &courseCollection,
+		"course_requests":   &requestCollection,
+		"oidc_states":       &oidcStates,
+		"invitations":       &inviteCollection,
+		"invitation_events": &inviteEventCollection,
+		"email_outbox":      &outboxCollection,
+		"audit_log":         &auditCollection,
+		"service_accounts":  &serviceAccountCollection,
+		"api_keys":          &apiKeyCollection,
+		"faculty":           &facultyCollection,
+		"course_records":    &courseRecordCollection,
+		"waitlist":          &waitlistCollection,
+		"terms":             &termCollection,
+		"offerings":         &offeringCollection,
+	}
+	for name, collection := range collections {
+		previous := *collection
+		*collection = mt.DB.Collection(name)
+		collection := collection
+		mt.Cleanup(func() { *collection = previous })
+	}
+
+	// Transactions run against the mock deployment too, each one ending in a
+	// commitTransaction that needs its own mock response
+	previous := mongoClient
+	mongoClient = mt.Client
+	mt.Cleanup(func() { mongoClient = previous })
+}
+
+// inSession runs fn with a session on the mock deployment of mt, for helpers
+// that take a mongo.SessionContext
+func inSession(mt *mtest.T, fn func(sc mongo.SessionContext) error) error {
+	mt.Helper()
+	session, err := mt.Client.StartSession()
+	if err != nil {
+		mt.Fatal(err)
+	}
+	defer session.EndSession(ctx)
+	return mongo.WithSession(ctx, session, fn)
+}
+
+// matchedDocuments is the mock response to an update matching n documents
+func matchedDocuments(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+// countedDocuments is the mock response to a CountDocuments returning n
+func countedDocuments(ns string, n int) bson.D {
+	return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+}
+
+// sentUpdates returns the first statement of every update sent to the mock
+// deployment, together with the collection it went to
+func sentUpdates(mt *mtest.T) (collections []string, updates []bson.Raw) {
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == "update" {
+			collections = append(collections, event.Command.Lookup("update").StringValue())
+			updates = append(updates, event.Command.Lookup("updates").Array().Index(0).Value().Document())
+		}
+	}
+	return collections, updates
+}
+
+// sentCommand returns the last command with the given name sent to the mock deployment
+func sentCommand(mt *mtest.T, name string) bson.Raw {
+	mt.Helper()
+	var command bson.Raw
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == name {
+			command = event.Command
+		}
+	}
+	if command == nil {
+		mt.Fatalf("no %s command was sent", name)
+	}
+	return command
+}
+
+// noDocuments is the mock response to a find that matches nothing
+func noDocuments(ns string) bson.D {
+	return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch)
+}
+
+// serveJSON runs a handler on a request with a JSON body and records the response
+func serveJSON(handler gin.HandlerFunc, method, target string, body interface{}) *httptest.ResponseRecorder {
+	return serveRoute(handler, method, target, target, body, "", "")
+}
+
+// serveJSONAs is serveJSON with a session token for the user
+func serveJSONAs(handler gin.HandlerFunc, username, role, method, target string, body interface{}) *httptest.ResponseRecorder {
+	return serveRoute(handler, method, target, target, body, username, role)
+}
+
+// serveRoute mounts a handler on a route pattern such as /api/courses/:id and
+// serves a request for target, with a session token when username is set
+func serveRoute(handler gin.HandlerFunc, method, route, target string, body interface{}, username, role string) *httptest.ResponseRecorder {
+	var payload io.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		payload = bytes.NewReader(encoded)
+	}
+	request := httptest.NewRequest(method, target, payload)
+	request.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		token, _ := generateJWT(username, role, 0, true)
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	router := gin.New()
+	router.Handle(method, route, handler)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// activeSession is the mock response to authenticate's session lookup
+func activeSession() bson.D {
+	return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{{Key: "tokenVersion", Value: 0}})
+}
+
+// responseBody decodes a recorded JSON response
+func responseBody(t testing.TB, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, recorder.Body.String())
+	}
+	return body
+}
+
+func expectStatus(t testing.TB, recorder *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if recorder.Code != status {
+		t.Fatalf("status = %d, want %d: %s", recorder.Code, status, recorder.Body.String())
+	}
+}
+
+func TestLoginRequiresReverification(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("reset by admin", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "password", Value: string(hashed)},
+			{Key: "role", Value: "student"},
+			{Key: "isVerified", Value: true},
+			{Key: "reverificationRequired", Value: true},
+		}))
+		body := map[string]string{"username": "asha@iitk.ac.in", "password": "correct horse"}
+		recorder := serveJSON(login, http.MethodPost, "/api/login", body)
+		expectStatus(mt, recorder, http.StatusUnauthorized)
+	})
+}
+
+func TestVerifyOTPAttempts(t *testing.T) {
+	pendingUser := func(attemptsLeft int) bson.D {
+		return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "role", Value: "student"},
+			{Key: "isVerified", Value: true},
+			{Key: "reverificationRequired", Value: true},
+			{Key: "otp", Value: "123456"},
+			{Key: "otpAttemptsLeft", Value: attemptsLeft},
+		})
+	}
+	verify := func(otp string) *httptest.ResponseRecorder {
+		return serveJSON(verifyOTP, http.MethodPost, "/api/verify", map[string]string{"username": "asha@iitk.ac.in", "otp": otp})
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("attempt is used before checking", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(pendingUser(3), matchedDocuments(1))
+		expectStatus(mt, verify("654321"), http.StatusUnauthorized)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 || updates[0].Lookup("u", "$inc", "otpAttemptsLeft").Int32() != -1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if updates[0].Lookup("q", "otp").StringValue() != "123456" {
+			mt.Errorf("attempt is not tied to the OTP it checks: %v", updates[0])
+		}
+	})
+
+	mt.Run("no attempts left", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(pendingUser(1), matchedDocuments(0))
+		expectStatus(mt, verify("123456"), http.StatusUnauthorized)
+		if _, updates := sentUpdates(mt); len(updates) != 1 {
+			mt.Errorf("account verified without an attempt left: %v", updates)
+		}
+	})
+
+	mt.Run("last wrong guess discards the OTP", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(pendingUser(1), matchedDocuments(1), matchedDocuments(1))
+		expectStatus(mt, verify("654321"), http.StatusUnauthorized)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 2 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if _, err := updates[1].LookupErr("u", "$unset", "otp"); err != nil {
+			mt.Errorf("OTP was kept after the last attempt: %v", updates[1])
+		}
+	})
+
+	mt.Run("correct OTP is used up", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(pendingUser(3), matchedDocuments(1), matchedDocuments(1))
+		expectStatus(mt, verify("123456"), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 2 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if updates[1].Lookup("q", "otp").StringValue() != "123456" {
+			mt.Errorf("verification does not check the OTP is still unused: %v", updates[1])
+		}
+		for _, field := range []string{"otp", "reverificationRequired"} {
+			if _, err := updates[1].LookupErr("u", "$unset", field); err != nil {
+				mt.Errorf("%s kept after verification: %v", field, updates[1])
+			}
+		}
+	})
+}
+
+func TestEnrollmentChangesRequireTheStudentOrAdmin(t *testing.T) {
+	body := map[string]string{"username": "asha@iitk.ac.in", "course": "Mechanics"}
+	handlers := map[string]struct {
+		handler gin.HandlerFunc
+		method  string
+	}{
+		"add":    {addCourseToStudent, http.MethodPost},
+		"delete": {deleteCourseForStudent, http.MethodDelete},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	for name, route := range handlers {
+		route := route
+		mt.Run(name+" anonymously", func(mt *mtest.T) {
+			useMockCollections(mt)
+			recorder := serveJSON(route.handler, route.method, "/api/enrollment", body)
+			expectStatus(mt, recorder, http.StatusUnauthorized)
+		})
+
+		mt.Run(name+" for another student", func(mt *mtest.T) {
+			useMockCollections(mt)
+			mt.AddMockResponses(activeSession())
+			recorder := serveJSONAs(route.handler, "ravi@iitk.ac.in", "student", route.method, "/api/enrollment", body)
+			expectStatus(mt, recorder, http.StatusForbidden)
+			if len(mt.GetAllStartedEvents()) != 1 {
+				mt.Errorf("handler went on after refusing the request")
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Moderation states of a course record; only approved records are shown to other students
+const (
+	recordPending  = "pending"
+	recordApproved = "approved"
+	recordRejected = "rejected"
+)
+
+var errRecordReviewed = errors.New("course record was reviewed concurrently")
+
+// ReviewInput is the body of a moderation decision
+type ReviewInput struct {
+	Decision string `json:"decision"`
+	Comment  string `json:"comment"`
+}
+
+// migrateCourseRecords queues records submitted before moderation existed for
+// review and indexes the moderation queue
+func migrateCourseRecords() {
+	result, err := courseRecordCollection.UpdateMany(ctx,
+		bson.M{"status": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"status": recordPending}})
+	if err != nil {
+		log.Printf("Failed to migrate course records: %v", err)
+	} else if result.ModifiedCount > 0 {
+		log.Printf("Queued %d existing course records for review", result.ModifiedCount)
+	}
+
+	if _, err := courseRecordCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}},
+	}); err != nil {
+		log.Printf("Failed to create course record status index: %v", err)
+	}
+}
+
+// hideReview strips the moderation details other students should not see
+func (r *CourseRecord) hideReview() {
+	r.ReviewedBy, r.ReviewedAt, r.ReviewComment = "", nil, ""
+}
+
+// Route for admins to page through the moderation queue, oldest first. Pending
+// records are shown unless another status is asked for.
+func listRecordQueue(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	status := c.DefaultQuery("status", recordPending)
+	if status != recordPending && status != recordApproved && status != recordRejected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be pending, approved or rejected"})
+		return
+	}
+	filter := bson.M{"status": status}
+	if username := c.Query("username"); username != "" {
+		filter["username"] = username
+	}
+	if course := c.Query("course"); course != "" {
+		filter["courseCode"] = normaliseCourseCode(course)
+	}
+	if recordType := c.Query("type"); recordType != "" {
+		filter["type"] = recordType
+	}
+	if reviewer := c.Query("reviewedBy"); reviewer != "" {
+		filter["reviewedBy"] = reviewer
+	}
+
+	created := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " time, use RFC 3339"})
+			return
+		}
+		created[op] = t
+	}
+	if len(created) > 0 {
+		filter["createdAt"] = created
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+
+	total, err := courseRecordCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch review queue"})
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	cursor, err := courseRecordCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch review queue"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	records := []CourseRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode course records"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"records": records, "total": total, "page": page, "limit": limit})
+}
+
+// Route for admins to approve or reject a course record. A decision can be
+// changed later, and the submitter is emailed each time.
+func reviewCourseRecord(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid record ID"})
+		return
+	}
+
+	var input ReviewInput
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Comment = strings.TrimSpace(input.Comment)
+
+	var status, templateName string
+	switch input.Decision {
+	case "approve":
+		status, templateName = recordApproved, "record_approved"
+	case "reject":
+		status, templateName = recordRejected, "record_rejected"
+		if input.Comment == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A comment is required when rejecting a record", "field": "comment"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Decision must be approve or reject", "field": "decision"})
+		return
+	}
+	if len(input.Comment) > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Comment must be at most 1000 characters", "field": "comment"})
+		return
+	}
+
+	var before CourseRecord
+	if err := courseRecordCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&before); err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course record not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course record"})
+		return
+	}
+	if before.Status == status {
+		c.JSON(http.StatusConflict, gin.H{"error": "Course record is already " + status})
+		return
+	}
+
+	now := time.Now()
+	after := before
+	after.Status, after.ReviewedBy, after.ReviewedAt, after.ReviewComment = status, claims.Username, &now, input.Comment
+
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		// Match the old status so two admins deciding at once cannot both win
+		result, err := courseRecordCollection.UpdateOne(sc,
+			bson.M{"_id": id, "status": before.Status},
+			bson.M{"$set": bson.M{
+				"status":        status,
+				"reviewedBy":    claims.Username,
+				"reviewedAt":    now,
+				"reviewComment": input.Comment,
+			}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errRecordReviewed
+		}
+		if err := queueRecordDecision(sc, &after, templateName); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "record."+input.Decision, "record:"+id.Hex(), before, after)
+	})
+	if err == errRecordReviewed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Course record was reviewed by someone else, reload and try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to review course record"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Course record " + status, "record": after})
+}
+
+// queueRecordDecision emails the submitter of a record about its review; records
+// whose submitter has since been deleted are skipped
+func queueRecordDecision(sc mongo.SessionContext, record *CourseRecord, templateName string) error {
+	var submitter UserRegistration
+	err := registeredUsers.FindOne(sc, bson.M{"username": record.Username}).Decode(&submitter)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	course := record.CourseCode
+	if record.CourseName != "" && record.CourseName != record.CourseCode {
+		course += " " + record.CourseName
+	}
+	return enqueueEmail(sc, record.Username, templateName, submitter.Locale, EmailData{
+		"Course":  course,
+		"Type":    record.Type,
+		"Comment": record.ReviewComment,
+	})
+}
+
+// Route listing approved course records for any logged-in user, filtered by
+// course, type, batch and instructor
+func listApprovedRecords(c *gin.Context) {
+	if _, ok := authenticate(c); !ok {
+		return
+	}
+
+	filter := bson.M{"status": recordApproved}
+	if course := c.Query("course"); course != "" {
+		filter["courseCode"] = normaliseCourseCode(course)
+	}
+	if recordType := c.Query("type"); recordType != "" {
+		filter["type"] = recordType
+	}
+	if batch := c.Query("batch"); batch != "" {
+		year, err := strconv.Atoi(batch)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Batch must be a year"})
+			return
+		}
+		filter["batch"] = year
+	}
+	if instructor := c.Query("instructor"); instructor != "" {
+		filter["instructorId"] = instructor
+	}
+
+	cursor, err := courseRecordCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course records"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	records := []CourseRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode course records"})
+		return
+	}
+	for i := range records {
+		records[i].hideReview()
+	}
+
+	c.JSON(http.StatusOK, records)
+}
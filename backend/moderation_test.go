@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestReviewCourseRecord(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	record := func(status string) bson.D {
+		return mtest.CreateCursorResponse(0, "db.course_records", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: id},
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "courseCode", Value: "PHY103"},
+			{Key: "courseName", Value: "Mechanics"},
+			{Key: "type", Value: "notes"},
+			{Key: "status", Value: status},
+			{Key: "createdAt", Value: time.Now()},
+		})
+	}
+	submitter := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{{Key: "username", Value: "asha@iitk.ac.in"}})
+	review := func(decision, comment string) int {
+		return serveRoute(reviewCourseRecord, http.MethodPost, "/api/admin/records/:id/review", "/api/admin/records/"+id.Hex()+"/review",
+			map[string]string{"decision": decision, "comment": comment}, "admin@iitk.ac.in", "admin").Code
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("approve pending record", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			record(recordPending),
+			matchedDocuments(1),
+			submitter,
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		if status := review("approve", ""); status != http.StatusOK {
+			mt.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if updates[0].Lookup("q", "status").StringValue() != recordPending {
+			mt.Errorf("decision does not check the status it was made on: %v", updates[0])
+		}
+		set := updates[0].Lookup("u", "$set").Document()
+		if set.Lookup("status").StringValue() != recordApproved || set.Lookup("reviewedBy").StringValue() != "admin@iitk.ac.in" {
+			mt.Errorf("update = %v", set)
+		}
+		var emailed bool
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" && event.Command.Lookup("insert").StringValue() == "email_outbox" {
+				emailed = event.Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("template").StringValue() == "record_approved"
+			}
+		}
+		if !emailed {
+			mt.Error("submitter was not emailed the decision")
+		}
+	})
+
+	mt.Run("reject approved record", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			record(recordApproved),
+			matchedDocuments(1),
+			submitter,
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		if status := review("reject", "Scanned pages are unreadable"); status != http.StatusOK {
+			mt.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 || updates[0].Lookup("u", "$set", "status").StringValue() != recordRejected {
+			mt.Errorf("updates = %v", updates)
+		}
+	})
+
+	mt.Run("reject without a comment", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		if status := review("reject", " "); status != http.StatusBadRequest {
+			mt.Errorf("status = %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+
+	mt.Run("same decision again", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), record(recordApproved))
+		if status := review("approve", ""); status != http.StatusConflict {
+			mt.Errorf("status = %d, want %d", status, http.StatusConflict)
+		}
+		if _, updates := sentUpdates(mt); len(updates) != 0 {
+			mt.Errorf("updates = %v", updates)
+		}
+	})
+
+	mt.Run("reviewed concurrently", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), record(recordPending), matchedDocuments(0), mtest.CreateSuccessResponse())
+		if status := review("approve", ""); status != http.StatusConflict {
+			mt.Errorf("status = %d, want %d", status, http.StatusConflict)
+		}
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" {
+				mt.Errorf("losing decision was emailed or audited: %v", event.Command)
+			}
+		}
+	})
+}
+
+func TestListApprovedRecords(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("only approved, without review details", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), mtest.CreateCursorResponse(0, "db.course_records", mtest.FirstBatch, bson.D{
+			{Key: "courseCode", Value: "PHY103"},
+			{Key: "status", Value: recordApproved},
+			{Key: "reviewedBy", Value: "admin@iitk.ac.in"},
+			{Key: "reviewComment", Value: "Looks good"},
+		}))
+		recorder := serveRoute(listApprovedRecords, http.MethodGet, "/api/records", "/api/records?course=phy103", nil, "ravi@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusOK)
+		if body := recorder.Body.String(); strings.Contains(body, "admin@iitk.ac.in") || strings.Contains(body, "Looks good") {
+			mt.Errorf("review details were shown: %s", body)
+		}
+
+		filter := sentCommand(mt, "find").Lookup("filter").Document()
+		if filter.Lookup("status").StringValue() != recordApproved || filter.Lookup("courseCode").StringValue() != "PHY103" {
+			mt.Errorf("filter = %v", filter)
+		}
+	})
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	oidcStates *mongo.Collection
+	oidc       *oidcProvider
+)
+
+// oidcConfig holds the settings for single sign-on against an OpenID Connect issuer
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	RoleClaim    string
+	AdminValues  []string
+}
+
+// oidcProvider caches the issuer's discovery document and signing keys
+type oidcProvider struct {
+	config oidcConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	State        string    `bson:"state"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"codeVerifier"`
+	CreatedAt    time.Time `bson:"createdAt"`
+}
+
+// loadOIDCConfig reads the OIDC settings from the environment, returning nil
+// when single sign-on is not configured
+func loadOIDCConfig() *oidcConfig {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	scopes := strings.Fields(os.Getenv("OIDC_SCOPES"))
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	roleClaim := os.Getenv("OIDC_ROLE_CLAIM")
+	if roleClaim == "" {
+		roleClaim = "roles"
+	}
+
+	var adminValues []string
+	for _, value := range strings.Split(os.Getenv("OIDC_ADMIN_ROLES"), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			adminValues = append(adminValues, value)
+		}
+	}
+
+	return &oidcConfig{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       scopes,
+		RoleClaim:    roleClaim,
+		AdminValues:  adminValues,
+	}
+}
+
+func newOIDCProvider(config oidcConfig) *oidcProvider {
+	return &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// getJSON fetches a URL and decodes the JSON response into v
+func (p *oidcProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getDiscovery returns the issuer's discovery document, fetching it on first use
+func (p *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(p.config.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match configured issuer %q", discovery.Issuer, p.config.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// getKey returns the RSA signing key with the given ID, refreshing the JWKS
+// when the key is unknown so that issuer key rotation is picked up
+func (p *oidcProvider) getKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no signing key with id %q", kid)
+	}
+	return key, nil
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the raw ID token
+func (p *oidcProvider) exchangeCode(code, codeVerifier string) (string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response did not include an id_token")
+	}
+
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the ID token signature, issuer, audience, expiry and nonce
+func (p *oidcProvider) verifyIDToken(rawToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.config.Issuer {
+		return nil, errors.New("id token issuer mismatch")
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) && !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, errors.New("id token audience mismatch")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id token has no expiry")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// audienceContains handles the array form of the aud claim, which jwt-go v3 does not
+func audienceContains(aud interface{}, clientID string) bool {
+	values, ok := aud.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, value := range values {
+		if s, _ := value.(string); s == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// mapRole derives the EduWise role from the configured role claim
+func (p *oidcProvider) mapRole(claims jwt.MapClaims) string {
+	var values []string
+	switch v := claims[p.config.RoleClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	for _, value := range values {
+		for _, admin := range p.config.AdminValues {
+			if value == admin {
+				return "admin"
+			}
+		}
+	}
+	return "student"
+}
+
+// randomURLString returns n random bytes encoded as unpadded base64url
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Route to start the OIDC authorization-code flow
+func oidcLogin(c *gin.Context) {
+	discovery, err := oidc.getDiscovery()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to contact identity provider"})
+		return
+	}
+
+	state, err := randomURLString(24)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start single sign-on"})
+		return
+	}
+	nonce, err := randomURLString(24)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start single sign-on"})
+		return
+	}
+	codeVerifier, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start single sign-on"})
+		return
+	}
+
+	_, err = oidcStates.InsertOne(ctx, oidcState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start single sign-on"})
+		return
+	}
+
+	// PKCE S256 challenge
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", oidc.config.ClientID)
+	params.Set("redirect_uri", oidc.config.RedirectURL)
+	params.Set("scope", strings.Join(oidc.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	c.JSON(http.StatusOK, gin.H{"authorizationUrl": discovery.AuthorizationEndpoint + "?" + params.Encode()})
+}
+
+// Route to complete the OIDC flow; the frontend posts back the code and state
+// it received on the redirect URL
+func oidcCallback(c *gin.Context) {
+	var req struct {
+		Code  string `json:"code" binding:"required"`
+		State string `json:"state" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// States are single-use
+	var state oidcState
+	err := oidcStates.FindOneAndDelete(ctx, bson.M{"state": req.State}).Decode(&state)
+	if err != nil || time.Since(state.CreatedAt) > oidcStateTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	rawToken, err := oidc.exchangeCode(req.Code, state.CodeVerifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Failed to exchange authorization code"})
+		return
+	}
+
+	claims, err := oidc.verifyIDToken(rawToken, state.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	emailVerified, _ := claims["email_verified"].(bool)
+	if subject == "" || email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "ID token is missing the sub or email claim"})
+		return
+	}
+
+	role := oidc.mapRole(claims)
+	email, err = validateAccountEmail(email, role)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	dbUser, status, err := findOrProvisionOIDCUser(subject, email, emailVerified, role)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	respondWithSession(c, dbUser)
+}
+
+// findOrProvisionOIDCUser resolves the local account for an OIDC identity,
+// linking an existing account by email or creating a new one just in time
+func findOrProvisionOIDCUser(subject, email string, emailVerified bool, role string) (*UserRegistration, int, error) {
+	var dbUser UserRegistration
+
+	// Already linked
+	err := registeredUsers.FindOne(ctx, bson.M{"oidcIssuer": oidc.config.Issuer, "oidcSubject": subject}).Decode(&dbUser)
+	if err == nil {
+		return &dbUser, http.StatusOK, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, http.StatusInternalServerError, errors.New("Failed to look up user")
+	}
+
+	err = registeredUsers.FindOne(ctx, bson.M{"username": email}).Decode(&dbUser)
+	if err == nil {
+		// Take over an existing account, but only when the provider vouches for the address
+		if dbUser.OIDCSubject != "" {
+			return nil, http.StatusConflict, errors.New("Account is already linked to another identity")
+		}
+		if !emailVerified {
+			return nil, http.StatusForbidden, errors.New("Identity provider has not verified this email address")
+		}
+
+		if !dbUser.IsVerified {
+			// Nobody proved ownership of an unverified registration, so whoever
+			// made it must not keep a password; replace it with a fresh account
+			document, provisioned := newOIDCUser(subject, email, role)
+			result, err := registeredUsers.ReplaceOne(ctx, bson.M{"username": email, "isVerified": false}, document)
+			if err != nil || result.MatchedCount == 0 {
+				return nil, http.StatusInternalServerError, errors.New("Failed to provision user")
+			}
+			return provisioned, http.StatusOK, nil
+		}
+
+		update := bson.M{"$set": bson.M{"oidcIssuer": oidc.config.Issuer, "oidcSubject": subject}}
+		if _, err := registeredUsers.UpdateOne(ctx, bson.M{"username": email, "isVerified": true}, update); err != nil {
+			return nil, http.StatusInternalServerError, errors.New("Failed to link account")
+		}
+		dbUser.OIDCIssuer = oidc.config.Issuer
+		dbUser.OIDCSubject = subject
+		return &dbUser, http.StatusOK, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, http.StatusInternalServerError, errors.New("Failed to look up user")
+	}
+
+	// Just-in-time provisioning, which claims the address for good, so only
+	// for addresses the provider has verified
+	if !emailVerified {
+		return nil, http.StatusForbidden, errors.New("Identity provider has not verified this email address")
+	}
+	document, provisioned := newOIDCUser(subject, email, role)
+	if _, err := registeredUsers.InsertOne(ctx, document); mongo.IsDuplicateKeyError(err) {
+		return nil, http.StatusConflict, errors.New("Account was created by another login, please try again")
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("Failed to provision user")
+	}
+	return provisioned, http.StatusOK, nil
+}
+
+// newOIDCUser returns the stored document and the user for a new account
+// provisioned from an OIDC identity; these accounts have no local password
+func newOIDCUser(subject, email, role string) (bson.M, *UserRegistration) {
+	document := bson.M{
+		"username":    email,
+		"role":        role,
+		"isVerified":  true,
+		"oidcIssuer":  oidc.config.Issuer,
+		"oidcSubject": subject,
+	}
+	return document, &UserRegistration{
+		Username:    email,
+		Role:        role,
+		IsVerified:  true,
+		OIDCIssuer:  oidc.config.Issuer,
+		OIDCSubject: subject,
+	}
+}
+
+// ensureOIDCIndexes expires abandoned login states
+func ensureOIDCIndexes() {
+	if _, err := oidcStates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(oidcStateTTL.Seconds())),
+	}); err != nil {
+		log.Printf("Failed to create OIDC state index: %v", err)
+	}
+}
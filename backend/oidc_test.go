@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const (
+	testClientID     = "eduwise"
+	testClientSecret = "client-secret"
+	testRedirectURL  = "http://localhost:3000/sso/callback"
+)
+
+// mockIdentityProvider is a local OpenID Connect issuer serving discovery,
+// JWKS and token endpoints
+type mockIdentityProvider struct {
+	*httptest.Server
+	t *testing.T
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PrivateKey
+	jwksFetches int
+	codes       map[string]mockAuthorization
+}
+
+// mockAuthorization is an authorization code waiting to be redeemed
+type mockAuthorization struct {
+	challenge string
+	idToken   string
+}
+
+func newMockIdentityProvider(t *testing.T) *mockIdentityProvider {
+	idp := &mockIdentityProvider{t: t, keys: map[string]*rsa.PrivateKey{}, codes: map[string]mockAuthorization{}}
+	idp.addKey("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", idp.serveJWKS)
+	mux.HandleFunc("/token", idp.serveToken)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdentityProvider) addKey(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keys[kid] = key
+}
+
+func (idp *mockIdentityProvider) removeKey(kid string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	delete(idp.keys, kid)
+}
+
+func (idp *mockIdentityProvider) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.jwksFetches++
+
+	keys := []map[string]string{}
+	for kid, key := range idp.keys {
+		keys = append(keys, map[string]string{
+			"kid": kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// serveToken redeems a code once, checking the client credentials and the PKCE verifier
+func (idp *mockIdentityProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if id, secret, _ := r.BasicAuth(); id != testClientID || secret != testClientSecret {
+		fail("invalid_client")
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("redirect_uri") != testRedirectURL {
+		fail("invalid_request")
+		return
+	}
+
+	idp.mu.Lock()
+	authorization, ok := idp.codes[r.Form.Get("code")]
+	delete(idp.codes, r.Form.Get("code"))
+	idp.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != authorization.challenge {
+		fail("invalid_grant")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": authorization.idToken, "token_type": "Bearer"})
+}
+
+// claims returns valid ID token claims for the subject and nonce
+func (idp *mockIdentityProvider) claims(subject, email, nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.URL,
+		"aud":            testClientID,
+		"sub":            subject,
+		"email":          email,
+		"email_verified": true,
+		"nonce":          nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+	}
+}
+
+// sign signs claims with the published key kid
+func (idp *mockIdentityProvider) sign(kid string, claims jwt.MapClaims) string {
+	idp.mu.Lock()
+	key := idp.keys[kid]
+	idp.mu.Unlock()
+	return signWithKey(idp.t, key, kid, claims)
+}
+
+func signWithKey(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// issueCode stores an ID token behind a new authorization code bound to the verifier
+func (idp *mockIdentityProvider) issueCode(codeVerifier, idToken string) string {
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	code, _ := randomURLString(12)
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.codes[code] = mockAuthorization{challenge: base64.RawURLEncoding.EncodeToString(challenge[:]), idToken: idToken}
+	return code
+}
+
+// useMockIdentityProvider configures single sign-on against idp for the rest of the test
+func useMockIdentityProvider(t *testing.T, idp *mockIdentityProvider) {
+	previous := oidc
+	oidc = newOIDCProvider(oidcConfig{
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "email"},
+		RoleClaim:    "roles",
+		AdminValues:  []string{"eduwise-admin"},
+	})
+	t.Cleanup(func() { oidc = previous })
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	useMockIdentityProvider(t, idp)
+
+	strangerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := idp.claims("user-1", "a@iitk.ac.in", "nonce-1")
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", idp.sign("key-1", with(nil)), true},
+		{"audience list", idp.sign("key-1", with(jwt.MapClaims{"aud": []string{"other", testClientID}})), true},
+		{"wrong nonce", idp.sign("key-1", with(jwt.MapClaims{"nonce": "nonce-2"})), false},
+		{"missing nonce", idp.sign("key-1", with(jwt.MapClaims{"nonce": nil})), false},
+		{"wrong audience", idp.sign("key-1", with(jwt.MapClaims{"aud": "someone-else"})), false},
+		{"wrong issuer", idp.sign("key-1", with(jwt.MapClaims{"iss": "https://evil.example"})), false},
+		{"expired", idp.sign("key-1", with(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), false},
+		{"no expiry", idp.sign("key-1", with(jwt.MapClaims{"exp": nil})), false},
+		{"forged signature", signWithKey(t, strangerKey, "key-1", with(nil)), false},
+		{"unknown key", signWithKey(t, strangerKey, "key-9", with(nil)), false},
+		{"symmetric algorithm", func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, with(nil)).SignedString([]byte("secret"))
+			return signed
+		}(), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := oidc.verifyIDToken(test.token, "nonce-1")
+			if test.valid && err != nil {
+				t.Fatalf("verifyIDToken rejected a valid token: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("verifyIDToken accepted an invalid token: %v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenKeyRotation(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	useMockIdentityProvider(t, idp)
+
+	if _, err := oidc.verifyIDToken(idp.sign("key-1", idp.claims("user-1", "a@iitk.ac.in", "n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oidc.verifyIDToken(idp.sign("key-1", idp.claims("user-1", "a@iitk.ac.in", "n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksFetches != 1 {
+		t.Fatalf("JWKS fetched %d times for a known key, want 1", idp.jwksFetches)
+	}
+
+	// The issuer rotates to a new key and retires the old one
+	idp.addKey("key-2")
+	oldToken := idp.sign("key-1", idp.claims("user-1", "a@iitk.ac.in", "n"))
+	idp.removeKey("key-1")
+
+	if _, err := oidc.verifyIDToken(idp.sign("key-2", idp.claims("user-1", "a@iitk.ac.in", "n")), "n"); err != nil {
+		t.Fatalf("token signed with the rotated key was rejected: %v", err)
+	}
+	if idp.jwksFetches != 2 {
+		t.Fatalf("JWKS fetched %d times after rotation, want 2", idp.jwksFetches)
+	}
+	if _, err := oidc.verifyIDToken(oldToken, "n"); err == nil {
+		t.Fatal("token signed with the retired key was accepted")
+	}
+}
+
+func TestOIDCMapRole(t *testing.T) {
+	provider := newOIDCProvider(oidcConfig{RoleClaim: "roles", AdminValues: []string{"eduwise-admin", "staff"}})
+	tests := []struct {
+		claim interface{}
+		role  string
+	}{
+		{nil, "student"},
+		{"student", "student"},
+		{"reader staff", "admin"},
+		{[]interface{}{"reader", "eduwise-admin"}, "admin"},
+		{[]interface{}{"eduwise-admins", 7}, "student"},
+	}
+	for _, test := range tests {
+		claims := jwt.MapClaims{}
+		if test.claim != nil {
+			claims["roles"] = test.claim
+		}
+		if role := provider.mapRole(claims); role != test.role {
+			t.Errorf("mapRole(%v) = %q, want %q", test.claim, role, test.role)
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	useMockIdentityProvider(t, idp)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("authorization url", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		recorder := serveJSON(oidcLogin, http.MethodGet, "/api/oidc/login", nil)
+		expectStatus(mt, recorder, http.StatusOK)
+		authorizationURL, err := url.Parse(responseBody(mt, recorder)["authorizationUrl"].(string))
+		if err != nil {
+			mt.Fatal(err)
+		}
+		query := authorizationURL.Query()
+
+		inserted := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		verifier := inserted.Lookup("codeVerifier").StringValue()
+		challenge := sha256.Sum256([]byte(verifier))
+		if query.Get("state") != inserted.Lookup("state").StringValue() || query.Get("nonce") != inserted.Lookup("nonce").StringValue() {
+			mt.Errorf("stored state does not match the authorization URL %s", authorizationURL)
+		}
+		if query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) || query.Get("code_challenge_method") != "S256" {
+			mt.Errorf("authorization URL has the wrong PKCE challenge: %s", authorizationURL)
+		}
+		if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL {
+			mt.Errorf("authorization URL has the wrong client: %s", authorizationURL)
+		}
+	})
+}
+
+func TestOIDCCallback(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	useMockIdentityProvider(t, idp)
+
+	const (
+		state    = "state-1"
+		nonce    = "nonce-1"
+		verifier = "verifier-1"
+		email    = "asha@iitk.ac.in"
+		usersNS  = "db.registered_users"
+	)
+	storedState := func(createdAt time.Time) bson.D {
+		return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: bson.D{
+			{Key: "state", Value: state},
+			{Key: "nonce", Value: nonce},
+			{Key: "codeVerifier", Value: verifier},
+			{Key: "createdAt", Value: createdAt},
+		}}}
+	}
+	callback := func(claims jwt.MapClaims) map[string]string {
+		return map[string]string{"state": state, "code": idp.issueCode(verifier, idp.sign("key-1", claims))}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("unknown state", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: nil}})
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(idp.claims("user-1", email, nonce)))
+		expectStatus(mt, recorder, http.StatusBadRequest)
+	})
+
+	mt.Run("expired state", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(storedState(time.Now().Add(-oidcStateTTL - time.Minute)))
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(idp.claims("user-1", email, nonce)))
+		expectStatus(mt, recorder, http.StatusBadRequest)
+	})
+
+	mt.Run("nonce mismatch", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(storedState(time.Now()))
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(idp.claims("user-1", email, "replayed")))
+		expectStatus(mt, recorder, http.StatusUnauthorized)
+	})
+
+	mt.Run("wrong code verifier", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(storedState(time.Now()))
+		body := map[string]string{"state": state, "code": idp.issueCode("other-verifier", idp.sign("key-1", idp.claims("user-1", email, nonce)))}
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", body)
+		expectStatus(mt, recorder, http.StatusUnauthorized)
+	})
+
+	mt.Run("links verified account", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			storedState(time.Now()),
+			noDocuments(usersNS),
+			mtest.CreateCursorResponse(0, usersNS, mtest.FirstBatch, bson.D{
+				{Key: "username", Value: email},
+				{Key: "password", Value: "$2a$10$hash"},
+				{Key: "role", Value: "student"},
+				{Key: "isVerified", Value: true},
+			}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(idp.claims("user-1", email, nonce)))
+		expectStatus(mt, recorder, http.StatusOK)
+
+		update := sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document()
+		set := update.Lookup("u", "$set").Document()
+		if set.Lookup("oidcSubject").StringValue() != "user-1" || set.Lookup("oidcIssuer").StringValue() != idp.URL {
+			mt.Errorf("link update = %v", update)
+		}
+		if _, err := set.LookupErr("isVerified"); err == nil {
+			mt.Errorf("linking changed the verification state: %v", update)
+		}
+	})
+
+	mt.Run("replaces unverified registration", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			storedState(time.Now()),
+			noDocuments(usersNS),
+			mtest.CreateCursorResponse(0, usersNS, mtest.FirstBatch, bson.D{
+				{Key: "username", Value: email},
+				{Key: "password", Value: "$2a$10$attacker"},
+				{Key: "role", Value: "student"},
+				{Key: "isVerified", Value: false},
+			}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(idp.claims("user-1", email, nonce)))
+		expectStatus(mt, recorder, http.StatusOK)
+
+		update := sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document()
+		if verified, ok := update.Lookup("q", "isVerified").BooleanOK(); !ok || verified {
+			mt.Errorf("replacement is not limited to the unverified account: %v", update)
+		}
+		replacement := update.Lookup("u").Document()
+		if _, err := replacement.LookupErr("password"); err == nil {
+			mt.Errorf("replacement kept the unverified password: %v", replacement)
+		}
+		if replacement.Lookup("oidcSubject").StringValue() != "user-1" || !replacement.Lookup("isVerified").Boolean() {
+			mt.Errorf("replacement = %v", replacement)
+		}
+	})
+
+	mt.Run("unverified email is not linked", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			storedState(time.Now()),
+			noDocuments(usersNS),
+			mtest.CreateCursorResponse(0, usersNS, mtest.FirstBatch, bson.D{
+				{Key: "username", Value: email},
+				{Key: "role", Value: "student"},
+				{Key: "isVerified", Value: true},
+			}),
+		)
+		claims := idp.claims("user-1", email, nonce)
+		claims["email_verified"] = false
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(claims))
+		expectStatus(mt, recorder, http.StatusForbidden)
+	})
+
+	mt.Run("unverified email is not provisioned", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			storedState(time.Now()),
+			noDocuments(usersNS),
+			noDocuments(usersNS),
+			mtest.CreateSuccessResponse(),
+		)
+		claims := idp.claims("user-4", email, nonce)
+		claims["email_verified"] = false
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(claims))
+		expectStatus(mt, recorder, http.StatusForbidden)
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" {
+				mt.Errorf("account provisioned for an unverified address: %v", event.Command)
+			}
+		}
+	})
+
+	mt.Run("provisions admin from role claim", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			storedState(time.Now()),
+			noDocuments(usersNS),
+			noDocuments(usersNS),
+			mtest.CreateSuccessResponse(),
+		)
+		claims := idp.claims("user-2", "Ravi@IITK.ac.in", nonce)
+		claims["roles"] = []string{"staff", "eduwise-admin"}
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(claims))
+		expectStatus(mt, recorder, http.StatusOK)
+
+		inserted := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		if inserted.Lookup("username").StringValue() != "ravi@iitk.ac.in" || inserted.Lookup("role").StringValue() != "admin" {
+			mt.Errorf("provisioned user = %v", inserted)
+		}
+		token, _, err := new(jwt.Parser).ParseUnverified(responseBody(mt, recorder)["token"].(string), &Claims{})
+		if err != nil || token.Claims.(*Claims).Role != "admin" {
+			mt.Errorf("session token = %v, %v", token, err)
+		}
+	})
+	mt.Run("concurrent provisioning", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			storedState(time.Now()),
+			noDocuments(usersNS),
+			noDocuments(usersNS),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "E11000 duplicate key error"}),
+		)
+		recorder := serveJSON(oidcCallback, http.MethodPost, "/api/oidc/callback", callback(idp.claims("user-3", email, nonce)))
+		expectStatus(mt, recorder, http.StatusConflict)
+	})
+}
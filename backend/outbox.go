@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	outboxPending = "pending"
+	outboxSending = "sending"
+	outboxSent    = "sent"
+	outboxDead    = "dead"
+
+	outboxMaxAttempts  = 8
+	outboxBaseBackoff  = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+	outboxLeaseTimeout = 2 * time.Minute
+	outboxPollInterval = 5 * time.Second
+
+	// outboxSentRetention is how long delivered messages are kept for admins to inspect
+	outboxSentRetention = 30 * 24 * time.Hour
+)
+
+var outboxCollection *mongo.Collection
+
+// secretEmailTemplates carry one-time codes or tokens. Their content is
+// discarded once delivery has succeeded or given up, so dead ones cannot be
+// retried. Reset, invitation and email change codes are stored hashed; the
+// registration OTP is kept in plain text on the unverified account until it
+// is verified.
+var secretEmailTemplates = map[string]bool{
+	"verification":   true,
+	"password_reset": true,
+	"invitation":     true,
+	"email_change":   true,
+}
+
+// OutboxMessage is an email waiting to be delivered by the background worker.
+// Text and HTML are removed once the message is sent, and sent messages are
+// deleted after outboxSentRetention.
+type OutboxMessage struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	To            []string           `json:"to" bson:"to"`
+	Template      string             `json:"template" bson:"template"`
+	Subject       string             `json:"subject" bson:"subject"`
+	Text          string             `json:"-" bson:"text"`
+	HTML          string             `json:"-" bson:"html"`
+	Status        string             `json:"status" bson:"status"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LockedUntil   time.Time          `json:"-" bson:"lockedUntil,omitempty"`
+	SentAt        *time.Time         `json:"sentAt,omitempty" bson:"sentAt,omitempty"`
+}
+
+// checkTransactionSupport stops the server when MongoDB cannot run the
+// transactions every write goes through, rather than failing each write with a
+// 500. Transactions need a replica set or a sharded cluster.
+func checkTransactionSupport(client *mongo.Client) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return err
+	}
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return errors.New("MONGO_URI points at a standalone mongod, but transactions need a replica set; " +
+			"start mongod with --replSet and run rs.initiate(), a single-node replica set is enough")
+	}
+	return nil
+}
+
+// withTransaction runs fn inside a MongoDB transaction so that data changes and
+// the outbox messages describing them are committed together
+func withTransaction(fn func(sc mongo.SessionContext) error) error {
+	session, err := mongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// enqueueEmail renders the named template and stores it in the outbox using
+// the caller's context, which may be a transaction
+func enqueueEmail(c context.Context, to, name, locale string, data EmailData) error {
+	msg, err := renderEmail(name, locale, data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = outboxCollection.InsertOne(c, OutboxMessage{
+		To:            []string{to},
+		Template:      name,
+		Subject:       msg.Subject,
+		Text:          msg.Text,
+		HTML:          msg.HTML,
+		Status:        outboxPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	})
+	return err
+}
+
+// outboxBackoff returns the delay before the given attempt, doubling each time with some jitter
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxBaseBackoff << uint(attempts-1)
+	if delay > outboxMaxBackoff || delay <= 0 {
+		delay = outboxMaxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/10)+1))
+}
+
+// startOutboxWorker delivers queued messages until the process exits
+func startOutboxWorker() {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "sentAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(outboxSentRetention.Seconds()))},
+	}
+	if _, err := outboxCollection.Indexes().CreateMany(ctx, models); err != nil {
+		log.Printf("Failed to create outbox indexes: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// Drain everything that is due before waiting for the next tick
+			for deliverNextOutboxMessage() {
+			}
+		}
+	}()
+}
+
+// deliverNextOutboxMessage claims one due message and tries to send it,
+// returning false when there was nothing to do
+func deliverNextOutboxMessage() bool {
+	now := time.Now()
+
+	// Claim a due message, or one whose previous sender died mid-delivery.
+	// Attempts are counted when claimed, so a delivery that never reported
+	// back still counts.
+	filter := bson.M{"$or": []bson.M{
+		{"status": outboxPending, "nextAttemptAt": bson.M{"$lte": now}},
+		{"status": outboxSending, "lockedUntil": bson.M{"$lt": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": outboxSending, "lockedUntil": now.Add(outboxLeaseTimeout)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.M{"nextAttemptAt": 1}).
+		SetReturnDocument(options.After)
+
+	var msg OutboxMessage
+	err := outboxCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to claim outbox message: %v", err)
+		return false
+	}
+
+	attempts := msg.Attempts
+	var sendErr error
+	if attempts > outboxMaxAttempts {
+		// Every allowed attempt was claimed by senders that died mid-delivery
+		sendErr = errors.New("delivery did not complete")
+	} else {
+		sendErr = mailer.Send(&Message{
+			To:      msg.To,
+			Subject: msg.Subject,
+			Text:    msg.Text,
+			HTML:    msg.HTML,
+		})
+	}
+
+	var result bson.M
+	switch {
+	case sendErr == nil:
+		result = bson.M{
+			"$set":   bson.M{"status": outboxSent, "sentAt": time.Now()},
+			"$unset": bson.M{"lockedUntil": "", "text": "", "html": ""},
+		}
+	case attempts >= outboxMaxAttempts:
+		log.Printf("Outbox message %s to %v failed permanently after %d attempts: %v", msg.ID.Hex(), msg.To, attempts, sendErr)
+		unset := bson.M{"lockedUntil": ""}
+		if secretEmailTemplates[msg.Template] {
+			unset["text"] = ""
+			unset["html"] = ""
+		}
+		result = bson.M{"$set": bson.M{"status": outboxDead, "lastError": sendErr.Error()}, "$unset": unset}
+	default:
+		log.Printf("Outbox message %s to %v failed (attempt %d): %v", msg.ID.Hex(), msg.To, attempts, sendErr)
+		result = bson.M{
+			"$set": bson.M{
+				"status":        outboxPending,
+				"lastError":     sendErr.Error(),
+				"nextAttemptAt": time.Now().Add(outboxBackoff(attempts)),
+			},
+			"$unset": bson.M{"lockedUntil": ""},
+		}
+	}
+
+	if _, err := outboxCollection.UpdateOne(ctx, bson.M{"_id": msg.ID}, result); err != nil {
+		log.Printf("Failed to record outcome of outbox message %s: %v", msg.ID.Hex(), err)
+	}
+	return true
+}
+
+// Route for admins to list outbox messages, optionally filtered by status
+func listOutbox(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	filter := bson.M{}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(200)
+	cursor, err := outboxCollection.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch outbox messages"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	messages := []OutboxMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode outbox messages"})
+		return
+	}
+
+	c.JSON(http.StatusOK, messages)
+}
+
+// Route for admins to send a dead message again with a fresh set of attempts
+func retryOutboxMessage(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var msg OutboxMessage
+	if err := outboxCollection.FindOne(ctx, bson.M{"_id": id, "status": outboxDead}).Decode(&msg); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No failed message with that ID"})
+		return
+	}
+	if msg.Text == "" && msg.HTML == "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "The content of this message contained a one-time code and was discarded; the user has to request a new one",
+			"reason": "content_discarded",
+		})
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"status": outboxPending, "attempts": 0, "nextAttemptAt": time.Now()}}
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := outboxCollection.UpdateOne(sc, bson.M{"_id": id, "status": outboxDead}, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		return recordAuditIn(sc, c, "outbox.retry", "outbox:"+id.Hex(), gin.H{"status": outboxDead}, gin.H{"status": outboxPending})
+	})
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No failed message with that ID"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry message"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message queued for delivery"})
+}
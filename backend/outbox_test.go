@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+type failingMailer struct{}
+
+func (failingMailer) Send(msg *Message) error {
+	return errors.New("connection refused")
+}
+
+// useMailer replaces the mailer for the rest of the test
+func useMailer(t testing.TB, m Mailer) {
+	previous := mailer
+	mailer = m
+	t.Cleanup(func() { mailer = previous })
+}
+
+func TestDeliverOutboxMessage(t *testing.T) {
+	claimed := func(template string, attempts int) bson.D {
+		return bson.D{{Key: "ok", Value: 1}, {Key: "value", Value: bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "to", Value: bson.A{"asha@iitk.ac.in"}},
+			{Key: "template", Value: template},
+			{Key: "subject", Value: "Your code"},
+			{Key: "text", Value: "Your code is 123456"},
+			{Key: "html", Value: "<p>Your code is 123456</p>"},
+			{Key: "status", Value: outboxSending},
+			{Key: "attempts", Value: attempts},
+			{Key: "createdAt", Value: time.Now()},
+		}}}
+	}
+	outcome := func(mt *mtest.T) bson.Raw {
+		return sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("claim counts the attempt", func(mt *mtest.T) {
+		useMockCollections(mt)
+		useMailer(mt, NewMemoryMailer("EduWise <noreply@iitk.ac.in>"))
+		mt.AddMockResponses(claimed("verification", 1), mtest.CreateSuccessResponse())
+		deliverNextOutboxMessage()
+
+		claim := sentCommand(mt, "findAndModify").Lookup("update").Document()
+		if claim.Lookup("$inc", "attempts").Int32() != 1 {
+			mt.Errorf("claim does not count the attempt: %v", claim)
+		}
+	})
+
+	mt.Run("sent message drops its content", func(mt *mtest.T) {
+		useMockCollections(mt)
+		sink := NewMemoryMailer("EduWise <noreply@iitk.ac.in>")
+		useMailer(mt, sink)
+		mt.AddMockResponses(claimed("verification", 1), mtest.CreateSuccessResponse())
+		deliverNextOutboxMessage()
+
+		if len(sink.Sent()) != 1 {
+			mt.Fatalf("sent %d messages, want 1", len(sink.Sent()))
+		}
+		update := outcome(mt)
+		if update.Lookup("$set", "status").StringValue() != outboxSent {
+			mt.Errorf("outcome = %v", update)
+		}
+		for _, field := range []string{"text", "html"} {
+			if _, err := update.LookupErr("$unset", field); err != nil {
+				mt.Errorf("sent message keeps its %s: %v", field, update)
+			}
+		}
+	})
+
+	mt.Run("dead message with a code drops its content", func(mt *mtest.T) {
+		useMockCollections(mt)
+		useMailer(mt, failingMailer{})
+		mt.AddMockResponses(claimed("password_reset", outboxMaxAttempts), mtest.CreateSuccessResponse())
+		deliverNextOutboxMessage()
+
+		update := outcome(mt)
+		if update.Lookup("$set", "status").StringValue() != outboxDead {
+			mt.Errorf("outcome = %v", update)
+		}
+		if _, err := update.LookupErr("$unset", "text"); err != nil {
+			mt.Errorf("dead message keeps its one-time code: %v", update)
+		}
+	})
+
+	mt.Run("dead message without a code can be retried", func(mt *mtest.T) {
+		useMockCollections(mt)
+		useMailer(mt, failingMailer{})
+		mt.AddMockResponses(claimed("request_approved", outboxMaxAttempts), mtest.CreateSuccessResponse())
+		deliverNextOutboxMessage()
+
+		update := outcome(mt)
+		if _, err := update.LookupErr("$unset", "text"); err == nil {
+			mt.Errorf("dead message lost the content needed to retry it: %v", update)
+		}
+	})
+
+	mt.Run("abandoned deliveries use up attempts", func(mt *mtest.T) {
+		useMockCollections(mt)
+		sink := NewMemoryMailer("EduWise <noreply@iitk.ac.in>")
+		useMailer(mt, sink)
+		mt.AddMockResponses(claimed("verification", outboxMaxAttempts+1), mtest.CreateSuccessResponse())
+		deliverNextOutboxMessage()
+
+		if len(sink.Sent()) != 0 {
+			mt.Errorf("message was sent after running out of attempts")
+		}
+		if update := outcome(mt); update.Lookup("$set", "status").StringValue() != outboxDead {
+			mt.Errorf("outcome = %v", update)
+		}
+	})
+}
+
+func TestCheckTransactionSupport(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("standalone", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "isWritablePrimary", Value: true}))
+		if err := checkTransactionSupport(mt.Client); err == nil {
+			mt.Error("standalone mongod was accepted")
+		}
+	})
+
+	mt.Run("replica set", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "isWritablePrimary", Value: true}, bson.E{Key: "setName", Value: "rs0"}))
+		if err := checkTransactionSupport(mt.Client); err != nil {
+			mt.Error(err)
+		}
+	})
+
+	mt.Run("sharded cluster", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "isWritablePrimary", Value: true}, bson.E{Key: "msg", Value: "isdbgrid"}))
+		if err := checkTransactionSupport(mt.Client); err != nil {
+			mt.Error(err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL      = time.Hour
+	passwordResetAttempts = 5
+)
+
+// generateResetToken returns a random code in the same xxxx-xxxx form as recovery codes
+func generateResetToken() (string, error) {
+	raw := make([]byte, 5)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+	return encoded[:4] + "-" + encoded[4:], nil
+}
+
+// startPasswordReset stores a hashed reset code on the account and emails the code to it
+func startPasswordReset(dbUser *UserRegistration) error {
+	return withTransaction(func(sc mongo.SessionContext) error {
+		return queuePasswordReset(sc, dbUser)
+	})
+}
+
+// queuePasswordReset stores a fresh reset code for dbUser and queues the email
+// carrying it, within the transaction of sc
+func queuePasswordReset(sc mongo.SessionContext, dbUser *UserRegistration) error {
+	token, err := generateResetToken()
+	if err != nil {
+		return err
+	}
+	hashedToken, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(passwordResetTTL)
+	_, err = registeredUsers.UpdateOne(sc, bson.M{"username": dbUser.Username}, bson.M{"$set": bson.M{
+		"resetToken":        string(hashedToken),
+		"resetExpires":      expires,
+		"resetAttemptsLeft": passwordResetAttempts,
+	}})
+	if err != nil {
+		return err
+	}
+	return enqueueEmail(sc, dbUser.Username, "password_reset", dbUser.Locale, EmailData{
+		"Username":  dbUser.Username,
+		"Token":     token,
+		"ExpiresAt": formatEmailTime(expires),
+	})
+}
+
+// Route for a user who forgot their password to ask for a reset code
+func requestPasswordReset(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+
+	// Respond the same way whether or not the account exists so the endpoint
+	// cannot be used to discover registered addresses
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": req.Username}).Decode(&dbUser)
+	if err == nil && dbUser.IsVerified && !dbUser.Disabled {
+		if err := startPasswordReset(&dbUser); err != nil {
+			log.Printf("Failed to start password reset for %s: %v", dbUser.Username, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the account exists, a reset code has been sent to it"})
+}
+
+// Route to choose a new password with the code sent by email
+func confirmPasswordReset(c *gin.Context) {
+	var req struct {
+		Username    string `json:"username" binding:"required"`
+		Token       string `json:"token" binding:"required"`
+		NewPassword string `json:"newPassword" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if len(req.NewPassword) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("New password must be at least %d characters", minPasswordLength)})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": req.Username}).Decode(&dbUser)
+	if err != nil || dbUser.ResetToken == "" || time.Now().After(dbUser.ResetExpires) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset code"})
+		return
+	}
+
+	// Each guess uses up an attempt before it is checked, so parallel guesses
+	// cannot get past the limit
+	result, err := registeredUsers.UpdateOne(ctx,
+		bson.M{"username": dbUser.Username, "resetToken": dbUser.ResetToken, "resetAttemptsLeft": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"resetAttemptsLeft": -1}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check reset code"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset code"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(dbUser.ResetToken), []byte(strings.ToLower(strings.TrimSpace(req.Token)))) != nil {
+		// The code is discarded with the last attempt
+		if dbUser.ResetAttemptsLeft <= 1 {
+			_, err := registeredUsers.UpdateOne(ctx,
+				bson.M{"username": dbUser.Username, "resetToken": dbUser.ResetToken},
+				bson.M{"$unset": bson.M{"resetToken": "", "resetExpires": "", "resetAttemptsLeft": ""}})
+			if err != nil {
+				log.Printf("Failed to discard password reset code for %s: %v", dbUser.Username, err)
+			}
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset code"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	// The reset code is single use and every existing session is revoked
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := registeredUsers.UpdateOne(sc,
+			bson.M{"username": dbUser.Username, "resetToken": dbUser.ResetToken},
+			bson.M{
+				"$set":   bson.M{"password": string(hashedPassword)},
+				"$inc":   bson.M{"tokenVersion": 1},
+				"$unset": bson.M{"resetToken": "", "resetExpires": "", "resetAttemptsLeft": ""},
+			})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errSessionChanged
+		}
+		return enqueueEmail(sc, dbUser.Username, "password_changed", dbUser.Locale, EmailData{
+			"Username":  dbUser.Username,
+			"ChangedAt": formatEmailTime(time.Now()),
+		})
+	})
+	if err == errSessionChanged {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset code"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset. Please log in with your new password"})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestConfirmPasswordResetAttempts(t *testing.T) {
+	hashedToken, err := bcrypt.GenerateFromPassword([]byte("abcd-efgh"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resettingUser := func(attemptsLeft int) bson.D {
+		return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "role", Value: "student"},
+			{Key: "resetToken", Value: string(hashedToken)},
+			{Key: "resetExpires", Value: time.Now().Add(time.Minute)},
+			{Key: "resetAttemptsLeft", Value: attemptsLeft},
+		})
+	}
+	matched := func(n int) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+	}
+	confirm := func(token string) int {
+		body := map[string]string{"username": "asha@iitk.ac.in", "token": token, "newPassword": "a much longer password"}
+		return serveJSON(confirmPasswordReset, http.MethodPost, "/api/password-reset/confirm", body).Code
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("attempt is used before checking", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(resettingUser(3), matched(1))
+		if status := confirm("zzzz-zzzz"); status != http.StatusBadRequest {
+			mt.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+		}
+		update := sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document()
+		if update.Lookup("u", "$inc", "resetAttemptsLeft").Int32() != -1 {
+			mt.Errorf("wrong guess did not use up an attempt: %v", update)
+		}
+		if _, err := update.LookupErr("q", "resetAttemptsLeft", "$gt"); err != nil {
+			mt.Errorf("attempt is taken without checking any are left: %v", update)
+		}
+	})
+
+	mt.Run("no attempts left", func(mt *mtest.T) {
+		useMockCollections(mt)
+		// Another guess took the last attempt after the account was read
+		mt.AddMockResponses(resettingUser(1), matched(0))
+		if status := confirm("abcd-efgh"); status != http.StatusBadRequest {
+			mt.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+
+	mt.Run("last wrong guess discards the code", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(resettingUser(1), matched(1), matched(1))
+		if status := confirm("zzzz-zzzz"); status != http.StatusBadRequest {
+			mt.Fatalf("status = %d, want %d", status, http.StatusBadRequest)
+		}
+		update := sentCommand(mt, "update").Lookup("updates").Array().Index(0).Value().Document()
+		if _, err := update.LookupErr("u", "$unset", "resetToken"); err != nil {
+			mt.Errorf("reset code was kept after the last attempt: %v", update)
+		}
+	})
+}
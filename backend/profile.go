@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserProfile holds the descriptive attributes a user can edit about themselves
+type UserProfile struct {
+	DisplayName string `json:"displayName,omitempty" bson:"displayName,omitempty"`
+	RollNumber  string `json:"rollNumber,omitempty" bson:"rollNumber,omitempty"`
+	Department  string `json:"department,omitempty" bson:"department,omitempty"`
+	Programme   string `json:"programme,omitempty" bson:"programme,omitempty"`
+	BatchYear   int    `json:"batchYear,omitempty" bson:"batchYear,omitempty"`
+}
+
+// Academic departments by their institute code
+var departments = map[string]bool{
+	"AE": true, "BSBE": true, "CE": true, "CHE": true, "CHM": true, "CGS": true,
+	"CSE": true, "DES": true, "ECO": true, "EE": true, "ES": true, "HSS": true,
+	"IME": true, "MSE": true, "ME": true, "MTH": true, "PHY": true, "SDS": true,
+	"SEE": true,
+}
+
+// Degree programmes offered
+var programmes = map[string]bool{
+	"BT": true, "BS": true, "DUAL": true, "MT": true, "MSC": true, "MSR": true,
+	"MBA": true, "MDES": true, "PHD": true,
+}
+
+var rollNumberPattern = regexp.MustCompile(`^[A-Z0-9]{4,15}$`)
+
+// ProfileUpdate is the body of PUT /api/me; omitted fields are left unchanged
+// and empty strings clear a field
+type ProfileUpdate struct {
+	DisplayName *string `json:"displayName"`
+	RollNumber  *string `json:"rollNumber"`
+	Department  *string `json:"department"`
+	Programme   *string `json:"programme"`
+	BatchYear   *int    `json:"batchYear"`
+	Locale      *string `json:"locale"`
+}
+
+// validate normalises the update in place and returns field-level errors
+func (u *ProfileUpdate) validate() map[string]string {
+	errs := map[string]string{}
+
+	if u.DisplayName != nil {
+		name := strings.Join(strings.Fields(*u.DisplayName), " ")
+		switch {
+		case len([]rune(name)) > 100:
+			errs["displayName"] = "Display name must be at most 100 characters"
+		case strings.IndexFunc(name, unicode.IsControl) >= 0:
+			errs["displayName"] = "Display name contains invalid characters"
+		}
+		u.DisplayName = &name
+	}
+
+	if u.RollNumber != nil {
+		roll := strings.ToUpper(strings.TrimSpace(*u.RollNumber))
+		if roll != "" && !rollNumberPattern.MatchString(roll) {
+			errs["rollNumber"] = "Roll number must be 4 to 15 letters or digits"
+		}
+		u.RollNumber = &roll
+	}
+
+	if u.Department != nil {
+		department := strings.ToUpper(strings.TrimSpace(*u.Department))
+		if department != "" && !departments[department] {
+			errs["department"] = "Unknown department code"
+		}
+		u.Department = &department
+	}
+
+	if u.Programme != nil {
+		programme := strings.ToUpper(strings.TrimSpace(*u.Programme))
+		if programme != "" && !programmes[programme] {
+			errs["programme"] = "Unknown programme"
+		}
+		u.Programme = &programme
+	}
+
+	if u.BatchYear != nil && *u.BatchYear != 0 {
+		if *u.BatchYear < 1960 || *u.BatchYear > time.Now().Year()+1 {
+			errs["batchYear"] = "Batch year is out of range"
+		}
+	}
+
+	if u.Locale != nil {
+		locale := resolveLocale(*u.Locale)
+		u.Locale = &locale
+	}
+
+	return errs
+}
+
+// ensureProfileIndexes keeps roll numbers unique among the accounts that have one
+func ensureProfileIndexes() {
+	if _, err := registeredUsers.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "profile.rollNumber", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"profile.rollNumber": bson.M{"$type": "string"}}),
+	}); err != nil {
+		log.Printf("Failed to create roll number index: %v", err)
+	}
+}
+
+// Route returning the logged-in user's own account and profile
+func getMe(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, meResponse(&dbUser))
+}
+
+// Route for the logged-in user to edit their profile
+func updateMe(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	var req ProfileUpdate
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errs := req.validate(); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile", "fields": errs})
+		return
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	setOrUnset := func(field string, value string) {
+		if value == "" {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+	if req.DisplayName != nil {
+		setOrUnset("profile.displayName", *req.DisplayName)
+	}
+	if req.RollNumber != nil {
+		setOrUnset("profile.rollNumber", *req.RollNumber)
+	}
+	if req.Department != nil {
+		setOrUnset("profile.department", *req.Department)
+	}
+	if req.Programme != nil {
+		setOrUnset("profile.programme", *req.Programme)
+	}
+	if req.BatchYear != nil {
+		if *req.BatchYear == 0 {
+			unset["profile.batchYear"] = ""
+		} else {
+			set["profile.batchYear"] = *req.BatchYear
+		}
+	}
+	if req.Locale != nil {
+		set["locale"] = *req.Locale
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) > 0 {
+		result, err := registeredUsers.UpdateOne(ctx, bson.M{"username": claims.Username}, update)
+		if mongo.IsDuplicateKeyError(err) {
+			// Roll numbers identify a student, so two accounts cannot share one
+			c.JSON(http.StatusConflict, gin.H{"error": "Roll number is already in use", "fields": gin.H{"rollNumber": "Roll number is already in use"}})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, meResponse(&dbUser))
+}
+
+// meResponse is the public view of a user's own account
+func meResponse(dbUser *UserRegistration) gin.H {
+	profile := UserProfile{}
+	if dbUser.Profile != nil {
+		profile = *dbUser.Profile
+	}
+
+	return gin.H{
+		"username":    dbUser.Username,
+		"role":        dbUser.Role,
+		"isVerified":  dbUser.IsVerified,
+		"totpEnabled": dbUser.TOTPEnabled,
+		"locale":      resolveLocale(dbUser.Locale),
+		"courses":     dbUser.Courses,
+		"profile":     profile,
+	}
+}
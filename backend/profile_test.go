@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestUpdateMeRollNumberTaken(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("duplicate roll number", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "E11000 duplicate key error"}),
+		)
+
+		body := map[string]string{"rollNumber": "210123"}
+		recorder := serveJSONAs(updateMe, "asha@iitk.ac.in", "student", http.MethodPut, "/api/me", body)
+		expectStatus(mt, recorder, http.StatusConflict)
+		if fields, _ := responseBody(mt, recorder)["fields"].(map[string]interface{}); fields["rollNumber"] == nil {
+			mt.Errorf("conflict does not name the rollNumber field: %s", recorder.Body.String())
+		}
+	})
+}
+
+func TestProfileUpdateValidate(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	text := func(s string) *string { return &s }
+	nextYear := time.Now().Year() + 1
+
+	tests := []struct {
+		name   string
+		update ProfileUpdate
+		field  string // the field expected to be rejected, if any
+		check  func(u *ProfileUpdate) bool
+	}{
+		{"nothing", ProfileUpdate{}, "", nil},
+
+		{"display name spaces collapse", ProfileUpdate{DisplayName: text("  Asha \t  Rao ")}, "",
+			func(u *ProfileUpdate) bool { return *u.DisplayName == "Asha Rao" }},
+		{"display name cleared", ProfileUpdate{DisplayName: text("   ")}, "",
+			func(u *ProfileUpdate) bool { return *u.DisplayName == "" }},
+		{"display name of 100 characters", ProfileUpdate{DisplayName: text(strings.Repeat("अ", 100))}, "", nil},
+		{"display name too long", ProfileUpdate{DisplayName: text(strings.Repeat("a", 101))}, "displayName", nil},
+		{"display name with control characters", ProfileUpdate{DisplayName: text("Asha\x00Rao")}, "displayName", nil},
+
+		{"roll number upper-cased", ProfileUpdate{RollNumber: text(" 21cs0123 ")}, "",
+			func(u *ProfileUpdate) bool { return *u.RollNumber == "21CS0123" }},
+		{"roll number cleared", ProfileUpdate{RollNumber: text("")}, "",
+			func(u *ProfileUpdate) bool { return *u.RollNumber == "" }},
+		{"roll number too short", ProfileUpdate{RollNumber: text("210")}, "rollNumber", nil},
+		{"roll number too long", ProfileUpdate{RollNumber: text(strings.Repeat("1", 16))}, "rollNumber", nil},
+		{"roll number with punctuation", ProfileUpdate{RollNumber: text("21-0123")}, "rollNumber", nil},
+
+		{"department upper-cased", ProfileUpdate{Department: text("cse")}, "",
+			func(u *ProfileUpdate) bool { return *u.Department == "CSE" }},
+		{"department cleared", ProfileUpdate{Department: text(" ")}, "", nil},
+		{"unknown department", ProfileUpdate{Department: text("Computer Science")}, "department", nil},
+
+		{"programme upper-cased", ProfileUpdate{Programme: text(" phd")}, "",
+			func(u *ProfileUpdate) bool { return *u.Programme == "PHD" }},
+		{"programme cleared", ProfileUpdate{Programme: text("")}, "", nil},
+		{"unknown programme", ProfileUpdate{Programme: text("BTECH")}, "programme", nil},
+
+		{"batch year", ProfileUpdate{BatchYear: func() *int { y := 2021; return &y }()}, "", nil},
+		{"batch year cleared", ProfileUpdate{BatchYear: func() *int { y := 0; return &y }()}, "", nil},
+		{"batch year 1960", ProfileUpdate{BatchYear: func() *int { y := 1960; return &y }()}, "", nil},
+		{"batch year before 1960", ProfileUpdate{BatchYear: func() *int { y := 1959; return &y }()}, "batchYear", nil},
+		{"batch year next year", ProfileUpdate{BatchYear: &nextYear}, "", nil},
+		{"batch year too far ahead", ProfileUpdate{BatchYear: func() *int { y := nextYear + 1; return &y }()}, "batchYear", nil},
+
+		{"locale resolved", ProfileUpdate{Locale: text(" HI-IN ")}, "",
+			func(u *ProfileUpdate) bool { return *u.Locale == "hi" }},
+		{"unknown locale falls back", ProfileUpdate{Locale: text("fr")}, "",
+			func(u *ProfileUpdate) bool { return *u.Locale == defaultLocale }},
+	}
+	for _, tt := range tests {
+		update := tt.update
+		errs := update.validate()
+		if tt.field == "" && len(errs) > 0 {
+			t.Errorf("%s: unexpected errors %v", tt.name, errs)
+		}
+		if tt.field != "" && (len(errs) != 1 || errs[tt.field] == "") {
+			t.Errorf("%s: errors = %v, want one for %s", tt.name, errs, tt.field)
+		}
+		if tt.check != nil && !tt.check(&update) {
+			t.Errorf("%s: normalised to %+v", tt.name, update)
+		}
+	}
+
+	// Every bad field is reported at once
+	year := 1900
+	update := ProfileUpdate{RollNumber: text("x"), Department: text("XYZ"), Programme: text("XYZ"), BatchYear: &year}
+	if errs := update.validate(); len(errs) != 4 {
+		t.Errorf("errors = %v, want all four fields", errs)
+	}
+}
+
+func TestGetMeHidesSecrets(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("secrets", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+				{Key: "username", Value: "asha@iitk.ac.in"},
+				{Key: "password", Value: "$2a$10$hashedpassword"},
+				{Key: "role", Value: "student"},
+				{Key: "isverified", Value: true},
+				{Key: "otp", Value: "123456"},
+				{Key: "totpEnabled", Value: true},
+				{Key: "totpSecret", Value: "JBSWY3DPEHPK3PXP"},
+				{Key: "recoveryCodes", Value: bson.A{"$2a$10$recovery"}},
+				{Key: "resetToken", Value: "$2a$10$reset"},
+				{Key: "pendingEmailOtp", Value: "654321"},
+				{Key: "oidcSubject", Value: "sub-42"},
+				{Key: "tokenVersion", Value: 3},
+				{Key: "profile", Value: bson.D{{Key: "rollNumber", Value: "210123"}}},
+			}),
+		)
+		recorder := serveJSONAs(getMe, "asha@iitk.ac.in", "student", http.MethodGet, "/api/me", nil)
+		expectStatus(mt, recorder, http.StatusOK)
+
+		body := responseBody(mt, recorder)
+		if body["username"] != "asha@iitk.ac.in" || body["totpEnabled"] != true {
+			mt.Errorf("response = %v", body)
+		}
+		if profile, _ := body["profile"].(map[string]interface{}); profile["rollNumber"] != "210123" {
+			mt.Errorf("profile = %v", body["profile"])
+		}
+		for _, secret := range []string{"$2a$10$", "123456", "654321", "JBSWY3DPEHPK3PXP", "sub-42"} {
+			if strings.Contains(recorder.Body.String(), secret) {
+				mt.Errorf("response reveals %q: %s", secret, recorder.Body.String())
+			}
+		}
+		for _, field := range []string{"password", "otp", "totpSecret", "recoveryCodes", "resetToken", "tokenVersion", "oidcSubject"} {
+			if _, ok := body[field]; ok {
+				mt.Errorf("response has %s", field)
+			}
+		}
+	})
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Requirement is a parsed prerequisite or co-requisite rule: either a single
+// course code or an "and"/"or" of sub-rules
+type Requirement struct {
+	Op    string
+	Code  string
+	Terms []*Requirement
+}
+
+// RequirementResult explains how a rule was evaluated for a student, mirroring
+// the shape of the rule
+type RequirementResult struct {
+	Course    string              `json:"course,omitempty"`
+	Operator  string              `json:"operator,omitempty"`
+	Satisfied bool                `json:"satisfied"`
+	Terms     []RequirementResult `json:"terms,omitempty"`
+}
+
+// UnmetRequirement is returned to clients for each kind of rule a request fails
+type UnmetRequirement struct {
+	Kind        string            `json:"kind"`
+	Rule        string            `json:"rule"`
+	Explanation string            `json:"explanation"`
+	Result      RequirementResult `json:"result"`
+}
+
+// parseRequirement parses rules such as "CS201 AND (MTH101 OR MTH102)". AND
+// binds tighter than OR; "&", "|" and "," (meaning AND) are accepted too. An
+// empty rule parses to nil.
+func parseRequirement(rule string) (*Requirement, error) {
+	p := &requirementParser{tokens: tokenizeRequirement(rule)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	req, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return req, nil
+}
+
+func tokenizeRequirement(rule string) []string {
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range rule {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case strings.ContainsRune("()&|,", r):
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type requirementParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *requirementParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToUpper(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *requirementParser) parseOr() (*Requirement, error) {
+	return p.parseList("or", []string{"OR", "|"}, p.parseAnd)
+}
+
+func (p *requirementParser) parseAnd() (*Requirement, error) {
+	return p.parseList("and", []string{"AND", "&", ","}, p.parseTerm)
+}
+
+// parseList parses operands joined by any of the given operator tokens,
+// flattening nested lists of the same operator
+func (p *requirementParser) parseList(op string, operators []string, operand func() (*Requirement, error)) (*Requirement, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	list := &Requirement{Op: op}
+	add := func(term *Requirement) {
+		if term.Op == op {
+			list.Terms = append(list.Terms, term.Terms...)
+		} else {
+			list.Terms = append(list.Terms, term)
+		}
+	}
+	add(first)
+
+	for isOneOf(p.peek(), operators) {
+		p.pos++
+		next, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		add(next)
+	}
+	if len(list.Terms) == 1 {
+		return list.Terms[0], nil
+	}
+	return list, nil
+}
+
+func (p *requirementParser) parseTerm() (*Requirement, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("rule ends too early")
+	case token == "(":
+		p.pos++
+		req, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return req, nil
+	case token == "AND" || token == "OR" || strings.ContainsAny(token, ")&|,"):
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+
+	code := normaliseCourseCode(token)
+	if !courseCodePattern.MatchString(code) {
+		return nil, fmt.Errorf("%q is not a valid course code", p.tokens[p.pos])
+	}
+	p.pos++
+	return &Requirement{Code: code}, nil
+}
+
+func isOneOf(token string, options []string) bool {
+	for _, option := range options {
+		if token == option {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the rule canonically, parenthesising every nested combination
+func (r *Requirement) String() string {
+	if r == nil {
+		return ""
+	}
+	if r.Op == "" {
+		return r.Code
+	}
+	parts := make([]string, len(r.Terms))
+	for i, term := range r.Terms {
+		parts[i] = term.String()
+		if term.Op != "" {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " "+strings.ToUpper(r.Op)+" ")
+}
+
+// Codes lists every course code the rule mentions, in order of first appearance
+func (r *Requirement) Codes() []string {
+	codes := []string{}
+	var walk func(*Requirement)
+	walk = func(r *Requirement) {
+		if r == nil {
+			return
+		}
+		if r.Op == "" {
+			codes = appendUnique(codes, r.Code)
+		}
+		for _, term := range r.Terms {
+			walk(term)
+		}
+	}
+	walk(r)
+	return codes
+}
+
+// Evaluate checks the rule against the set of course codes a student has
+func (r *Requirement) Evaluate(has map[string]bool) RequirementResult {
+	if r.Op == "" {
+		return RequirementResult{Course: r.Code, Satisfied: has[r.Code]}
+	}
+
+	result := RequirementResult{Operator: r.Op, Satisfied: r.Op == "and"}
+	for _, term := range r.Terms {
+		sub := term.Evaluate(has)
+		result.Terms = append(result.Terms, sub)
+		if r.Op == "and" {
+			result.Satisfied = result.Satisfied && sub.Satisfied
+		} else {
+			result.Satisfied = result.Satisfied || sub.Satisfied
+		}
+	}
+	return result
+}
+
+// explain describes what is still missing from an unsatisfied result
+func (res RequirementResult) explain() string {
+	if res.Operator == "" {
+		return res.Course
+	}
+
+	var parts []string
+	for _, term := range res.Terms {
+		if res.Operator == "and" && term.Satisfied {
+			continue
+		}
+		parts = append(parts, term.explain())
+	}
+	// A part only needs parentheses when it sits beside others
+	if len(parts) > 1 {
+		for i, text := range parts {
+			if strings.Contains(text, " ") {
+				parts[i] = "(" + text + ")"
+			}
+		}
+	}
+	if res.Operator == "or" {
+		if len(parts) == 1 {
+			return parts[0]
+		}
+		return "one of " + strings.Join(parts, ", ")
+	}
+	return strings.Join(parts, " and ")
+}
+
+// prerequisiteRule is the course's prerequisite rule; courses defined with a
+// plain list require every course in it
+func (course *Course) prerequisiteRule() string {
+	if course.Requires != "" {
+		return course.Requires
+	}
+	return strings.Join(course.Prerequisites, " AND ")
+}
+
+// courseCodesByName maps enrollment strings, which hold course names, to
+// course codes. Strings that match no course are kept as codes in case they are one.
+func courseCodesByName(c context.Context, names []string) (map[string]bool, error) {
+	codes := map[string]bool{}
+	if len(names) == 0 {
+		return codes, nil
+	}
+	cursor, err := courseCollection.Find(c, bson.M{"name": bson.M{"$in": names}})
+	if err != nil {
+		return nil, err
+	}
+	var courses []Course
+	if err := cursor.All(c, &courses); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		codes[normaliseCourseCode(name)] = true
+	}
+	for _, course := range courses {
+		codes[course.Code] = true
+	}
+	return codes, nil
+}
+
+// checkRequirements evaluates the course's rules for a student taking it in
+// term. Prerequisites must have been taken in an earlier term; co-requisites
+// may also be taken in the same term or be pending requests for it other than
+// the one being checked. With term empty every enrollment and request counts.
+func checkRequirements(c context.Context, student *UserRegistration, course *Course, term string) ([]UnmetRequirement, error) {
+	prerequisites, err := parseRequirement(course.prerequisiteRule())
+	if err != nil {
+		return nil, fmt.Errorf("course %s has an invalid prerequisite rule: %v", course.Code, err)
+	}
+	corequisites, err := parseRequirement(course.Corequires)
+	if err != nil {
+		return nil, fmt.Errorf("course %s has an invalid co-requisite rule: %v", course.Code, err)
+	}
+	unmet := []UnmetRequirement{}
+	if prerequisites == nil && corequisites == nil {
+		return unmet, nil
+	}
+
+	earlier := student.coursesBefore(term)
+	taken, err := courseCodesByName(c, earlier)
+	if err != nil {
+		return nil, err
+	}
+	if prerequisites != nil {
+		if result := prerequisites.Evaluate(taken); !result.Satisfied {
+			unmet = append(unmet, UnmetRequirement{
+				Kind:        "prerequisite",
+				Rule:        prerequisites.String(),
+				Explanation: "Requires " + result.explain() + " to have been taken",
+				Result:      result,
+			})
+		}
+	}
+
+	if corequisites != nil {
+		var requests []CourseUpdateRequest
+		filter := bson.M{"username": student.Username, "course": bson.M{"$ne": course.Name}}
+		if term != "" {
+			filter["term"] = term
+		}
+		cursor, err := requestCollection.Find(c, filter)
+		if err != nil {
+			return nil, err
+		}
+		if err := cursor.All(c, &requests); err != nil {
+			return nil, err
+		}
+		names := earlier
+		if term != "" {
+			names = append(names, student.coursesIn(term)...)
+		}
+		for _, request := range requests {
+			names = append(names, request.Course)
+		}
+		alongside, err := courseCodesByName(c, names)
+		if err != nil {
+			return nil, err
+		}
+
+		if result := corequisites.Evaluate(alongside); !result.Satisfied {
+			unmet = append(unmet, UnmetRequirement{
+				Kind:        "corequisite",
+				Rule:        corequisites.String(),
+				Explanation: "Requires " + result.explain() + " to be taken or requested alongside",
+				Result:      result,
+			})
+		}
+	}
+	return unmet, nil
+}
+
+// studentMeetsRequirements checks a student's eligibility for a course in a term,
+// writing a 409 that explains every unmet rule when they are not eligible.
+// With advisoryCorequisites set, unmet co-requisites do not block and are
+// returned instead, so courses that require each other can be requested one
+// after the other; they are enforced when the request is approved.
+func studentMeetsRequirements(c *gin.Context, student *UserRegistration, course *Course, term string, advisoryCorequisites bool) ([]UnmetRequirement, bool) {
+	unmet, err := checkRequirements(ctx, student, course, term)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check course requirements"})
+		return nil, false
+	}
+
+	var advisory []UnmetRequirement
+	if advisoryCorequisites {
+		blocking := []UnmetRequirement{}
+		for _, requirement := range unmet {
+			if requirement.Kind == "corequisite" {
+				advisory = append(advisory, requirement)
+			} else {
+				blocking = append(blocking, requirement)
+			}
+		}
+		unmet = blocking
+	}
+	if len(unmet) == 0 {
+		return advisory, true
+	}
+
+	explanations := make([]string, len(unmet))
+	for i, requirement := range unmet {
+		explanations[i] = requirement.Explanation
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":  fmt.Sprintf("Requirements for %s are not met: %s", course.Code, strings.Join(explanations, "; ")),
+		"reason": "requirements_not_met",
+		"unmet":  unmet,
+	})
+	return nil, false
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCorequisitesAdvisoryUntilApproval(t *testing.T) {
+	student := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+		{Key: "username", Value: "asha@iitk.ac.in"},
+		{Key: "role", Value: "student"},
+		{Key: "courses", Value: bson.A{}},
+	})
+	course := func(requires string) bson.D {
+		return mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{
+			{Key: "code", Value: "PHY103"},
+			{Key: "name", Value: "Mechanics"},
+			{Key: "requires", Value: requires},
+			{Key: "corequires", Value: "PHY103L"},
+		})
+	}
+	body := map[string]string{"username": "asha@iitk.ac.in", "course": "PHY103"}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("request reports the missing co-requisite", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			course(""),
+			noDocuments("db.terms"),
+			mtest.CreateCursorResponse(0, "db.course_requests", mtest.FirstBatch, bson.D{{Key: "n", Value: 0}}),
+			noDocuments("db.course_requests"),
+			noDocuments("db.course_requests"),
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveJSONAs(addCourseToStudent, "asha@iitk.ac.in", "student", http.MethodPost, "/api/add-course", body)
+		expectStatus(mt, recorder, http.StatusOK)
+
+		unmet, _ := responseBody(mt, recorder)["unmetCorequisites"].([]interface{})
+		if len(unmet) != 1 || unmet[0].(map[string]interface{})["rule"] != "PHY103L" {
+			mt.Errorf("unmetCorequisites = %v", unmet)
+		}
+		stored := false
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" && event.Command.Lookup("insert").StringValue() == "course_requests" {
+				stored = true
+				request := event.Command.Lookup("documents").Array().Index(0).Value().Document()
+				if _, err := request.LookupErr("unmetCorequisites"); err != nil {
+					mt.Errorf("request does not keep its unmet co-requisites: %v", request)
+				}
+			}
+		}
+		if !stored {
+			mt.Error("no request was stored")
+		}
+	})
+
+	mt.Run("prerequisites still block the request", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			course("MTH101"),
+			noDocuments("db.terms"),
+			mtest.CreateCursorResponse(0, "db.course_requests", mtest.FirstBatch, bson.D{{Key: "n", Value: 0}}),
+			noDocuments("db.course_requests"),
+		)
+		recorder := serveJSONAs(addCourseToStudent, "asha@iitk.ac.in", "student", http.MethodPost, "/api/add-course", body)
+		expectStatus(mt, recorder, http.StatusConflict)
+
+		unmet, _ := responseBody(mt, recorder)["unmet"].([]interface{})
+		if len(unmet) != 1 || unmet[0].(map[string]interface{})["kind"] != "prerequisite" {
+			mt.Errorf("unmet = %v, want only the prerequisite", unmet)
+		}
+	})
+
+	mt.Run("approval enforces the co-requisite", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateCursorResponse(0, "db.course_requests", mtest.FirstBatch, bson.D{
+				{Key: "username", Value: "asha@iitk.ac.in"},
+				{Key: "course", Value: "Mechanics"},
+			}),
+			course(""),
+			student,
+			noDocuments("db.course_requests"),
+		)
+		approval := map[string]interface{}{"username": "asha@iitk.ac.in", "course": "Mechanics", "verified": true}
+		recorder := serveJSONAs(updateCourseVerificationStatus, "admin@iitk.ac.in", "admin", http.MethodPut, "/api/update-course-verification", approval)
+		expectStatus(mt, recorder, http.StatusConflict)
+		if reason := responseBody(mt, recorder)["reason"]; reason != "requirements_not_met" {
+			mt.Errorf("reason = %v", reason)
+		}
+	})
+}
+
+func TestTokenizeRequirement(t *testing.T) {
+	tests := []struct {
+		rule string
+		want []string
+	}{
+		{"", nil},
+		{"  CS201  ", []string{"CS201"}},
+		{"CS201 AND (MTH101 OR MTH102)", []string{"CS201", "AND", "(", "MTH101", "OR", "MTH102", ")"}},
+		{"CS201&(MTH101|MTH102),PHY103", []string{"CS201", "&", "(", "MTH101", "|", "MTH102", ")", ",", "PHY103"}},
+	}
+	for _, tt := range tests {
+		if got := tokenizeRequirement(tt.rule); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeRequirement(%q) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestParseRequirement(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"cs201", "CS201"},
+		{"((CS201))", "CS201"},
+		{"CS201 AND MTH101 OR MTH102", "(CS201 AND MTH101) OR MTH102"},
+		{"CS201 OR MTH101 AND MTH102", "CS201 OR (MTH101 AND MTH102)"},
+		{"CS201 AND (MTH101 OR MTH102)", "CS201 AND (MTH101 OR MTH102)"},
+		{"cs201 and mth101 or mth102", "(CS201 AND MTH101) OR MTH102"},
+		{"CS201 & MTH101 | PHY103, PHY103L", "(CS201 AND MTH101) OR (PHY103 AND PHY103L)"},
+		{"CS201, MTH101", "CS201 AND MTH101"},
+		{"CS201 AND (MTH101 AND MTH102)", "CS201 AND MTH101 AND MTH102"},
+		{"(CS201 OR MTH101) OR (MTH102 | PHY103)", "CS201 OR MTH101 OR MTH102 OR PHY103"},
+	}
+	for _, tt := range tests {
+		req, err := parseRequirement(tt.rule)
+		if err != nil {
+			t.Errorf("parseRequirement(%q) failed: %v", tt.rule, err)
+			continue
+		}
+		if got := req.String(); got != tt.want {
+			t.Errorf("parseRequirement(%q) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+
+	// Nested lists of the same operator are flattened into one
+	req, _ := parseRequirement("CS201 AND (MTH101 AND (MTH102 AND PHY103))")
+	if req.Op != "and" || len(req.Terms) != 4 {
+		t.Errorf("nested AND parsed as %+v, want one list of four", req)
+	}
+}
+
+func TestParseRequirementErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"CS201 AND", "rule ends too early"},
+		{"CS201 OR", "rule ends too early"},
+		{"(CS201", "missing closing parenthesis"},
+		{"(CS201 OR MTH101", "missing closing parenthesis"},
+		{"CS201)", `unexpected ")"`},
+		{"AND CS201", `unexpected "AND"`},
+		{"CS201 OR | MTH101", `unexpected "|"`},
+		{"CS201 MTH101", `unexpected "MTH101"`},
+		{"()", `unexpected ")"`},
+		{"CS_201", `"CS_201" is not a valid course code`},
+		{"CS201 AND C", `"C" is not a valid course code`},
+	}
+	for _, tt := range tests {
+		req, err := parseRequirement(tt.rule)
+		if err == nil {
+			t.Errorf("parseRequirement(%q) = %v, want an error", tt.rule, req)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("parseRequirement(%q) error = %q, want %q", tt.rule, err, tt.want)
+		}
+	}
+}
+
+func TestRequirementString(t *testing.T) {
+	tests := []struct {
+		req  *Requirement
+		want string
+	}{
+		{nil, ""},
+		{&Requirement{Code: "CS201"}, "CS201"},
+		{&Requirement{Op: "or", Terms: []*Requirement{{Code: "MTH101"}, {Code: "MTH102"}}}, "MTH101 OR MTH102"},
+		{&Requirement{Op: "and", Terms: []*Requirement{
+			{Code: "CS201"},
+			{Op: "or", Terms: []*Requirement{{Code: "MTH101"}, {Code: "MTH102"}}},
+		}}, "CS201 AND (MTH101 OR MTH102)"},
+	}
+	for _, tt := range tests {
+		if got := tt.req.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestEvaluateRequirement(t *testing.T) {
+	tests := []struct {
+		rule      string
+		has       []string
+		satisfied bool
+		explain   string
+	}{
+		{"CS201", nil, false, "CS201"},
+		{"CS201", []string{"CS201"}, true, ""},
+		{"CS201 AND MTH101", []string{"CS201"}, false, "MTH101"},
+		{"CS201 AND MTH101", nil, false, "CS201 and MTH101"},
+		{"CS201 OR MTH101", nil, false, "one of CS201, MTH101"},
+		{"CS201 OR MTH101", []string{"MTH101"}, true, ""},
+		{"CS201 AND (MTH101 OR MTH102)", nil, false, "CS201 and (one of MTH101, MTH102)"},
+		{"CS201 AND (MTH101 OR MTH102)", []string{"CS201"}, false, "one of MTH101, MTH102"},
+		{"CS201 AND (MTH101 OR MTH102)", []string{"MTH102"}, false, "CS201"},
+		{"CS201 AND (MTH101 OR MTH102)", []string{"CS201", "MTH102"}, true, ""},
+		{"CS201 OR (MTH101 AND MTH102)", nil, false, "one of CS201, (MTH101 and MTH102)"},
+		{"CS201 OR (MTH101 AND MTH102)", []string{"MTH101"}, false, "one of CS201, MTH102"},
+	}
+	for _, tt := range tests {
+		req, err := parseRequirement(tt.rule)
+		if err != nil {
+			t.Fatalf("parseRequirement(%q) failed: %v", tt.rule, err)
+		}
+		has := map[string]bool{}
+		for _, code := range tt.has {
+			has[code] = true
+		}
+		result := req.Evaluate(has)
+		if result.Satisfied != tt.satisfied {
+			t.Errorf("%q with %v: satisfied = %v, want %v", tt.rule, tt.has, result.Satisfied, tt.satisfied)
+		}
+		if !tt.satisfied {
+			if got := result.explain(); got != tt.explain {
+				t.Errorf("%q with %v: explain() = %q, want %q", tt.rule, tt.has, got, tt.explain)
+			}
+		}
+	}
+
+	// The result mirrors the shape of the rule
+	req, _ := parseRequirement("CS201 AND (MTH101 OR MTH102)")
+	want := RequirementResult{Operator: "and", Terms: []RequirementResult{
+		{Course: "CS201", Satisfied: true},
+		{Operator: "or", Terms: []RequirementResult{
+			{Course: "MTH101"},
+			{Course: "MTH102"},
+		}},
+	}}
+	if got := req.Evaluate(map[string]bool{"CS201": true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Evaluate() = %+v, want %+v", got, want)
+	}
+}
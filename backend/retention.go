@@ -0,0 +1,136 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// unverifiedAccountTTL is how long an account may stay unverified before it is purged
+	unverifiedAccountTTL = 72 * time.Hour
+	// reregisterAfter is how long a username stays reserved by an unverified
+	// account before someone may register it again
+	reregisterAfter = 15 * time.Minute
+
+	unverifiedPurged      = expvar.NewInt("unverified_accounts_purged_total")
+	unverifiedOverwritten = expvar.NewInt("unverified_accounts_overwritten_total")
+	unverifiedPurgeErrors = expvar.NewInt("unverified_account_purge_errors_total")
+)
+
+// accountAge is the part of a user document needed to decide whether it is stale
+type accountAge struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	IsVerified bool               `bson:"isVerified"`
+	CreatedAt  time.Time          `bson:"createdAt"`
+}
+
+// createdAt falls back to the ObjectID timestamp for accounts stored before createdAt existed
+func (a accountAge) createdAt() time.Time {
+	if !a.CreatedAt.IsZero() {
+		return a.CreatedAt
+	}
+	return a.ID.Timestamp()
+}
+
+// canBeOverwritten reports whether a new registration may replace this account
+func (a accountAge) canBeOverwritten(now time.Time) bool {
+	return !a.IsVerified && now.Sub(a.createdAt()) >= reregisterAfter
+}
+
+// loadRetentionConfig reads UNVERIFIED_ACCOUNT_TTL and UNVERIFIED_REREGISTER_AFTER
+func loadRetentionConfig() {
+	if value := os.Getenv("UNVERIFIED_ACCOUNT_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid UNVERIFIED_ACCOUNT_TTL %q", value)
+		}
+		unverifiedAccountTTL = ttl
+	}
+	if value := os.Getenv("UNVERIFIED_REREGISTER_AFTER"); value != "" {
+		after, err := time.ParseDuration(value)
+		if err != nil || after < 0 {
+			log.Fatalf("Invalid UNVERIFIED_REREGISTER_AFTER %q", value)
+		}
+		reregisterAfter = after
+	}
+}
+
+// startUnverifiedAccountPurge removes abandoned registrations every hour
+func startUnverifiedAccountPurge() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			purgeUnverifiedAccounts()
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeUnverifiedAccounts deletes accounts that have stayed unverified past
+// the retention window, along with any course requests they made
+func purgeUnverifiedAccounts() {
+	cutoff := time.Now().Add(-unverifiedAccountTTL)
+	filter := bson.M{
+		"isVerified": false,
+		"$or": []bson.M{
+			{"createdAt": bson.M{"$lt": cutoff}},
+			{"createdAt": bson.M{"$exists": false}, "_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(cutoff)}},
+		},
+	}
+
+	cursor, err := registeredUsers.Find(ctx, filter)
+	if err != nil {
+		unverifiedPurgeErrors.Add(1)
+		log.Printf("Failed to find unverified accounts to purge: %v", err)
+		return
+	}
+	var stale []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Username string             `bson:"username"`
+	}
+	if err := cursor.All(ctx, &stale); err != nil {
+		unverifiedPurgeErrors.Add(1)
+		log.Printf("Failed to decode unverified accounts to purge: %v", err)
+		return
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(stale))
+	usernames := make([]string, 0, len(stale))
+	for _, account := range stale {
+		ids = append(ids, account.ID)
+		usernames = append(usernames, account.Username)
+	}
+
+	// Re-check verification so an account verified since the Find is kept
+	result, err := registeredUsers.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}, "isVerified": false})
+	if err != nil {
+		unverifiedPurgeErrors.Add(1)
+		log.Printf("Failed to purge unverified accounts: %v", err)
+		return
+	}
+	if _, err := requestCollection.DeleteMany(ctx, bson.M{"username": bson.M{"$in": usernames}}); err != nil {
+		log.Printf("Failed to remove course requests of purged accounts: %v", err)
+	}
+
+	unverifiedPurged.Add(result.DeletedCount)
+	log.Printf("Purged %d unverified accounts older than %s", result.DeletedCount, unverifiedAccountTTL)
+}
+
+// Route exposing process metrics, including purge counts, to admins
+func adminMetrics(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
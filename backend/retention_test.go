@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCanBeOverwritten(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		account accountAge
+		want    bool
+	}{
+		"verified":             {accountAge{IsVerified: true, CreatedAt: now.Add(-time.Hour)}, false},
+		"recently registered":  {accountAge{CreatedAt: now.Add(-time.Minute)}, false},
+		"abandoned":            {accountAge{CreatedAt: now.Add(-reregisterAfter)}, true},
+		"legacy, recent":       {accountAge{ID: primitive.NewObjectIDFromTimestamp(now.Add(-time.Minute))}, false},
+		"legacy, abandoned":    {accountAge{ID: primitive.NewObjectIDFromTimestamp(now.Add(-time.Hour))}, true},
+		"legacy with new date": {accountAge{ID: primitive.NewObjectIDFromTimestamp(now.Add(-time.Hour)), CreatedAt: now}, false},
+	}
+	for name, test := range tests {
+		if got := test.account.canBeOverwritten(now); got != test.want {
+			t.Errorf("%s: canBeOverwritten = %v, want %v", name, got, test.want)
+		}
+	}
+}
+
+func TestPurgeUnverifiedAccounts(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("stale accounts", func(mt *mtest.T) {
+		useMockCollections(mt)
+		first, second := primitive.NewObjectID(), primitive.NewObjectID()
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: first}, {Key: "username", Value: "asha@iitk.ac.in"}},
+				bson.D{{Key: "_id", Value: second}, {Key: "username", Value: "ravi@iitk.ac.in"}}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+		before := unverifiedPurged.Value()
+
+		purgeUnverifiedAccounts()
+
+		var deletes []bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "delete" {
+				deletes = append(deletes, event.Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").Document())
+			}
+		}
+		if len(deletes) != 2 {
+			mt.Fatalf("deletes = %v", deletes)
+		}
+		// An account verified between the find and the delete is kept
+		if verified, err := deletes[0].LookupErr("isVerified"); err != nil || verified.Boolean() {
+			mt.Errorf("delete does not re-check verification: %v", deletes[0])
+		}
+		if ids, _ := deletes[0].Lookup("_id", "$in").Array().Values(); len(ids) != 2 {
+			mt.Errorf("deleted %v, want both stale accounts", deletes[0])
+		}
+		if names, _ := deletes[1].Lookup("username", "$in").Array().Values(); len(names) != 2 {
+			mt.Errorf("course requests removed for %v", deletes[1])
+		}
+		if got := unverifiedPurged.Value() - before; got != 2 {
+			mt.Errorf("purge counter grew by %d, want 2", got)
+		}
+	})
+
+	mt.Run("nothing to purge", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(noDocuments("db.registered_users"))
+
+		purgeUnverifiedAccounts()
+
+		if events := mt.GetAllStartedEvents(); len(events) != 1 {
+			mt.Errorf("sent %d commands, want only the find", len(events))
+		}
+	})
+}
+
+func TestRegisterOverUnverifiedAccount(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	abandoned := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+		{Key: "_id", Value: id},
+		{Key: "isVerified", Value: false},
+		{Key: "createdAt", Value: time.Now().Add(-time.Hour)},
+	})
+	body := map[string]string{"username": "asha@iitk.ac.in", "password": "correct horse", "role": "student"}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("still reserved", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "isVerified", Value: false},
+			{Key: "createdAt", Value: time.Now().Add(-time.Minute)},
+		}))
+		recorder := serveJSON(register, http.MethodPost, "/api/register", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+	})
+
+	mt.Run("abandoned", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			abandoned,
+			matchedDocuments(1),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		before := unverifiedOverwritten.Value()
+		recorder := serveJSON(register, http.MethodPost, "/api/register", body)
+		expectStatus(mt, recorder, http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 || updates[0].Lookup("q", "_id").ObjectID() != id {
+			mt.Fatalf("updates = %v, want the abandoned account replaced", updates)
+		}
+		if verified, err := updates[0].LookupErr("q", "isVerified"); err != nil || verified.Boolean() {
+			mt.Errorf("replacement does not re-check verification: %v", updates[0])
+		}
+		if got := unverifiedOverwritten.Value() - before; got != 1 {
+			mt.Errorf("overwrite counter grew by %d, want 1", got)
+		}
+	})
+
+	mt.Run("verified meanwhile", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(abandoned, matchedDocuments(0), mtest.CreateSuccessResponse())
+		recorder := serveJSON(register, http.MethodPost, "/api/register", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the chunk uploaded per request; S3 requires at least 5 MiB
+	// for every part but the last
+	s3PartSize = 5 << 20
+
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3Algorithm        = "AWS4-HMAC-SHA256"
+	s3TimeFormat       = "20060102T150405Z"
+)
+
+// S3BlobStore keeps blobs in a bucket of any S3-compatible service, such as
+// AWS S3 or MinIO, signing requests with AWS Signature Version 4
+type S3BlobStore struct {
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket as endpoint/bucket rather than bucket.endpoint
+	PathStyle bool
+	Client    *http.Client
+
+	// now is replaced in tests to sign with a fixed time
+	now func() time.Time
+}
+
+// newS3BlobStoreFromEnv reads S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_PREFIX,
+// S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY and S3_PATH_STYLE
+func newS3BlobStoreFromEnv() (*S3BlobStore, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	store := &S3BlobStore{
+		Endpoint:        parsed,
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		Prefix:          strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       os.Getenv("S3_PATH_STYLE") != "false",
+		Client:          &http.Client{Timeout: 10 * time.Minute},
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.Bucket == "" || store.AccessKeyID == "" || store.SecretAccessKey == "" {
+		return nil, errors.New("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for the s3 blob store")
+	}
+	return store, nil
+}
+
+func (s *S3BlobStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// objectURL returns the URL of key, or of the bucket itself when key is empty
+func (s *S3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.Endpoint
+	path := ""
+	if key != "" {
+		path = "/" + key
+		if s.Prefix != "" {
+			path = "/" + s.Prefix + "/" + key
+		}
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + path
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = path
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// s3Escape percent-encodes everything but RFC 3986 unreserved characters, as
+// SigV4 requires; slashes are kept when encoding a path
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~', ch == '/' && keepSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signature computes the SigV4 signature for a canonical request made at t
+func (s *S3BlobStore) signature(t time.Time, canonicalRequest string) (scope, signature string) {
+	date := t.Format("20060102")
+	scope = date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := s3Algorithm + "\n" + t.Format(s3TimeFormat) + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalRequest builds the SigV4 canonical form of a request and the list of signed headers
+func canonicalRequest(method string, u *url.URL, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		method,
+		s3Escape(path, true),
+		u.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+// do signs and sends a request whose body, if any, is already in memory
+func (s *S3BlobStore) do(method, key string, query url.Values, extraHeaders map[string]string, body []byte) (*http.Response, error) {
+	u := s.objectURL(key, query)
+	t := s.clock().UTC()
+
+	payloadHash := s3EmptyPayloadHash
+	if body != nil {
+		payloadHash = sha256Hex(body)
+	}
+	headers := map[string]string{
+		"host":                 u.Host,
+		"x-amz-date":           t.Format(s3TimeFormat),
+		"x-amz-content-sha256": payloadHash,
+	}
+	for name, value := range extraHeaders {
+		headers[strings.ToLower(name)] = value
+	}
+
+	canonical, signedHeaders := canonicalRequest(method, u, headers, payloadHash)
+	scope, signature := s.signature(t, canonical)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKeyID, scope, signedHeaders, signature))
+
+	return s.Client.Do(req)
+}
+
+// s3Error turns an unexpected response into an error, reading the S3 error code if present
+func s3Error(resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		return fmt.Errorf("s3 %s: %s: %s", resp.Status, body.Code, body.Message)
+	}
+	return fmt.Errorf("s3 %s", resp.Status)
+}
+
+// Put uploads small blobs in one request and larger ones as a multipart
+// upload, holding at most one part in memory at a time
+func (s *S3BlobStore) Put(key string, r io.Reader) (int64, error) {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), s.putObject(key, buf[:n])
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	uploadID, err := s.createMultipartUpload(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		etags []string
+		total int64
+	)
+	for part := buf[:n]; len(part) > 0; {
+		etag, err := s.uploadPart(key, uploadID, len(etags)+1, part)
+		if err != nil {
+			s.abortMultipartUpload(key, uploadID)
+			return 0, err
+		}
+		etags = append(etags, etag)
+		total += int64(len(part))
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abortMultipartUpload(key, uploadID)
+			return 0, err
+		}
+		part = buf[:n]
+	}
+
+	if err := s.completeMultipartUpload(key, uploadID, etags); err != nil {
+		s.abortMultipartUpload(key, uploadID)
+		return 0, err
+	}
+	return total, nil
+}
+
+func (s *S3BlobStore) putObject(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) createMultipartUpload(key string) (string, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", errors.New("s3 did not return an upload ID")
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3BlobStore) uploadPart(key, uploadID string, number int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := s.do(http.MethodPut, key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *S3BlobStore) completeMultipartUpload(key, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, map[string]string{"content-type": "application/xml"}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3CheckBody(resp)
+}
+
+// s3CheckBody catches errors that S3 reports with a 200 status, which
+// CompleteMultipartUpload and CopyObject can do
+func s3CheckBody(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		var body struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.Unmarshal(data, &body)
+		return fmt.Errorf("s3: %s: %s", body.Code, body.Message)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) abortMultipartUpload(key, uploadID string) {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Get streams the object body straight from S3
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) Stat(key string) (int64, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("s3 %s", resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+// Move copies the object server-side and deletes the original
+func (s *S3BlobStore) Move(from, to string) error {
+	source := "/" + s.Bucket + "/" + from
+	if s.Prefix != "" {
+		source = "/" + s.Bucket + "/" + s.Prefix + "/" + from
+	}
+	resp, err := s.do(http.MethodPut, to, nil, map[string]string{"x-amz-copy-source": s3Escape(source, true)}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := s3CheckBody(resp); err != nil {
+		return err
+	}
+	return s.Delete(from)
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// SignedURL presigns a GET so clients download straight from the bucket,
+// with the filename and content type the API would have sent
+func (s *S3BlobStore) SignedURL(key, filename, contentType string, ttl time.Duration) (string, error) {
+	t := s.clock().UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.AccessKeyID + "/" + t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"},
+		"X-Amz-Date":          {t.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if filename != "" {
+		query.Set("response-content-disposition", attachmentDisposition(filename))
+	}
+	if contentType != "" {
+		query.Set("response-content-type", contentType)
+	}
+
+	u := s.objectURL(key, query)
+	canonical, _ := canonicalRequest(http.MethodGet, u, map[string]string{"host": u.Host}, s3UnsignedPayload)
+	_, signature := s.signature(t, canonical)
+
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errCourseFull      = errors.New("course is full")
+	errAlreadyEnrolled = errors.New("student is already enrolled")
+	errNotEnrolled     = errors.New("student is not enrolled")
+)
+
+// fillSeats sets the derived seat count returned to clients
+func (course *Course) fillSeats() {
+	course.Available = nil
+	if course.Capacity > 0 {
+		available := course.Capacity - course.Enrolled
+		if available < 0 {
+			available = 0
+		}
+		course.Available = &available
+	}
+}
+
+// migrateSeatCounts counts the enrolled students of courses that have no seat
+// counter yet; after that the counter is only changed by reserveSeat and releaseSeat
+func migrateSeatCounts() {
+	cursor, err := courseCollection.Find(ctx, bson.M{"enrolled": bson.M{"$exists": false}})
+	if err != nil {
+		log.Printf("Failed to find courses without seat counts: %v", err)
+		return
+	}
+	var courses []Course
+	if err := cursor.All(ctx, &courses); err != nil {
+		log.Printf("Failed to decode courses without seat counts: %v", err)
+		return
+	}
+
+	for _, course := range courses {
+		enrolled, err := registeredUsers.CountDocuments(ctx, bson.M{"courses": course.Name})
+		if err != nil {
+			log.Printf("Failed to count students of course '%s': %v", course.Name, err)
+			continue
+		}
+		_, err = courseCollection.UpdateOne(ctx,
+			bson.M{"_id": course.ID, "enrolled": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"enrolled": enrolled, "capacity": course.Capacity}})
+		if err != nil {
+			log.Printf("Failed to store seat count of course '%s': %v", course.Name, err)
+		}
+	}
+}
+
+// seatCounter returns the collection and filter of the document counting the
+// seats of a course in a term: the term's offering, or the catalog course
+// itself for enrollments outside any term
+func seatCounter(courseName, term string) (*mongo.Collection, bson.M) {
+	if term == "" {
+		return courseCollection, bson.M{"name": courseName}
+	}
+	return offeringCollection, bson.M{"courseName": courseName, "term": term}
+}
+
+// reserveSeat takes a seat in the named course in the term, failing with
+// errCourseFull when none is left. Courses that are not in the catalog or not
+// offered in the term are not counted.
+func reserveSeat(sc mongo.SessionContext, courseName, term string) error {
+	collection, filter := seatCounter(courseName, term)
+	limited := bson.M{
+		// A capacity of 0 means the course is not limited
+		"$expr": bson.M{"$or": bson.A{
+			bson.M{"$lte": bson.A{"$capacity", 0}},
+			bson.M{"$lt": bson.A{"$enrolled", "$capacity"}},
+		}},
+	}
+	for key, value := range filter {
+		limited[key] = value
+	}
+	result, err := collection.UpdateOne(sc, limited, bson.M{"$inc": bson.M{"enrolled": 1}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err := collection.CountDocuments(sc, filter)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errCourseFull
+	}
+	return nil
+}
+
+// releaseSeat gives back a seat in the named course in the term and offers it
+// to the next student on that term's waitlist
+func releaseSeat(sc mongo.SessionContext, courseName, term string) error {
+	collection, filter := seatCounter(courseName, term)
+	filter["enrolled"] = bson.M{"$gt": 0}
+	if _, err := collection.UpdateOne(sc, filter, bson.M{"$inc": bson.M{"enrolled": -1}}); err != nil {
+		return err
+	}
+	return offerSeats(sc, courseName, term)
+}
+
+// addEnrollment adds the course to the student's enrollments for the term,
+// which may be empty, without touching seat counts. A course can be taken
+// again in a later term; the plain list of courses still holds it once.
+func addEnrollment(sc mongo.SessionContext, username, courseName, term string) error {
+	enrollment := Enrollment{Course: courseName, Term: term, EnrolledAt: time.Now()}
+	if term == "" {
+		result, err := registeredUsers.UpdateOne(sc,
+			bson.M{"username": username, "courses": bson.M{"$ne": courseName}},
+			bson.M{"$push": bson.M{"courses": courseName, "verified": true, "enrollments": enrollment}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errAlreadyEnrolled
+		}
+		return nil
+	}
+
+	result, err := registeredUsers.UpdateOne(sc,
+		bson.M{"username": username, "enrollments": bson.M{"$not": bson.M{"$elemMatch": bson.M{"course": courseName, "term": term}}}},
+		bson.M{"$push": bson.M{"enrollments": enrollment}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errAlreadyEnrolled
+	}
+	_, err = registeredUsers.UpdateOne(sc,
+		bson.M{"username": username, "courses": bson.M{"$ne": courseName}},
+		bson.M{"$push": bson.M{"courses": courseName, "verified": true}})
+	return err
+}
+
+// enrollStudent adds the course to the student's enrollments and takes a seat for it
+func enrollStudent(sc mongo.SessionContext, username, courseName, term string) error {
+	if err := addEnrollment(sc, username, courseName, term); err != nil {
+		return err
+	}
+	return reserveSeat(sc, courseName, term)
+}
+
+// respondCourseFull writes the 409 for a course with no free seats in the term
+func respondCourseFull(c *gin.Context, courseName, term string) {
+	var counter struct {
+		Code       string `bson:"code"`
+		CourseCode string `bson:"courseCode"`
+		Capacity   int    `bson:"capacity"`
+		Enrolled   int    `bson:"enrolled"`
+	}
+	collection, filter := seatCounter(courseName, term)
+	if err := collection.FindOne(ctx, filter).Decode(&counter); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Course is full", "reason": "course_full"})
+		return
+	}
+	code := counter.Code
+	if term != "" {
+		code = counter.CourseCode + " in " + term
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":    fmt.Sprintf("Course is full: %s has %d of %d seats taken", code, counter.Enrolled, counter.Capacity),
+		"reason":   "course_full",
+		"term":     term,
+		"capacity": counter.Capacity,
+		"enrolled": counter.Enrolled,
+	})
+}
+
+// pullEnrollment removes the student's enrollment in the course and term,
+// reporting whether it was still there to remove
+func pullEnrollment(sc mongo.SessionContext, username string, enrollment Enrollment) (bool, error) {
+	// Enrollments outside any term are stored without one
+	match := bson.M{"course": enrollment.Course, "term": nil}
+	if enrollment.Term != "" {
+		match["term"] = enrollment.Term
+	}
+	result, err := registeredUsers.UpdateOne(sc,
+		bson.M{"username": username, "enrollments": bson.M{"$elemMatch": match}},
+		bson.M{"$pull": bson.M{"enrollments": match}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// dropCourse takes the course off the student's plain list of courses, along
+// with its flag in the parallel verified list, once no enrollment in any term
+// holds it. It reports whether the course was on the list.
+func dropCourse(sc mongo.SessionContext, username, courseName string) (bool, error) {
+	index := bson.M{"$indexOfArray": bson.A{"$courses", courseName}}
+	result, err := registeredUsers.UpdateOne(sc,
+		bson.M{"username": username, "courses": courseName, "enrollments.course": bson.M{"$ne": courseName}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"courses":  withoutElement("$courses", index),
+			"verified": withoutElement("$verified", index),
+		}}}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// withoutElement is an aggregation expression for the array at path with the
+// element at index left out
+func withoutElement(path string, index interface{}) bson.M {
+	return bson.M{"$let": bson.M{
+		"vars": bson.M{"items": bson.M{"$ifNull": bson.A{path, bson.A{}}}, "skip": index},
+		"in": bson.M{"$map": bson.M{
+			"input": bson.M{"$filter": bson.M{
+				"input": bson.M{"$range": bson.A{0, bson.M{"$size": "$$items"}}},
+				"cond":  bson.M{"$ne": bson.A{"$$this", "$$skip"}},
+			}},
+			"in": bson.M{"$arrayElemAt": bson.A{"$$items", "$$this"}},
+		}},
+	}}
+}
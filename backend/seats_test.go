@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestReserveSeat(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("free seat in a course", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(1))
+		err := inSession(mt, func(sc mongo.SessionContext) error { return reserveSeat(sc, "Mechanics", "") })
+		if err != nil {
+			mt.Fatal(err)
+		}
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || collections[0] != "details" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if updates[0].Lookup("q", "name").StringValue() != "Mechanics" {
+			mt.Errorf("seat taken in the wrong course: %v", updates[0])
+		}
+		if _, err := updates[0].LookupErr("q", "$expr"); err != nil {
+			mt.Errorf("seat taken without checking the capacity: %v", updates[0])
+		}
+		if updates[0].Lookup("u", "$inc", "enrolled").Int32() != 1 {
+			mt.Errorf("update = %v", updates[0])
+		}
+	})
+
+	mt.Run("free seat in a term", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(1))
+		err := inSession(mt, func(sc mongo.SessionContext) error { return reserveSeat(sc, "Mechanics", "2026-27-odd") })
+		if err != nil {
+			mt.Fatal(err)
+		}
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || collections[0] != "offerings" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		query := updates[0].Lookup("q").Document()
+		if query.Lookup("courseName").StringValue() != "Mechanics" || query.Lookup("term").StringValue() != "2026-27-odd" {
+			mt.Errorf("seat taken in the wrong offering: %v", query)
+		}
+	})
+
+	mt.Run("course full", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(0), countedDocuments("db.details", 1))
+		err := inSession(mt, func(sc mongo.SessionContext) error { return reserveSeat(sc, "Mechanics", "") })
+		if err != errCourseFull {
+			mt.Errorf("err = %v, want %v", err, errCourseFull)
+		}
+	})
+
+	mt.Run("course without a seat counter", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(0), countedDocuments("db.offerings", 0))
+		err := inSession(mt, func(sc mongo.SessionContext) error { return reserveSeat(sc, "Mechanics", "2026-27-odd") })
+		if err != nil {
+			mt.Errorf("err = %v, want the seat to go uncounted", err)
+		}
+	})
+}
+
+func TestReleaseSeat(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("nobody waiting", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(1), noDocuments("db.waitlist"))
+		err := inSession(mt, func(sc mongo.SessionContext) error { return releaseSeat(sc, "Mechanics", "2026-27-odd") })
+		if err != nil {
+			mt.Fatal(err)
+		}
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || collections[0] != "offerings" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if _, err := updates[0].LookupErr("q", "enrolled", "$gt"); err != nil {
+			mt.Errorf("seat count can drop below zero: %v", updates[0])
+		}
+		if updates[0].Lookup("u", "$inc", "enrolled").Int32() != -1 {
+			mt.Errorf("update = %v", updates[0])
+		}
+
+		next := sentCommand(mt, "find")
+		if next.Lookup("find").StringValue() != "waitlist" || next.Lookup("filter", "term").StringValue() != "2026-27-odd" {
+			mt.Errorf("freed seat was not offered to the term's waitlist: %v", next)
+		}
+	})
+}
+
+func TestAddEnrollment(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("first time in the term", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(1), matchedDocuments(1))
+		err := inSession(mt, func(sc mongo.SessionContext) error {
+			return addEnrollment(sc, "asha@iitk.ac.in", "Mechanics", "2026-27-odd")
+		})
+		if err != nil {
+			mt.Fatal(err)
+		}
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 2 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		pushed := updates[0].Lookup("u", "$push", "enrollments").Document()
+		if pushed.Lookup("term").StringValue() != "2026-27-odd" || pushed.Lookup("course").StringValue() != "Mechanics" {
+			mt.Errorf("enrollment = %v", pushed)
+		}
+		if _, err := updates[1].LookupErr("u", "$push", "courses"); err != nil {
+			mt.Errorf("course was not added to the plain list: %v", updates[1])
+		}
+	})
+
+	mt.Run("already enrolled in the term", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(0))
+		err := inSession(mt, func(sc mongo.SessionContext) error {
+			return addEnrollment(sc, "asha@iitk.ac.in", "Mechanics", "2026-27-odd")
+		})
+		if err != errAlreadyEnrolled {
+			mt.Errorf("err = %v, want %v", err, errAlreadyEnrolled)
+		}
+	})
+
+	mt.Run("already enrolled outside terms", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(matchedDocuments(0))
+		err := inSession(mt, func(sc mongo.SessionContext) error {
+			return addEnrollment(sc, "asha@iitk.ac.in", "Mechanics", "")
+		})
+		if err != errAlreadyEnrolled {
+			mt.Errorf("err = %v, want %v", err, errAlreadyEnrolled)
+		}
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 || updates[0].Lookup("q", "courses", "$ne").StringValue() != "Mechanics" {
+			mt.Errorf("updates = %v", updates)
+		}
+	})
+}
+
+func TestDeleteCourseForStudent(t *testing.T) {
+	student := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+		{Key: "username", Value: "asha@iitk.ac.in"},
+		{Key: "role", Value: "student"},
+		{Key: "courses", Value: bson.A{"Mechanics"}},
+		{Key: "verified", Value: bson.A{true}},
+		{Key: "enrollments", Value: bson.A{bson.D{{Key: "course", Value: "Mechanics"}, {Key: "term", Value: "2026-27-odd"}}}},
+	})
+	body := map[string]string{"username": "asha@iitk.ac.in", "course": "Mechanics", "term": "2026-27-odd"}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("drop", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			matchedDocuments(1),
+			matchedDocuments(1),
+			noDocuments("db.waitlist"),
+			matchedDocuments(1),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveJSONAs(deleteCourseForStudent, "asha@iitk.ac.in", "student", http.MethodDelete, "/api/enrollment", body)
+		expectStatus(mt, recorder, http.StatusOK)
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 3 {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if updates[0].Lookup("q", "enrollments", "$elemMatch", "term").StringValue() != "2026-27-odd" {
+			mt.Errorf("enrollment removed without checking it is still there: %v", updates[0])
+		}
+		if _, err := updates[0].LookupErr("u", "$pull", "enrollments"); err != nil {
+			mt.Errorf("update = %v", updates[0])
+		}
+		if collections[1] != "offerings" || updates[1].Lookup("u", "$inc", "enrolled").Int32() != -1 {
+			mt.Errorf("seat was not given back: %v %v", collections[1], updates[1])
+		}
+		if updates[2].Lookup("q", "courses").StringValue() != "Mechanics" {
+			mt.Errorf("course dropped from the plain list unconditionally: %v", updates[2])
+		}
+		if _, err := updates[2].LookupErr("u", "$set"); err == nil {
+			mt.Errorf("plain list replaced with a stored copy: %v", updates[2])
+		}
+	})
+
+	mt.Run("already dropped by a concurrent request", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			matchedDocuments(0),
+			matchedDocuments(0),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveJSONAs(deleteCourseForStudent, "asha@iitk.ac.in", "student", http.MethodDelete, "/api/enrollment", body)
+		expectStatus(mt, recorder, http.StatusBadRequest)
+
+		collections, _ := sentUpdates(mt)
+		for _, collection := range collections {
+			if collection != "registered_users" {
+				mt.Errorf("seat given back for an enrollment this request did not remove: %v", collections)
+			}
+		}
+	})
+}
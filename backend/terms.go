@@ -0,0 +1,684 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Term states. Requests can only be made and approved while a term is open.
+const (
+	termPlanned = "planned"
+	termOpen    = "open"
+	termClosed  = "closed"
+)
+
+var (
+	termCollection     *mongo.Collection
+	offeringCollection *mongo.Collection
+
+	// Term codes look like 2026-27-odd
+	termCodePattern = regexp.MustCompile(`^(\d{4})-(\d{2})-(odd|even|summer)$`)
+
+	errTermNotFound = errors.New("term not found")
+)
+
+// Term is an academic session such as "2026-27 Odd"
+type Term struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Code      string             `json:"code" bson:"code"`
+	Name      string             `json:"name" bson:"name"`
+	Year      string             `json:"year" bson:"year"`
+	Semester  string             `json:"semester" bson:"semester"`
+	Status    string             `json:"status" bson:"status"`
+	StartsOn  string             `json:"startsOn,omitempty" bson:"startsOn,omitempty"`
+	EndsOn    string             `json:"endsOn,omitempty" bson:"endsOn,omitempty"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// Offering is a catalog course taught in a term. CourseName is kept alongside
+// the code because requests and enrollments refer to courses by name.
+type Offering struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Term       string             `json:"term" bson:"term"`
+	CourseCode string             `json:"courseCode" bson:"courseCode"`
+	CourseName string             `json:"courseName" bson:"courseName"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+
+	// Capacity limits enrollment in the term, 0 meaning unlimited. Enrolled
+	// counts the seats taken and is only changed through reserveSeat and releaseSeat.
+	Capacity  int  `json:"capacity" bson:"capacity"`
+	Enrolled  int  `json:"enrolled" bson:"enrolled"`
+	Available *int `json:"available" bson:"-"`
+}
+
+// Enrollment records the term a student took a course in. The student's
+// courses list still holds every course, for compatibility.
+type Enrollment struct {
+	Course     string    `json:"course" bson:"course"`
+	Term       string    `json:"term,omitempty" bson:"term,omitempty"`
+	EnrolledAt time.Time `json:"enrolledAt" bson:"enrolledAt"`
+}
+
+// fillSeats sets the derived seat count returned to clients
+func (offering *Offering) fillSeats() {
+	offering.Available = nil
+	if offering.Capacity > 0 {
+		available := offering.Capacity - offering.Enrolled
+		if available < 0 {
+			available = 0
+		}
+		offering.Available = &available
+	}
+}
+
+// termKey is the filter value for documents of a term. Documents made outside
+// any term have no term field, which nil matches.
+func termKey(term string) interface{} {
+	if term == "" {
+		return nil
+	}
+	return term
+}
+
+// requestFilter selects a student's request for a course in a term
+func requestFilter(username, courseName, term string) bson.M {
+	return bson.M{"username": username, "course": courseName, "term": termKey(term)}
+}
+
+// termBefore reports whether term a comes before term b. Within an academic
+// year the odd semester comes first and summer last.
+func termBefore(a, b string) bool {
+	ma, mb := termCodePattern.FindStringSubmatch(a), termCodePattern.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return false
+	}
+	if ma[1] != mb[1] {
+		return ma[1] < mb[1]
+	}
+	order := map[string]int{"odd": 0, "even": 1, "summer": 2}
+	return order[ma[3]] < order[mb[3]]
+}
+
+// allEnrollments fills in the enrollments made before terms existed, which
+// only appear in the plain list of courses, as enrollments outside any term
+func allEnrollments(courses []string, enrollments []Enrollment) []Enrollment {
+	recorded := map[string]bool{}
+	for _, enrollment := range enrollments {
+		recorded[enrollment.Course] = true
+	}
+	all := append([]Enrollment{}, enrollments...)
+	for _, name := range courses {
+		if !recorded[name] {
+			all = append(all, Enrollment{Course: name})
+		}
+	}
+	return all
+}
+
+// coursesIn returns the courses the student takes in term. With term empty,
+// as for requests outside any term, every course counts.
+func (u *UserRegistration) coursesIn(term string) []string {
+	if term == "" {
+		return append([]string{}, u.Courses...)
+	}
+	names := []string{}
+	for _, enrollment := range allEnrollments(u.Courses, u.Enrollments) {
+		if enrollment.Term == term {
+			names = append(names, enrollment.Course)
+		}
+	}
+	return names
+}
+
+// coursesBefore returns the courses the student took before term, counting
+// enrollments outside any term as earlier. With term empty every course counts.
+func (u *UserRegistration) coursesBefore(term string) []string {
+	if term == "" {
+		return append([]string{}, u.Courses...)
+	}
+	names := []string{}
+	for _, enrollment := range allEnrollments(u.Courses, u.Enrollments) {
+		if enrollment.Term == "" || termBefore(enrollment.Term, term) {
+			names = append(names, enrollment.Course)
+		}
+	}
+	return names
+}
+
+// ensureTermIndexes keeps term codes unique and each course offered once per term
+func ensureTermIndexes() {
+	if _, err := termCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Printf("Failed to create term code index: %v", err)
+	}
+	if _, err := offeringCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "term", Value: 1}, {Key: "courseCode", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		log.Printf("Failed to create offering index: %v", err)
+	}
+}
+
+// normaliseTermCode turns "2026-27 Odd" into the code 2026-27-odd
+func normaliseTermCode(raw string) string {
+	return strings.ToLower(strings.Join(strings.Fields(raw), "-"))
+}
+
+// findTerm looks a term up by code or name
+func findTerm(ref string) (*Term, error) {
+	var term Term
+	err := termCollection.FindOne(ctx, bson.M{"code": normaliseTermCode(ref)}).Decode(&term)
+	if err == mongo.ErrNoDocuments {
+		return nil, errTermNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &term, nil
+}
+
+// findTermOrRespond loads the term in the URL, writing a 404 when missing
+func findTermOrRespond(c *gin.Context) (*Term, bool) {
+	term, err := findTerm(c.Param("term"))
+	if err == errTermNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Term not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch term"})
+		return nil, false
+	}
+	return term, true
+}
+
+// requestTerm works out the term a new course request is for: the one asked
+// for, or else the only open term. Requests stay unscoped while no term is open
+// and none is asked for. On failure the error response has been written.
+func requestTerm(c *gin.Context, ref string, course *Course) (string, bool) {
+	var term *Term
+	if ref != "" {
+		found, err := findTerm(ref)
+		if err == errTermNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Term not found", "field": "term"})
+			return "", false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch term"})
+			return "", false
+		}
+		term = found
+	} else {
+		var open []Term
+		cursor, err := termCollection.Find(ctx, bson.M{"status": termOpen})
+		if err == nil {
+			err = cursor.All(ctx, &open)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch terms"})
+			return "", false
+		}
+		switch len(open) {
+		case 0:
+			return "", true
+		case 1:
+			term = &open[0]
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Several terms are open, say which one the request is for", "field": "term"})
+			return "", false
+		}
+	}
+
+	if term.Status != termOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": "Term " + term.Name + " is not open for requests", "reason": "term_not_open"})
+		return "", false
+	}
+	offered, err := offeringCollection.CountDocuments(ctx, bson.M{"term": term.Code, "courseCode": course.Code})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch offerings"})
+		return "", false
+	}
+	if offered == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s is not offered in %s", course.Code, term.Name), "reason": "not_offered"})
+		return "", false
+	}
+	return term.Code, true
+}
+
+// checkTermOpen writes a 409 unless the request's term is still open; unscoped requests always pass
+func checkTermOpen(c *gin.Context, code string) bool {
+	if code == "" {
+		return true
+	}
+	term, err := findTerm(code)
+	if err != nil && err != errTermNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch term"})
+		return false
+	}
+	if term == nil || term.Status != termOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": "The request's term is no longer open", "reason": "term_not_open"})
+		return false
+	}
+	return true
+}
+
+// openTermCode returns the code of the only open term, or "" when no term or
+// several terms are open
+func openTermCode() (string, error) {
+	var open []Term
+	cursor, err := termCollection.Find(ctx, bson.M{"status": termOpen})
+	if err != nil {
+		return "", err
+	}
+	if err := cursor.All(ctx, &open); err != nil {
+		return "", err
+	}
+	if len(open) != 1 {
+		return "", nil
+	}
+	return open[0].Code, nil
+}
+
+// migrateOfferingSeats gives offerings made before they had seat counters the
+// capacity of their course and a count of the students enrolled in the term
+func migrateOfferingSeats() {
+	cursor, err := offeringCollection.Find(ctx, bson.M{"enrolled": bson.M{"$exists": false}})
+	if err != nil {
+		log.Printf("Failed to find offerings without seat counts: %v", err)
+		return
+	}
+	var offerings []Offering
+	if err := cursor.All(ctx, &offerings); err != nil {
+		log.Printf("Failed to decode offerings without seat counts: %v", err)
+		return
+	}
+
+	for _, offering := range offerings {
+		var course Course
+		if err := courseCollection.FindOne(ctx, bson.M{"code": offering.CourseCode}).Decode(&course); err != nil && err != mongo.ErrNoDocuments {
+			log.Printf("Failed to fetch course %s: %v", offering.CourseCode, err)
+			continue
+		}
+		enrolled, err := registeredUsers.CountDocuments(ctx, bson.M{"enrollments": bson.M{"$elemMatch": bson.M{"course": offering.CourseName, "term": offering.Term}}})
+		if err != nil {
+			log.Printf("Failed to count students of %s in %s: %v", offering.CourseCode, offering.Term, err)
+			continue
+		}
+		_, err = offeringCollection.UpdateOne(ctx,
+			bson.M{"_id": offering.ID, "enrolled": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"enrolled": enrolled, "capacity": course.Capacity}})
+		if err != nil {
+			log.Printf("Failed to store seat count of %s in %s: %v", offering.CourseCode, offering.Term, err)
+		}
+	}
+}
+
+// offeredCourseNames returns the names of the courses offered in a term
+func offeredCourseNames(code string) ([]string, error) {
+	names := []string{}
+	cursor, err := offeringCollection.Find(ctx, bson.M{"term": normaliseTermCode(code)})
+	if err != nil {
+		return nil, err
+	}
+	var offerings []Offering
+	if err := cursor.All(ctx, &offerings); err != nil {
+		return nil, err
+	}
+	for _, offering := range offerings {
+		names = append(names, offering.CourseName)
+	}
+	return names, nil
+}
+
+// Route listing terms, newest first, optionally filtered by status
+func listTerms(c *gin.Context) {
+	filter := bson.M{}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := termCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "year", Value: -1}, {Key: "createdAt", Value: -1}}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch terms"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	terms := []Term{}
+	if err := cursor.All(ctx, &terms); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode terms"})
+		return
+	}
+
+	c.JSON(http.StatusOK, terms)
+}
+
+// Route for admins to create a term; it starts out planned
+func createTerm(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	var req struct {
+		Year     string `json:"year"`
+		Semester string `json:"semester"`
+		StartsOn string `json:"startsOn"`
+		EndsOn   string `json:"endsOn"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	code := normaliseTermCode(req.Year + " " + req.Semester)
+	match := termCodePattern.FindStringSubmatch(code)
+	errs := map[string]string{}
+	if match == nil {
+		errs["year"] = "Year must look like 2026-27 and semester must be odd, even or summer"
+	} else {
+		start, _ := strconv.Atoi(match[1])
+		end, _ := strconv.Atoi(match[2])
+		if (start+1)%100 != end {
+			errs["year"] = "The two years of an academic year must be consecutive"
+		}
+	}
+	for field, value := range map[string]string{"startsOn": req.StartsOn, "endsOn": req.EndsOn} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err != nil {
+			errs[field] = "Dates must be YYYY-MM-DD"
+		}
+	}
+	if req.StartsOn != "" && req.EndsOn != "" && req.EndsOn < req.StartsOn {
+		errs["endsOn"] = "A term must end after it starts"
+	}
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid term", "fields": errs})
+		return
+	}
+
+	term := Term{
+		Code:      code,
+		Name:      match[1] + "-" + match[2] + " " + strings.ToUpper(match[3][:1]) + match[3][1:],
+		Year:      match[1] + "-" + match[2],
+		Semester:  match[3],
+		Status:    termPlanned,
+		StartsOn:  req.StartsOn,
+		EndsOn:    req.EndsOn,
+		CreatedAt: time.Now(),
+	}
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		result, err := termCollection.InsertOne(sc, term)
+		if err != nil {
+			return err
+		}
+		term.ID = result.InsertedID.(primitive.ObjectID)
+		return recordAuditIn(sc, c, "term.create", "term:"+term.Code, nil, term)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Term " + term.Name + " already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create term"})
+		return
+	}
+
+	c.JSON(http.StatusOK, term)
+}
+
+// setTermStatus returns a route for admins to open or close a term. Closed
+// terms can be reopened, for example to fix late requests.
+func setTermStatus(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checkRole(c, "admin") {
+			return
+		}
+		term, ok := findTermOrRespond(c)
+		if !ok {
+			return
+		}
+		if term.Status == status {
+			c.JSON(http.StatusConflict, gin.H{"error": "Term " + term.Name + " is already " + status})
+			return
+		}
+
+		before := *term
+		term.Status = status
+		action := "term.open"
+		if status == termClosed {
+			action = "term.close"
+		}
+		err := withTransaction(func(sc mongo.SessionContext) error {
+			if _, err := termCollection.UpdateOne(sc, bson.M{"_id": term.ID}, bson.M{"$set": bson.M{"status": status}}); err != nil {
+				return err
+			}
+			return recordAuditIn(sc, c, action, "term:"+term.Code, before, term)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update term"})
+			return
+		}
+
+		c.JSON(http.StatusOK, term)
+	}
+}
+
+// Route listing the courses offered in a term
+func listOfferings(c *gin.Context) {
+	term, ok := findTermOrRespond(c)
+	if !ok {
+		return
+	}
+
+	cursor, err := offeringCollection.Find(ctx, bson.M{"term": term.Code}, options.Find().SetSort(bson.M{"courseCode": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch offerings"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	offerings := []Offering{}
+	if err := cursor.All(ctx, &offerings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode offerings"})
+		return
+	}
+	for i := range offerings {
+		offerings[i].fillSeats()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"term": term, "offerings": offerings})
+}
+
+// Route for admins to offer a catalog course in a term
+func createOffering(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+	term, ok := findTermOrRespond(c)
+	if !ok {
+		return
+	}
+	if term.Status == termClosed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Term " + term.Name + " is closed"})
+		return
+	}
+
+	var req struct {
+		Course   string `json:"course" binding:"required"`
+		Capacity *int   `json:"capacity"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Capacity != nil && *req.Capacity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Capacity cannot be negative", "field": "capacity"})
+		return
+	}
+	course, err := findCourse(req.Course)
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found", "field": "course"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return
+	}
+
+	// The course's capacity is the default for each term
+	offering := Offering{Term: term.Code, CourseCode: course.Code, CourseName: course.Name, CreatedAt: time.Now(), Capacity: course.Capacity}
+	if req.Capacity != nil {
+		offering.Capacity = *req.Capacity
+	}
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := offeringCollection.InsertOne(sc, offering)
+		if err != nil {
+			return err
+		}
+		offering.ID = result.InsertedID.(primitive.ObjectID)
+		return recordAuditIn(sc, c, "offering.create", "term:"+term.Code, nil, offering)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": course.Code + " is already offered in " + term.Name})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create offering"})
+		return
+	}
+
+	offering.fillSeats()
+	c.JSON(http.StatusOK, offering)
+}
+
+// Route for admins to change the capacity of an offering; seats it adds go to
+// the term's waitlist first
+func updateOffering(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+	term, ok := findTermOrRespond(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Capacity *int `json:"capacity" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if *req.Capacity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Capacity cannot be negative", "field": "capacity"})
+		return
+	}
+
+	var offering Offering
+	err := offeringCollection.FindOne(ctx, bson.M{"term": term.Code, "courseCode": normaliseCourseCode(c.Param("course"))}).Decode(&offering)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Offering not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch offering"})
+		return
+	}
+
+	before := offering
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		if _, err := offeringCollection.UpdateOne(sc, bson.M{"_id": offering.ID}, bson.M{"$set": bson.M{"capacity": *req.Capacity}}); err != nil {
+			return err
+		}
+		if err := offerSeats(sc, offering.CourseName, term.Code); err != nil {
+			return err
+		}
+		if err := offeringCollection.FindOne(sc, bson.M{"_id": offering.ID}).Decode(&offering); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "offering.update", "term:"+term.Code, before, offering)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update offering"})
+		return
+	}
+
+	offering.fillSeats()
+	c.JSON(http.StatusOK, offering)
+}
+
+// Route for admins to withdraw an offering that nobody has requested or enrolled in
+func deleteOffering(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+	term, ok := findTermOrRespond(c)
+	if !ok {
+		return
+	}
+
+	var offering Offering
+	err := offeringCollection.FindOne(ctx, bson.M{"term": term.Code, "courseCode": normaliseCourseCode(c.Param("course"))}).Decode(&offering)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Offering not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch offering"})
+		return
+	}
+
+	scoped := bson.M{"course": offering.CourseName, "term": term.Code}
+	requests, err := requestCollection.CountDocuments(ctx, scoped)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check requests"})
+		return
+	}
+	enrolled, err := registeredUsers.CountDocuments(ctx, bson.M{"enrollments": bson.M{"$elemMatch": scoped}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check enrollments"})
+		return
+	}
+	waiting, err := waitlistCollection.CountDocuments(ctx, bson.M{"course": offering.CourseName, "term": term.Code, "active": true})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check the waitlist"})
+		return
+	}
+	if requests > 0 || enrolled > 0 || waiting > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    "The offering has requests, enrollments or a waitlist",
+			"requests": requests,
+			"enrolled": enrolled,
+			"waiting":  waiting,
+		})
+		return
+	}
+
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		if _, err := offeringCollection.DeleteOne(sc, bson.M{"_id": offering.ID}); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "offering.delete", "term:"+term.Code, offering, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete offering"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Offering deleted successfully"})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestTermBefore(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2025-26-odd", "2025-26-even", true},
+		{"2025-26-even", "2025-26-summer", true},
+		{"2025-26-summer", "2026-27-odd", true},
+		{"2026-27-odd", "2025-26-summer", false},
+		{"2026-27-odd", "2026-27-odd", false},
+		{"", "2026-27-odd", false},
+	}
+	for _, tt := range tests {
+		if got := termBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("termBefore(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestStudentCoursesByTerm(t *testing.T) {
+	student := UserRegistration{
+		// Mechanics predates terms, so it only appears in the plain list
+		Courses: []string{"Mechanics", "Linear Algebra", "Compilers"},
+		Enrollments: []Enrollment{
+			{Course: "Linear Algebra", Term: "2025-26-odd"},
+			{Course: "Compilers", Term: "2026-27-odd"},
+			{Course: "Linear Algebra", Term: "2026-27-odd"},
+		},
+	}
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"in a term", student.coursesIn("2026-27-odd"), []string{"Compilers", "Linear Algebra"}},
+		{"in a term without enrollments", student.coursesIn("2025-26-even"), []string{}},
+		{"outside any term", student.coursesIn(""), student.Courses},
+		{"before a term", student.coursesBefore("2026-27-odd"), []string{"Linear Algebra", "Mechanics"}},
+		{"before the first term", student.coursesBefore("2025-26-odd"), []string{"Mechanics"}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestCourseRequestInTerm(t *testing.T) {
+	student := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+		{Key: "username", Value: "asha@iitk.ac.in"},
+		{Key: "role", Value: "student"},
+		{Key: "courses", Value: bson.A{"Mechanics"}},
+		{Key: "enrollments", Value: bson.A{bson.D{{Key: "course", Value: "Mechanics"}, {Key: "term", Value: "2025-26-odd"}}}},
+	})
+	course := mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{
+		{Key: "code", Value: "PHY103"},
+		{Key: "name", Value: "Mechanics"},
+	})
+	openTerm := func(code string) bson.D {
+		return mtest.CreateCursorResponse(0, "db.terms", mtest.FirstBatch, bson.D{{Key: "code", Value: code}, {Key: "status", Value: termOpen}})
+	}
+	counted := func(ns string, n int) bson.D {
+		return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+	}
+	body := map[string]string{"username": "asha@iitk.ac.in", "course": "PHY103"}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("course taken in an earlier term", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			course,
+			openTerm("2026-27-odd"),
+			counted("db.offerings", 1),
+			counted("db.course_requests", 0),
+			noDocuments("db.course_requests"),
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveJSONAs(addCourseToStudent, "asha@iitk.ac.in", "student", http.MethodPost, "/api/add-course", body)
+		expectStatus(mt, recorder, http.StatusOK)
+		if term := responseBody(mt, recorder)["term"]; term != "2026-27-odd" {
+			mt.Errorf("term = %v", term)
+		}
+
+		pending := sentCommand(mt, "aggregate").Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match")
+		if term, _ := pending.Document().Lookup("term").StringValueOK(); term != "2026-27-odd" {
+			mt.Errorf("pending requests are not counted per term: %v", pending)
+		}
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "find" && event.Command.Lookup("find").StringValue() == "course_requests" {
+				if term, _ := event.Command.Lookup("filter", "term").StringValueOK(); term != "2026-27-odd" {
+					mt.Errorf("clashes are checked against requests of other terms: %v", event.Command.Lookup("filter"))
+				}
+			}
+		}
+	})
+
+	mt.Run("course already taken in the term", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			course,
+			openTerm("2025-26-odd"),
+			counted("db.offerings", 1),
+		)
+		recorder := serveJSONAs(addCourseToStudent, "asha@iitk.ac.in", "student", http.MethodPost, "/api/add-course", body)
+		expectStatus(mt, recorder, http.StatusConflict)
+		if reason := responseBody(mt, recorder)["reason"]; reason != "already_enrolled" {
+			mt.Errorf("reason = %v", reason)
+		}
+	})
+}
+
+func TestDeleteOfferingWithWaitlist(t *testing.T) {
+	counted := func(ns string, n int) bson.D {
+		return mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{{Key: "n", Value: n}})
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("students still waiting", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			mtest.CreateCursorResponse(0, "db.terms", mtest.FirstBatch, bson.D{{Key: "code", Value: "2026-27-odd"}, {Key: "status", Value: termOpen}}),
+			mtest.CreateCursorResponse(0, "db.offerings", mtest.FirstBatch, bson.D{
+				{Key: "term", Value: "2026-27-odd"},
+				{Key: "courseCode", Value: "PHY103"},
+				{Key: "courseName", Value: "Mechanics"},
+			}),
+			counted("db.course_requests", 0),
+			counted("db.registered_users", 0),
+			counted("db.waitlist", 2),
+		)
+		recorder := serveRoute(deleteOffering, http.MethodDelete, "/api/terms/:term/offerings/:course",
+			"/api/terms/2026-27-odd/offerings/PHY103", nil, "admin@iitk.ac.in", "admin")
+		expectStatus(mt, recorder, http.StatusConflict)
+		if waiting := responseBody(mt, recorder)["waiting"]; waiting != float64(2) {
+			mt.Errorf("waiting = %v", waiting)
+		}
+
+		count := sentCommand(mt, "aggregate")
+		if count.Lookup("aggregate").StringValue() != "waitlist" {
+			mt.Fatalf("last count = %v", count)
+		}
+		match := count.Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match").Document()
+		if match.Lookup("term").StringValue() != "2026-27-odd" || !match.Lookup("active").Boolean() {
+			mt.Errorf("waitlist is not counted for the term's active entries: %v", match)
+		}
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "delete" {
+				mt.Errorf("offering was deleted: %v", event.Command)
+			}
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Clash policies: hard refuses clashing requests and approvals, soft allows
+// them but reports and records the clashes
+const (
+	clashPolicyHard = "hard"
+	clashPolicySoft = "soft"
+)
+
+var (
+	clashPolicy = clashPolicySoft
+
+	// weekdays maps accepted day names to their position in the week
+	weekdays = map[string]int{"mon": 0, "tue": 1, "wed": 2, "thu": 3, "fri": 4, "sat": 5, "sun": 6}
+	// weekdayNames maps full day names to the names kept in weekdays
+	weekdayNames = map[string]string{
+		"monday": "mon", "tuesday": "tue", "wednesday": "wed", "thursday": "thu",
+		"friday": "fri", "saturday": "sat", "sunday": "sun",
+	}
+
+	clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+)
+
+// CourseSlot is one weekly meeting of a course. Times are "HH:MM" in local time.
+type CourseSlot struct {
+	Day   string `json:"day" bson:"day"`
+	Start string `json:"start" bson:"start"`
+	End   string `json:"end" bson:"end"`
+	Room  string `json:"room,omitempty" bson:"room,omitempty"`
+}
+
+// TimetableClash is an overlap between a slot of Course and a slot of With
+type TimetableClash struct {
+	Course string     `json:"course" bson:"course"`
+	With   string     `json:"with" bson:"with"`
+	Slot   CourseSlot `json:"slot" bson:"slot"`
+	Other  CourseSlot `json:"other" bson:"other"`
+}
+
+// TimetableEntry is a slot in a student's weekly timetable
+type TimetableEntry struct {
+	CourseSlot
+	Code  string `json:"code"`
+	Title string `json:"title"`
+}
+
+// loadTimetableConfig reads TIMETABLE_CLASH_POLICY
+func loadTimetableConfig() {
+	switch policy := os.Getenv("TIMETABLE_CLASH_POLICY"); policy {
+	case "":
+	case clashPolicyHard, clashPolicySoft:
+		clashPolicy = policy
+	default:
+		log.Fatalf("Invalid TIMETABLE_CLASH_POLICY %q, use hard or soft", policy)
+	}
+}
+
+// minutes converts a validated "HH:MM" time to minutes after midnight
+func minutes(clock string) int {
+	var h, m int
+	fmt.Sscanf(clock, "%d:%d", &h, &m)
+	return h*60 + m
+}
+
+// overlaps reports whether two slots meet on the same day at the same time;
+// a slot ending when the other starts does not overlap it
+func (s CourseSlot) overlaps(other CourseSlot) bool {
+	return s.Day == other.Day && minutes(s.Start) < minutes(other.End) && minutes(other.Start) < minutes(s.End)
+}
+
+// validateSlots normalises slots in place and returns the first problem found
+func validateSlots(slots []CourseSlot) string {
+	for i := range slots {
+		slot := &slots[i]
+		slot.Day = strings.ToLower(strings.TrimSpace(slot.Day))
+		if short, ok := weekdayNames[slot.Day]; ok {
+			slot.Day = short
+		}
+		slot.Start, slot.End = strings.TrimSpace(slot.Start), strings.TrimSpace(slot.End)
+		slot.Room = strings.TrimSpace(slot.Room)
+
+		if _, ok := weekdays[slot.Day]; !ok {
+			return "Day must be a weekday such as mon or monday"
+		}
+		if !clockPattern.MatchString(slot.Start) || !clockPattern.MatchString(slot.End) {
+			return "Start and end must be 24-hour HH:MM times"
+		}
+		if minutes(slot.Start) >= minutes(slot.End) {
+			return "A slot must end after it starts"
+		}
+		if len(slot.Room) > 50 {
+			return "Room must be at most 50 characters"
+		}
+		for _, earlier := range slots[:i] {
+			if slot.overlaps(earlier) {
+				return "Slots of a course cannot overlap each other"
+			}
+		}
+	}
+	return ""
+}
+
+// findClashes lists the overlaps between the course's slots and those of others
+func findClashes(course *Course, others []Course) []TimetableClash {
+	clashes := []TimetableClash{}
+	for _, other := range others {
+		if other.Code == course.Code {
+			continue
+		}
+		for _, slot := range course.Slots {
+			for _, otherSlot := range other.Slots {
+				if slot.overlaps(otherSlot) {
+					clashes = append(clashes, TimetableClash{Course: course.Code, With: other.Code, Slot: slot, Other: otherSlot})
+				}
+			}
+		}
+	}
+	return clashes
+}
+
+// coursesByName loads the catalog courses behind enrollment or request strings
+func coursesByName(c context.Context, names []string) ([]Course, error) {
+	courses := []Course{}
+	if len(names) == 0 {
+		return courses, nil
+	}
+	cursor, err := courseCollection.Find(c, bson.M{"name": bson.M{"$in": names}})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(c, &courses)
+	return courses, err
+}
+
+// checkClashes compares the course's slots with the student's enrollments in
+// the term and, when withRequests is set, their other pending requests for it.
+// With term empty every enrollment and request counts. Under the hard policy
+// it writes a 409 and returns false; under the soft policy the clashes are
+// returned for the caller to report.
+func checkClashes(c *gin.Context, student *UserRegistration, course *Course, term string, withRequests bool) ([]TimetableClash, bool) {
+	names := student.coursesIn(term)
+	if withRequests {
+		var requests []CourseUpdateRequest
+		filter := bson.M{"username": student.Username, "course": bson.M{"$ne": course.Name}}
+		if term != "" {
+			filter["term"] = term
+		}
+		cursor, err := requestCollection.Find(ctx, filter)
+		if err == nil {
+			err = cursor.All(ctx, &requests)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check timetable clashes"})
+			return nil, false
+		}
+		for _, request := range requests {
+			names = append(names, request.Course)
+		}
+	}
+
+	others, err := coursesByName(ctx, names)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check timetable clashes"})
+		return nil, false
+	}
+	clashes := findClashes(course, others)
+	if len(clashes) > 0 && clashPolicy == clashPolicyHard {
+		with := []string{}
+		for _, clash := range clashes {
+			with = appendUnique(with, clash.With)
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   fmt.Sprintf("%s clashes with %s", course.Code, strings.Join(with, ", ")),
+			"reason":  "timetable_clash",
+			"clashes": clashes,
+		})
+		return nil, false
+	}
+	return clashes, true
+}
+
+// Route returning a student's weekly timetable built from their enrollments in
+// ?term=, or else the only open term, with any clashes between them. With no
+// term every enrollment is shown.
+func getStudentTimetable(c *gin.Context) {
+	claims, ok := authenticateOrAPIKey(c, "enrollments:read")
+	if !ok {
+		return
+	}
+	username := c.Param("username")
+	if claims.Role == "student" && claims.Username != username {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access to another student's data"})
+		return
+	}
+
+	var student UserRegistration
+	if err := registeredUsers.FindOne(ctx, bson.M{"username": username}).Decode(&student); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+		return
+	}
+	term := normaliseTermCode(c.Query("term"))
+	if term == "" {
+		var err error
+		if term, err = openTermCode(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch terms"})
+			return
+		}
+	}
+	courses, err := coursesByName(ctx, student.coursesIn(term))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch courses"})
+		return
+	}
+
+	days := map[string][]TimetableEntry{}
+	for day := range weekdays {
+		days[day] = []TimetableEntry{}
+	}
+	clashes := []TimetableClash{}
+	unscheduled := []string{}
+	for i := range courses {
+		course := &courses[i]
+		if len(course.Slots) == 0 {
+			unscheduled = append(unscheduled, course.Code)
+		}
+		for _, slot := range course.Slots {
+			days[slot.Day] = append(days[slot.Day], TimetableEntry{CourseSlot: slot, Code: course.Code, Title: course.Title})
+		}
+		// Each pair is reported once, from the later course in the list
+		clashes = append(clashes, findClashes(course, courses[:i])...)
+	}
+	for _, entries := range days {
+		sort.Slice(entries, func(i, j int) bool {
+			return minutes(entries[i].Start) < minutes(entries[j].Start)
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"username":    username,
+		"term":        term,
+		"days":        days,
+		"clashes":     clashes,
+		"unscheduled": unscheduled,
+	})
+}
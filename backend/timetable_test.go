@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSlotOverlaps(t *testing.T) {
+	monday := CourseSlot{Day: "mon", Start: "09:00", End: "10:00"}
+	tests := []struct {
+		name  string
+		other CourseSlot
+		want  bool
+	}{
+		{"same time", CourseSlot{Day: "mon", Start: "09:00", End: "10:00"}, true},
+		{"starts during", CourseSlot{Day: "mon", Start: "09:30", End: "11:00"}, true},
+		{"contains", CourseSlot{Day: "mon", Start: "08:00", End: "12:00"}, true},
+		{"starts when it ends", CourseSlot{Day: "mon", Start: "10:00", End: "11:00"}, false},
+		{"ends when it starts", CourseSlot{Day: "mon", Start: "08:00", End: "09:00"}, false},
+		{"other day", CourseSlot{Day: "tue", Start: "09:00", End: "10:00"}, false},
+	}
+	for _, tt := range tests {
+		if got := monday.overlaps(tt.other); got != tt.want {
+			t.Errorf("%s: overlaps = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := tt.other.overlaps(monday); got != tt.want {
+			t.Errorf("%s: reversed overlaps = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSlots(t *testing.T) {
+	slots := []CourseSlot{{Day: " Monday ", Start: "09:00", End: "10:00", Room: " L7 "}, {Day: "THU", Start: "09:00", End: "10:00"}}
+	if problem := validateSlots(slots); problem != "" {
+		t.Fatal(problem)
+	}
+	if slots[0].Day != "mon" || slots[0].Room != "L7" || slots[1].Day != "thu" {
+		t.Errorf("slots were not normalised: %+v", slots)
+	}
+
+	invalid := map[string][]CourseSlot{
+		"unknown day":       {{Day: "someday", Start: "09:00", End: "10:00"}},
+		"abbreviation word": {{Day: "monkey", Start: "09:00", End: "10:00"}},
+		"day name prefix":   {{Day: "thursdayish", Start: "09:00", End: "10:00"}},
+		"12-hour time":      {{Day: "mon", Start: "9:00", End: "10:00"}},
+		"ends before":       {{Day: "mon", Start: "10:00", End: "09:00"}},
+		"empty slot":        {{Day: "mon", Start: "10:00", End: "10:00"}},
+		"overlapping slots": {{Day: "mon", Start: "09:00", End: "10:00"}, {Day: "mon", Start: "09:30", End: "10:30"}},
+	}
+	for name, slots := range invalid {
+		if validateSlots(slots) == "" {
+			t.Errorf("%s: slots were accepted", name)
+		}
+	}
+}
+
+func TestFindClashes(t *testing.T) {
+	course := &Course{Code: "PHY103", Slots: []CourseSlot{
+		{Day: "mon", Start: "09:00", End: "10:00"},
+		{Day: "wed", Start: "09:00", End: "10:00"},
+	}}
+	others := []Course{
+		// The course itself, e.g. from a request in another term
+		*course,
+		{Code: "MTH101", Slots: []CourseSlot{{Day: "wed", Start: "09:30", End: "10:30"}}},
+		{Code: "ESC101", Slots: []CourseSlot{{Day: "mon", Start: "10:00", End: "11:00"}}},
+	}
+	clashes := findClashes(course, others)
+	if len(clashes) != 1 || clashes[0].With != "MTH101" || clashes[0].Slot.Day != "wed" {
+		t.Errorf("clashes = %+v", clashes)
+	}
+}
+
+func TestCheckClashes(t *testing.T) {
+	student := &UserRegistration{
+		Username:    "asha@iitk.ac.in",
+		Courses:     []string{"Linear Algebra"},
+		Enrollments: []Enrollment{{Course: "Linear Algebra", Term: "2026-27-odd"}},
+	}
+	course := &Course{Code: "PHY103", Name: "Mechanics", Slots: []CourseSlot{{Day: "mon", Start: "09:00", End: "10:00"}}}
+	clashing := mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{
+		{Key: "code", Value: "MTH102"},
+		{Key: "name", Value: "Linear Algebra"},
+		{Key: "slots", Value: bson.A{bson.D{{Key: "day", Value: "mon"}, {Key: "start", Value: "09:30"}, {Key: "end", Value: "10:30"}}}},
+	})
+	withPolicy := func(mt *mtest.T, policy string) {
+		previous := clashPolicy
+		clashPolicy = policy
+		mt.Cleanup(func() { clashPolicy = previous })
+	}
+	check := func() (*httptest.ResponseRecorder, []TimetableClash, bool) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		clashes, ok := checkClashes(c, student, course, "2026-27-odd", true)
+		return recorder, clashes, ok
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("hard policy refuses", func(mt *mtest.T) {
+		useMockCollections(mt)
+		withPolicy(mt, clashPolicyHard)
+		mt.AddMockResponses(noDocuments("db.course_requests"), clashing)
+		recorder, _, ok := check()
+		if ok {
+			mt.Fatal("clashing course was allowed")
+		}
+		expectStatus(mt, recorder, http.StatusConflict)
+		if reason := responseBody(mt, recorder)["reason"]; reason != "timetable_clash" {
+			mt.Errorf("reason = %v", reason)
+		}
+	})
+
+	mt.Run("soft policy reports", func(mt *mtest.T) {
+		useMockCollections(mt)
+		withPolicy(mt, clashPolicySoft)
+		mt.AddMockResponses(noDocuments("db.course_requests"), clashing)
+		_, clashes, ok := check()
+		if !ok || len(clashes) != 1 || clashes[0].With != "MTH102" {
+			mt.Fatalf("clashes = %+v, ok %v", clashes, ok)
+		}
+
+		var requested, enrolled bson.RawValue
+		for _, event := range mt.GetAllStartedEvents() {
+			switch event.CommandName + " " + event.Command.Lookup("find").StringValue() {
+			case "find course_requests":
+				requested = event.Command.Lookup("filter")
+			case "find details":
+				enrolled = event.Command.Lookup("filter", "name", "$in")
+			}
+		}
+		if requested.Document().Lookup("term").StringValue() != "2026-27-odd" {
+			mt.Errorf("requests of other terms were compared: %v", requested)
+		}
+		if names, _ := enrolled.Array().Values(); len(names) != 1 || names[0].StringValue() != "Linear Algebra" {
+			mt.Errorf("compared with %v", enrolled)
+		}
+	})
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpIssuer        = "EduWise"
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1 // Accept codes from one step either side of the current one
+	recoveryCodeCount = 10
+
+	// Wrong codes allowed at the second login step before it is locked
+	twoFactorAttempts = 5
+	twoFactorLockout  = 15 * time.Minute
+
+	// Token scopes for partially authenticated sessions
+	scopeTwoFactorPending = "2fa-pending"
+	scopeTwoFactorEnrol   = "2fa-enrol"
+)
+
+var (
+	requireAdmin2FA bool
+
+	errTwoFactorRequired = errors.New("two-factor authentication is required for admin accounts")
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	// Recovery codes are eight base32 characters split by a hyphen
+	recoveryCodePattern = regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}$`)
+)
+
+// generateTOTPSecret returns a new random 160-bit secret encoded as unpadded base32
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// totpURI builds the otpauth:// URI that authenticator apps read from a QR code
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the RFC 6238 code for the given secret and time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation as described in RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// validateTOTP checks a code against the secret and returns the matched time
+// step so that callers can reject replays of the same code
+func validateTOTP(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := current + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// generateRecoveryCodes returns plain-text recovery codes along with their bcrypt hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+
+	return codes, hashes, nil
+}
+
+// generateScopedJWT issues a short-lived token that only grants access to a
+// single step of the login flow. It carries the account's token version so
+// that revoking sessions revokes it too.
+func generateScopedJWT(username, role, scope string, version int, ttl time.Duration) (string, error) {
+	claims := &Claims{
+		Username: username,
+		Role:     role,
+		Scope:    scope,
+		Version:  version,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+// authenticateEnrolment accepts either a full session or the enrolment token
+// handed out at login to admins who still have to set up two-factor
+func authenticateEnrolment(c *gin.Context) (*Claims, bool) {
+	claims, ok := parseToken(c, "", scopeTwoFactorEnrol)
+	if !ok {
+		return nil, false
+	}
+	if claims.Scope == "" {
+		return authenticate(c)
+	}
+	if !checkSession(c, claims) {
+		return nil, false
+	}
+	return claims, true
+}
+
+// takeTwoFactorAttempt uses up one of the user's attempts at a two-factor code
+// before it is checked, so parallel guesses cannot get past the limit; a
+// correct code gives the attempts back. When none is left it writes the
+// response itself. The returned failed responds to a wrong code.
+func takeTwoFactorAttempt(c *gin.Context, username string) (failed func(message string), ok bool) {
+	now := time.Now()
+	var attempt struct {
+		Failures int `bson:"totpFailures"`
+	}
+	err := registeredUsers.FindOneAndUpdate(ctx,
+		bson.M{
+			"username":        username,
+			"totpFailures":    bson.M{"$not": bson.M{"$gte": twoFactorAttempts}},
+			"totpLockedUntil": bson.M{"$not": bson.M{"$gt": now}},
+		},
+		bson.M{"$inc": bson.M{"totpFailures": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"totpFailures": 1}),
+	).Decode(&attempt)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed two-factor attempts. Please try again later"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify two-factor code"})
+		return nil, false
+	}
+
+	return func(message string) {
+		// Only the request that took the last attempt sees the count at the
+		// limit, and it locks two-factor codes out for a while
+		if attempt.Failures >= twoFactorAttempts {
+			_, err := registeredUsers.UpdateOne(ctx, bson.M{"username": username}, bson.M{
+				"$set": bson.M{"totpFailures": 0, "totpLockedUntil": now.Add(twoFactorLockout)},
+			})
+			if err != nil {
+				log.Printf("Failed to lock two-factor codes for %s: %v", username, err)
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+	}, true
+}
+
+// useTOTPStep records step as the last one used and gives the attempts back,
+// applying set and unset along with it. Nothing changes unless the account
+// matches filter and nobody used the same or a newer code in the meantime.
+// It writes the response itself when it fails.
+func useTOTPStep(c *gin.Context, filter bson.M, step int64, set, unset bson.M) bool {
+	filter["totpLastStep"] = bson.M{"$not": bson.M{"$gte": step}}
+	if set == nil {
+		set = bson.M{}
+	}
+	set["totpLastStep"] = step
+	set["totpFailures"] = 0
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	result, err := registeredUsers.UpdateOne(ctx, filter, update)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify two-factor code"})
+		return false
+	}
+	if result.ModifiedCount == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return false
+	}
+	return true
+}
+
+// Route to begin TOTP enrolment by generating a new secret
+func setupTwoFactor(c *gin.Context) {
+	claims, ok := authenticateEnrolment(c)
+	if !ok {
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if dbUser.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate two-factor secret"})
+		return
+	}
+
+	// Keep the secret pending until the user proves their authenticator works
+	_, err = registeredUsers.UpdateOne(ctx, bson.M{"username": claims.Username}, bson.M{"$set": bson.M{"totpPendingSecret": secret}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store two-factor secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": totpURI(claims.Username, secret),
+	})
+}
+
+// Route to confirm TOTP enrolment with a code from the authenticator app
+func confirmTwoFactor(c *gin.Context) {
+	claims, ok := authenticateEnrolment(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if dbUser.TOTPPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup has not been started"})
+		return
+	}
+
+	failed, ok := takeTwoFactorAttempt(c, dbUser.Username)
+	if !ok {
+		return
+	}
+	step, valid := validateTOTP(dbUser.TOTPPendingSecret, req.Code, dbUser.TOTPLastStep)
+	if !valid {
+		failed("Invalid two-factor code")
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	// The pending secret is enabled once, by whichever request gets there first
+	filter := bson.M{"username": dbUser.Username, "totpPendingSecret": dbUser.TOTPPendingSecret}
+	set := bson.M{
+		"totpEnabled":   true,
+		"totpSecret":    dbUser.TOTPPendingSecret,
+		"recoveryCodes": hashes,
+	}
+	if !useTOTPStep(c, filter, step, set, bson.M{"totpPendingSecret": ""}) {
+		return
+	}
+
+	// The user has just proven possession of the second factor, so hand out a full session
+	tokenString, err := generateJWT(dbUser.Username, dbUser.Role, dbUser.TokenVersion, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Two-factor authentication enabled. Store these recovery codes somewhere safe",
+		"recoveryCodes": codes,
+		"token":         tokenString,
+	})
+}
+
+// Route to turn off TOTP for the logged-in user
+func disableTwoFactor(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if requireAdmin2FA && claims.Role == "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication cannot be disabled for admin accounts"})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if !dbUser.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	failed, ok := takeTwoFactorAttempt(c, dbUser.Username)
+	if !ok {
+		return
+	}
+	step, valid := validateTOTP(dbUser.TOTPSecret, req.Code, dbUser.TOTPLastStep)
+	if !valid {
+		failed("Invalid two-factor code")
+		return
+	}
+
+	// The step stays recorded so the code cannot be used again if two-factor
+	// is turned back on
+	filter := bson.M{"username": dbUser.Username, "totpEnabled": true}
+	unset := bson.M{"totpSecret": "", "recoveryCodes": ""}
+	if !useTOTPStep(c, filter, step, bson.M{"totpEnabled": false}, unset) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// Route for the second login step, exchanging a pending token and a TOTP or
+// recovery code for a full session token
+func verifyTwoFactorLogin(c *gin.Context) {
+	claims, ok := parseToken(c, scopeTwoFactorPending)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A two-factor code or recovery code is required"})
+		return
+	}
+
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": claims.Username}).Decode(&dbUser)
+	if err != nil || !dbUser.TOTPEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+		return
+	}
+	if dbUser.Disabled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+	if dbUser.TokenVersion != claims.Version {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked. Please log in again"})
+		return
+	}
+
+	failed, ok := takeTwoFactorAttempt(c, dbUser.Username)
+	if !ok {
+		return
+	}
+
+	if req.Code != "" {
+		step, valid := validateTOTP(dbUser.TOTPSecret, req.Code, dbUser.TOTPLastStep)
+		if !valid {
+			failed("Invalid two-factor code")
+			return
+		}
+
+		if !useTOTPStep(c, bson.M{"username": dbUser.Username}, step, nil, nil) {
+			return
+		}
+	} else {
+		// Codes that cannot be recovery codes are turned away without hashing
+		code := strings.ToLower(strings.TrimSpace(req.RecoveryCode))
+		matched := ""
+		if recoveryCodePattern.MatchString(code) {
+			for _, hash := range dbUser.RecoveryCodes {
+				if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+					matched = hash
+					break
+				}
+			}
+		}
+		if matched == "" {
+			failed("Invalid recovery code")
+			return
+		}
+
+		// Recovery codes are single-use
+		result, err := registeredUsers.UpdateOne(ctx,
+			bson.M{"username": dbUser.Username, "recoveryCodes": matched},
+			bson.M{"$pull": bson.M{"recoveryCodes": matched}, "$set": bson.M{"totpFailures": 0}})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify recovery code"})
+			return
+		}
+		if result.ModifiedCount == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid recovery code"})
+			return
+		}
+	}
+
+	tokenString, err := generateJWT(dbUser.Username, dbUser.Role, dbUser.TokenVersion, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+}
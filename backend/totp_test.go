@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// serveWithToken runs a handler on a request with a JSON body carrying the
+// given bearer token
+func serveWithToken(handler gin.HandlerFunc, method, target, token string, body interface{}) *httptest.ResponseRecorder {
+	encoded, _ := json.Marshal(body)
+	request := httptest.NewRequest(method, target, bytes.NewReader(encoded))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	router := gin.New()
+	router.Handle(method, target, handler)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, keeping the last six of the eight digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		time int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(secret, tt.time/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.time, code, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	current := time.Now().Unix() / totpPeriod
+	codeAt := func(step int64) string {
+		code, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	step, ok := validateTOTP(secret, codeAt(current), 0)
+	if !ok || step < current {
+		t.Fatalf("current code rejected: step %d, ok %v", step, ok)
+	}
+	if _, ok := validateTOTP(secret, codeAt(step), step); ok {
+		t.Error("code of the last used step was accepted again")
+	}
+	if _, ok := validateTOTP(secret, codeAt(current-1), 0); !ok {
+		t.Error("code from the previous step was rejected")
+	}
+	if _, ok := validateTOTP(secret, codeAt(current-1), current-1); ok {
+		t.Error("code older than the last used step was accepted")
+	}
+	if _, ok := validateTOTP(secret, codeAt(current-3), 0); ok {
+		t.Error("code from outside the allowed skew was accepted")
+	}
+	if _, ok := validateTOTP(secret, "12345", 0); ok {
+		t.Error("short code was accepted")
+	}
+}
+
+// takenAttempts is the mock response to taking a two-factor attempt, leaving
+// the count of failures at n
+func takenAttempts(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "totpFailures", Value: n}}})
+}
+
+// noAttemptsLeft is the mock response to taking an attempt while locked out
+func noAttemptsLeft() bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+}
+
+func TestVerifyTwoFactorLogin(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	user := func(fields ...bson.E) bson.D {
+		doc := bson.D{
+			{Key: "username", Value: "admin@iitk.ac.in"},
+			{Key: "role", Value: "admin"},
+			{Key: "totpEnabled", Value: true},
+			{Key: "totpSecret", Value: secret},
+		}
+		return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, append(doc, fields...))
+	}
+	matched := func(n int) bson.D {
+		return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+	}
+	pending, err := generateScopedJWT("admin@iitk.ac.in", "admin", scopeTwoFactorPending, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(code string) *httptest.ResponseRecorder {
+		return serveWithToken(verifyTwoFactorLogin, http.MethodPost, "/api/login/2fa", pending, map[string]string{"code": code})
+	}
+	updates := func(mt *mtest.T) []bson.Raw {
+		var sent []bson.Raw
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "update" {
+				sent = append(sent, event.Command.Lookup("updates").Array().Index(0).Value().Document())
+			}
+		}
+		return sent
+	}
+	current, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if wrong == current {
+		wrong = "111111"
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("wrong code uses up an attempt", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(user(), takenAttempts(1))
+		expectStatus(mt, verify(wrong), http.StatusUnauthorized)
+
+		taken := sentCommand(mt, "findAndModify")
+		if taken.Lookup("update", "$inc", "totpFailures").Int32() != 1 {
+			mt.Fatalf("attempt = %v", taken)
+		}
+		if _, err := taken.LookupErr("query", "totpLockedUntil"); err != nil {
+			mt.Errorf("attempt is taken while locked out: %v", taken)
+		}
+		if sent := updates(mt); len(sent) != 0 {
+			mt.Errorf("step locked after one wrong code: %v", sent)
+		}
+	})
+
+	mt.Run("no attempts left", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(user(), noAttemptsLeft())
+		expectStatus(mt, verify(current), http.StatusTooManyRequests)
+	})
+
+	mt.Run("last wrong code locks the step", func(mt *mtest.T) {
+		useMockCollections(mt)
+		// The account was read before parallel guesses used up the other attempts
+		mt.AddMockResponses(user(), takenAttempts(twoFactorAttempts), matched(1))
+		expectStatus(mt, verify(wrong), http.StatusUnauthorized)
+
+		sent := updates(mt)
+		if len(sent) != 1 {
+			mt.Fatalf("updates = %v", sent)
+		}
+		if _, err := sent[0].LookupErr("u", "$set", "totpLockedUntil"); err != nil {
+			mt.Errorf("last attempt did not lock the step: %v", sent[0])
+		}
+	})
+
+	mt.Run("lock follows the count taken, not the one read", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(user(bson.E{Key: "totpFailures", Value: twoFactorAttempts - 1}), takenAttempts(2))
+		expectStatus(mt, verify(wrong), http.StatusUnauthorized)
+		if sent := updates(mt); len(sent) != 0 {
+			mt.Errorf("step locked with attempts left: %v", sent)
+		}
+	})
+
+	mt.Run("correct code resets the attempts", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(user(), takenAttempts(3), matched(1))
+		expectStatus(mt, verify(current), http.StatusOK)
+
+		sent := updates(mt)
+		if len(sent) != 1 || sent[0].Lookup("u", "$set", "totpFailures").Int32() != 0 {
+			mt.Errorf("updates = %v", sent)
+		}
+	})
+
+	mt.Run("revoked pending token", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(user(bson.E{Key: "tokenVersion", Value: 1}))
+		expectStatus(mt, verify(current), http.StatusUnauthorized)
+		if sent := updates(mt); len(sent) != 0 {
+			mt.Errorf("revoked token used an attempt: %v", sent)
+		}
+	})
+
+	mt.Run("disabled account", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(user(bson.E{Key: "disabled", Value: true}))
+		expectStatus(mt, verify(current), http.StatusForbidden)
+	})
+}
+
+func TestSetupTwoFactorRevokedToken(t *testing.T) {
+	// Changing the password moved the account on to token version 1
+	revoked := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{{Key: "tokenVersion", Value: 1}})
+
+	enrolment, err := generateScopedJWT("admin@iitk.ac.in", "admin", scopeTwoFactorEnrol, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := generateJWT("asha@iitk.ac.in", "student", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	for name, token := range map[string]string{"enrolment token": enrolment, "session token": session} {
+		token := token
+		mt.Run(name, func(mt *mtest.T) {
+			useMockCollections(mt)
+			mt.AddMockResponses(revoked)
+			recorder := serveWithToken(setupTwoFactor, http.MethodPost, "/api/2fa/setup", token, nil)
+			expectStatus(mt, recorder, http.StatusUnauthorized)
+			if _, err := sentCommand(mt, "find").LookupErr("filter", "username"); err != nil {
+				mt.Errorf("session was not looked up: %v", err)
+			}
+			for _, event := range mt.GetAllStartedEvents() {
+				if event.CommandName == "update" {
+					mt.Errorf("revoked token stored a two-factor secret: %v", event.Command)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeTwoFactor(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	step := time.Now().Unix() / totpPeriod
+	current, err := totpCode(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if wrong == current {
+		wrong = "111111"
+	}
+	enrolment, err := generateScopedJWT("admin@iitk.ac.in", "admin", scopeTwoFactorEnrol, 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := generateJWT("asha@iitk.ac.in", "student", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pending is an account part way through enrolment, enabled one that has
+	// two-factor on; lastStep is the step of the last code used
+	pending := func(lastStep int64) bson.D {
+		return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "username", Value: "admin@iitk.ac.in"},
+			{Key: "role", Value: "admin"},
+			{Key: "totpPendingSecret", Value: secret},
+			{Key: "totpLastStep", Value: lastStep},
+		})
+	}
+	enabled := func(lastStep int64) bson.D {
+		return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "role", Value: "student"},
+			{Key: "totpEnabled", Value: true},
+			{Key: "totpSecret", Value: secret},
+			{Key: "totpLastStep", Value: lastStep},
+		})
+	}
+	confirm := func(code string) *httptest.ResponseRecorder {
+		return serveWithToken(confirmTwoFactor, http.MethodPost, "/api/2fa/confirm", enrolment, map[string]string{"code": code})
+	}
+	disable := func(code string) *httptest.ResponseRecorder {
+		return serveWithToken(disableTwoFactor, http.MethodPost, "/api/2fa/disable", session, map[string]string{"code": code})
+	}
+	// expectUnchanged checks that nothing but the attempt counter was written
+	expectUnchanged := func(mt *mtest.T) {
+		mt.Helper()
+		if _, updates := sentUpdates(mt); len(updates) != 0 {
+			mt.Errorf("updates = %v", updates)
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("confirm", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), pending(0), takenAttempts(1), matchedDocuments(1))
+		expectStatus(mt, confirm(current), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if updates[0].Lookup("q", "totpPendingSecret").StringValue() != secret {
+			mt.Errorf("pending secret can be enabled twice: %v", updates[0])
+		}
+		if updates[0].Lookup("u", "$set", "totpLastStep").Int64() != step {
+			mt.Errorf("code was not used up: %v", updates[0])
+		}
+	})
+
+	mt.Run("confirm with a replayed code", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), pending(step), takenAttempts(1))
+		expectStatus(mt, confirm(current), http.StatusUnauthorized)
+		expectUnchanged(mt)
+	})
+
+	mt.Run("confirm while locked out", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), pending(0), noAttemptsLeft())
+		expectStatus(mt, confirm(current), http.StatusTooManyRequests)
+		expectUnchanged(mt)
+	})
+
+	mt.Run("disable", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), enabled(0), takenAttempts(1), matchedDocuments(1))
+		expectStatus(mt, disable(current), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if _, err := updates[0].LookupErr("q", "totpLastStep"); err != nil {
+			mt.Errorf("disabled without checking the code is unused: %v", updates[0])
+		}
+		if updates[0].Lookup("u", "$set", "totpLastStep").Int64() != step || updates[0].Lookup("u", "$set", "totpEnabled").Boolean() {
+			mt.Errorf("update = %v", updates[0])
+		}
+	})
+
+	mt.Run("disable with a replayed code", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), enabled(step), takenAttempts(1))
+		expectStatus(mt, disable(current), http.StatusUnauthorized)
+		expectUnchanged(mt)
+	})
+
+	mt.Run("disable with a code used meanwhile", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), enabled(0), takenAttempts(1), matchedDocuments(0))
+		expectStatus(mt, disable(current), http.StatusUnauthorized)
+	})
+
+	mt.Run("disable while locked out", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), enabled(0), noAttemptsLeft())
+		expectStatus(mt, disable(current), http.StatusTooManyRequests)
+		expectUnchanged(mt)
+	})
+
+	mt.Run("last wrong code locks disabling", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), enabled(0), takenAttempts(twoFactorAttempts), matchedDocuments(1))
+		expectStatus(mt, disable(wrong), http.StatusUnauthorized)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if _, err := updates[0].LookupErr("u", "$set", "totpLockedUntil"); err != nil {
+			mt.Errorf("last attempt did not lock two-factor codes: %v", updates[0])
+		}
+	})
+}
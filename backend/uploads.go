@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	courseRecordCollection *mongo.Collection
+
+	// maxUploadBytes caps the size of an attached file
+	maxUploadBytes int64 = 20 << 20
+
+	errUploadType = errors.New("file type is not allowed")
+)
+
+// Kinds of course record a student can submit
+var recordTypes = map[string]bool{
+	"Midsem": true, "Endsem": true, "Quiz": true, "Lecture Note": true, "Assignments": true,
+}
+
+// Allowed attachment extensions and the content types their bytes must sniff as
+var uploadTypes = map[string][]string{
+	".pdf":  {"application/pdf"},
+	".png":  {"image/png"},
+	".jpg":  {"image/jpeg"},
+	".jpeg": {"image/jpeg"},
+	".txt":  {"text/plain; charset=utf-8", "text/plain; charset=utf-16be", "text/plain; charset=utf-16le"},
+	".zip":  {"application/zip"},
+	".docx": {"application/zip"},
+	".pptx": {"application/zip"},
+	".xlsx": {"application/zip"},
+	".doc":  {"application/octet-stream"},
+	".ppt":  {"application/octet-stream"},
+}
+
+// Leading bytes required of extensions whose content does not sniff as
+// anything more specific than application/octet-stream
+var uploadMagic = map[string][]byte{
+	".doc": ole2Magic,
+	".ppt": ole2Magic,
+}
+
+// ole2Magic starts every OLE2 compound file, the container of legacy Office documents
+var ole2Magic = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// CourseRecord is a student's submission of material for a course
+type CourseRecord struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username     string             `json:"username" bson:"username"`
+	CourseCode   string             `json:"courseCode" bson:"courseCode"`
+	CourseName   string             `json:"courseName" bson:"courseName"`
+	Batch        int                `json:"batch,omitempty" bson:"batch,omitempty"`
+	InstructorID string             `json:"instructorId,omitempty" bson:"instructorId,omitempty"`
+	Instructor   string             `json:"instructor,omitempty" bson:"instructor,omitempty"`
+	Type         string             `json:"type" bson:"type"`
+	Detail       string             `json:"detail,omitempty" bson:"detail,omitempty"`
+	Remark       string             `json:"remark,omitempty" bson:"remark,omitempty"`
+	File         *RecordFile        `json:"file,omitempty" bson:"file,omitempty"`
+	CreatedAt    time.Time          `json:"createdAt" bson:"createdAt"`
+
+	// Status is one of the record* moderation states
+	Status        string     `json:"status" bson:"status"`
+	ReviewedBy    string     `json:"reviewedBy,omitempty" bson:"reviewedBy,omitempty"`
+	ReviewedAt    *time.Time `json:"reviewedAt,omitempty" bson:"reviewedAt,omitempty"`
+	ReviewComment string     `json:"reviewComment,omitempty" bson:"reviewComment,omitempty"`
+}
+
+// RecordFile describes the attachment of a course record held in the blob store
+type RecordFile struct {
+	BlobKey     string `json:"-" bson:"blobKey"`
+	Filename    string `json:"filename" bson:"filename"`
+	ContentType string `json:"contentType" bson:"contentType"`
+	Size        int64  `json:"size" bson:"size"`
+}
+
+// loadUploadConfig reads UPLOAD_MAX_BYTES
+func loadUploadConfig() {
+	if value := os.Getenv("UPLOAD_MAX_BYTES"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			log.Fatalf("Invalid UPLOAD_MAX_BYTES %q", value)
+		}
+		maxUploadBytes = limit
+	}
+}
+
+// sniffUpload checks the file's extension and leading bytes against the allow-list
+// and returns the content type to store it with
+func sniffUpload(filename string, head []byte) (string, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	allowed, ok := uploadTypes[ext]
+	if !ok {
+		return "", errUploadType
+	}
+	if magic, ok := uploadMagic[ext]; ok && !bytes.HasPrefix(head, magic) {
+		return "", errUploadType
+	}
+	sniffed := http.DetectContentType(head)
+	for _, contentType := range allowed {
+		if sniffed == contentType {
+			if byExt := mime.TypeByExtension(ext); byExt != "" {
+				return byExt, nil
+			}
+			return sniffed, nil
+		}
+	}
+	return "", errUploadType
+}
+
+// errUploadTooLarge is returned by uploadLimitReader once the file exceeds maxUploadBytes
+var errUploadTooLarge = errors.New("file is too large")
+
+// uploadLimitReader fails the read that takes the stream past its limit, so an
+// oversized file is never stored in full
+type uploadLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// attachmentDisposition builds a Content-Disposition header that downloads as filename
+func attachmentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+// newCourseRecord validates the form fields of an upload, writing the error response if they are invalid
+func newCourseRecord(c *gin.Context, claims *Claims, fields map[string]string) (*CourseRecord, bool) {
+	field := func(name string) string { return strings.TrimSpace(fields[name]) }
+	record := &CourseRecord{
+		Username:  claims.Username,
+		Type:      field("type"),
+		Detail:    field("detail"),
+		Remark:    field("remark"),
+		CreatedAt: time.Now(),
+		Status:    recordPending,
+	}
+
+	errs := map[string]string{}
+	if !recordTypes[record.Type] {
+		errs["type"] = "Type must be Midsem, Endsem, Quiz, Lecture Note or Assignments"
+	}
+	if len(record.Detail) > 5000 {
+		errs["detail"] = "Detail must be at most 5000 characters"
+	}
+	if len(record.Remark) > 1000 {
+		errs["remark"] = "Remark must be at most 1000 characters"
+	}
+	if batch := field("batch"); batch != "" {
+		year, err := strconv.Atoi(batch)
+		if err != nil || year < 1960 || year > time.Now().Year()+1 {
+			errs["batch"] = "Year is out of range"
+		}
+		record.Batch = year
+	}
+
+	course, err := findCourse(field("courseName"))
+	if err == errCourseNotFound {
+		errs["courseName"] = "Course not found"
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return nil, false
+	} else {
+		record.CourseCode, record.CourseName = course.Code, course.Name
+	}
+
+	if ref := field("instructor"); ref != "" {
+		member, err := resolveInstructor(ref)
+		if err == errFacultyNotFound {
+			errs["instructor"] = "Instructor must be a faculty member in the directory"
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch instructor"})
+			return nil, false
+		} else {
+			record.InstructorID, record.Instructor = member.ID.Hex(), member.Name
+		}
+	}
+
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course record", "fields": errs})
+		return nil, false
+	}
+	return record, true
+}
+
+// storeRecordFile sniffs and streams one file part into the blob store. The
+// blob stays locked until release is called; see putBlobDeduplicated.
+func storeRecordFile(c *gin.Context, claims *Claims, part *multipart.Part) (file *RecordFile, release func(), ok bool) {
+	reader := bufio.NewReaderSize(&uploadLimitReader{r: part, remaining: maxUploadBytes}, 512)
+	head, err := reader.Peek(512)
+	if err == errUploadTooLarge {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large", "field": "file"})
+		return nil, nil, false
+	}
+	if err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file", "field": "file"})
+		return nil, nil, false
+	}
+	contentType, err := sniffUpload(part.FileName(), head)
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "File type is not allowed", "field": "file"})
+		return nil, nil, false
+	}
+
+	key, size, release, err := putBlobDeduplicated(blobStore, reader)
+	if errors.Is(err, errUploadTooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large", "field": "file"})
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to store upload from %s: %v", claims.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return nil, nil, false
+	}
+
+	return &RecordFile{
+		BlobKey:     key,
+		Filename:    filepath.Base(part.FileName()),
+		ContentType: contentType,
+		Size:        size,
+	}, release, true
+}
+
+// discardRecordFile deletes the blob of a file no record was stored for. The
+// blob may be shared with an earlier identical upload, so it is only deleted
+// while unreferenced; the caller holds its lock, which keeps another upload
+// from resolving to it meanwhile.
+func discardRecordFile(file *RecordFile) {
+	n, err := courseRecordCollection.CountDocuments(ctx, bson.M{"file.blobKey": file.BlobKey})
+	if err != nil {
+		log.Printf("Failed to check references to blob %s: %v", file.BlobKey, err)
+		return
+	}
+	if n == 0 {
+		if err := blobStore.Delete(file.BlobKey); err != nil {
+			log.Printf("Failed to delete unreferenced blob %s: %v", file.BlobKey, err)
+		}
+	}
+}
+
+// Route for a logged-in user to submit a course record with an optional file.
+// The form is read as a stream, so the fields must come before the file.
+func uploadCourseRecord(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	// Leave a little room for the other form fields
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadBytes+1<<20)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload must be a multipart form"})
+		return
+	}
+
+	fields := map[string]string{}
+	var record *CourseRecord
+	var release func()
+	stored := false
+	defer func() {
+		// A file stored for a record that was then refused is removed again
+		if record != nil && record.File != nil && !stored {
+			discardRecordFile(record.File)
+		}
+		if release != nil {
+			release()
+		}
+	}()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload is too large or not a valid multipart form"})
+			return
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			if record != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Only one file may be attached", "field": "file"})
+				return
+			}
+			if record, ok = newCourseRecord(c, claims, fields); !ok {
+				return
+			}
+			if record.File, release, ok = storeRecordFile(c, claims, part); !ok {
+				return
+			}
+			continue
+		}
+		if record != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Form fields must come before the file", "field": part.FormName()})
+			return
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, 64<<10+1))
+		if err != nil || len(value) > 64<<10 {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Form field is too large", "field": part.FormName()})
+			return
+		}
+		fields[part.FormName()] = string(value)
+	}
+
+	if record == nil {
+		if record, ok = newCourseRecord(c, claims, fields); !ok {
+			return
+		}
+	}
+
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		result, err := courseRecordCollection.InsertOne(sc, record)
+		if err != nil {
+			return err
+		}
+		record.ID = result.InsertedID.(primitive.ObjectID)
+		return recordAuditIn(sc, c, "record.create", "record:"+record.ID.Hex(), nil, record)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store course record"})
+		return
+	}
+	stored = true
+
+	c.JSON(http.StatusOK, gin.H{"message": "Course record uploaded successfully", "record": record})
+}
+
+// Route listing course records: students see their own, admins see all and
+// may filter by username, course, type and status
+func listCourseRecords(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{}
+	if claims.Role == "admin" {
+		if username := c.Query("username"); username != "" {
+			filter["username"] = username
+		}
+	} else {
+		filter["username"] = claims.Username
+	}
+	if course := c.Query("course"); course != "" {
+		filter["courseCode"] = normaliseCourseCode(course)
+	}
+	if recordType := c.Query("type"); recordType != "" {
+		filter["type"] = recordType
+	}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := courseRecordCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course records"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	records := []CourseRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode course records"})
+		return
+	}
+
+	c.JSON(http.StatusOK, records)
+}
+
+// findAccessibleRecord loads the record in the URL if it has been approved, the
+// caller submitted it or the caller is an admin
+func findAccessibleRecord(c *gin.Context, claims *Claims) (*CourseRecord, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid record ID"})
+		return nil, false
+	}
+
+	var record CourseRecord
+	err = courseRecordCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course record not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course record"})
+		return nil, false
+	}
+
+	switch {
+	case claims.Role == "admin" || record.Username == claims.Username:
+	case record.Status == recordApproved:
+		record.hideReview()
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course record not found"})
+		return nil, false
+	}
+	return &record, true
+}
+
+// Route returning one course record
+func getCourseRecord(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	record, ok := findAccessibleRecord(c, claims)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, record)
+}
+
+// Route streaming the file attached to a course record
+func downloadCourseRecord(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	record, ok := findAccessibleRecord(c, claims)
+	if !ok {
+		return
+	}
+	if record.File == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course record has no file"})
+		return
+	}
+
+	streamBlob(c, record.File.BlobKey, record.File.Filename, record.File.ContentType)
+}
+
+// Route returning a time-limited link to the file attached to a course record
+func linkCourseRecord(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	record, ok := findAccessibleRecord(c, claims)
+	if !ok {
+		return
+	}
+	if record.File == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course record has no file"})
+		return
+	}
+
+	link, expires, err := signedBlobURL(c, record.File.BlobKey, record.File.Filename, record.File.ContentType, signedBlobURLTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create download link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"url": link, "expiresAt": expires})
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSniffUpload(t *testing.T) {
+	ole2 := append(append([]byte{}, ole2Magic...), make([]byte, 504)...)
+	tests := []struct {
+		filename string
+		head     []byte
+		wantErr  bool
+	}{
+		{"notes.pdf", []byte("%PDF-1.7\n"), false},
+		{"notes.doc", ole2, false},
+		{"slides.PPT", ole2, false},
+		{"notes.doc", []byte("MZ\x90\x00\x03\x00\x00\x00"), true},
+		{"slides.ppt", make([]byte, 512), true},
+		{"notes.pdf", ole2, true},
+		{"run.exe", []byte("MZ\x90\x00"), true},
+	}
+	for _, tt := range tests {
+		_, err := sniffUpload(tt.filename, tt.head)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sniffUpload(%s, % x) error = %v, wantErr %v", tt.filename, tt.head[:8], err, tt.wantErr)
+		}
+	}
+}
+
+func TestPutBlobDeduplicatedLocksKey(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _, release, err := putBlobDeduplicated(store, strings.NewReader("lecture notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An identical upload resolves to the same blob only once the first lets go
+	done := make(chan string)
+	go func() {
+		again, _, release, err := putBlobDeduplicated(store, strings.NewReader("lecture notes"))
+		if err != nil {
+			t.Error(err)
+		} else {
+			release()
+		}
+		done <- again
+	}()
+	select {
+	case <-done:
+		t.Fatal("second upload resolved the blob while it was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	if again := <-done; again != key {
+		t.Errorf("second upload stored under %s, want %s", again, key)
+	}
+	if len(blobLocks.held) != 0 {
+		t.Errorf("%d blob locks left behind", len(blobLocks.held))
+	}
+}
+
+func TestBlobURLSecret(t *testing.T) {
+	t.Setenv("BLOB_STORE", "local")
+	t.Setenv("BLOB_DIR", t.TempDir())
+	defer func(secret []byte) { blobURLSecret = secret }(blobURLSecret)
+
+	t.Setenv("BLOB_URL_SECRET", "")
+	if _, err := newBlobStoreFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if len(blobURLSecret) == 0 || bytes.Equal(blobURLSecret, jwtKey) {
+		t.Errorf("download links are signed with the JWT key")
+	}
+
+	t.Setenv("BLOB_URL_SECRET", "links only")
+	if _, err := newBlobStoreFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if string(blobURLSecret) != "links only" {
+		t.Errorf("secret = %q, want BLOB_URL_SECRET", blobURLSecret)
+	}
+}
+
+// formPart is one part of a multipart upload; parts with a filename are files
+type formPart struct {
+	name, filename, value string
+}
+
+// serveUpload posts parts in order to uploadCourseRecord as the user
+func serveUpload(parts []formPart, username, role string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, part := range parts {
+		if part.filename != "" {
+			w, _ := form.CreateFormFile(part.name, part.filename)
+			w.Write([]byte(part.value))
+		} else {
+			form.WriteField(part.name, part.value)
+		}
+	}
+	form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/api/records", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	token, _ := generateJWT(username, role, 0, true)
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	router := gin.New()
+	router.POST("/api/records", uploadCourseRecord)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// useTempBlobStore points blobStore at an empty local store for the test and
+// returns its directory
+func useTempBlobStore(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewLocalBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := blobStore
+	blobStore = store
+	t.Cleanup(func() { blobStore = previous })
+	return dir
+}
+
+// storedBlobs counts the files kept under a local blob store directory
+func storedBlobs(t testing.TB, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUploadCourseRecordRemovesRefusedFile(t *testing.T) {
+	course := mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{
+		{Key: "code", Value: "PHY103"},
+		{Key: "name", Value: "Mechanics"},
+	})
+	// A valid upload followed by a part that gets it refused
+	refused := func(after formPart) []formPart {
+		return []formPart{
+			{name: "type", value: "Quiz"},
+			{name: "courseName", value: "PHY103"},
+			{name: "file", filename: "quiz.pdf", value: "%PDF-1.7\n"},
+			after,
+		}
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("field after the file", func(mt *mtest.T) {
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course, countedDocuments("db.course_records", 0))
+
+		recorder := serveUpload(refused(formPart{name: "remark", value: "late"}), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if n := storedBlobs(mt, dir); n != 0 {
+			mt.Errorf("%d blobs left behind by a refused upload", n)
+		}
+	})
+
+	mt.Run("second file", func(mt *mtest.T) {
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course, countedDocuments("db.course_records", 0))
+
+		recorder := serveUpload(refused(formPart{name: "file", filename: "again.pdf", value: "%PDF-1.4\n"}), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if n := storedBlobs(mt, dir); n != 0 {
+			mt.Errorf("%d blobs left behind by a refused upload", n)
+		}
+	})
+
+	mt.Run("file shared with a stored record", func(mt *mtest.T) {
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course, countedDocuments("db.course_records", 1))
+
+		recorder := serveUpload(refused(formPart{name: "remark", value: "late"}), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if n := storedBlobs(mt, dir); n != 1 {
+			mt.Errorf("%d blobs kept, want the one another record refers to", n)
+		}
+	})
+}
+
+func TestUploadCourseRecordRefusals(t *testing.T) {
+	course := mtest.CreateCursorResponse(0, "db.details", mtest.FirstBatch, bson.D{
+		{Key: "code", Value: "PHY103"},
+		{Key: "name", Value: "Mechanics"},
+	})
+	upload := func(course, instructor string, file formPart) []formPart {
+		parts := []formPart{{name: "type", value: "Quiz"}, {name: "courseName", value: course}}
+		if instructor != "" {
+			parts = append(parts, formPart{name: "instructor", value: instructor})
+		}
+		return append(parts, file)
+	}
+	pdf := formPart{name: "file", filename: "quiz.pdf", value: "%PDF-1.7\n" + strings.Repeat("x", 100)}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("file too large", func(mt *mtest.T) {
+		defer func(limit int64) { maxUploadBytes = limit }(maxUploadBytes)
+		maxUploadBytes = 64
+
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course)
+		recorder := serveUpload(upload("PHY103", "", pdf), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusRequestEntityTooLarge)
+		if n := storedBlobs(mt, dir); n != 0 {
+			mt.Errorf("%d blobs kept from a file over the limit", n)
+		}
+	})
+
+	mt.Run("file type not allowed", func(mt *mtest.T) {
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course)
+		exe := formPart{name: "file", filename: "quiz.pdf", value: "MZ\x90\x00\x03\x00\x00\x00"}
+		recorder := serveUpload(upload("PHY103", "", exe), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusUnsupportedMediaType)
+		if n := storedBlobs(mt, dir); n != 0 {
+			mt.Errorf("%d blobs kept from a refused file type", n)
+		}
+	})
+
+	mt.Run("unknown course", func(mt *mtest.T) {
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), noDocuments("db.details"), noDocuments("db.details"))
+		recorder := serveUpload(upload("XYZ999", "", pdf), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if fields, _ := responseBody(mt, recorder)["fields"].(map[string]interface{}); fields["courseName"] == nil {
+			mt.Errorf("response does not name the courseName field: %s", recorder.Body.String())
+		}
+		if n := storedBlobs(mt, dir); n != 0 {
+			mt.Errorf("%d blobs kept for an unknown course", n)
+		}
+	})
+
+	mt.Run("unknown instructor", func(mt *mtest.T) {
+		useMockCollections(mt)
+		dir := useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course, noDocuments("db.faculty"))
+		recorder := serveUpload(upload("PHY103", "Dr Nobody", pdf), "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if fields, _ := responseBody(mt, recorder)["fields"].(map[string]interface{}); fields["instructor"] == nil {
+			mt.Errorf("response does not name the instructor field: %s", recorder.Body.String())
+		}
+		if n := storedBlobs(mt, dir); n != 0 {
+			mt.Errorf("%d blobs kept for an unknown instructor", n)
+		}
+	})
+
+	mt.Run("ambiguous instructor", func(mt *mtest.T) {
+		useMockCollections(mt)
+		useTempBlobStore(mt)
+		mt.AddMockResponses(activeSession(), course, mtest.CreateCursorResponse(0, "db.faculty", mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "name", Value: "A. Gupta"}},
+			bson.D{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "name", Value: "a. gupta"}},
+		))
+		expectStatus(mt, serveUpload(upload("PHY103", "A. Gupta", pdf), "asha@iitk.ac.in", "student"), http.StatusBadRequest)
+	})
+}
+
+func TestListCourseRecords(t *testing.T) {
+	// sentFilter lists records as the user and returns the filter of the query
+	sentFilter := func(mt *mtest.T, username, role, query string) bson.Raw {
+		mt.Helper()
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), noDocuments("db.course_records"))
+		recorder := serveRoute(listCourseRecords, http.MethodGet, "/api/uploads", "/api/uploads?"+query, nil, username, role)
+		expectStatus(mt, recorder, http.StatusOK)
+		return sentCommand(mt, "find").Lookup("filter").Document()
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("students see only their own", func(mt *mtest.T) {
+		filter := sentFilter(mt, "asha@iitk.ac.in", "student", "username=ravi@iitk.ac.in&course=phy+103")
+		if filter.Lookup("username").StringValue() != "asha@iitk.ac.in" || filter.Lookup("courseCode").StringValue() != "PHY103" {
+			mt.Errorf("filter = %v", filter)
+		}
+	})
+
+	mt.Run("admins see everyone's", func(mt *mtest.T) {
+		filter := sentFilter(mt, "admin@iitk.ac.in", "admin", "")
+		if _, err := filter.LookupErr("username"); err == nil {
+			mt.Errorf("filter = %v", filter)
+		}
+	})
+
+	mt.Run("admins filter by user", func(mt *mtest.T) {
+		filter := sentFilter(mt, "admin@iitk.ac.in", "admin", "username=ravi@iitk.ac.in&type=Quiz&status=approved")
+		if filter.Lookup("username").StringValue() != "ravi@iitk.ac.in" ||
+			filter.Lookup("type").StringValue() != "Quiz" ||
+			filter.Lookup("status").StringValue() != recordApproved {
+			mt.Errorf("filter = %v", filter)
+		}
+	})
+}
+
+func TestGetCourseRecordVisibility(t *testing.T) {
+	id := primitive.NewObjectID()
+	record := func(status string) bson.D {
+		return mtest.CreateCursorResponse(0, "db.course_records", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: id},
+			{Key: "username", Value: "asha@iitk.ac.in"},
+			{Key: "courseCode", Value: "PHY103"},
+			{Key: "type", Value: "Quiz"},
+			{Key: "status", Value: status},
+			{Key: "reviewedBy", Value: "admin@iitk.ac.in"},
+			{Key: "reviewComment", Value: "Blurry scan"},
+		})
+	}
+	get := func(username, role, target string) *httptest.ResponseRecorder {
+		return serveRoute(getCourseRecord, http.MethodGet, "/api/uploads/:id", target, nil, username, role)
+	}
+
+	tests := []struct {
+		name           string
+		username, role string
+		status         string
+		want           int
+		review         bool
+	}{
+		{"own pending record", "asha@iitk.ac.in", "student", recordPending, http.StatusOK, true},
+		{"own rejected record", "asha@iitk.ac.in", "student", recordRejected, http.StatusOK, true},
+		{"another student's pending record", "ravi@iitk.ac.in", "student", recordPending, http.StatusNotFound, false},
+		{"another student's rejected record", "ravi@iitk.ac.in", "student", recordRejected, http.StatusNotFound, false},
+		{"another student's approved record", "ravi@iitk.ac.in", "student", recordApproved, http.StatusOK, false},
+		{"admin", "admin@iitk.ac.in", "admin", recordPending, http.StatusOK, true},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockCollections(mt)
+			mt.AddMockResponses(activeSession(), record(tt.status))
+			recorder := get(tt.username, tt.role, "/api/uploads/"+id.Hex())
+			expectStatus(mt, recorder, tt.want)
+			if tt.want != http.StatusOK {
+				return
+			}
+			body := responseBody(mt, recorder)
+			if shown := body["reviewComment"] != nil && body["reviewedBy"] != nil; shown != tt.review {
+				mt.Errorf("review shown = %v, want %v: %v", shown, tt.review, body)
+			}
+		})
+	}
+
+	mt.Run("missing record", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), noDocuments("db.course_records"))
+		expectStatus(mt, get("asha@iitk.ac.in", "student", "/api/uploads/"+id.Hex()), http.StatusNotFound)
+	})
+
+	mt.Run("invalid ID", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		expectStatus(mt, get("asha@iitk.ac.in", "student", "/api/uploads/not-an-id"), http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AdminUserView is what admins see about an account
+type AdminUserView struct {
+	Username               string       `json:"username" bson:"username"`
+	Role                   string       `json:"role" bson:"role"`
+	IsVerified             bool         `json:"isVerified" bson:"isVerified"`
+	ReverificationRequired bool         `json:"reverificationRequired" bson:"reverificationRequired"`
+	Disabled               bool         `json:"disabled" bson:"disabled"`
+	TOTPEnabled            bool         `json:"totpEnabled" bson:"totpEnabled"`
+	SSO                    bool         `json:"sso" bson:"-"`
+	OIDCSubject            string       `json:"-" bson:"oidcSubject,omitempty"`
+	Profile                *UserProfile `json:"profile,omitempty" bson:"profile,omitempty"`
+	Courses                []string     `json:"courses,omitempty" bson:"courses,omitempty"`
+	Enrollments            []Enrollment `json:"enrollments,omitempty" bson:"enrollments,omitempty"`
+	CreatedAt              *time.Time   `json:"createdAt,omitempty" bson:"createdAt,omitempty"`
+}
+
+// Route for admins to search all users
+func searchUsers(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	filter := bson.M{}
+	if q := c.Query("q"); q != "" {
+		pattern := containsPattern(q)
+		filter["$or"] = []bson.M{
+			{"username": pattern},
+			{"profile.displayName": pattern},
+			{"profile.rollNumber": pattern},
+		}
+	}
+	if role := c.Query("role"); role != "" {
+		filter["role"] = role
+	}
+	switch c.Query("status") {
+	case "":
+	case "active":
+		filter["disabled"] = bson.M{"$ne": true}
+	case "disabled":
+		filter["disabled"] = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be active or disabled"})
+		return
+	}
+	if verified := c.Query("verified"); verified != "" {
+		value, err := strconv.ParseBool(verified)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Verified must be true or false"})
+			return
+		}
+		filter["isVerified"] = value
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+
+	total, err := registeredUsers.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+		return
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"username": 1}).
+		SetSkip(int64((page - 1) * limit)).
+		SetLimit(int64(limit))
+	cursor, err := registeredUsers.Find(ctx, filter, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	users := []AdminUserView{}
+	if err := cursor.All(ctx, &users); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode users"})
+		return
+	}
+	for i := range users {
+		users[i].SSO = users[i].OIDCSubject != ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "total": total, "page": page, "limit": limit})
+}
+
+// containsPattern builds a case-insensitive substring match for user-supplied text
+func containsPattern(text string) bson.M {
+	return bson.M{"$regex": regexp.QuoteMeta(text), "$options": "i"}
+}
+
+// findManagedUser loads the user named in the URL, writing a 404 when missing
+func findManagedUser(c *gin.Context) (*UserRegistration, bool) {
+	var dbUser UserRegistration
+	err := registeredUsers.FindOne(ctx, bson.M{"username": c.Param("username")}).Decode(&dbUser)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return nil, false
+	}
+	return &dbUser, true
+}
+
+// Route for admins to change a user's role
+func changeUserRole(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be admin or student"})
+		return
+	}
+	if c.Param("username") == claims.Username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot change their own role"})
+		return
+	}
+
+	dbUser, ok := findManagedUser(c)
+	if !ok {
+		return
+	}
+	// The new role's domain policy applies as it would to a new account
+	if err := checkEmailDomain(dbUser.Username, req.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "field": "role"})
+		return
+	}
+
+	// Tokens carry the role, so existing sessions are revoked
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		_, err := registeredUsers.UpdateOne(sc, bson.M{"username": dbUser.Username}, bson.M{
+			"$set": bson.M{"role": req.Role},
+			"$inc": bson.M{"tokenVersion": 1},
+		})
+		if err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "user.role", "user:"+dbUser.Username, gin.H{"role": dbUser.Role}, gin.H{"role": req.Role})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully"})
+}
+
+// Route for admins to disable or enable an account
+func setUserDisabled(disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := authenticate(c)
+		if !ok {
+			return
+		}
+		if claims.Role != "admin" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+			return
+		}
+		if disabled && c.Param("username") == claims.Username {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot disable their own account"})
+			return
+		}
+
+		dbUser, ok := findManagedUser(c)
+		if !ok {
+			return
+		}
+
+		update := bson.M{"$set": bson.M{"disabled": disabled}}
+		if disabled {
+			// Sign the user out everywhere
+			update["$inc"] = bson.M{"tokenVersion": 1}
+		}
+		action := "user.enable"
+		if disabled {
+			action = "user.disable"
+		}
+		err := withTransaction(func(sc mongo.SessionContext) error {
+			if _, err := registeredUsers.UpdateOne(sc, bson.M{"username": dbUser.Username}, update); err != nil {
+				return err
+			}
+			return recordAuditIn(sc, c, action, "user:"+dbUser.Username, gin.H{"disabled": dbUser.Disabled}, gin.H{"disabled": disabled})
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
+			return
+		}
+
+		if disabled {
+			c.JSON(http.StatusOK, gin.H{"message": "Account disabled"})
+		} else {
+			c.JSON(http.StatusOK, gin.H{"message": "Account enabled"})
+		}
+	}
+}
+
+// Route for admins to force-verify an account, or reset it to unverified and
+// send a fresh OTP
+func setUserVerification(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	var req struct {
+		Verified *bool `json:"verified" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dbUser, ok := findManagedUser(c)
+	if !ok {
+		return
+	}
+
+	before := gin.H{"isVerified": dbUser.IsVerified, "reverificationRequired": dbUser.ReverificationRequired}
+	if *req.Verified {
+		err := withTransaction(func(sc mongo.SessionContext) error {
+			_, err := registeredUsers.UpdateOne(sc, bson.M{"username": dbUser.Username}, bson.M{
+				"$set":   bson.M{"isVerified": true},
+				"$unset": bson.M{"otp": "", "otpAttemptsLeft": "", "reverificationRequired": ""},
+			})
+			if err != nil {
+				return err
+			}
+			return recordAuditIn(sc, c, "user.verify", "user:"+dbUser.Username, before, gin.H{"isVerified": true, "reverificationRequired": false})
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify account"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Account verified"})
+		return
+	}
+
+	otp, err := generateOTP()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate OTP"})
+		return
+	}
+
+	// The account stays verified, so it is neither purged nor open to
+	// re-registration, but cannot log in until the new OTP is entered
+	err = withTransaction(func(sc mongo.SessionContext) error {
+		_, err := registeredUsers.UpdateOne(sc, bson.M{"username": dbUser.Username}, bson.M{
+			"$set": bson.M{"reverificationRequired": true, "otp": otp, "otpAttemptsLeft": verificationAttempts},
+			"$inc": bson.M{"tokenVersion": 1},
+		})
+		if err != nil {
+			return err
+		}
+		if err := queueVerificationOTP(sc, dbUser.Username, otp, dbUser.Locale); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "user.unverify", "user:"+dbUser.Username, before, gin.H{"isVerified": dbUser.IsVerified, "reverificationRequired": true})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset verification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification reset and a new OTP has been sent"})
+}
+
+// Route for admins to send a user a password reset code
+func adminTriggerPasswordReset(c *gin.Context) {
+	if !checkRole(c, "admin") {
+		return
+	}
+
+	dbUser, ok := findManagedUser(c)
+	if !ok {
+		return
+	}
+
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		if err := queuePasswordReset(sc, dbUser); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "user.password_reset", "user:"+dbUser.Username, nil, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start password reset"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset code sent"})
+}
+
+// Route for admins to delete a user together with their requests and enrollments
+func deleteUser(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized access"})
+		return
+	}
+	if c.Param("username") == claims.Username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot delete their own account"})
+		return
+	}
+
+	dbUser, ok := findManagedUser(c)
+	if !ok {
+		return
+	}
+
+	// Enrollments live on the user document, so deleting it removes them too
+	var removedRequests int64
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		if _, err := registeredUsers.DeleteOne(sc, bson.M{"username": dbUser.Username}); err != nil {
+			return err
+		}
+		if err := leaveAllWaitlists(sc, dbUser.Username); err != nil {
+			return err
+		}
+		for _, enrollment := range allEnrollments(dbUser.Courses, dbUser.Enrollments) {
+			if err := releaseSeat(sc, enrollment.Course, enrollment.Term); err != nil {
+				return err
+			}
+		}
+		result, err := requestCollection.DeleteMany(sc, bson.M{"username": dbUser.Username})
+		if err != nil {
+			return err
+		}
+		removedRequests = result.DeletedCount
+		return recordAuditIn(sc, c, "user.delete", "user:"+dbUser.Username, gin.H{
+			"role":            dbUser.Role,
+			"courses":         dbUser.Courses,
+			"removedRequests": removedRequests,
+		}, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":            "User deleted successfully",
+		"removedRequests":    removedRequests,
+		"removedEnrollments": len(dbUser.Courses),
+	})
+}
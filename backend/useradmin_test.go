@@ -0,0 +1,343 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// managedUser is the mock response to findManagedUser loading username
+func managedUser(username string, fields ...bson.E) bson.D {
+	user := bson.D{
+		{Key: "username", Value: username},
+		{Key: "role", Value: "student"},
+		{Key: "isVerified", Value: true},
+	}
+	return mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, append(user, fields...))
+}
+
+// auditedCommit is the mock responses to an audit entry appended inside a
+// transaction and the commit that follows it
+func auditedCommit() []bson.D {
+	return []bson.D{noDocuments("db.audit_log"), mtest.CreateSuccessResponse(), mtest.CreateSuccessResponse()}
+}
+
+// sentAuditAction is the action of the last audit entry sent to the mock deployment
+func sentAuditAction(mt *mtest.T) string {
+	mt.Helper()
+	insert := sentCommand(mt, "insert")
+	if insert.Lookup("insert").StringValue() != "audit_log" {
+		mt.Fatalf("last insert went to %s, not the audit log", insert.Lookup("insert").StringValue())
+	}
+	return insert.Lookup("documents").Array().Index(0).Value().Document().Lookup("action").StringValue()
+}
+
+func TestChangeUserRole(t *testing.T) {
+	changeRole := func(username, role string) *httptest.ResponseRecorder {
+		return serveRoute(changeUserRole, http.MethodPut, "/api/admin/users/:username/role",
+			"/api/admin/users/"+username+"/role", map[string]string{"role": role}, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("students cannot change roles", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		recorder := serveRoute(changeUserRole, http.MethodPut, "/api/admin/users/:username/role",
+			"/api/admin/users/ravi@iitk.ac.in/role", map[string]string{"role": "admin"}, "asha@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusForbidden)
+	})
+
+	mt.Run("unknown role", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		expectStatus(mt, changeRole("asha@iitk.ac.in", "teacher"), http.StatusBadRequest)
+	})
+
+	mt.Run("own role", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		expectStatus(mt, changeRole("admin@iitk.ac.in", "student"), http.StatusBadRequest)
+	})
+
+	mt.Run("role changes and sessions are revoked", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{activeSession(), managedUser("asha@iitk.ac.in"), matchedDocuments(1)}, auditedCommit()...)...)
+		expectStatus(mt, changeRole("asha@iitk.ac.in", "admin"), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if updates[0].Lookup("u", "$set", "role").StringValue() != "admin" || updates[0].Lookup("u", "$inc", "tokenVersion").Int32() != 1 {
+			mt.Errorf("update = %v", updates[0])
+		}
+		if action := sentAuditAction(mt); action != "user.role" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+
+	mt.Run("new role's email domains apply", func(mt *mtest.T) {
+		previous := emailDomainPolicy
+		mt.Cleanup(func() { emailDomainPolicy = previous })
+		emailDomainPolicy = map[string][]string{"admin": {"iitk.ac.in"}}
+
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), managedUser("asha@gmail.com"))
+		recorder := changeRole("asha@gmail.com", "admin")
+		expectStatus(mt, recorder, http.StatusBadRequest)
+		if field := responseBody(mt, recorder)["field"]; field != "role" {
+			mt.Errorf("field = %v", field)
+		}
+		if _, updates := sentUpdates(mt); len(updates) != 0 {
+			mt.Errorf("role changed against the domain policy: %v", updates)
+		}
+	})
+}
+
+func TestSetUserDisabled(t *testing.T) {
+	setDisabled := func(username string, disabled bool) *httptest.ResponseRecorder {
+		action := "enable"
+		if disabled {
+			action = "disable"
+		}
+		return serveRoute(setUserDisabled(disabled), http.MethodPost, "/api/admin/users/:username/"+action,
+			"/api/admin/users/"+username+"/"+action, nil, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("admins cannot disable themselves", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		expectStatus(mt, setDisabled("admin@iitk.ac.in", true), http.StatusBadRequest)
+		if len(mt.GetAllStartedEvents()) != 1 {
+			mt.Errorf("handler went on after refusing to disable the caller")
+		}
+	})
+
+	mt.Run("disabling revokes sessions", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{activeSession(), managedUser("asha@iitk.ac.in"), matchedDocuments(1)}, auditedCommit()...)...)
+		expectStatus(mt, setDisabled("asha@iitk.ac.in", true), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if !updates[0].Lookup("u", "$set", "disabled").Boolean() || updates[0].Lookup("u", "$inc", "tokenVersion").Int32() != 1 {
+			mt.Errorf("update = %v", updates[0])
+		}
+		if action := sentAuditAction(mt); action != "user.disable" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+
+	mt.Run("enabling keeps sessions", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{activeSession(), managedUser("asha@iitk.ac.in", bson.E{Key: "disabled", Value: true}), matchedDocuments(1)}, auditedCommit()...)...)
+		expectStatus(mt, setDisabled("asha@iitk.ac.in", false), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 || updates[0].Lookup("u", "$set", "disabled").Boolean() {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if _, err := updates[0].LookupErr("u", "$inc"); err == nil {
+			mt.Errorf("enabling an account revoked its sessions: %v", updates[0])
+		}
+		if action := sentAuditAction(mt); action != "user.enable" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+}
+
+func TestSetUserVerification(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	setVerified := func(verified bool) *httptest.ResponseRecorder {
+		return serveRoute(setUserVerification, http.MethodPost, "/api/admin/users/:username/verification",
+			"/api/admin/users/asha@iitk.ac.in/verification", map[string]bool{"verified": verified}, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("verify", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{
+			activeSession(),
+			managedUser("asha@iitk.ac.in", bson.E{Key: "reverificationRequired", Value: true}, bson.E{Key: "otp", Value: "123456"}),
+			matchedDocuments(1),
+		}, auditedCommit()...)...)
+		expectStatus(mt, setVerified(true), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 || !updates[0].Lookup("u", "$set", "isVerified").Boolean() {
+			mt.Fatalf("updates = %v", updates)
+		}
+		for _, field := range []string{"otp", "otpAttemptsLeft", "reverificationRequired"} {
+			if _, err := updates[0].LookupErr("u", "$unset", field); err != nil {
+				mt.Errorf("%s kept after verification: %v", field, updates[0])
+			}
+		}
+		if action := sentAuditAction(mt); action != "user.verify" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+
+	mt.Run("reset sends a new OTP", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{
+			activeSession(),
+			managedUser("asha@iitk.ac.in"),
+			matchedDocuments(1),
+			mtest.CreateSuccessResponse(),
+		}, auditedCommit()...)...)
+		expectStatus(mt, setVerified(false), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if !updates[0].Lookup("u", "$set", "reverificationRequired").Boolean() || updates[0].Lookup("u", "$inc", "tokenVersion").Int32() != 1 {
+			mt.Errorf("update = %v", updates[0])
+		}
+		if _, err := updates[0].LookupErr("u", "$set", "isVerified"); err == nil {
+			mt.Errorf("reset marked the account unverified, opening it to re-registration: %v", updates[0])
+		}
+
+		queued := false
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "insert" && event.Command.Lookup("insert").StringValue() == "email_outbox" {
+				queued = event.Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("template").StringValue() == "verification"
+			}
+		}
+		if !queued {
+			mt.Error("no verification email was queued")
+		}
+		if action := sentAuditAction(mt); action != "user.unverify" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+}
+
+func TestAdminTriggerPasswordReset(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	trigger := func(username string) *httptest.ResponseRecorder {
+		return serveRoute(adminTriggerPasswordReset, http.MethodPost, "/api/admin/users/:username/password-reset",
+			"/api/admin/users/"+username+"/password-reset", nil, "admin@iitk.ac.in", "admin")
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("unknown user", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), noDocuments("db.registered_users"))
+		expectStatus(mt, trigger("nobody@iitk.ac.in"), http.StatusNotFound)
+	})
+
+	mt.Run("code is stored and sent", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{
+			activeSession(),
+			managedUser("asha@iitk.ac.in"),
+			matchedDocuments(1),
+			mtest.CreateSuccessResponse(),
+		}, auditedCommit()...)...)
+		expectStatus(mt, trigger("asha@iitk.ac.in"), http.StatusOK)
+
+		_, updates := sentUpdates(mt)
+		if len(updates) != 1 {
+			mt.Fatalf("updates = %v", updates)
+		}
+		if updates[0].Lookup("u", "$set", "resetToken").StringValue() == "" ||
+			updates[0].Lookup("u", "$set", "resetAttemptsLeft").Int32() != passwordResetAttempts {
+			mt.Errorf("update = %v", updates[0])
+		}
+		if action := sentAuditAction(mt); action != "user.password_reset" {
+			mt.Errorf("audit action = %q", action)
+		}
+	})
+}
+
+func TestDeleteUser(t *testing.T) {
+	deleteAs := func(admin, username string) *httptest.ResponseRecorder {
+		return serveRoute(deleteUser, http.MethodDelete, "/api/admin/users/:username",
+			"/api/admin/users/"+username, nil, admin, "admin")
+	}
+	student := managedUser("asha@iitk.ac.in", bson.E{Key: "courses", Value: bson.A{"Mechanics"}})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("admins cannot delete themselves", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession())
+		expectStatus(mt, deleteAs("admin@iitk.ac.in", "admin@iitk.ac.in"), http.StatusBadRequest)
+	})
+
+	mt.Run("account, seats and requests go together", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(append([]bson.D{
+			activeSession(),
+			student,
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			noDocuments("db.waitlist"),
+			matchedDocuments(1),
+			noDocuments("db.waitlist"),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}),
+		}, auditedCommit()...)...)
+		recorder := deleteAs("admin@iitk.ac.in", "asha@iitk.ac.in")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		body := responseBody(mt, recorder)
+		if body["removedRequests"] != float64(2) || body["removedEnrollments"] != float64(1) {
+			mt.Errorf("response = %v", body)
+		}
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || collections[0] != "details" || updates[0].Lookup("u", "$inc", "enrolled").Int32() != -1 {
+			mt.Errorf("seat not released: %v %v", collections, updates)
+		}
+		var deleted []string
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "delete" {
+				deleted = append(deleted, event.Command.Lookup("delete").StringValue())
+			}
+		}
+		if len(deleted) != 2 || deleted[0] != "registered_users" || deleted[1] != "course_requests" {
+			mt.Errorf("deleted from %v", deleted)
+		}
+		if action := sentAuditAction(mt); action != "user.delete" {
+			mt.Errorf("audit action = %q", action)
+		}
+		sentCommand(mt, "commitTransaction")
+	})
+
+	mt.Run("failure rolls the whole delete back", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			student,
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			noDocuments("db.waitlist"),
+			matchedDocuments(1),
+			noDocuments("db.waitlist"),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 8, Message: "requests unavailable"}),
+			mtest.CreateSuccessResponse(),
+		)
+		expectStatus(mt, deleteAs("admin@iitk.ac.in", "asha@iitk.ac.in"), http.StatusInternalServerError)
+
+		sentCommand(mt, "abortTransaction")
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "commitTransaction" {
+				mt.Error("delete was committed after a step failed")
+			}
+		}
+	})
+}
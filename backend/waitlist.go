@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// States of a waitlist entry. Waiting and offered entries are active; the rest are history.
+const (
+	waitlistWaiting  = "waiting"
+	waitlistOffered  = "offered"
+	waitlistAccepted = "accepted"
+	waitlistDeclined = "declined"
+	waitlistExpired  = "expired"
+	waitlistRemoved  = "removed"
+)
+
+var (
+	waitlistCollection *mongo.Collection
+
+	// waitlistOfferTTL is how long a student has to accept an offered seat
+	waitlistOfferTTL = 48 * time.Hour
+
+	errAlreadyWaitlisted = errors.New("student is already on the waitlist")
+	errOfferChanged      = errors.New("waitlist entry was modified concurrently")
+)
+
+// WaitlistEntry is a student's place in the queue for a full course in a term.
+// Course is the course name, as in enrollments. While an offer is open its seat
+// is held in the enrolled count of the offering, or of the course for entries
+// outside any term.
+type WaitlistEntry struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Course         string             `json:"course" bson:"course"`
+	Term           string             `json:"term,omitempty" bson:"term,omitempty"`
+	Username       string             `json:"username" bson:"username"`
+	Status         string             `json:"status" bson:"status"`
+	Active         bool               `json:"-" bson:"active"`
+	JoinedAt       time.Time          `json:"joinedAt" bson:"joinedAt"`
+	OfferedAt      *time.Time         `json:"offeredAt,omitempty" bson:"offeredAt,omitempty"`
+	OfferExpiresAt *time.Time         `json:"offerExpiresAt,omitempty" bson:"offerExpiresAt,omitempty"`
+	ClosedAt       *time.Time         `json:"closedAt,omitempty" bson:"closedAt,omitempty"`
+	// Position is 1 for the next student to be offered a seat; it is only set while waiting
+	Position int `json:"position,omitempty" bson:"-"`
+}
+
+// loadWaitlistConfig reads WAITLIST_OFFER_TTL
+func loadWaitlistConfig() {
+	if value := os.Getenv("WAITLIST_OFFER_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid WAITLIST_OFFER_TTL %q", value)
+		}
+		waitlistOfferTTL = ttl
+	}
+}
+
+// ensureWaitlistIndexes keeps one active entry per student and course in a
+// term and indexes the queue order and offer expiry
+func ensureWaitlistIndexes() {
+	// Entries used to be unique per course alone, which kept students off the
+	// waitlist of a course they had waited for in another term
+	for _, name := range []string{"course_1_username_1", "course_1_active_1_joinedAt_1"} {
+		if _, err := waitlistCollection.Indexes().DropOne(ctx, name); err != nil {
+			if commandErr, ok := err.(mongo.CommandError); !ok || (commandErr.Code != 26 && commandErr.Code != 27) {
+				log.Printf("Failed to drop waitlist index %s: %v", name, err)
+			}
+		}
+	}
+
+	models := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "term", Value: 1}, {Key: "course", Value: 1}, {Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"active": true}),
+		},
+		{Keys: bson.D{{Key: "term", Value: 1}, {Key: "course", Value: 1}, {Key: "active", Value: 1}, {Key: "joinedAt", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "offerExpiresAt", Value: 1}}},
+	}
+	if _, err := waitlistCollection.Indexes().CreateMany(ctx, models); err != nil {
+		log.Printf("Failed to create waitlist indexes: %v", err)
+	}
+}
+
+// startWaitlistWorker passes expired offers down the list every minute
+func startWaitlistWorker() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			expireWaitlistOffers()
+			<-ticker.C
+		}
+	}()
+}
+
+// expireWaitlistOffers closes offers past their deadline and offers the held
+// seats to the next students in line
+func expireWaitlistOffers() {
+	cursor, err := waitlistCollection.Find(ctx, bson.M{
+		"status":         waitlistOffered,
+		"offerExpiresAt": bson.M{"$lt": time.Now()},
+	})
+	if err != nil {
+		log.Printf("Failed to find expired waitlist offers: %v", err)
+		return
+	}
+	var expired []WaitlistEntry
+	if err := cursor.All(ctx, &expired); err != nil {
+		log.Printf("Failed to decode expired waitlist offers: %v", err)
+		return
+	}
+
+	for _, entry := range expired {
+		err := withTransaction(func(sc mongo.SessionContext) error {
+			if err := closeWaitlistEntry(sc, &entry, waitlistExpired); err != nil {
+				return err
+			}
+			return releaseSeat(sc, entry.Course, entry.Term)
+		})
+		if err == errOfferChanged {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to expire waitlist offer %s: %v", entry.ID.Hex(), err)
+			continue
+		}
+		log.Printf("Waitlist offer of %s for '%s' expired", entry.Username, entry.Course)
+	}
+}
+
+// joinWaitlist puts the student at the back of the course's waitlist for the
+// term and returns their position
+func joinWaitlist(sc mongo.SessionContext, username, courseName, term string) (int, error) {
+	entry := WaitlistEntry{
+		Course:   courseName,
+		Term:     term,
+		Username: username,
+		Status:   waitlistWaiting,
+		Active:   true,
+		JoinedAt: time.Now(),
+	}
+	result, err := waitlistCollection.InsertOne(sc, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return 0, errAlreadyWaitlisted
+	}
+	if err != nil {
+		return 0, err
+	}
+	entry.ID = result.InsertedID.(primitive.ObjectID)
+
+	position, err := waitlistPosition(sc, &entry)
+	if err != nil {
+		return 0, err
+	}
+	return position, queueWaitlistEmail(sc, username, "waitlist_joined", EmailData{"Course": courseName, "Position": position})
+}
+
+// waitlistPosition counts the students still waiting ahead of entry
+func waitlistPosition(c context.Context, entry *WaitlistEntry) (int, error) {
+	ahead, err := waitlistCollection.CountDocuments(c, bson.M{
+		"course": entry.Course,
+		"term":   termKey(entry.Term),
+		"status": waitlistWaiting,
+		"$or": []bson.M{
+			{"joinedAt": bson.M{"$lt": entry.JoinedAt}},
+			{"joinedAt": entry.JoinedAt, "_id": bson.M{"$lt": entry.ID}},
+		},
+	})
+	return int(ahead) + 1, err
+}
+
+// offerSeats offers free seats in the course in the term to waiting students,
+// oldest first, holding a seat for each offer until it is accepted, declined or expires
+func offerSeats(sc mongo.SessionContext, courseName, term string) error {
+	for {
+		var next WaitlistEntry
+		err := waitlistCollection.FindOne(sc,
+			bson.M{"course": courseName, "term": termKey(term), "status": waitlistWaiting},
+			options.FindOne().SetSort(bson.D{{Key: "joinedAt", Value: 1}, {Key: "_id", Value: 1}}),
+		).Decode(&next)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := reserveSeat(sc, courseName, term); err == errCourseFull {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		expires := now.Add(waitlistOfferTTL)
+		if _, err := waitlistCollection.UpdateOne(sc, bson.M{"_id": next.ID}, bson.M{"$set": bson.M{
+			"status":         waitlistOffered,
+			"offeredAt":      now,
+			"offerExpiresAt": expires,
+		}}); err != nil {
+			return err
+		}
+		if err := queueWaitlistEmail(sc, next.Username, "waitlist_offer", EmailData{
+			"Course":    courseName,
+			"ExpiresAt": formatEmailTime(expires),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// closeWaitlistEntry moves an active entry to a final status, failing with
+// errOfferChanged if it has left the status it was read in
+func closeWaitlistEntry(sc mongo.SessionContext, entry *WaitlistEntry, status string) error {
+	result, err := waitlistCollection.UpdateOne(sc,
+		bson.M{"_id": entry.ID, "status": entry.Status},
+		bson.M{"$set": bson.M{"status": status, "active": false, "closedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errOfferChanged
+	}
+	return nil
+}
+
+// leaveAllWaitlists removes a student from every waitlist, giving back seats held for their offers
+func leaveAllWaitlists(sc mongo.SessionContext, username string) error {
+	cursor, err := waitlistCollection.Find(sc, bson.M{"username": username, "active": true})
+	if err != nil {
+		return err
+	}
+	var entries []WaitlistEntry
+	if err := cursor.All(sc, &entries); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := closeWaitlistEntry(sc, &entry, waitlistRemoved); err != nil {
+			return err
+		}
+		if entry.Status == waitlistOffered {
+			if err := releaseSeat(sc, entry.Course, entry.Term); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func queueWaitlistEmail(sc mongo.SessionContext, username, templateName string, data EmailData) error {
+	var student UserRegistration
+	if err := registeredUsers.FindOne(sc, bson.M{"username": username}).Decode(&student); err != nil {
+		return err
+	}
+	return enqueueEmail(sc, username, templateName, student.Locale, data)
+}
+
+// findOwnWaitlistEntry loads the active entry in the URL if it belongs to the caller
+func findOwnWaitlistEntry(c *gin.Context, claims *Claims) (*WaitlistEntry, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid waitlist entry ID"})
+		return nil, false
+	}
+
+	var entry WaitlistEntry
+	err = waitlistCollection.FindOne(ctx, bson.M{"_id": id, "username": claims.Username, "active": true}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waitlist entry not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waitlist entry"})
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Route listing the caller's active waitlist entries with their positions
+func getOwnWaitlist(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+
+	cursor, err := waitlistCollection.Find(ctx, bson.M{"username": claims.Username, "active": true},
+		options.Find().SetSort(bson.M{"joinedAt": 1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	entries := []WaitlistEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode waitlist"})
+		return
+	}
+	for i := range entries {
+		if entries[i].Status != waitlistWaiting {
+			continue
+		}
+		if entries[i].Position, err = waitlistPosition(ctx, &entries[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waitlist position"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// Route for a student to take the seat they were offered
+func acceptWaitlistOffer(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	entry, ok := findOwnWaitlistEntry(c, claims)
+	if !ok {
+		return
+	}
+	if entry.Status != waitlistOffered {
+		c.JSON(http.StatusConflict, gin.H{"error": "No seat has been offered yet"})
+		return
+	}
+	if entry.OfferExpiresAt != nil && time.Now().After(*entry.OfferExpiresAt) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The offer has expired"})
+		return
+	}
+	if !checkTermOpen(c, entry.Term) {
+		return
+	}
+
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		if err := closeWaitlistEntry(sc, entry, waitlistAccepted); err != nil {
+			return err
+		}
+		// The seat was taken when the offer was made
+		if err := addEnrollment(sc, entry.Username, entry.Course, entry.Term); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "waitlist.accept", "user:"+entry.Username, entry, gin.H{"enrolled": entry.Course})
+	})
+	if err == errOfferChanged {
+		c.JSON(http.StatusConflict, gin.H{"error": "The offer is no longer open"})
+		return
+	}
+	if err == errAlreadyEnrolled {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are already enrolled in the course"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept offer"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Enrolled in " + entry.Course})
+}
+
+// Route for a student to leave a waitlist or decline an offered seat, which
+// passes it to the next student
+func leaveWaitlist(c *gin.Context) {
+	claims, ok := authenticate(c)
+	if !ok {
+		return
+	}
+	entry, ok := findOwnWaitlistEntry(c, claims)
+	if !ok {
+		return
+	}
+
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		if entry.Status == waitlistWaiting {
+			if err := closeWaitlistEntry(sc, entry, waitlistRemoved); err != nil {
+				return err
+			}
+		} else {
+			if err := closeWaitlistEntry(sc, entry, waitlistDeclined); err != nil {
+				return err
+			}
+			if err := releaseSeat(sc, entry.Course, entry.Term); err != nil {
+				return err
+			}
+		}
+		return recordAuditIn(sc, c, "waitlist.leave", "user:"+entry.Username, entry, nil)
+	})
+	if err == errOfferChanged {
+		c.JSON(http.StatusConflict, gin.H{"error": "The waitlist entry changed, reload and try again"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left the waitlist for " + entry.Course})
+}
+
+// Route for admins to see a course's waitlist in order, open offers first. The
+// waitlist is that of ?term=, or else of the only open term.
+func getCourseWaitlist(c *gin.Context) {
+	if !checkRoleOrScope(c, "admin", "requests:read") {
+		return
+	}
+
+	course, err := findCourse(c.Param("id"))
+	if err == errCourseNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch course"})
+		return
+	}
+
+	term := normaliseTermCode(c.Query("term"))
+	if term == "" {
+		if term, err = openTermCode(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch terms"})
+			return
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "status", Value: 1}, {Key: "joinedAt", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := waitlistCollection.Find(ctx, bson.M{"course": course.Name, "term": termKey(term), "active": true}, opts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	entries := []WaitlistEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode waitlist"})
+		return
+	}
+	position := 0
+	for i := range entries {
+		if entries[i].Status == waitlistWaiting {
+			position++
+			entries[i].Position = position
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"course": course.Code, "term": term, "entries": entries})
+}
+
+// addRequestToWaitlist handles the approval of a request for a full course by
+// moving the request onto the course's waitlist
+func addRequestToWaitlist(c *gin.Context, request *CourseUpdateRequest) {
+	var position int
+	err := withTransaction(func(sc mongo.SessionContext) error {
+		var err error
+		if position, err = joinWaitlist(sc, request.Username, request.Course, request.Term); err != nil {
+			return err
+		}
+		if _, err := requestCollection.DeleteOne(sc, requestFilter(request.Username, request.Course, request.Term)); err != nil {
+			return err
+		}
+		return recordAuditIn(sc, c, "waitlist.join", "user:"+request.Username, request, gin.H{"waitlisted": request.Course, "position": position})
+	})
+	if err == errAlreadyWaitlisted {
+		respondCourseFull(c, request.Course, request.Term)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add student to the waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Course is full, the student was added to the waitlist",
+		"reason":   "course_full",
+		"position": position,
+	})
+}
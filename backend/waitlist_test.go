@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// waitlistEntry is the mock response to a find returning one waitlist entry
+func waitlistEntry(id primitive.ObjectID, term, status string, offerExpiresAt time.Time) bson.D {
+	entry := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "course", Value: "Mechanics"},
+		{Key: "username", Value: "ravi@iitk.ac.in"},
+		{Key: "status", Value: status},
+		{Key: "active", Value: true},
+		{Key: "joinedAt", Value: time.Now().Add(-time.Hour)},
+	}
+	if term != "" {
+		entry = append(entry, bson.E{Key: "term", Value: term})
+	}
+	if !offerExpiresAt.IsZero() {
+		entry = append(entry, bson.E{Key: "offerExpiresAt", Value: offerExpiresAt})
+	}
+	return mtest.CreateCursorResponse(0, "db.waitlist", mtest.FirstBatch, entry)
+}
+
+func TestOfferSeats(t *testing.T) {
+	if err := loadEmailTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	id := primitive.NewObjectID()
+	student := mtest.CreateCursorResponse(0, "db.registered_users", mtest.FirstBatch, bson.D{{Key: "username", Value: "ravi@iitk.ac.in"}})
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("seat free", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			waitlistEntry(id, "2026-27-odd", waitlistWaiting, time.Time{}),
+			matchedDocuments(1),
+			matchedDocuments(1),
+			student,
+			mtest.CreateSuccessResponse(),
+			noDocuments("db.waitlist"),
+		)
+		err := inSession(mt, func(sc mongo.SessionContext) error { return offerSeats(sc, "Mechanics", "2026-27-odd") })
+		if err != nil {
+			mt.Fatal(err)
+		}
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 2 || collections[0] != "offerings" || collections[1] != "waitlist" {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		offer := updates[1]
+		if offer.Lookup("q", "_id").ObjectID() != id || offer.Lookup("u", "$set", "status").StringValue() != waitlistOffered {
+			mt.Errorf("offer = %v", offer)
+		}
+		expires := offer.Lookup("u", "$set", "offerExpiresAt").Time()
+		if until := time.Until(expires); until <= 0 || until > waitlistOfferTTL {
+			mt.Errorf("offer expires in %v, want within %v", until, waitlistOfferTTL)
+		}
+		email := sentCommand(mt, "insert").Lookup("documents").Array().Index(0).Value().Document()
+		if email.Lookup("template").StringValue() != "waitlist_offer" {
+			mt.Errorf("email = %v", email)
+		}
+	})
+
+	mt.Run("still full", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			waitlistEntry(id, "2026-27-odd", waitlistWaiting, time.Time{}),
+			matchedDocuments(0),
+			countedDocuments("db.offerings", 1),
+		)
+		err := inSession(mt, func(sc mongo.SessionContext) error { return offerSeats(sc, "Mechanics", "2026-27-odd") })
+		if err != nil {
+			mt.Fatal(err)
+		}
+		if collections, _ := sentUpdates(mt); len(collections) != 1 {
+			mt.Errorf("a seat was offered in a full course: %v", collections)
+		}
+	})
+}
+
+func TestExpireWaitlistOffers(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("expired offer passes the seat on", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			waitlistEntry(id, "", waitlistOffered, time.Now().Add(-time.Minute)),
+			matchedDocuments(1),
+			matchedDocuments(1),
+			noDocuments("db.waitlist"),
+			mtest.CreateSuccessResponse(),
+		)
+		expireWaitlistOffers()
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 2 {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		closed := updates[0]
+		if closed.Lookup("q", "status").StringValue() != waitlistOffered || closed.Lookup("u", "$set", "status").StringValue() != waitlistExpired {
+			mt.Errorf("offer was not closed as expired: %v", closed)
+		}
+		if collections[1] != "details" || updates[1].Lookup("u", "$inc", "enrolled").Int32() != -1 {
+			mt.Errorf("held seat was not given back: %v %v", collections[1], updates[1])
+		}
+		if _, err := sentCommand(mt, "find").LookupErr("filter", "status"); err != nil {
+			mt.Error("freed seat was not offered on")
+		}
+		sentCommand(mt, "commitTransaction")
+	})
+}
+
+func TestRespondToWaitlistOffer(t *testing.T) {
+	id := primitive.NewObjectID()
+	target := "/api/waitlist/" + id.Hex()
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("accepting an expired offer", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(activeSession(), waitlistEntry(id, "", waitlistOffered, time.Now().Add(-time.Minute)))
+		recorder := serveRoute(acceptWaitlistOffer, http.MethodPost, "/api/waitlist/:id/accept", target+"/accept", nil, "ravi@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusConflict)
+		if collections, _ := sentUpdates(mt); len(collections) != 0 {
+			mt.Errorf("expired offer was accepted: %v", collections)
+		}
+	})
+
+	mt.Run("declining an offer", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			waitlistEntry(id, "", waitlistOffered, time.Now().Add(time.Hour)),
+			matchedDocuments(1),
+			matchedDocuments(1),
+			noDocuments("db.waitlist"),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveRoute(leaveWaitlist, http.MethodPost, "/api/waitlist/:id/leave", target+"/leave", nil, "ravi@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 2 || updates[0].Lookup("u", "$set", "status").StringValue() != waitlistDeclined {
+			mt.Fatalf("updates = %v %v", collections, updates)
+		}
+		if collections[1] != "details" {
+			mt.Errorf("declined seat was not given back: %v", updates[1])
+		}
+	})
+
+	mt.Run("leaving while waiting", func(mt *mtest.T) {
+		useMockCollections(mt)
+		mt.AddMockResponses(
+			activeSession(),
+			waitlistEntry(id, "", waitlistWaiting, time.Time{}),
+			matchedDocuments(1),
+			noDocuments("db.audit_log"),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+		recorder := serveRoute(leaveWaitlist, http.MethodPost, "/api/waitlist/:id/leave", target+"/leave", nil, "ravi@iitk.ac.in", "student")
+		expectStatus(mt, recorder, http.StatusOK)
+
+		collections, updates := sentUpdates(mt)
+		if len(updates) != 1 || updates[0].Lookup("u", "$set", "status").StringValue() != waitlistRemoved {
+			mt.Errorf("updates = %v %v", collections, updates)
+		}
+	})
+}
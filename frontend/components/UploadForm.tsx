@@ -10,6 +10,21 @@ interface UploadFormProps {
     username: string; // Add username prop
 }
 
+// Only admins may add instructors and courses, so the "Add new" options are hidden from everyone else
+const isAdminToken = (): boolean => {
+    const token = localStorage.getItem('token');
+    if (!token) {
+        return false;
+    }
+    try {
+        return JSON.parse(atob(token.split('.')[1])).role === 'admin';
+    } catch {
+        return false;
+    }
+};
+
+const authHeaders = () => ({ Authorization: `Bearer ${localStorage.getItem('token')}` });
+
 const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, username }) => {
     const [courseName, setCourseName] = useState('');
     const [batch, setBatch] = useState('');
@@ -24,6 +39,11 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
     const [filteredCourseOptions, setFilteredCourseOptions] = useState<any[]>([]); // Filtered list of course options
     const [showNewInstructorPopup, setShowNewInstructorPopup] = useState(false);
     const [showNewCoursePopup, setShowNewCoursePopup] = useState(false); // State to control the visibility of the new course popup
+    const [isAdmin, setIsAdmin] = useState(false);
+
+    useEffect(() => {
+        setIsAdmin(isAdminToken());
+    }, []);
 
     useEffect(() => {
         fetchFacultyList();
@@ -35,10 +55,10 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
             const response = await axios.get('http://localhost:8080/api/faculty');
             const facultyList = response.data.map((faculty: any) => ({ value: faculty.name, label: faculty.name }));
             facultyList.sort((a: { label: string }, b: { label: string }) => a.label.localeCompare(b.label));
-            setFacultyOptions([
+            setFacultyOptions(isAdminToken() ? [
                 ...facultyList,
                 { value: 'not_in_list', label: 'Not in the list - Add new' }
-            ]);
+            ] : facultyList);
             setFilteredFacultyOptions(facultyList);
         } catch (error) {
             console.error('Error fetching faculty list:', error);
@@ -50,10 +70,10 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
             const response = await axios.get('http://localhost:8080/api/courses');
             const courseList = response.data.map((course: any) => ({ value: course.name, label: course.name }));
             courseList.sort((a: { label: string }, b: { label: string }) => a.label.localeCompare(b.label));
-            setCourseOptions([
+            setCourseOptions(isAdminToken() ? [
                 ...courseList,
                 { value: 'not_in_list', label: 'Not in the list - Add new' }
-            ]);
+            ] : courseList);
             setFilteredCourseOptions(courseList);
         } catch (error) {
             console.error('Error fetching course list:', error);
@@ -68,7 +88,7 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
 
     const handleNewInstructorSubmit = async (newInstructorName: string) => {
         try {
-            await axios.post('http://localhost:8080/api/faculty', { name: newInstructorName });
+            await axios.post('http://localhost:8080/api/faculty', { name: newInstructorName }, { headers: authHeaders() });
             alert('New instructor added successfully!');
             fetchFacultyList();
             setShowNewInstructorPopup(false);
@@ -80,7 +100,7 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
 
     const handleNewCourseSubmit = async (newCourseName: string) => {
         try {
-            await axios.post('http://localhost:8080/api/courses', { name: newCourseName });
+            await axios.post('http://localhost:8080/api/courses', { name: newCourseName }, { headers: authHeaders() });
             alert('New course added successfully!');
             fetchCourseList();
             setShowNewCoursePopup(false);
@@ -167,7 +187,7 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
                                 onInputChange={filterCourseOptions}
                                 value={courseName ? { value: courseName, label: courseName } : null}
                                 onChange={handleCourseChange}
-                                noOptionsMessage={() => (
+                                noOptionsMessage={() => isAdmin ? (
                                     <button
                                         type="button"
                                         onClick={() => setShowNewCoursePopup(true)}
@@ -175,7 +195,7 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
                                     >
                                         Not in the list - Add new
                                     </button>
-                                )}
+                                ) : 'Not in the list - ask an admin to add it'}
                                 styles={{
                                     option: (provided, state) => ({
                                         ...provided,
@@ -208,7 +228,7 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
                                 onInputChange={filterFacultyOptions}
                                 value={instructor ? { value: instructor, label: instructor } : null}
                                 onChange={handleInstructorChange}
-                                noOptionsMessage={() => (
+                                noOptionsMessage={() => isAdmin ? (
                                     <button
                                         type="button"
                                         onClick={() => setShowNewInstructorPopup(true)}
@@ -216,7 +236,7 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
                                     >
                                         Not in the list - Add new
                                     </button>
-                                )}
+                                ) : 'Not in the list - ask an admin to add it'}
                                 styles={{
                                     option: (provided, state) => ({
                                         ...provided,
@@ -285,13 +305,13 @@ const UploadForm: React.FC<UploadFormProps> = ({ fetchStudentCourses, onClose, u
                 </div>
                 <button type="submit" className="w-full bg-blue-500 text-white py-2 my-4 px-4 rounded-md hover:bg-blue-600 transition duration-300">Upload</button>
             </form>
-            {showNewInstructorPopup && (
+            {isAdmin && showNewInstructorPopup && (
                 <NewInstructorPopup
                     onSubmit={handleNewInstructorSubmit}
                     onClose={() => setShowNewInstructorPopup(false)}
                 />
             )}
-            {showNewCoursePopup && (
+            {isAdmin && showNewCoursePopup && (
                 <NewCoursePopup
                     onSubmit={handleNewCourseSubmit}
                     onClose={() => setShowNewCoursePopup(false)}
@@ -9,7 +9,7 @@ const LoginPage: React.FC = () => {
   const [error, setError] = useState<string | null>(null);
   const [isRegistering, setIsRegistering] = useState(false);
   const [role, setRole] = useState('student'); // Default role is student
-  const [securityCode, setSecurityCode] = useState('');
+  const [inviteToken, setInviteToken] = useState('');
   const router = useRouter();
 
   const handleRegister = async () => {
@@ -22,7 +22,7 @@ const LoginPage: React.FC = () => {
         headers: {
           'Content-Type': 'application/json',
         },
-        body: JSON.stringify({ username: username + '@iitk.ac.in', password, role, securityCode }),
+        body: JSON.stringify({ username: username + '@iitk.ac.in', password, role, inviteToken }),
       });
 
       if (response.ok) {
@@ -132,9 +132,9 @@ const LoginPage: React.FC = () => {
             <div className="mb-2">
               <input
                 type="text"
-                placeholder="Security Code"
-                value={securityCode}
-                onChange={(e) => setSecurityCode(e.target.value)}
+                placeholder="Invitation Code"
+                value={inviteToken}
+                onChange={(e) => setInviteToken(e.target.value)}
                 className="border text-black rounded-md px-4 py-2 w-72"
               />
             </div>